@@ -0,0 +1,230 @@
+package binn
+
+import (
+	"io"
+	"sync"
+	"time"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+)
+
+type AuditEventType string
+
+const (
+	AUDIT_CREATED   AuditEventType = "created"
+	AUDIT_DELIVERED AuditEventType = "delivered"
+	AUDIT_RETURNED  AuditEventType = "returned"
+	AUDIT_REJECTED  AuditEventType = "rejected"
+	AUDIT_EVICTED   AuditEventType = "evicted"
+	AUDIT_SUNK      AuditEventType = "sunk"
+	AUDIT_DRIFTED   AuditEventType = "drifted"
+)
+
+const (
+	DEFAULT_AUDIT_MAX_EVENTS = 10000
+	DEFAULT_AUDIT_MAX_AGE = 7 * 24 * time.Hour
+)
+
+// AuditEvent is one state transition of a bottle, Lineage is the first
+// id of the bottle so every hop of it can be found by any of its ids
+type AuditEvent struct {
+	Seq       uint64         `json:"seq"`
+	Time      time.Time      `json:"time"`
+	Type      AuditEventType `json:"type"`
+	ID        string         `json:"id,omitempty"`
+	NewID     string         `json:"new_id,omitempty"`
+	Lineage   string         `json:"lineage"`
+	Client    string         `json:"client,omitempty"`
+	Reason    string         `json:"reason,omitempty"`
+	RequestID string         `json:"request_id,omitempty"`
+}
+
+// AuditLog keeps bottle transitions in memory within retention limits
+// and appends every event to a writer when it is set
+type AuditLog struct {
+	events        []AuditEvent
+	seq           uint64
+	lineageOf     map[string]string
+	lineageIDs    map[string][]string
+	lineageEvents map[string]int
+	maxEvents     int
+	maxAge        time.Duration
+	salt          []byte
+	w             io.Writer
+	logger        *Logger
+	mux           *sync.Mutex
+}
+
+func NewAuditLog(maxEvents int, maxAge time.Duration, salt string) *AuditLog {
+	return &AuditLog{
+		events:        []AuditEvent{},
+		lineageOf:     map[string]string{},
+		lineageIDs:    map[string][]string{},
+		lineageEvents: map[string]int{},
+		maxEvents:     maxEvents,
+		maxAge:        maxAge,
+		salt:          []byte(salt),
+		logger:        DefaultLogger(),
+		mux:           &sync.Mutex{},
+	}
+}
+
+func DefaultAuditLog() *AuditLog {
+	return NewAuditLog(DEFAULT_AUDIT_MAX_EVENTS, DEFAULT_AUDIT_MAX_AGE, "")
+}
+
+func (a *AuditLog) SetWriter(w io.Writer) {
+	a.mux.Lock()
+	defer a.mux.Unlock()
+	a.w = w
+}
+
+func (a *AuditLog) SetLogger(l *Logger) {
+	a.mux.Lock()
+	defer a.mux.Unlock()
+	a.logger = l
+}
+
+// HashClient returns a keyed hash of the subject of i,
+// so a client can be followed without recording who it is
+func (a *AuditLog) HashClient(i *Identity) string {
+	if a == nil || i.Anonymous() {
+		return ""
+	}
+	h := hmac.New(sha256.New, a.salt)
+	h.Write([]byte(i.Method + ":" + i.Subject))
+	return hex.EncodeToString(h.Sum(nil)[:16])
+}
+
+// Known reports whether id belongs to a recorded lineage
+func (a *AuditLog) Known(id string) bool {
+	if a == nil || id == "" {
+		return false
+	}
+	a.mux.Lock()
+	defer a.mux.Unlock()
+	_, ok := a.lineageOf[id]
+	return ok
+}
+
+func (a *AuditLog) link(id string, lineage string) {
+	if id == "" {
+		return
+	}
+	if _, ok := a.lineageOf[id]; ok {
+		return
+	}
+	a.lineageOf[id] = lineage
+	a.lineageIDs[lineage] = append(a.lineageIDs[lineage], id)
+}
+
+// Record appends e, a nil audit log records nothing
+func (a *AuditLog) Record(e AuditEvent) {
+	if a == nil {
+		return
+	}
+	a.mux.Lock()
+	defer a.mux.Unlock()
+
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	a.seq++
+	e.Seq = a.seq
+
+	lineage, ok := a.lineageOf[e.ID]
+	if !ok || e.ID == "" {
+		lineage = e.ID
+		if lineage == "" {
+			lineage = e.NewID
+		}
+	}
+	e.Lineage = lineage
+	a.link(e.ID, lineage)
+	a.link(e.NewID, lineage)
+
+	a.events = append(a.events, e)
+	a.lineageEvents[lineage]++
+	a.prune(e.Time)
+
+	if a.w != nil {
+		bytes, err := json.Marshal(&e)
+		if err == nil {
+			_, err = a.w.Write(append(bytes, '\n'))
+		}
+		if err != nil {
+			a.logger.Warn("failed to write an audit event", F("seq", e.Seq), F("error", err))
+		}
+	}
+}
+
+func (a *AuditLog) prune(now time.Time) {
+	n := 0
+	for n < len(a.events) {
+		e := a.events[n]
+		if len(a.events) - n <= a.maxEvents && (a.maxAge <= 0 || now.Sub(e.Time) <= a.maxAge) {
+			break
+		}
+		a.lineageEvents[e.Lineage]--
+		if a.lineageEvents[e.Lineage] <= 0 {
+			for _, id := range a.lineageIDs[e.Lineage] {
+				delete(a.lineageOf, id)
+			}
+			delete(a.lineageIDs, e.Lineage)
+			delete(a.lineageEvents, e.Lineage)
+		}
+		n++
+	}
+	if n > 0 {
+		a.events = append([]AuditEvent{}, a.events[n:]...)
+	}
+}
+
+func (a *AuditLog) Len() int {
+	a.mux.Lock()
+	defer a.mux.Unlock()
+	a.prune(time.Now())
+	return len(a.events)
+}
+
+// List returns events from the oldest retained one
+func (a *AuditLog) List(offset int, limit int) []AuditEvent {
+	a.mux.Lock()
+	defer a.mux.Unlock()
+	a.prune(time.Now())
+
+	if offset < 0 || offset >= len(a.events) || limit <= 0 {
+		return []AuditEvent{}
+	}
+	end := offset + limit
+	if end > len(a.events) {
+		end = len(a.events)
+	}
+	return append([]AuditEvent{}, a.events[offset:end]...)
+}
+
+// Lineage returns every retained event of the bottle which has had id
+func (a *AuditLog) Lineage(id string) []AuditEvent {
+	a.mux.Lock()
+	defer a.mux.Unlock()
+	a.prune(time.Now())
+
+	events := []AuditEvent{}
+	lineage, ok := a.lineageOf[id]
+	if !ok {
+		return events
+	}
+	for _, e := range a.events {
+		if e.Lineage == lineage {
+			events = append(events, e)
+		}
+	}
+	return events
+}
+
+// Audited is implemented by storages recording an audit log
+type Audited interface {
+	AuditLog() *AuditLog
+}
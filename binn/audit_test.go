@@ -0,0 +1,92 @@
+package binn
+
+import (
+	"time"
+	"bytes"
+	"strings"
+	"testing"
+	"encoding/json"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAuditLogFollowsLineage(t *testing.T) {
+	audit := DefaultAuditLog()
+	idStorage := DefaultIDStorage()
+	storage := NewContainerStorage(true, time.Duration(10) * time.Minute, idStorage)
+	storage.SetAuditLog(audit)
+
+	idStorage.Add("1", time.Now().Add(time.Minute))
+	b := NewBottle("1", "", nil)
+	b.SetIdentity(NewIdentity("alice", "api_key", SCOPE_THROW))
+	assert.Nil(t, storage.Add(b))
+
+	c, err := storage.Get()
+	assert.Nil(t, err)
+	assert.Nil(t, storage.Add(NewBottle(c.ID(), "Hello", nil)))
+	assert.NotNil(t, storage.Add(NewBottle(c.ID(), "Hello again", nil)))
+
+	events := audit.Lineage(c.ID())
+	types := []AuditEventType{}
+	for _, e := range events {
+		types = append(types, e.Type)
+		assert.Equal(t, "1", e.Lineage)
+	}
+	assert.Equal(t, []AuditEventType{AUDIT_CREATED, AUDIT_DELIVERED, AUDIT_RETURNED, AUDIT_REJECTED}, types)
+	assert.Equal(t, "1", events[0].ID)
+	assert.Equal(t, c.ID(), events[0].NewID)
+	assert.Equal(t, c.ID(), events[2].ID)
+	assert.NotEqual(t, "", events[0].Client)
+	assert.NotContains(t, events[0].Client, "alice")
+	assert.Equal(t, "", events[2].Client)
+	assert.Equal(t, events, audit.Lineage("1"))
+	assert.Equal(t, []AuditEvent{}, audit.Lineage("unknown"))
+}
+
+func TestAuditLogHashesClientsWithSalt(t *testing.T) {
+	i := NewIdentity("alice", "api_key", SCOPE_THROW)
+	a := NewAuditLog(10, time.Hour, "salt")
+	assert.Equal(t, a.HashClient(i), NewAuditLog(10, time.Hour, "salt").HashClient(i))
+	assert.NotEqual(t, a.HashClient(i), NewAuditLog(10, time.Hour, "pepper").HashClient(i))
+	assert.Equal(t, "", a.HashClient(AnonymousIdentity()))
+}
+
+func TestAuditLogRetention(t *testing.T) {
+	a := NewAuditLog(2, time.Hour, "")
+	a.Record(AuditEvent{ Type: AUDIT_CREATED, NewID: "1" })
+	a.Record(AuditEvent{ Type: AUDIT_CREATED, NewID: "2" })
+	a.Record(AuditEvent{ Type: AUDIT_CREATED, NewID: "3" })
+
+	assert.Equal(t, 2, a.Len())
+	assert.False(t, a.Known("1"))
+	assert.True(t, a.Known("3"))
+	assert.Equal(t, uint64(2), a.List(0, 10)[0].Seq)
+
+	a = NewAuditLog(10, time.Hour, "")
+	a.Record(AuditEvent{ Type: AUDIT_CREATED, NewID: "1", Time: time.Now().Add(-2 * time.Hour) })
+	a.Record(AuditEvent{ Type: AUDIT_CREATED, NewID: "2" })
+	assert.Equal(t, 1, a.Len())
+	assert.Equal(t, []AuditEvent{}, a.Lineage("1"))
+}
+
+func TestAuditLogAppendsToWriter(t *testing.T) {
+	var buf bytes.Buffer
+	a := DefaultAuditLog()
+	a.SetWriter(&buf)
+	a.Record(AuditEvent{ Type: AUDIT_CREATED, NewID: "1" })
+	a.Record(AuditEvent{ Type: AUDIT_DELIVERED, ID: "1" })
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	assert.Equal(t, 2, len(lines))
+
+	var e AuditEvent
+	assert.Nil(t, json.Unmarshal([]byte(lines[1]), &e))
+	assert.Equal(t, AUDIT_DELIVERED, e.Type)
+	assert.Equal(t, "1", e.Lineage)
+}
+
+func TestNilAuditLogRecordsNothing(t *testing.T) {
+	var a *AuditLog
+	a.Record(AuditEvent{ Type: AUDIT_CREATED, NewID: "1" })
+	assert.False(t, a.Known("1"))
+}
@@ -1,14 +1,17 @@
 package binn
 
 import (
-	"os"
-	"log"
 	"fmt"
 	"time"
+	"sync"
 	"context"
+	"sync/atomic"
 )
 
-var Logger = log.New(os.Stderr, "[ENGINE] ", log.LstdFlags)
+var ErrNotRunning = fmt.Errorf("this engine is not running")
+// ErrPending is returned by Submit when ctx is done after the engine took
+// the container, it is still added or rejected later
+var ErrPending = fmt.Errorf("this container is pending")
 
 type GenerateContainerHandlerFunc func (cs ContainerKeeper) error
 
@@ -17,17 +20,42 @@ type Engine struct {
 	storage  ContainerKeeper
 	inCh     chan Container
 	outCh    chan Container
+	reloadCh chan struct{}
+	running  int32
+	draining int32
+	generateLoop *loopState
+	deliveryLoop *loopState
+	mux      *sync.Mutex
+	hooks    *Hooks
+	queue    *queueState
 	generateContainerHandler GenerateContainerHandlerFunc
 }
 
 func NewEngine(cfg *Config, storage ContainerKeeper) *Engine {
-	return &Engine{
+	e := &Engine{
 		cfg:     cfg,
 		storage: storage,
-		inCh:    make(chan Container, 1),
-		outCh:   make(chan Container, 1),
+		inCh:    make(chan Container, cfg.InQueueSize()),
+		outCh:   make(chan Container, cfg.OutQueueSize()),
+		reloadCh: make(chan struct{}),
+		generateLoop: &loopState{},
+		deliveryLoop: &loopState{},
+		mux:     &sync.Mutex{},
+		hooks:   DefaultHooks(),
+		queue:   newQueueState(),
 		generateContainerHandler: DefaultGenerateContainerHandlerFunc(),
 	}
+	if n, ok := storage.(EvictNotifier); ok {
+		n.SetEvictHandler(func(c Container) {
+			e.hooks.emit(EVENT_EVICTED, c, "storage is full")
+		})
+	}
+	if n, ok := storage.(SinkNotifier); ok {
+		n.SetSinkHandler(func(c Container, reason string) {
+			e.hooks.emit(EVENT_SUNK, c, reason)
+		})
+	}
+	return e
 }
 
 func DefaultEngine() *Engine {
@@ -37,18 +65,27 @@ func DefaultEngine() *Engine {
 	)
 }
 
-func (e *Engine) logf(format string, v ...interface{}) {
-	if !e.GetConfig().Debug() {
-		return
-	}
-	
-	Logger.Printf(format, v...)
+func (e *Engine) logger() *Logger {
+	return e.cfg.Logger()
 }
 
 func (e *Engine) GetConfig() *Config {
 	return e.cfg
 }
 
+func (e *Engine) GetStorage() ContainerKeeper {
+	return e.storage
+}
+
+// GetHooks returns the hooks called on every event of the engine
+func (e *Engine) GetHooks() *Hooks {
+	return e.hooks
+}
+
+func (e *Engine) Running() bool {
+	return atomic.LoadInt32(&e.running) == 1
+}
+
 func (e *Engine) GetInChan() chan Container {
 	return e.inCh
 }
@@ -57,6 +94,33 @@ func (e *Engine) GetOutChan() chan Container {
 	return e.outCh
 }
 
+// Reload applies cfg to the running engine and re-arms the tickers
+// of Run when a cycle has changed, a invalid cfg changes nothing
+func (e *Engine) Reload(cfg *Config) ([]string, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	changes := e.cfg.Update(cfg)
+	if len(changes) == 0 {
+		return changes, nil
+	}
+
+	e.mux.Lock()
+	close(e.reloadCh)
+	e.reloadCh = make(chan struct{})
+	e.mux.Unlock()
+
+	return changes, nil
+}
+
+// reloaded returns the channel the next Reload closes, a loop keeps
+// it until it is closed so a reload while the loop is busy is not missed
+func (e *Engine) reloaded() chan struct{} {
+	e.mux.Lock()
+	defer e.mux.Unlock()
+	return e.reloadCh
+}
+
 func (e *Engine) SetGenerateContainerHandler(h GenerateContainerHandlerFunc) {
 	e.generateContainerHandler = h
 }
@@ -72,12 +136,28 @@ func DefaultGenerateContainerHandlerFunc() GenerateContainerHandlerFunc {
 	}
 }
 
+func senderOf(c Container) string {
+	if i := identityOf(c); !i.Anonymous() {
+		return i.Subject
+	}
+	return ""
+}
+
 func (e *Engine) Run(ctx context.Context) {
+	atomic.StoreInt32(&e.running, 1)
 	go func() {
-		if !e.cfg.Validation() {
-			return
-		}
-		
+		<- ctx.Done()
+		atomic.StoreInt32(&e.running, 0)
+	}()
+
+	e.generateLoop.tick()
+	e.deliveryLoop.tick()
+
+	e.hooks.SetLogger(e.logger())
+	go e.hooks.Run(ctx)
+
+	go func() {
+		reloaded := e.reloaded()
 		t := time.NewTicker(e.cfg.GenerateCycle())
 		defer t.Stop()
 	Loop:
@@ -85,13 +165,25 @@ func (e *Engine) Run(ctx context.Context) {
 			select {
 			case <- ctx.Done():
 				break Loop
+			case <- reloaded:
+				reloaded = e.reloaded()
+				t.Reset(e.cfg.GenerateCycle())
 			case <- t.C:
-				err := e.generateContainerHandler(e.storage)
+				e.generateLoop.tick()
+				if s, ok := e.storage.(Sweeper); ok {
+					if n := s.Sweep(); n > 0 {
+						e.logger().Debug("sweep expired ids", F("count", n))
+					}
+				}
+				if !e.cfg.Validation() {
+					break
+				}
+				err := e.generateContainerHandler(&hookedKeeper{ e.storage, e.hooks })
 				if err != nil {
-					e.logf("%s", err)
+					e.logger().Warn("failed to generate a container", F("error", err))
 					break
 				}
-				e.logf("generate a empty container")
+				e.logger().Debug("generate a empty container")
 			}
 		}
 	}()
@@ -103,24 +195,20 @@ func (e *Engine) Run(ctx context.Context) {
 			case <- ctx.Done():
 				break Loop
 			case c := <- e.inCh:
-				// ignore a error intentionally
-				// it is not necessary for a user to tell a error
-				// it hides whether server received bottle or not
-				if err := e.storage.Add(c); err == nil {
-					e.logf(fmt.Sprintf("add a container(id=%#v message=%#v)",
-						c.ID(),
-						c.Message().Text,
-					))
-				} else {
-					e.logf("failed: %s", err)
+				// a error is only told to a caller of Submit,
+				// containers pushed to inCh directly hide whether
+				// server received bottle or not
+				if s, ok := c.(*submission); ok {
+					s.result <- e.receive(s.Container)
+					break
 				}
-			default:
-				break
+				e.receive(c)
 			}
 		}
 	}()
 
 	go func() {
+		reloaded := e.reloaded()
 		t := time.NewTicker(e.cfg.DeliveryCycle())
 		defer t.Stop()
 
@@ -129,20 +217,122 @@ func (e *Engine) Run(ctx context.Context) {
 			select {
 			case <- ctx.Done():
 				break Loop
+			case <- reloaded:
+				reloaded = e.reloaded()
+				t.Reset(e.cfg.DeliveryCycle())
 			case <- t.C:
-				c, err := e.storage.Get()
+				e.deliveryLoop.tick()
+				c, err := e.next()
 				if err != nil {
 					break
 				}
 
-				e.logf(fmt.Sprintf("deliver a container(id=%#v message=%#v)",
-					c.ID(),
-					c.Message().Text,
-				))
-				e.outCh <- c
-			default:
-				break
+				e.deliver(c)
+				e.deliveryLoop.tick()
 			}
 		}
 	}()
 }
+
+// submission is a container pushed by Submit waiting for its result
+type submission struct {
+	Container
+	result chan error
+}
+
+// Submit passes c to the engine like Enqueue and waits until the storage
+// accepts or rejects it, it returns ErrQueueFull when the overflow policy
+// drops or rejects c, the block policy also stops blocking when ctx is done,
+// and ErrPending when ctx is done after c was passed
+func (e *Engine) Submit(ctx context.Context, c Container) error {
+	if !e.Running() {
+		return ErrNotRunning
+	}
+
+	s := &submission{ Container: c, result: make(chan error, 1) }
+	if err := e.enqueue(ctx, s); err != nil {
+		return err
+	}
+
+	select {
+	case err := <- s.result:
+		return err
+	case <- ctx.Done():
+		return ErrPending
+	}
+}
+
+func (e *Engine) receive(c Container) error {
+	// every engine span is started with the tracer of the config like deliverTo
+	ctx, span := e.cfg.Tracer().Start(ContextOf(c), "engine.receive", SPAN_KIND_CONSUMER)
+	defer span.End()
+	span.SetMessage(c, "process")
+	if span != nil {
+		setContextOf(c, ctx)
+	}
+
+	logger := e.logger().WithContext(ctx)
+	c, err := e.hooks.runSync(EVENT_RECEIVED, c)
+	if err != nil {
+		logger.Debug("a hook rejected a container", F("id", c.ID()), F("error", err))
+		span.SetError(err)
+		e.hooks.emit(EVENT_REJECTED, c, err.Error())
+		return err
+	}
+	e.hooks.emit(EVENT_RECEIVED, c, "")
+
+	if err := e.storage.Add(c); err != nil {
+		logger.Debug("failed to add a container", F("id", c.ID()), F("error", err))
+		span.SetError(err)
+		e.hooks.emit(EVENT_REJECTED, c, err.Error())
+		return err
+	}
+	logger.Debug("add a container",
+		F("id", c.ID()),
+		F("message", logger.Redact(c.Message().Text)),
+		F("sender", senderOf(c)),
+	)
+	e.hooks.emit(EVENT_ACCEPTED, c, "")
+	return nil
+}
+
+func (e *Engine) deliver(c Container) {
+	e.deliverTo(c, func(c Container) bool {
+		e.deliveryLoop.wait(true)
+		e.outCh <- c
+		e.deliveryLoop.wait(false)
+		return true
+	})
+}
+
+// deliverTo runs the delivered hooks on c and passes it to send,
+// c counts as delivered only when send returns true
+func (e *Engine) deliverTo(c Container, send func(c Container) bool) {
+	ctx, span := e.cfg.Tracer().Start(ContextOf(c), "engine.deliver", SPAN_KIND_PRODUCER)
+	defer span.End()
+	span.SetMessage(c, "")
+	if span != nil {
+		setContextOf(c, ctx)
+	}
+
+	logger := e.logger().WithContext(ctx)
+	c, err := e.hooks.runSync(EVENT_DELIVERED, c)
+	if err != nil {
+		logger.Debug("a hook withheld a container", F("id", c.ID()), F("error", err))
+		span.SetError(err)
+		// c is already picked up, so it is rejected instead of lost silently
+		if a, ok := e.storage.(Audited); ok {
+			a.AuditLog().Record(AuditEvent{ Type: AUDIT_REJECTED, ID: c.ID(), Reason: err.Error() })
+		}
+		e.hooks.emit(EVENT_REJECTED, c, err.Error())
+		return
+	}
+
+	logger.Debug("deliver a container",
+		F("id", c.ID()),
+		F("message", logger.Redact(c.Message().Text)),
+	)
+	if send(c) {
+		e.hooks.emit(EVENT_DELIVERED, c, "")
+	}
+}
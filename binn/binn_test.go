@@ -146,3 +146,159 @@ func TestGetEmptyBottleIsGenerated(t *testing.T) {
 
 	assert.Equal(t, "", bottle.Message().Text)
 }
+
+func TestReloadRearmsDeliveryCycle(t *testing.T) {
+	storage := NewContainerStorage(false, 0, nil)
+	_ = storage.Add(NewBottle("", "This is a Test Message", nil))
+
+	engine := NewEngine(
+		DefaultConfig(),
+		storage,
+	)
+
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	engine.Run(ctx)
+	defer cancelFunc()
+
+	cfg := DefaultConfig()
+	cfg.SetDeliveryCycle(time.Duration(1) * time.Millisecond)
+	changes, err := engine.Reload(cfg)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"delivery cycle: 15m0s -> 1ms"}, changes)
+
+	select {
+	case bottle := <- engine.GetOutChan():
+		assert.Equal(t, "This is a Test Message", bottle.Message().Text)
+	case <- time.After(time.Duration(1) * time.Second):
+		assert.Fail(t, "delivery cycle was not re-armed")
+	}
+}
+
+func TestReloadWhileDeliveryIsBlocked(t *testing.T) {
+	storage := NewContainerStorage(false, 0, nil)
+	for i := 0; i < 3; i++ {
+		_ = storage.Add(NewBottle("", "This is a Test Message", nil))
+	}
+	cfg := DefaultConfig()
+	cfg.SetDeliveryCycle(time.Duration(10) * time.Millisecond)
+	engine := NewEngine(cfg, storage)
+
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	engine.Run(ctx)
+	defer cancelFunc()
+
+	// the delivery loop waits on the full out channel during the reload
+	assert.Eventually(t, func() bool {
+		return storage.Len() == 1
+	}, time.Second, time.Duration(5) * time.Millisecond)
+	_, err := engine.Reload(DefaultConfig())
+	assert.Nil(t, err)
+
+	<- engine.GetOutChan()
+	<- engine.GetOutChan()
+	select {
+	case <- engine.GetOutChan():
+		assert.Fail(t, "delivery cycle was not re-armed")
+	case <- time.After(time.Duration(100) * time.Millisecond):
+	}
+}
+
+func TestReloadRejectsInvalidCycle(t *testing.T) {
+	engine := NewEngine(DefaultConfig(), NewContainerStorage(false, 0, nil))
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	engine.Run(ctx)
+	defer cancelFunc()
+
+	for _, cfg := range []*Config{
+		NewConfig(42, 0, true, time.Minute, false),
+		NewConfig(42, time.Minute, true, -time.Minute, false),
+	} {
+		changes, err := engine.Reload(cfg)
+		assert.NotNil(t, err)
+		assert.Nil(t, changes)
+	}
+	assert.Equal(t, time.Duration(15) * time.Minute, engine.GetConfig().DeliveryCycle())
+	assert.Equal(t, time.Duration(15) * time.Minute, engine.GetConfig().GenerateCycle())
+}
+
+func TestSubmitReturnsStorageResult(t *testing.T) {
+	idStorage := DefaultIDStorage()
+	storage := NewContainerStorage(true, time.Duration(10) * time.Minute, idStorage)
+	engine := NewEngine(DefaultConfig(), storage)
+
+	assert.Equal(t, ErrNotRunning, engine.Submit(context.Background(), NewBottle("1", "Hello", nil)))
+
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	engine.Run(ctx)
+	defer cancelFunc()
+
+	idStorage.Add("1", time.Now().Add(time.Minute))
+	assert.Nil(t, engine.Submit(context.Background(), NewBottle("1", "Hello", nil)))
+	assert.Equal(t, 1, storage.Len())
+	assert.NotNil(t, engine.Submit(context.Background(), NewBottle("1", "Hello", nil)))
+}
+
+func TestSubmitReturnsPendingAfterEngineTookContainer(t *testing.T) {
+	engine := NewEngine(DefaultConfig(), NewContainerStorage(false, 0, nil))
+	release := make(chan struct{})
+	engine.GetHooks().OnSync(EVENT_RECEIVED, func(ctx context.Context, c Container) (Container, error) {
+		<- release
+		return c, nil
+	})
+
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	engine.Run(ctx)
+	defer cancelFunc()
+
+	sctx, scancelFunc := context.WithTimeout(context.Background(), time.Duration(10) * time.Millisecond)
+	defer scancelFunc()
+	assert.Equal(t, ErrPending, engine.Submit(sctx, NewBottle("1", "Hello", nil)))
+	close(release)
+}
+
+func TestSubmitBlocksWhileInChanIsFull(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.SetInQueueSize(1)
+	engine := NewEngine(cfg, NewContainerStorage(false, 0, nil))
+	held := make(chan struct{})
+	engine.GetHooks().OnSync(EVENT_RECEIVED, func(ctx context.Context, c Container) (Container, error) {
+		close(held)
+		<- ctx.Done()
+		return nil, nil
+	})
+
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	engine.Run(ctx)
+	defer cancelFunc()
+
+	go engine.Submit(context.Background(), NewBottle("1", "held", nil))
+	<- held
+	engine.GetInChan() <- NewBottle("2", "queued", nil)
+
+	sctx, scancelFunc := context.WithTimeout(context.Background(), time.Duration(10) * time.Millisecond)
+	defer scancelFunc()
+	assert.Equal(t, context.DeadlineExceeded, engine.Submit(sctx, NewBottle("3", "blocked", nil)))
+}
+
+func TestSubmitFollowsOverflowPolicy(t *testing.T) {
+	for _, p := range []OverflowPolicy{ OVERFLOW_DROP_NEWEST, OVERFLOW_REJECT } {
+		engine := newQueueTestEngine(p)
+		ctx, cancelFunc := context.WithCancel(context.Background())
+		engine.Run(ctx)
+		held := make(chan struct{}, 2)
+		engine.GetHooks().OnSync(EVENT_RECEIVED, func(ctx context.Context, c Container) (Container, error) {
+			held <- struct{}{}
+			<- ctx.Done()
+			return nil, nil
+		})
+
+		go engine.Submit(context.Background(), NewBottle("1", "held", nil))
+		<- held
+		engine.GetInChan() <- NewBottle("2", "queued", nil)
+
+		assert.Equal(t, ErrQueueFull, engine.Submit(context.Background(), NewBottle("3", "full", nil)), p)
+		stats := engine.QueueStats()
+		assert.Equal(t, uint64(1), stats.Dropped + stats.Rejected, p)
+		cancelFunc()
+	}
+}
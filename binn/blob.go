@@ -0,0 +1,131 @@
+package binn
+
+import (
+	"io"
+	"os"
+	"fmt"
+	"time"
+	"strings"
+	"path/filepath"
+)
+
+// BlobStore keeps the files attached to bottles, every blob has an
+// expiration and Sweep removes the blobs whose expiration has passed
+type BlobStore interface {
+	Put(key string, r io.Reader, expiredAt time.Time) error
+	// Open returns a error matching os.ErrNotExist for a unknown key
+	Open(key string) (io.ReadCloser, error)
+	Expire(key string, expiredAt time.Time) error
+	Delete(key string) error
+	Sweep(now time.Time) int
+}
+
+// FileBlobStore keeps every blob in a file of dir named by its key,
+// the modification time of a file is its expiration
+type FileBlobStore struct {
+	dir string
+}
+
+func NewFileBlobStore(dir string) (*FileBlobStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &FileBlobStore{ dir: dir }, nil
+}
+
+// validBlobKey accepts letters, digits, hyphens and dots not leading,
+// so a key never leaves the directory
+func validBlobKey(key string) bool {
+	if key == "" || strings.HasPrefix(key, ".") || len(key) > 128 {
+		return false
+	}
+	for _, r := range key {
+		if !(r == '-' || r == '.' || r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9') {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *FileBlobStore) path(key string) (string, error) {
+	if !validBlobKey(key) {
+		return "", fmt.Errorf("this blob key (%#v) is invalid", key)
+	}
+	return filepath.Join(s.dir, key), nil
+}
+
+// Put writes to a temporary file and renames it, so a blob is never
+// read while it is written
+func (s *FileBlobStore) Put(key string, r io.Reader, expiredAt time.Time) error {
+	path, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(s.dir, ".put-*")
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	if err := os.Chtimes(f.Name(), expiredAt, expiredAt); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+func (s *FileBlobStore) Open(key string) (io.ReadCloser, error) {
+	path, err := s.path(key)
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(path)
+}
+
+func (s *FileBlobStore) Expire(key string, expiredAt time.Time) error {
+	path, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	return os.Chtimes(path, expiredAt, expiredAt)
+}
+
+func (s *FileBlobStore) Delete(key string) error {
+	path, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// Sweep removes expired blobs, temporary files of a Put are left alone
+func (s *FileBlobStore) Sweep(now time.Time) int {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return 0
+	}
+	n := 0
+	for _, e := range entries {
+		if e.IsDir() || !validBlobKey(e.Name()) {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil || !info.ModTime().Before(now) {
+			continue
+		}
+		if os.Remove(filepath.Join(s.dir, e.Name())) == nil {
+			n++
+		}
+	}
+	return n
+}
@@ -0,0 +1,48 @@
+package binn
+
+import (
+	"io"
+	"os"
+	"time"
+	"strings"
+	"testing"
+	"path/filepath"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFileBlobStore(t *testing.T) {
+	dir := t.TempDir()
+	s, err := NewFileBlobStore(dir)
+	require.Nil(t, err)
+
+	require.Nil(t, s.Put("kept.png", strings.NewReader("kept"), time.Now().Add(time.Hour)))
+	require.Nil(t, s.Put("expired.png", strings.NewReader("expired"), time.Now().Add(time.Hour)))
+	require.Nil(t, s.Expire("expired.png", time.Now().Add(-time.Minute)))
+
+	f, err := s.Open("kept.png")
+	require.Nil(t, err)
+	data, _ := io.ReadAll(f)
+	f.Close()
+	assert.Equal(t, "kept", string(data))
+
+	assert.Equal(t, 1, s.Sweep(time.Now()))
+	_, err = s.Open("expired.png")
+	assert.True(t, os.IsNotExist(err))
+
+	require.Nil(t, s.Delete("kept.png"))
+	assert.Nil(t, s.Delete("kept.png"))
+	entries, _ := os.ReadDir(dir)
+	assert.Equal(t, 0, len(entries))
+}
+
+func TestFileBlobStoreRejectsKeysOutsideDir(t *testing.T) {
+	s, err := NewFileBlobStore(filepath.Join(t.TempDir(), "blobs"))
+	require.Nil(t, err)
+	for _, key := range []string{ "", "../escape", ".hidden", "a/b", strings.Repeat("a", 129) } {
+		assert.NotNil(t, s.Put(key, strings.NewReader("x"), time.Now()), key)
+		_, err := s.Open(key)
+		assert.NotNil(t, err, key)
+	}
+}
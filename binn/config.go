@@ -1,82 +1,301 @@
 package binn
 
 import (
+	"fmt"
 	"time"
+	"sync"
+	"strings"
 )
 
+type OverflowPolicy string
+
+const (
+	OVERFLOW_BLOCK       OverflowPolicy = "block"
+	OVERFLOW_DROP_NEWEST OverflowPolicy = "drop-newest"
+	OVERFLOW_DROP_OLDEST OverflowPolicy = "drop-oldest"
+	OVERFLOW_REJECT      OverflowPolicy = "reject"
+)
+
+const (
+	DEFAULT_IN_QUEUE_SIZE = 64
+	DEFAULT_OUT_QUEUE_SIZE = 1
+	DEFAULT_ENQUEUE_TIMEOUT = 5 * time.Second
+)
+
+func ParseOverflowPolicy(s string) (OverflowPolicy, error) {
+	switch p := OverflowPolicy(strings.ToLower(strings.TrimSpace(s))); p {
+	case "":
+		return OVERFLOW_BLOCK, nil
+	case OVERFLOW_BLOCK, OVERFLOW_DROP_NEWEST, OVERFLOW_DROP_OLDEST, OVERFLOW_REJECT:
+		return p, nil
+	}
+	return "", fmt.Errorf("this overflow policy (%#v) is unknown", s)
+}
+
 
 type Config struct {
-	seed          int
-	deliveryCycle time.Duration
-	validation    bool
-	generateCycle time.Duration
-	debug         bool
+	seed           int
+	deliveryCycle  time.Duration
+	validation     bool
+	generateCycle  time.Duration
+	debug          bool
+	logger         *Logger
+	tracer         *Tracer
+	inQueueSize    int
+	outQueueSize   int
+	overflow       OverflowPolicy
+	enqueueTimeout time.Duration
+	mux            *sync.RWMutex
 }
 
 func NewConfig(s int, d time.Duration, v bool, g time.Duration, ed bool) *Config {
 	return &Config{
-		seed:          s,
-		deliveryCycle: d,
-		validation:    v,
-		generateCycle: g,
-		debug:         ed,
+		seed:           s,
+		deliveryCycle:  d,
+		validation:     v,
+		generateCycle:  g,
+		debug:          ed,
+		logger:         DefaultLogger(),
+		inQueueSize:    DEFAULT_IN_QUEUE_SIZE,
+		outQueueSize:   DEFAULT_OUT_QUEUE_SIZE,
+		overflow:       OVERFLOW_BLOCK,
+		enqueueTimeout: DEFAULT_ENQUEUE_TIMEOUT,
+		mux:            &sync.RWMutex{},
 	}
 }
 
 func DefaultConfig() *Config {
 	return &Config{
-		seed:          42,
-		deliveryCycle: time.Duration(15 * time.Minute),
-		validation:    true,
-		generateCycle: time.Duration(15 * time.Minute),
-		debug:         false,
+		seed:           42,
+		deliveryCycle:  time.Duration(15 * time.Minute),
+		validation:     true,
+		generateCycle:  time.Duration(15 * time.Minute),
+		debug:          false,
+		logger:         DefaultLogger(),
+		inQueueSize:    DEFAULT_IN_QUEUE_SIZE,
+		outQueueSize:   DEFAULT_OUT_QUEUE_SIZE,
+		overflow:       OVERFLOW_BLOCK,
+		enqueueTimeout: DEFAULT_ENQUEUE_TIMEOUT,
+		mux:            &sync.RWMutex{},
 	}
 }
 
 func (c *Config) Seed() int {
+	c.mux.RLock()
+	defer c.mux.RUnlock()
 	return c.seed
 }
 
 func (c *Config) SetSeed(s int) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
 	c.seed = s
 }
 
 func (c *Config) DeliveryCycle() time.Duration {
+	c.mux.RLock()
+	defer c.mux.RUnlock()
 	return c.deliveryCycle
 }
 
 func (c *Config) SetDeliveryCycle(d time.Duration) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
 	c.deliveryCycle = d
 }
 
 func (c *Config) Validation() bool {
+	c.mux.RLock()
+	defer c.mux.RUnlock()
 	return c.validation
 }
 
 func (c *Config) EnableValidation() {
+	c.mux.Lock()
+	defer c.mux.Unlock()
 	c.validation = true
 }
 
 func (c *Config) DisableValidation() {
+	c.mux.Lock()
+	defer c.mux.Unlock()
 	c.validation = false
 }
 
 func (c *Config) GenerateCycle() time.Duration {
+	c.mux.RLock()
+	defer c.mux.RUnlock()
 	return c.generateCycle
 }
 
 func (c *Config) SetGenerateCycle(g time.Duration) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
 	c.generateCycle = g
 }
 
 func (c *Config) Debug() bool {
+	c.mux.RLock()
+	defer c.mux.RUnlock()
 	return c.debug
 }
 
 func (c *Config) EnableDebug() {
+	c.mux.Lock()
+	defer c.mux.Unlock()
 	c.debug = true
 }
 
 func (c *Config) DisableDebug() {
+	c.mux.Lock()
+	defer c.mux.Unlock()
 	c.debug = false
 }
+
+// Logger returns the logger of the engine,
+// debug records are enabled while debug is enabled
+func (c *Config) Logger() *Logger {
+	c.mux.RLock()
+	defer c.mux.RUnlock()
+	if c.debug && !c.logger.Enabled(LEVEL_DEBUG) {
+		return c.logger.WithLevel(LEVEL_DEBUG)
+	}
+	return c.logger
+}
+
+func (c *Config) SetLogger(l *Logger) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	c.logger = l
+}
+
+// Tracer returns the tracer of the engine, nil disables tracing
+func (c *Config) Tracer() *Tracer {
+	c.mux.RLock()
+	defer c.mux.RUnlock()
+	return c.tracer
+}
+
+func (c *Config) SetTracer(t *Tracer) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	c.tracer = t
+}
+
+// InQueueSize is the capacity of inCh, it is read once by NewEngine
+func (c *Config) InQueueSize() int {
+	c.mux.RLock()
+	defer c.mux.RUnlock()
+	return c.inQueueSize
+}
+
+func (c *Config) SetInQueueSize(n int) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	c.inQueueSize = n
+}
+
+// OutQueueSize is the capacity of outCh, it is read once by NewEngine
+func (c *Config) OutQueueSize() int {
+	c.mux.RLock()
+	defer c.mux.RUnlock()
+	return c.outQueueSize
+}
+
+func (c *Config) SetOutQueueSize(n int) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	c.outQueueSize = n
+}
+
+func (c *Config) Overflow() OverflowPolicy {
+	c.mux.RLock()
+	defer c.mux.RUnlock()
+	return c.overflow
+}
+
+func (c *Config) SetOverflow(p OverflowPolicy) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	c.overflow = p
+}
+
+// EnqueueTimeout bounds how long the block policy waits for room in inCh
+func (c *Config) EnqueueTimeout() time.Duration {
+	c.mux.RLock()
+	defer c.mux.RUnlock()
+	return c.enqueueTimeout
+}
+
+func (c *Config) SetEnqueueTimeout(d time.Duration) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	c.enqueueTimeout = d
+}
+
+// Validate fails when a cycle is not positive, a ticker can not run with it
+func (c *Config) Validate() error {
+	c.mux.RLock()
+	defer c.mux.RUnlock()
+	if c.deliveryCycle <= 0 {
+		return fmt.Errorf("this delivery cycle (%s) is not positive", c.deliveryCycle)
+	}
+	if c.generateCycle <= 0 {
+		return fmt.Errorf("this generate cycle (%s) is not positive", c.generateCycle)
+	}
+	return nil
+}
+
+// Update copies every field of n but the queue sizes into c and
+// returns a human readable description of each changed field
+func (c *Config) Update(n *Config) []string {
+	if c == n {
+		return []string{}
+	}
+
+	n.mux.RLock()
+	defer n.mux.RUnlock()
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	changes := []string{}
+	if c.seed != n.seed {
+		changes = append(changes, fmt.Sprintf("seed: %d -> %d", c.seed, n.seed))
+		c.seed = n.seed
+	}
+	if c.deliveryCycle != n.deliveryCycle {
+		changes = append(changes, fmt.Sprintf("delivery cycle: %s -> %s", c.deliveryCycle, n.deliveryCycle))
+		c.deliveryCycle = n.deliveryCycle
+	}
+	if c.validation != n.validation {
+		changes = append(changes, fmt.Sprintf("validation: %t -> %t", c.validation, n.validation))
+		c.validation = n.validation
+	}
+	if c.generateCycle != n.generateCycle {
+		changes = append(changes, fmt.Sprintf("generate cycle: %s -> %s", c.generateCycle, n.generateCycle))
+		c.generateCycle = n.generateCycle
+	}
+	if c.debug != n.debug {
+		changes = append(changes, fmt.Sprintf("debug: %t -> %t", c.debug, n.debug))
+		c.debug = n.debug
+	}
+	if c.logger.String() != n.logger.String() {
+		changes = append(changes, fmt.Sprintf("logger: %s -> %s", c.logger, n.logger))
+		c.logger = n.logger
+	}
+	if c.overflow != n.overflow {
+		changes = append(changes, fmt.Sprintf("overflow: %s -> %s", c.overflow, n.overflow))
+		c.overflow = n.overflow
+	}
+	if c.enqueueTimeout != n.enqueueTimeout {
+		changes = append(changes, fmt.Sprintf("enqueue timeout: %s -> %s", c.enqueueTimeout, n.enqueueTimeout))
+		c.enqueueTimeout = n.enqueueTimeout
+	}
+	// queue sizes are kept, the channels are made once by NewEngine
+	if c.tracer != n.tracer {
+		changes = append(changes, "tracer: changed")
+		c.tracer = n.tracer
+	}
+
+	return changes
+}
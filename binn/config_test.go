@@ -59,3 +59,39 @@ func TestConfigDisableBoolValue(t *testing.T) {
 	assert.False(t, c.Validation())
 	assert.False(t, c.Debug())
 }
+
+func TestConfigUpdate(t *testing.T) {
+	c := DefaultConfig()
+	n := DefaultConfig()
+	n.SetDeliveryCycle(time.Duration(1) * time.Minute)
+	n.EnableDebug()
+
+	changes := c.Update(n)
+
+	assert.Equal(t, []string{
+		"delivery cycle: 15m0s -> 1m0s",
+		"debug: false -> true",
+	}, changes)
+	assert.Equal(t, 1.0, c.DeliveryCycle().Minutes())
+	assert.True(t, c.Debug())
+	assert.Empty(t, c.Update(n))
+}
+
+func TestConfigUpdateKeepsQueueSizes(t *testing.T) {
+	c := DefaultConfig()
+	n := DefaultConfig()
+	n.SetInQueueSize(1)
+	n.SetOutQueueSize(8)
+
+	assert.Empty(t, c.Update(n))
+	assert.Equal(t, DEFAULT_IN_QUEUE_SIZE, c.InQueueSize())
+	assert.Equal(t, DEFAULT_OUT_QUEUE_SIZE, c.OutQueueSize())
+}
+
+func TestConfigLoggerFollowsDebug(t *testing.T) {
+	c := DefaultConfig()
+	assert.Equal(t, LEVEL_INFO, c.Logger().Level())
+
+	c.EnableDebug()
+	assert.Equal(t, LEVEL_DEBUG, c.Logger().Level())
+}
@@ -0,0 +1,27 @@
+package binn_test
+
+import (
+	"time"
+	"testing"
+
+	"github.com/binn/binn"
+	"github.com/binn/binn/keepertest"
+)
+
+func TestContainerStorageConformance(t *testing.T) {
+	keepertest.Run(t, func(t *testing.T, e time.Duration) *keepertest.Harness {
+		ids := binn.DefaultIDStorage()
+		return &keepertest.Harness{ Keeper: binn.NewContainerStorage(true, e, ids), Issue: ids.Add }
+	})
+}
+
+func TestShardedContainerStorageConformance(t *testing.T) {
+	keepertest.Run(t, func(t *testing.T, e time.Duration) *keepertest.Harness {
+		ids := binn.NewStripedIDStorage(4)
+		return &keepertest.Harness{
+			Keeper:    binn.NewShardedContainerStorage(4, true, e, ids),
+			Issue:     ids.Add,
+			Unordered: true,
+		}
+	})
+}
@@ -1,7 +1,21 @@
 package binn
 
 import (
+	"sort"
 	"time"
+	"context"
+	"strings"
+)
+
+const (
+	MAX_MESSAGE_TAGS = 8
+	MAX_MESSAGE_TAG_LENGTH = 32
+	MAX_MESSAGE_LANGUAGE_LENGTH = 35
+	MAX_MESSAGE_SIGNATURE_LENGTH = 64
+	MAX_MESSAGE_METADATA = 16
+	MAX_MESSAGE_METADATA_KEY_LENGTH = 64
+	MAX_MESSAGE_METADATA_VALUE_LENGTH = 256
+	MAX_MESSAGE_ATTACHMENTS = 4
 )
 
 type Container interface {
@@ -10,14 +24,38 @@ type Container interface {
 	ExpiredAt() *time.Time
 }
 
+// Message is the content of a bottle, every field but Text is optional
+// and carried along when a storage rotates the id of the bottle
 type Message struct {
-	Text string
+	Text      string            `json:"text"`
+	// CreatedAt is when the message was stored first
+	CreatedAt *time.Time        `json:"created_at,omitempty"`
+	// Language is a BCP 47 tag like "en" or "pt-BR"
+	Language  string            `json:"language,omitempty"`
+	// Tags are topics and moods chosen by the writer, in lower case
+	Tags      []string          `json:"tags,omitempty"`
+	// Signature is a name the writer wants to be shown with the message
+	Signature string            `json:"signature,omitempty"`
+	// Hops counts the servers the bottle drifted to
+	Hops      int               `json:"hops,omitempty"`
+	Metadata  map[string]string `json:"metadata,omitempty"`
+	// Attachments are files kept in a BlobStore
+	Attachments []Attachment    `json:"attachments,omitempty"`
+}
+
+// Attachment is a file of a message, ID is the key of its blob
+type Attachment struct {
+	ID          string `json:"id"`
+	ContentType string `json:"content_type"`
+	Size        int64  `json:"size"`
 }
 
 type Bottle struct {
 	id        string
 	message   *Message
 	expiredAt *time.Time
+	identity  *Identity
+	ctx       context.Context
 }
 
 func NewBottle(id string, text string, expiredAt *time.Time) *Bottle {
@@ -30,6 +68,14 @@ func NewBottle(id string, text string, expiredAt *time.Time) *Bottle {
 	}
 }
 
+func NewBottleWithMessage(id string, m *Message, expiredAt *time.Time) *Bottle {
+	return &Bottle{
+		id:        id,
+		message:   m,
+		expiredAt: expiredAt,
+	}
+}
+
 func (b *Bottle) Message() *Message {
 	return b.message
 }
@@ -41,3 +87,143 @@ func (b *Bottle) ID() string {
 func (b *Bottle) ExpiredAt() *time.Time {
 	return b.expiredAt
 }
+
+func (b *Bottle) Identity() *Identity {
+	return b.identity
+}
+
+func (b *Bottle) SetIdentity(i *Identity) {
+	b.identity = i
+}
+
+func (b *Bottle) Context() context.Context {
+	return b.ctx
+}
+
+func (b *Bottle) SetContext(ctx context.Context) {
+	b.ctx = ctx
+}
+
+func (m *Message) Copy() *Message {
+	nm := *m
+	if m.CreatedAt != nil {
+		createdAt := *m.CreatedAt
+		nm.CreatedAt = &createdAt
+	}
+	if m.Tags != nil {
+		nm.Tags = append([]string{}, m.Tags...)
+	}
+	if m.Metadata != nil {
+		nm.Metadata = make(map[string]string, len(m.Metadata))
+		for k, v := range m.Metadata {
+			nm.Metadata[k] = v
+		}
+	}
+	if m.Attachments != nil {
+		nm.Attachments = append([]Attachment{}, m.Attachments...)
+	}
+	return &nm
+}
+
+// Stored returns the copy of m a storage keeps, every field is cut to
+// its limit and CreatedAt is set to now when m was never stored
+func (m *Message) Stored(now time.Time) *Message {
+	nm := m.Copy()
+	if len(nm.Text) > MAX_MESSAGE_TEXT_LENGTH {
+		nm.Text = nm.Text[:MAX_MESSAGE_TEXT_LENGTH]
+	}
+	if nm.CreatedAt == nil {
+		// a wall clock in utc reads back equal from json
+		createdAt := now.UTC().Round(0)
+		nm.CreatedAt = &createdAt
+	}
+	nm.Language = normalizeLanguage(nm.Language)
+	nm.Tags = normalizeTags(nm.Tags)
+	if len(nm.Signature) > MAX_MESSAGE_SIGNATURE_LENGTH {
+		nm.Signature = nm.Signature[:MAX_MESSAGE_SIGNATURE_LENGTH]
+	}
+	if nm.Hops < 0 {
+		nm.Hops = 0
+	}
+	nm.Metadata = boundMetadata(nm.Metadata)
+	if len(nm.Attachments) > MAX_MESSAGE_ATTACHMENTS {
+		nm.Attachments = nm.Attachments[:MAX_MESSAGE_ATTACHMENTS]
+	}
+	return nm
+}
+
+// normalizeLanguage drops a language which is not made of letters,
+// digits and hyphens
+func normalizeLanguage(l string) string {
+	l = strings.TrimSpace(l)
+	if len(l) > MAX_MESSAGE_LANGUAGE_LENGTH {
+		return ""
+	}
+	for _, r := range l {
+		if !(r == '-' || r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9') {
+			return ""
+		}
+	}
+	return l
+}
+
+// normalizeTags lower cases tags and drops empty, too long and
+// repeated tags, only the first MAX_MESSAGE_TAGS are kept
+func normalizeTags(tags []string) []string {
+	return normalizeTagsUpTo(tags, MAX_MESSAGE_TAGS)
+}
+
+// normalizeTagsUpTo is normalizeTags keeping the first max tags,
+// every tag when max is 0
+func normalizeTagsUpTo(tags []string, max int) []string {
+	if len(tags) == 0 {
+		return nil
+	}
+	seen := map[string]bool{}
+	nt := []string{}
+	for _, tag := range tags {
+		tag = strings.ToLower(strings.TrimSpace(tag))
+		if tag == "" || len(tag) > MAX_MESSAGE_TAG_LENGTH || seen[tag] {
+			continue
+		}
+		seen[tag] = true
+		nt = append(nt, tag)
+		if len(nt) == max {
+			break
+		}
+	}
+	if len(nt) == 0 {
+		return nil
+	}
+	return nt
+}
+
+// boundMetadata keeps the first MAX_MESSAGE_METADATA keys in order,
+// too long keys are dropped and too long values are cut
+func boundMetadata(metadata map[string]string) map[string]string {
+	if len(metadata) == 0 {
+		return nil
+	}
+	keys := make([]string, 0, len(metadata))
+	for k := range metadata {
+		if k != "" && len(k) <= MAX_MESSAGE_METADATA_KEY_LENGTH {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	if len(keys) > MAX_MESSAGE_METADATA {
+		keys = keys[:MAX_MESSAGE_METADATA]
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+	bounded := make(map[string]string, len(keys))
+	for _, k := range keys {
+		v := metadata[k]
+		if len(v) > MAX_MESSAGE_METADATA_VALUE_LENGTH {
+			v = v[:MAX_MESSAGE_METADATA_VALUE_LENGTH]
+		}
+		bounded[k] = v
+	}
+	return bounded
+}
@@ -1,7 +1,9 @@
 package binn
 
 import (
+	"fmt"
 	"time"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -20,3 +22,54 @@ func TestBottleGetter(t *testing.T) {
 	assert.Equal(t, b.Message().Text, "This is a Test Message")
 	assert.Equal(t, *b.ExpiredAt(), d_)
 }
+
+func TestMessageStored(t *testing.T) {
+	now := time.Date(2022, 5, 29, 22, 24, 0, 0, time.UTC)
+	metadata := map[string]string{ "": "empty", strings.Repeat("k", MAX_MESSAGE_METADATA_KEY_LENGTH + 1): "long" }
+	for i := 0; i < MAX_MESSAGE_METADATA + 2; i++ {
+		metadata[fmt.Sprintf("key%02d", i)] = strings.Repeat("v", MAX_MESSAGE_METADATA_VALUE_LENGTH + 1)
+	}
+	m := &Message{
+		Text:      strings.Repeat("a", MAX_MESSAGE_TEXT_LENGTH + 1),
+		Language:  "en-US",
+		Tags:      []string{ " Calm ", "calm", "", strings.Repeat("t", MAX_MESSAGE_TAG_LENGTH + 1), "a", "b", "c", "d", "e", "f", "g", "h" },
+		Signature: strings.Repeat("s", MAX_MESSAGE_SIGNATURE_LENGTH + 1),
+		Hops:      -1,
+		Metadata:  metadata,
+	}
+
+	stored := m.Stored(now)
+	assert.Equal(t, MAX_MESSAGE_TEXT_LENGTH, len(stored.Text))
+	assert.Equal(t, now, *stored.CreatedAt)
+	assert.Equal(t, "en-US", stored.Language)
+	assert.Equal(t, []string{ "calm", "a", "b", "c", "d", "e", "f", "g" }, stored.Tags)
+	assert.Equal(t, MAX_MESSAGE_SIGNATURE_LENGTH, len(stored.Signature))
+	assert.Equal(t, 0, stored.Hops)
+	assert.Equal(t, MAX_MESSAGE_METADATA, len(stored.Metadata))
+	assert.Equal(t, MAX_MESSAGE_METADATA_VALUE_LENGTH, len(stored.Metadata["key00"]))
+	assert.NotContains(t, stored.Metadata, "key16")
+
+	// m is left as it was and a stored message keeps its creation
+	assert.Equal(t, MAX_MESSAGE_TEXT_LENGTH + 1, len(m.Text))
+	assert.Nil(t, m.CreatedAt)
+	assert.Equal(t, now, *stored.Stored(now.Add(time.Hour)).CreatedAt)
+
+	assert.Equal(t, "", (&Message{ Language: "en US" }).Stored(now).Language)
+	assert.Nil(t, (&Message{ Tags: []string{ " " } }).Stored(now).Tags)
+}
+
+func TestMessageCopy(t *testing.T) {
+	m := &Message{
+		Text:        "hello",
+		Tags:        []string{ "calm" },
+		Metadata:    map[string]string{ "k": "v" },
+		Attachments: []Attachment{ { ID: "a.png", ContentType: "image/png", Size: 1 } },
+	}
+	c := m.Copy()
+	c.Tags[0] = "storm"
+	c.Metadata["k"] = "changed"
+	c.Attachments[0].ID = "b.png"
+	assert.Equal(t, "calm", m.Tags[0])
+	assert.Equal(t, "v", m.Metadata["k"])
+	assert.Equal(t, "a.png", m.Attachments[0].ID)
+}
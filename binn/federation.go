@@ -0,0 +1,491 @@
+package binn
+
+import (
+	"fmt"
+	"sync"
+	"time"
+	"bytes"
+	"context"
+	"strconv"
+	"strings"
+	"net/http"
+	"encoding/json"
+)
+
+const (
+	DEFAULT_FEDERATION_CYCLE = 5 * time.Minute
+	DEFAULT_FEDERATION_SAMPLE = 5
+	DEFAULT_FEDERATION_QUOTA = 100
+	FEDERATION_QUOTA_WINDOW = time.Hour
+	MAX_FEDERATION_BATCH = 100
+	MAX_FEDERATION_HOPS = 32
+	MAX_FEDERATION_CLOCK_SKEW = 5 * time.Minute
+	FEDERATION_INBOX_PATH = "/federation/inbox"
+	FEDERATION_PEER_HEADER = "X-Binn-Federation-Peer"
+)
+
+var (
+	ErrUnknownPeer = fmt.Errorf("this peer is unknown")
+	ErrDefederated = fmt.Errorf("this peer is defederated")
+	ErrInvalidSignature = fmt.Errorf("this signature is invalid")
+	ErrReplayed = fmt.Errorf("this payload is already received")
+)
+
+// Drifter is implemented by storages whose bottles can drift to other servers
+type Drifter interface {
+	Take(n int, skip func(c Container) bool) []Container
+	Requeue(containers []Container)
+	Drifted(c Container, peer string)
+	Inject(c Container) (Container, error)
+}
+
+// FederationPeer is a server exchanging bottles, Key is shared by both
+// servers and Quota is the number of bottles accepted from it per hour
+type FederationPeer struct {
+	Name  string
+	URL   string
+	Key   string
+	Quota int
+}
+
+// ParseFederationPeers parses "name;url;key" items with an optional ";quota"
+func ParseFederationPeers(items []string) ([]*FederationPeer, error) {
+	peers := []*FederationPeer{}
+	for _, item := range items {
+		parts := strings.Split(item, ";")
+		if len(parts) < 3 || len(parts) > 4 || parts[0] == "" || parts[1] == "" || parts[2] == "" {
+			return nil, fmt.Errorf("this peer (%#v) is invalid format", item)
+		}
+		p := &FederationPeer{
+			Name:  parts[0],
+			URL:   strings.TrimRight(parts[1], "/"),
+			Key:   parts[2],
+			Quota: DEFAULT_FEDERATION_QUOTA,
+		}
+		if len(parts) == 4 {
+			q, err := strconv.Atoi(parts[3])
+			if err != nil || q < 0 {
+				return nil, fmt.Errorf("this peer quota (%#v) is invalid", parts[3])
+			}
+			p.Quota = q
+		}
+		peers = append(peers, p)
+	}
+	return peers, nil
+}
+
+// FederationBottle is a bottle on its way, Via lists every server it
+// has visited so it never comes back to one of them
+type FederationBottle struct {
+	Message
+	ExpiredAt *time.Time `json:"expired_at,omitempty"`
+	Via       []string   `json:"via"`
+}
+
+type FederationPayload struct {
+	// ID is unique to every payload so a replayed one is refused
+	ID      string              `json:"id"`
+	Origin  string              `json:"origin"`
+	Bottles []*FederationBottle `json:"bottles"`
+}
+
+// FederationResult lists the indexes of the accepted bottles of a payload
+type FederationResult struct {
+	Accepted []int `json:"accepted"`
+}
+
+type FederationPeerStatus struct {
+	Name        string
+	URL         string
+	Quota       int
+	Defederated bool
+	Sent        uint64
+	Received    uint64
+	Rejected    uint64
+	LastError   string
+}
+
+type federationPeer struct {
+	*FederationPeer
+	defederated bool
+	windowStart time.Time
+	windowCount int
+	sent        uint64
+	received    uint64
+	rejected    uint64
+	lastError   string
+}
+
+// Federation exports a sample of the storage to its peers every cycle
+// and imports the bottles they export, a bottle whose answer is lost is
+// kept by both servers rather than lost
+type Federation struct {
+	name    string
+	peers   []*federationPeer
+	storage Drifter
+	via     map[string][]string
+	// ids of the received payloads until their timestamp leaves the skew window
+	seen    map[string]time.Time
+	sample  int
+	cycle   time.Duration
+	client  *http.Client
+	logger  *Logger
+	mux     *sync.Mutex
+}
+
+func NewFederation(name string, peers []*FederationPeer, storage Drifter) *Federation {
+	f := &Federation{
+		name:    name,
+		peers:   []*federationPeer{},
+		storage: storage,
+		via:     make(map[string][]string),
+		seen:    make(map[string]time.Time),
+		sample:  DEFAULT_FEDERATION_SAMPLE,
+		cycle:   DEFAULT_FEDERATION_CYCLE,
+		client:  &http.Client{ Timeout: 10 * time.Second },
+		logger:  DefaultLogger(),
+		mux:     &sync.Mutex{},
+	}
+	for _, p := range peers {
+		f.peers = append(f.peers, &federationPeer{ FederationPeer: p })
+	}
+	return f
+}
+
+func (f *Federation) Name() string {
+	return f.name
+}
+
+// SetSample sets the number of bottles exported to each peer per cycle
+func (f *Federation) SetSample(n int) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	f.sample = n
+}
+
+func (f *Federation) SetCycle(d time.Duration) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	f.cycle = d
+}
+
+func (f *Federation) SetLogger(l *Logger) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	f.logger = l
+}
+
+func (f *Federation) Peers() []FederationPeerStatus {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	peers := make([]FederationPeerStatus, 0, len(f.peers))
+	for _, p := range f.peers {
+		peers = append(peers, FederationPeerStatus{
+			Name:        p.Name,
+			URL:         p.URL,
+			Quota:       p.Quota,
+			Defederated: p.defederated,
+			Sent:        p.sent,
+			Received:    p.received,
+			Rejected:    p.rejected,
+			LastError:   p.lastError,
+		})
+	}
+	return peers
+}
+
+// Defederate stops exchanging bottles with the peer named name
+func (f *Federation) Defederate(name string) error {
+	return f.setDefederated(name, true)
+}
+
+func (f *Federation) Refederate(name string) error {
+	return f.setDefederated(name, false)
+}
+
+func (f *Federation) setDefederated(name string, v bool) error {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	p := f.peer(name)
+	if p == nil {
+		return fmt.Errorf("this peer (%#v) is not federated", name)
+	}
+	p.defederated = v
+	return nil
+}
+
+func (f *Federation) peer(name string) *federationPeer {
+	for _, p := range f.peers {
+		if p.Name == name {
+			return p
+		}
+	}
+	return nil
+}
+
+// Run exports bottles every cycle until ctx is done
+func (f *Federation) Run(ctx context.Context) {
+	f.mux.Lock()
+	cycle := f.cycle
+	f.mux.Unlock()
+
+	go func() {
+		t := time.NewTicker(cycle)
+		defer t.Stop()
+		for {
+			select {
+			case <- ctx.Done():
+				return
+			case <- t.C:
+				f.Export(ctx)
+			}
+		}
+	}()
+}
+
+// Export sends a sample of the storage to every federated peer
+func (f *Federation) Export(ctx context.Context) {
+	f.mux.Lock()
+	peers := []*federationPeer{}
+	for _, p := range f.peers {
+		if !p.defederated {
+			peers = append(peers, p)
+		}
+	}
+	logger := f.logger
+	f.mux.Unlock()
+
+	for _, p := range peers {
+		n, err := f.exportTo(ctx, p)
+		f.mux.Lock()
+		if err != nil {
+			p.lastError = err.Error()
+		} else {
+			p.lastError = ""
+			p.sent += uint64(n)
+		}
+		f.mux.Unlock()
+		if err != nil {
+			logger.Warn("failed to export bottles", F("peer", p.Name), F("error", err))
+			continue
+		}
+		if n > 0 {
+			logger.Debug("export bottles", F("peer", p.Name), F("count", n))
+		}
+	}
+}
+
+func (f *Federation) exportTo(ctx context.Context, p *federationPeer) (int, error) {
+	f.mux.Lock()
+	via := make(map[string][]string, len(f.via))
+	for id, v := range f.via {
+		via[id] = v
+	}
+	sample := f.sample
+	f.mux.Unlock()
+
+	// empty bottles are generated by every server and never drift,
+	// nor do bottles with attachments whose blobs stay on this server
+	stored := make(map[string]bool)
+	taken := f.storage.Take(sample, func(c Container) bool {
+		stored[c.ID()] = true
+		return c.Message().Text == "" || len(c.Message().Attachments) > 0 || contains(via[c.ID()], p.Name)
+	})
+
+	// forget the routes of bottles delivered on this server
+	f.mux.Lock()
+	for id := range via {
+		if !stored[id] {
+			delete(f.via, id)
+		}
+	}
+	f.mux.Unlock()
+
+	if len(taken) == 0 {
+		return 0, nil
+	}
+
+	payload := &FederationPayload{ ID: GenerateID(), Origin: f.name, Bottles: []*FederationBottle{} }
+	for _, c := range taken {
+		payload.Bottles = append(payload.Bottles, &FederationBottle{
+			Message:   *c.Message(),
+			ExpiredAt: c.ExpiredAt(),
+			Via:       append(append([]string{}, via[c.ID()]...), f.name),
+		})
+	}
+	res, err := f.send(ctx, p, payload)
+	if err != nil {
+		f.storage.Requeue(taken)
+		return 0, err
+	}
+
+	accepted := make(map[int]bool, len(res.Accepted))
+	for _, i := range res.Accepted {
+		accepted[i] = true
+	}
+	rest := []Container{}
+	for i, c := range taken {
+		if !accepted[i] {
+			rest = append(rest, c)
+			continue
+		}
+		f.storage.Drifted(c, p.Name)
+		f.mux.Lock()
+		delete(f.via, c.ID())
+		f.mux.Unlock()
+	}
+	f.storage.Requeue(rest)
+
+	return len(taken) - len(rest), nil
+}
+
+func (f *Federation) send(ctx context.Context, p *federationPeer, payload *FederationPayload) (*FederationResult, error) {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.URL + FEDERATION_INBOX_PATH, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(FEDERATION_PEER_HEADER, f.name)
+	req.Header.Set(WEBHOOK_TIMESTAMP_HEADER, timestamp)
+	req.Header.Set(WEBHOOK_SIGNATURE_HEADER, SignWebhook(p.Key, timestamp, body))
+
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("this peer (%#v) responded status %d", p.Name, resp.StatusCode)
+	}
+
+	var res FederationResult
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+// Receive imports the bottles of a payload signed by the peer named name,
+// bottles which visited this server or exceed the quota are not accepted
+func (f *Federation) Receive(name string, timestamp string, signature string, body []byte) (*FederationResult, error) {
+	f.mux.Lock()
+	p := f.peer(name)
+	if p == nil {
+		f.mux.Unlock()
+		return nil, ErrUnknownPeer
+	}
+	defederated, key := p.defederated, p.Key
+	f.mux.Unlock()
+	if defederated {
+		return nil, ErrDefederated
+	}
+
+	ts, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return nil, ErrInvalidSignature
+	}
+	if d := time.Since(time.Unix(ts, 0)); d > MAX_FEDERATION_CLOCK_SKEW || d < -MAX_FEDERATION_CLOCK_SKEW {
+		return nil, ErrInvalidSignature
+	}
+	if !VerifyWebhook(key, timestamp, body, signature) {
+		return nil, ErrInvalidSignature
+	}
+
+	var payload FederationPayload
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return nil, fmt.Errorf("this payload is invalid format, %s", err)
+	}
+	if payload.Origin != name {
+		return nil, fmt.Errorf("this payload (%#v) is not sent by %#v", payload.Origin, name)
+	}
+	if payload.ID == "" {
+		return nil, fmt.Errorf("this payload has no id")
+	}
+	if !f.firstSeen(name + "/" + payload.ID, time.Unix(ts, 0)) {
+		return nil, ErrReplayed
+	}
+
+	res := &FederationResult{ Accepted: []int{} }
+	now := time.Now()
+	for i, b := range payload.Bottles {
+		if i >= MAX_FEDERATION_BATCH || !f.admit(p, b, now) {
+			f.mux.Lock()
+			p.rejected++
+			f.mux.Unlock()
+			continue
+		}
+		m := b.Message.Copy()
+		m.Hops++
+		// attachments are kept in the blob store of the peer they were thrown to
+		m.Attachments = nil
+		c, err := f.storage.Inject(NewBottleWithMessage("", m, b.ExpiredAt))
+		if err != nil {
+			f.mux.Lock()
+			p.rejected++
+			f.mux.Unlock()
+			continue
+		}
+
+		f.mux.Lock()
+		f.via[c.ID()] = append([]string{}, b.Via...)
+		p.received++
+		f.mux.Unlock()
+		res.Accepted = append(res.Accepted, i)
+	}
+	return res, nil
+}
+
+// firstSeen records the id of a payload signed at signedAt, it is kept
+// as long as the signature is accepted and forgotten afterwards
+func (f *Federation) firstSeen(id string, signedAt time.Time) bool {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	now := time.Now()
+	for k, until := range f.seen {
+		if now.After(until) {
+			delete(f.seen, k)
+		}
+	}
+	if _, ok := f.seen[id]; ok {
+		return false
+	}
+	f.seen[id] = signedAt.Add(MAX_FEDERATION_CLOCK_SKEW)
+	return true
+}
+
+// admit checks b is not looping and counts it to the quota of p
+func (f *Federation) admit(p *federationPeer, b *FederationBottle, now time.Time) bool {
+	if b == nil || b.Text == "" || len(b.Via) > MAX_FEDERATION_HOPS || contains(b.Via, f.name) {
+		return false
+	}
+	if b.ExpiredAt != nil && now.After(*b.ExpiredAt) {
+		return false
+	}
+
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	if now.Sub(p.windowStart) >= FEDERATION_QUOTA_WINDOW {
+		p.windowStart = now
+		p.windowCount = 0
+	}
+	if p.windowCount >= p.Quota {
+		return false
+	}
+	p.windowCount++
+	return true
+}
+
+func contains(items []string, s string) bool {
+	for _, item := range items {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
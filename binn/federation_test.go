@@ -0,0 +1,211 @@
+package binn
+
+import (
+	"io"
+	"time"
+	"context"
+	"strconv"
+	"testing"
+	"net/http"
+	"encoding/json"
+	"net/http/httptest"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type federationTestServer struct {
+	storage    *ContainerStorage
+	federation *Federation
+	server     *httptest.Server
+}
+
+func federationInbox(f **Federation) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		res, err := (*f).Receive(
+			r.Header.Get(FEDERATION_PEER_HEADER),
+			r.Header.Get(WEBHOOK_TIMESTAMP_HEADER),
+			r.Header.Get(WEBHOOK_SIGNATURE_HEADER),
+			body,
+		)
+		if err != nil {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		json.NewEncoder(w).Encode(res)
+	}
+}
+
+// newFederationTestServers federates every server with all the others
+func newFederationTestServers(t *testing.T, names []string, quota int) map[string]*federationTestServer {
+	servers := map[string]*federationTestServer{}
+	for _, name := range names {
+		s := &federationTestServer{ storage: NewContainerStorage(false, 0, nil) }
+		s.server = httptest.NewServer(federationInbox(&s.federation))
+		t.Cleanup(s.server.Close)
+		servers[name] = s
+	}
+	for _, name := range names {
+		peers := []*FederationPeer{}
+		for _, other := range names {
+			if other != name {
+				peers = append(peers, &FederationPeer{
+					Name:  other,
+					URL:   servers[other].server.URL,
+					Key:   "key",
+					Quota: quota,
+				})
+			}
+		}
+		servers[name].federation = NewFederation(name, peers, servers[name].storage)
+	}
+	return servers
+}
+
+func TestFederationExportsBottles(t *testing.T) {
+	servers := newFederationTestServers(t, []string{ "a", "b" }, 10)
+	a, b := servers["a"], servers["b"]
+	require.Nil(t, a.storage.Add(NewBottle("", "hello", nil)))
+	require.Nil(t, a.storage.Add(NewBottle("", "", nil)))
+
+	a.federation.Export(context.Background())
+
+	assert.Equal(t, 1, a.storage.Len())
+	assert.Equal(t, "", a.storage.List(0, 1)[0].Message().Text)
+	assert.Equal(t, 1, b.storage.Len())
+	assert.Equal(t, "hello", b.storage.List(0, 1)[0].Message().Text)
+	assert.Equal(t, uint64(1), a.federation.Peers()[0].Sent)
+	assert.Equal(t, uint64(1), b.federation.Peers()[0].Received)
+}
+
+func TestFederationNeverReturnsBottles(t *testing.T) {
+	servers := newFederationTestServers(t, []string{ "a", "b", "c" }, 10)
+	require.Nil(t, servers["a"].storage.Add(NewBottle("", "hello", nil)))
+
+	servers["a"].federation.SetSample(1)
+	servers["a"].federation.Export(context.Background())
+	// the bottle reached either b or c and may only go on to the other one
+	next := "b"
+	if servers["c"].storage.Len() == 1 {
+		next = "c"
+	}
+	servers[next].federation.Export(context.Background())
+	last := map[string]string{ "b": "c", "c": "b" }[next]
+	require.Equal(t, 1, servers[last].storage.Len())
+
+	servers[last].federation.Export(context.Background())
+	assert.Equal(t, 1, servers[last].storage.Len())
+	assert.Equal(t, 0, servers["a"].storage.Len())
+}
+
+func TestFederationQuota(t *testing.T) {
+	servers := newFederationTestServers(t, []string{ "a", "b" }, 2)
+	a, b := servers["a"], servers["b"]
+	for i := 0; i < 5; i++ {
+		require.Nil(t, a.storage.Add(NewBottle("", "hello", nil)))
+	}
+
+	a.federation.Export(context.Background())
+	assert.Equal(t, 3, a.storage.Len())
+	assert.Equal(t, 2, b.storage.Len())
+	assert.Equal(t, uint64(3), b.federation.Peers()[0].Rejected)
+}
+
+func TestFederationDefederate(t *testing.T) {
+	servers := newFederationTestServers(t, []string{ "a", "b" }, 10)
+	a, b := servers["a"], servers["b"]
+	require.Nil(t, a.storage.Add(NewBottle("", "hello", nil)))
+
+	require.Nil(t, b.federation.Defederate("a"))
+	a.federation.Export(context.Background())
+	assert.Equal(t, 1, a.storage.Len())
+	assert.Equal(t, 0, b.storage.Len())
+	assert.NotEqual(t, "", a.federation.Peers()[0].LastError)
+
+	require.Nil(t, b.federation.Refederate("a"))
+	a.federation.Export(context.Background())
+	assert.Equal(t, 0, a.storage.Len())
+	assert.Equal(t, 1, b.storage.Len())
+
+	assert.NotNil(t, b.federation.Defederate("unknown"))
+}
+
+func TestFederationReceiveVerifiesSignature(t *testing.T) {
+	f := NewFederation("b", []*FederationPeer{ { Name: "a", Key: "key", Quota: 10 } }, NewContainerStorage(false, 0, nil))
+	body := []byte(`{"id":"1","origin":"a","bottles":[{"text":"hello","via":["a"]}]}`)
+	ts := time.Now().Unix()
+	now := strconv.FormatInt(ts, 10)
+
+	_, err := f.Receive("a", now, SignWebhook("wrong", now, body), body)
+	assert.Equal(t, ErrInvalidSignature, err)
+	stale := strconv.FormatInt(ts - 3600, 10)
+	_, err = f.Receive("a", stale, SignWebhook("key", stale, body), body)
+	assert.Equal(t, ErrInvalidSignature, err)
+	_, err = f.Receive("c", now, SignWebhook("key", now, body), body)
+	assert.Equal(t, ErrUnknownPeer, err)
+
+	res, err := f.Receive("a", now, SignWebhook("key", now, body), body)
+	assert.Nil(t, err)
+	assert.Equal(t, []int{ 0 }, res.Accepted)
+
+	// a captured payload is refused even when signed again in the skew window
+	_, err = f.Receive("a", now, SignWebhook("key", now, body), body)
+	assert.Equal(t, ErrReplayed, err)
+	later := strconv.FormatInt(ts + 60, 10)
+	_, err = f.Receive("a", later, SignWebhook("key", later, body), body)
+	assert.Equal(t, ErrReplayed, err)
+
+	noID := []byte(`{"origin":"a","bottles":[{"text":"hello","via":["a"]}]}`)
+	_, err = f.Receive("a", now, SignWebhook("key", now, noID), noID)
+	assert.NotNil(t, err)
+}
+
+func TestFederationForgetsPayloadsOutOfSkewWindow(t *testing.T) {
+	f := NewFederation("b", nil, NewContainerStorage(false, 0, nil))
+	signedAt := time.Now().Add(-MAX_FEDERATION_CLOCK_SKEW - time.Second)
+	assert.True(t, f.firstSeen("a/1", signedAt))
+	assert.True(t, f.firstSeen("a/2", time.Now()))
+	assert.Equal(t, 1, len(f.seen))
+	assert.False(t, f.firstSeen("a/2", time.Now()))
+}
+
+func TestParseFederationPeers(t *testing.T) {
+	peers, err := ParseFederationPeers([]string{ "a;https://a.example/;key", "b;https://b.example;key;5" })
+	assert.Nil(t, err)
+	assert.Equal(t, "https://a.example", peers[0].URL)
+	assert.Equal(t, DEFAULT_FEDERATION_QUOTA, peers[0].Quota)
+	assert.Equal(t, 5, peers[1].Quota)
+
+	_, err = ParseFederationPeers([]string{ "a;https://a.example" })
+	assert.NotNil(t, err)
+	_, err = ParseFederationPeers([]string{ "a;https://a.example;key;many" })
+	assert.NotNil(t, err)
+}
+
+func TestFederationCountsHops(t *testing.T) {
+	servers := newFederationTestServers(t, []string{ "a", "b" }, 10)
+	m := &Message{ Text: "hello", Language: "en", Tags: []string{ "calm" } }
+	require.Nil(t, servers["a"].storage.Add(NewBottleWithMessage("", m, nil)))
+
+	servers["a"].federation.Export(context.Background())
+	require.Equal(t, 1, servers["b"].storage.Len())
+	received := servers["b"].storage.List(0, 1)[0].Message()
+	assert.Equal(t, 1, received.Hops)
+	assert.Equal(t, "en", received.Language)
+	assert.Equal(t, []string{ "calm" }, received.Tags)
+	assert.Equal(t, 0, servers["a"].storage.Len())
+}
+
+func TestFederationDropsAttachments(t *testing.T) {
+	storage := NewContainerStorage(false, 0, nil)
+	f := NewFederation("b", []*FederationPeer{ { Name: "a", Key: "key", Quota: 10 } }, storage)
+	body := []byte(`{"id":"1","origin":"a","bottles":[{"text":"hello","attachments":[{"id":"doodle.png","content_type":"image/png","size":2048}],"via":["a"]}]}`)
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+
+	res, err := f.Receive("a", now, SignWebhook("key", now, body), body)
+	require.Nil(t, err)
+	assert.Equal(t, []int{ 0 }, res.Accepted)
+	require.Equal(t, 1, storage.Len())
+	assert.Empty(t, storage.List(0, 1)[0].Message().Attachments)
+}
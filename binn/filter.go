@@ -0,0 +1,216 @@
+package binn
+
+import (
+	"fmt"
+	"time"
+	"context"
+	"strings"
+)
+
+const MAX_FILTER_VALUES = 8
+
+// Filter picks the bottles a subscriber wants, a bottle matches when it
+// is in one of Languages, has one of Tags and has none of ExcludeTags,
+// a empty field matches every bottle
+type Filter struct {
+	// Languages are BCP 47 tags, "pt" also matches "pt-BR"
+	Languages   []string
+	Tags        []string
+	ExcludeTags []string
+}
+
+// Selector is implemented by storages which pick up the first container
+// a subscriber wants instead of the oldest one
+type Selector interface {
+	GetMatching(match func(c Container) bool) (Container, error)
+}
+
+// ErrFilterUnsupported is returned when a filtered container is asked of
+// a storage which is not a Selector
+var ErrFilterUnsupported = fmt.Errorf("this storage can not pick out containers by a filter")
+
+// Issuer is implemented by storages which accept a id issued by the engine
+type Issuer interface {
+	Issue(id string, e time.Time) error
+}
+
+// NewFilter normalizes the values like a stored message, it fails when
+// a field has more than MAX_FILTER_VALUES values
+func NewFilter(languages []string, tags []string, excludeTags []string) (*Filter, error) {
+	f := &Filter{}
+	for _, l := range languages {
+		if l = normalizeLanguage(l); l != "" {
+			f.Languages = append(f.Languages, strings.ToLower(l))
+		}
+	}
+	// only distinct values count against the limit
+	f.Tags = normalizeTagsUpTo(tags, 0)
+	f.ExcludeTags = normalizeTagsUpTo(excludeTags, 0)
+	if len(f.Languages) > MAX_FILTER_VALUES || len(f.Tags) > MAX_FILTER_VALUES || len(f.ExcludeTags) > MAX_FILTER_VALUES {
+		return nil, fmt.Errorf("this filter has more than %d values in a field", MAX_FILTER_VALUES)
+	}
+	return f, nil
+}
+
+// Empty tells whether f matches every bottle
+func (f *Filter) Empty() bool {
+	return f == nil || len(f.Languages) == 0 && len(f.Tags) == 0 && len(f.ExcludeTags) == 0
+}
+
+func (f *Filter) Match(c Container) bool {
+	if f.Empty() {
+		return true
+	}
+	m := c.Message()
+	if len(f.Languages) > 0 && !f.matchLanguage(m.Language) {
+		return false
+	}
+	if len(f.Tags) > 0 && !hasAnyTag(m.Tags, f.Tags) {
+		return false
+	}
+	return !hasAnyTag(m.Tags, f.ExcludeTags)
+}
+
+func (f *Filter) matchLanguage(language string) bool {
+	language = strings.ToLower(language)
+	for _, l := range f.Languages {
+		if language == l || strings.HasPrefix(language, l + "-") {
+			return true
+		}
+	}
+	return false
+}
+
+func hasAnyTag(tags []string, wanted []string) bool {
+	for _, tag := range tags {
+		for _, w := range wanted {
+			if strings.ToLower(tag) == w {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// generatedKeeper keeps the container a generate handler adds
+type generatedKeeper struct {
+	c Container
+}
+
+func (k *generatedKeeper) Get() (Container, error) {
+	return nil, fmt.Errorf("this storage has no containers")
+}
+
+func (k *generatedKeeper) Add(c Container) error {
+	k.c = c
+	return nil
+}
+
+// CanFilter tells whether the storage picks out the containers a filter matches
+func (e *Engine) CanFilter() bool {
+	_, ok := e.storage.(Selector)
+	return ok
+}
+
+// NextMatching picks up the first returned or stored container f matches,
+// it returns ErrFilterUnsupported when the storage is not a Selector
+func (e *Engine) NextMatching(f *Filter) (Container, error) {
+	e.queue.mux.Lock()
+	for i, c := range e.queue.pending {
+		if f.Match(c) {
+			e.queue.pending = append(e.queue.pending[:i:i], e.queue.pending[i + 1:]...)
+			e.queue.mux.Unlock()
+			return c, nil
+		}
+	}
+	e.queue.mux.Unlock()
+
+	if s, ok := e.storage.(Selector); ok {
+		return s.GetMatching(f.Match)
+	}
+	return nil, ErrFilterUnsupported
+}
+
+// generate makes a empty container for a subscriber nothing matched with
+// the generate container handler, a id the handler gave is kept since it
+// issued it and a container without one gets a id issued to the storage so
+// the subscriber can reply to it, it returns nil when the handler added
+// nothing like on a cluster follower
+func (e *Engine) generate() (Container, error) {
+	k := &generatedKeeper{}
+	if err := e.generateContainerHandler(&hookedKeeper{ k, e.hooks }); err != nil {
+		return nil, err
+	}
+	if k.c == nil {
+		return nil, nil
+	}
+
+	now := time.Now()
+	expiredAt := now.Add(time.Duration(MAX_EXPIRATION_HOUR) * time.Hour)
+	if at := k.c.ExpiredAt(); at != nil {
+		expiredAt = *at
+	}
+	id := k.c.ID()
+	if id == "" {
+		id = GenerateID()
+		if i, ok := e.storage.(Issuer); ok {
+			if err := i.Issue(id, expiredAt); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return NewBottleWithMessage(id, k.c.Message().Stored(now), &expiredAt), nil
+}
+
+// Matching delivers the containers f matches to one subscriber every
+// delivery cycle until ctx is done, when nothing matches for a generate
+// cycle it delivers a generated empty container like the generate loop
+func (e *Engine) Matching(ctx context.Context, f *Filter) <-chan Container {
+	ch := make(chan Container)
+	go func() {
+		defer close(ch)
+		reloaded := e.reloaded()
+		t := time.NewTicker(e.cfg.DeliveryCycle())
+		defer t.Stop()
+		lastMatch := time.Now()
+		for {
+			select {
+			case <- ctx.Done():
+				return
+			case <- reloaded:
+				reloaded = e.reloaded()
+				t.Reset(e.cfg.DeliveryCycle())
+				continue
+			case <- t.C:
+			}
+
+			c, err := e.NextMatching(f)
+			if err != nil {
+				// generation follows the generate loop which only runs with validation
+				if !e.cfg.Validation() || time.Since(lastMatch) < e.cfg.GenerateCycle() {
+					continue
+				}
+				if c, err = e.generate(); err != nil {
+					e.logger().Warn("failed to generate a container", F("error", err))
+					continue
+				}
+				if c == nil {
+					continue
+				}
+				e.logger().Debug("generate a empty container for a filter")
+			}
+			lastMatch = time.Now()
+
+			e.deliverTo(c, func(c Container) bool {
+				select {
+				case ch <- c:
+					return true
+				case <- ctx.Done():
+					e.Return(c)
+					return false
+				}
+			})
+		}
+	}()
+	return ch
+}
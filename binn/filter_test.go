@@ -0,0 +1,204 @@
+package binn
+
+import (
+	"time"
+	"strconv"
+	"strings"
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func bottleWith(language string, tags ...string) *Bottle {
+	return NewBottleWithMessage("", &Message{ Text: "hello", Language: language, Tags: tags }, nil)
+}
+
+func TestFilterMatch(t *testing.T) {
+	f, err := NewFilter([]string{ "PT", " ja " }, []string{ "Calm", "sea" }, []string{ "storm" })
+	require.Nil(t, err)
+	assert.Equal(t, []string{ "pt", "ja" }, f.Languages)
+	assert.Equal(t, []string{ "calm", "sea" }, f.Tags)
+
+	assert.True(t, f.Match(bottleWith("pt-BR", "calm")))
+	assert.True(t, f.Match(bottleWith("ja", "sea", "night")))
+	assert.False(t, f.Match(bottleWith("en", "calm")))
+	assert.False(t, f.Match(bottleWith("pta", "calm")))
+	assert.False(t, f.Match(bottleWith("", "calm")))
+	assert.False(t, f.Match(bottleWith("pt")))
+	assert.False(t, f.Match(bottleWith("pt", "calm", "storm")))
+
+	f, err = NewFilter(nil, nil, []string{ "storm" })
+	require.Nil(t, err)
+	assert.True(t, f.Match(bottleWith("")))
+	assert.False(t, f.Match(bottleWith("", "storm")))
+
+	var empty *Filter
+	assert.True(t, empty.Empty())
+	assert.True(t, empty.Match(bottleWith("en")))
+	f, err = NewFilter([]string{ "e n", "" }, []string{ " " }, nil)
+	require.Nil(t, err)
+	assert.True(t, f.Empty())
+}
+
+func TestNewFilterLimitsValues(t *testing.T) {
+	tags := make([]string, MAX_FILTER_VALUES + 1)
+	for i := range tags {
+		tags[i] = "tag" + strconv.Itoa(i)
+	}
+	_, err := NewFilter(nil, tags, nil)
+	assert.NotNil(t, err)
+	_, err = NewFilter(nil, tags[:MAX_FILTER_VALUES], nil)
+	assert.Nil(t, err)
+
+	// repeated and blank tags are not counted
+	tags = append(tags[:MAX_FILTER_VALUES], "", " ", strings.ToUpper(tags[0]))
+	f, err := NewFilter(nil, nil, tags)
+	assert.Nil(t, err)
+	assert.Equal(t, MAX_FILTER_VALUES, len(f.ExcludeTags))
+}
+
+func TestGetMatching(t *testing.T) {
+	f, _ := NewFilter([]string{ "ja" }, nil, nil)
+	for _, s := range []ContainerKeeper{
+		NewContainerStorage(false, 0, nil),
+		NewShardedContainerStorage(4, false, 0, NewStripedIDStorage(4)),
+	} {
+		s.Add(bottleWith("en"))
+		s.Add(bottleWith("ja", "first"))
+		s.Add(bottleWith("ja", "second"))
+
+		c, err := s.(Selector).GetMatching(f.Match)
+		require.Nil(t, err)
+		assert.Equal(t, "ja", c.Message().Language)
+		assert.NotNil(t, c.ExpiredAt())
+		_, err = s.(Selector).GetMatching(f.Match)
+		require.Nil(t, err)
+		_, err = s.(Selector).GetMatching(f.Match)
+		assert.NotNil(t, err)
+
+		c, err = s.Get()
+		require.Nil(t, err)
+		assert.Equal(t, "en", c.Message().Language)
+	}
+
+	// the oldest match is picked up first
+	s := NewContainerStorage(false, 0, nil)
+	s.Add(bottleWith("ja", "first"))
+	s.Add(bottleWith("ja", "second"))
+	c, _ := s.GetMatching(f.Match)
+	assert.Equal(t, []string{ "first" }, c.Message().Tags)
+}
+
+func TestNextMatchingPrefersReturned(t *testing.T) {
+	storage := NewContainerStorage(false, 0, nil)
+	storage.Add(bottleWith("ja", "stored"))
+	engine := NewEngine(DefaultConfig(), storage)
+	engine.Return(bottleWith("en", "returned"))
+	engine.Return(bottleWith("ja", "returned"))
+
+	f, _ := NewFilter([]string{ "ja" }, nil, nil)
+	c, err := engine.NextMatching(f)
+	require.Nil(t, err)
+	assert.Equal(t, []string{ "returned" }, c.Message().Tags)
+	c, err = engine.NextMatching(f)
+	require.Nil(t, err)
+	assert.Equal(t, []string{ "stored" }, c.Message().Tags)
+	_, err = engine.NextMatching(f)
+	assert.NotNil(t, err)
+	assert.Equal(t, 1, engine.QueueStats().Pending)
+}
+
+func TestNextMatchingNeedsSelector(t *testing.T) {
+	engine := NewEngine(DefaultConfig(), &generatedKeeper{})
+	assert.False(t, engine.CanFilter())
+	assert.True(t, NewEngine(DefaultConfig(), NewContainerStorage(false, 0, nil)).CanFilter())
+
+	f, _ := NewFilter([]string{ "ja" }, nil, nil)
+	_, err := engine.NextMatching(f)
+	assert.Equal(t, ErrFilterUnsupported, err)
+}
+
+func TestMatchingDeliversToOneSubscriber(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.SetDeliveryCycle(time.Duration(1) * time.Millisecond)
+	storage := NewContainerStorage(false, 0, nil)
+	engine := NewEngine(cfg, storage)
+	delivered := make(chan Container, 1)
+	engine.GetHooks().OnSync(EVENT_DELIVERED, func(ctx context.Context, c Container) (Container, error) {
+		delivered <- c
+		return c, nil
+	})
+
+	// the engine does not run so only the subscriber picks up
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	defer cancelFunc()
+
+	f, _ := NewFilter(nil, []string{ "calm" }, nil)
+	ch := engine.Matching(ctx, f)
+	storage.Add(bottleWith("en", "calm"))
+
+	select {
+	case c := <- ch:
+		assert.Equal(t, []string{ "calm" }, c.Message().Tags)
+	case <- time.After(time.Second):
+		t.Fatal("no container was delivered")
+	}
+	select {
+	case c := <- delivered:
+		assert.Equal(t, []string{ "calm" }, c.Message().Tags)
+	case <- time.After(time.Second):
+		t.Fatal("no delivered hook was called")
+	}
+}
+
+func TestMatchingGeneratesWhenNothingMatches(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.SetDeliveryCycle(time.Duration(1) * time.Millisecond)
+	cfg.SetGenerateCycle(time.Duration(5) * time.Millisecond)
+	ids := DefaultIDStorage()
+	storage := NewContainerStorage(true, 0, ids)
+	engine := NewEngine(cfg, storage)
+	engine.SetGenerateContainerHandler(func(cs ContainerKeeper) error {
+		return cs.Add(NewBottle("", "generated", nil))
+	})
+
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	defer cancelFunc()
+	f, _ := NewFilter([]string{ "ja" }, nil, nil)
+	var c Container
+	select {
+	case c = <- engine.Matching(ctx, f):
+	case <- time.After(time.Second):
+		t.Fatal("no container was generated")
+	}
+	assert.Equal(t, "generated", c.Message().Text)
+	assert.Equal(t, 0, storage.Len())
+
+	// the subscriber can reply to the generated bottle
+	assert.Nil(t, storage.Add(NewBottle(c.ID(), "reply", nil)))
+}
+
+func TestGenerateKeepsIssuedID(t *testing.T) {
+	ids := DefaultIDStorage()
+	engine := NewEngine(DefaultConfig(), NewContainerStorage(true, 0, ids))
+	issued := ""
+	engine.SetGenerateContainerHandler(func(cs ContainerKeeper) error {
+		issued = GenerateID()
+		ids.Add(issued, time.Now().Add(time.Minute))
+		return cs.Add(NewBottle(issued, "", nil))
+	})
+	c, err := engine.generate()
+	require.Nil(t, err)
+	assert.Equal(t, issued, c.ID())
+	assert.Equal(t, 1, ids.Len())
+
+	// a handler which adds nothing like on a cluster follower generates nothing
+	engine.SetGenerateContainerHandler(func(cs ContainerKeeper) error {
+		return nil
+	})
+	c, err = engine.generate()
+	assert.Nil(t, err)
+	assert.Nil(t, c)
+}
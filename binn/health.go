@@ -0,0 +1,116 @@
+package binn
+
+import (
+	"time"
+	"sync/atomic"
+)
+
+// LOOP_TICK_GRACE is added to twice the cycle before a loop is
+// considered stuck, so a slow tick is not reported as a failure
+const LOOP_TICK_GRACE = time.Duration(5) * time.Second
+
+// MAX_LOOP_WAIT bounds how long a loop may wait for a subscriber while
+// one is connected, a subscriber should take a container at once
+const MAX_LOOP_WAIT = time.Duration(1) * time.Minute
+
+type Pinger interface {
+	Ping() error
+}
+
+type LoopHealth struct {
+	LastTick time.Time
+	Cycle    time.Duration
+	Waiting  bool
+	Live     bool
+}
+
+type EngineHealth struct {
+	Running      bool
+	Draining     bool
+	GenerateLoop LoopHealth
+	DeliveryLoop LoopHealth
+}
+
+// loopState keeps unix nanoseconds, waitingSince is 0 while not waiting
+type loopState struct {
+	lastTick     int64
+	waitingSince int64
+}
+
+func (s *loopState) tick() {
+	atomic.StoreInt64(&s.lastTick, time.Now().UnixNano())
+}
+
+func (s *loopState) wait(waiting bool) {
+	var v int64
+	if waiting {
+		v = time.Now().UnixNano()
+	}
+	atomic.StoreInt64(&s.waitingSince, v)
+}
+
+// health reports whether the loop is live, a loop waiting without
+// subscribers has nothing to do but it is stuck when it waits longer
+// than MAX_LOOP_WAIT while a subscriber is connected
+func (s *loopState) health(cycle time.Duration, now time.Time, subscribed bool) LoopHealth {
+	h := LoopHealth{
+		Cycle: cycle,
+	}
+	if t := atomic.LoadInt64(&s.lastTick); t != 0 {
+		h.LastTick = time.Unix(0, t)
+	}
+	if t := atomic.LoadInt64(&s.waitingSince); t != 0 {
+		h.Waiting = true
+		h.Live = !subscribed || now.Sub(time.Unix(0, t)) <= MAX_LOOP_WAIT
+		return h
+	}
+	h.Live = !h.LastTick.IsZero() && now.Sub(h.LastTick) <= 2 * cycle + LOOP_TICK_GRACE
+	return h
+}
+
+// Drain marks the engine as shutting down so it stops being ready
+func (e *Engine) Drain() {
+	atomic.StoreInt32(&e.draining, 1)
+}
+
+func (e *Engine) Draining() bool {
+	return atomic.LoadInt32(&e.draining) == 1
+}
+
+func (e *Engine) Health() *EngineHealth {
+	now := time.Now()
+	running := e.Running()
+	h := &EngineHealth{
+		Running:      running,
+		Draining:     e.Draining(),
+		GenerateLoop: e.generateLoop.health(e.cfg.GenerateCycle(), now, false),
+		DeliveryLoop: e.deliveryLoop.health(e.cfg.DeliveryCycle(), now, atomic.LoadInt64(&e.queue.subscribers) > 0),
+	}
+	if !running {
+		h.GenerateLoop.Live = false
+		h.DeliveryLoop.Live = false
+	}
+	return h
+}
+
+// Ready reports whether the engine can serve, the reason is empty when ready
+func (e *Engine) Ready() (bool, string) {
+	h := e.Health()
+	switch {
+	case !h.Running:
+		return false, "engine is not running"
+	case h.Draining:
+		return false, "engine is draining"
+	case !h.GenerateLoop.Live:
+		return false, "generate loop is stuck"
+	case !h.DeliveryLoop.Live:
+		return false, "delivery loop is stuck"
+	}
+
+	if p, ok := e.storage.(Pinger); ok {
+		if err := p.Ping(); err != nil {
+			return false, "storage is unreachable, " + err.Error()
+		}
+	}
+	return true, ""
+}
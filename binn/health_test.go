@@ -0,0 +1,73 @@
+package binn
+
+import (
+	"time"
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEngineReady(t *testing.T) {
+	engine := DefaultEngine()
+
+	ready, reason := engine.Ready()
+	assert.False(t, ready)
+	assert.Equal(t, "engine is not running", reason)
+
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	engine.Run(ctx)
+	defer cancelFunc()
+
+	ready, reason = engine.Ready()
+	assert.True(t, ready)
+	assert.Equal(t, "", reason)
+
+	engine.Drain()
+	ready, reason = engine.Ready()
+	assert.False(t, ready)
+	assert.Equal(t, "engine is draining", reason)
+}
+
+func TestLoopHealth(t *testing.T) {
+	now := time.Now()
+	s := &loopState{}
+
+	assert.False(t, s.health(time.Second, now, false).Live)
+
+	s.tick()
+	assert.True(t, s.health(time.Second, now, false).Live)
+	assert.False(t, s.health(time.Second, now.Add(time.Minute), false).Live)
+
+	s.wait(true)
+	h := s.health(time.Second, now.Add(time.Hour), false)
+	assert.True(t, h.Waiting)
+	assert.True(t, h.Live)
+
+	// a subscriber does not take the container
+	assert.True(t, s.health(time.Second, now.Add(MAX_LOOP_WAIT / 2), true).Live)
+	assert.False(t, s.health(time.Second, now.Add(MAX_LOOP_WAIT * 2), true).Live)
+
+	s.wait(false)
+	assert.False(t, s.health(time.Second, now.Add(time.Hour), false).Waiting)
+}
+
+func TestDeliveryLoopWaitsForSubscriber(t *testing.T) {
+	storage := NewContainerStorage(false, 0, nil)
+	_ = storage.Add(NewBottle("", "first", nil))
+	_ = storage.Add(NewBottle("", "second", nil))
+
+	cfg := DefaultConfig()
+	cfg.SetDeliveryCycle(time.Duration(1) * time.Millisecond)
+	engine := NewEngine(cfg, storage)
+
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	engine.Run(ctx)
+	defer cancelFunc()
+
+	time.Sleep(time.Duration(50) * time.Millisecond)
+
+	h := engine.Health()
+	assert.True(t, h.DeliveryLoop.Waiting)
+	assert.True(t, h.DeliveryLoop.Live)
+}
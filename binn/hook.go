@@ -0,0 +1,224 @@
+package binn
+
+import (
+	"fmt"
+	"sync"
+	"time"
+	"context"
+)
+
+type EventType string
+
+const (
+	EVENT_RECEIVED  EventType = "received"
+	EVENT_ACCEPTED  EventType = "accepted"
+	EVENT_REJECTED  EventType = "rejected"
+	EVENT_DELIVERED EventType = "delivered"
+	EVENT_EVICTED   EventType = "evicted"
+	EVENT_GENERATED EventType = "generated"
+	EVENT_SUNK      EventType = "sunk"
+)
+
+const (
+	DEFAULT_HOOK_TIMEOUT = 100 * time.Millisecond
+	DEFAULT_HOOK_QUEUE_SIZE = 1024
+)
+
+type Event struct {
+	Type      EventType
+	Container Container
+	Reason    string
+	Time      time.Time
+}
+
+// SyncHookFunc runs before the engine acts on c, it returns the
+// container to use instead of c or an error to veto it
+type SyncHookFunc func(ctx context.Context, c Container) (Container, error)
+
+// AsyncHookFunc observes an event after it happened,
+// it must not modify the container of the event
+type AsyncHookFunc func(ev Event)
+
+// Hooks holds the callbacks of an engine, sync hooks run in order and
+// a hook which exceeds the timeout is skipped so a slow hook never drops bottles
+type Hooks struct {
+	syncHooks  map[EventType][]SyncHookFunc
+	asyncHooks map[EventType][]AsyncHookFunc
+	queue      chan Event
+	timeout    time.Duration
+	dropped    uint64
+	logger     *Logger
+	mux        *sync.RWMutex
+}
+
+func NewHooks(timeout time.Duration, queueSize int) *Hooks {
+	return &Hooks{
+		syncHooks:  map[EventType][]SyncHookFunc{},
+		asyncHooks: map[EventType][]AsyncHookFunc{},
+		queue:      make(chan Event, queueSize),
+		timeout:    timeout,
+		logger:     DefaultLogger(),
+		mux:        &sync.RWMutex{},
+	}
+}
+
+func DefaultHooks() *Hooks {
+	return NewHooks(DEFAULT_HOOK_TIMEOUT, DEFAULT_HOOK_QUEUE_SIZE)
+}
+
+func (h *Hooks) SetTimeout(d time.Duration) {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	h.timeout = d
+}
+
+func (h *Hooks) SetLogger(l *Logger) {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	h.logger = l
+}
+
+// OnSync registers f for received, delivered or generated,
+// the only events the engine can still veto
+func (h *Hooks) OnSync(typ EventType, f SyncHookFunc) error {
+	switch typ {
+	case EVENT_RECEIVED, EVENT_DELIVERED, EVENT_GENERATED:
+	default:
+		return fmt.Errorf("this event (%#v) does not support sync hooks", typ)
+	}
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	h.syncHooks[typ] = append(h.syncHooks[typ], f)
+	return nil
+}
+
+func (h *Hooks) On(typ EventType, f AsyncHookFunc) {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	h.asyncHooks[typ] = append(h.asyncHooks[typ], f)
+}
+
+// Dropped returns the number of events dropped because the queue was full
+func (h *Hooks) Dropped() uint64 {
+	h.mux.RLock()
+	defer h.mux.RUnlock()
+	return h.dropped
+}
+
+func (h *Hooks) runSync(typ EventType, c Container) (Container, error) {
+	h.mux.RLock()
+	hooks := h.syncHooks[typ]
+	timeout := h.timeout
+	logger := h.logger
+	h.mux.RUnlock()
+
+	for _, f := range hooks {
+		type result struct {
+			c   Container
+			err error
+		}
+		ctx, cancel := context.WithTimeout(ContextOf(c), timeout)
+		ch := make(chan result, 1)
+		go func(f SyncHookFunc, c Container) {
+			defer func() {
+				if r := recover(); r != nil {
+					logger.Error("sync hook panicked", F("event", string(typ)), F("panic", r))
+					ch <- result{}
+				}
+			}()
+			nc, err := f(ctx, c)
+			ch <- result{ nc, err }
+		}(f, c)
+
+		select {
+		case r := <- ch:
+			cancel()
+			if r.err != nil {
+				return c, r.err
+			}
+			if r.c != nil {
+				c = r.c
+			}
+		case <- ctx.Done():
+			cancel()
+			logger.WithContext(ContextOf(c)).Warn("skip a hook exceeding the timeout",
+				F("event", string(typ)),
+				F("timeout", timeout),
+			)
+		}
+	}
+	return c, nil
+}
+
+func (h *Hooks) emit(typ EventType, c Container, reason string) {
+	h.mux.RLock()
+	n := len(h.asyncHooks[typ])
+	h.mux.RUnlock()
+	if n == 0 {
+		return
+	}
+
+	select {
+	case h.queue <- Event{ Type: typ, Container: c, Reason: reason, Time: time.Now() }:
+	default:
+		h.mux.Lock()
+		h.dropped++
+		h.mux.Unlock()
+	}
+}
+
+// Run dispatches queued events to async hooks until ctx is done
+func (h *Hooks) Run(ctx context.Context) {
+	for {
+		select {
+		case <- ctx.Done():
+			return
+		case ev := <- h.queue:
+			h.mux.RLock()
+			hooks := h.asyncHooks[ev.Type]
+			h.mux.RUnlock()
+			for _, f := range hooks {
+				h.dispatch(f, ev)
+			}
+		}
+	}
+}
+
+func (h *Hooks) dispatch(f AsyncHookFunc, ev Event) {
+	defer func() {
+		if r := recover(); r != nil {
+			h.logger.Error("async hook panicked", F("event", string(ev.Type)), F("panic", r))
+		}
+	}()
+	f(ev)
+}
+
+// EvictNotifier is implemented by storages which report evicted containers
+type EvictNotifier interface {
+	SetEvictHandler(f func(c Container))
+}
+
+// SinkNotifier is implemented by storages which report sunk containers,
+// a container sunk by id expiry carries only its id and expiry
+type SinkNotifier interface {
+	SetSinkHandler(f func(c Container, reason string))
+}
+
+// hookedKeeper runs generated hooks for containers added by
+// the generate container handler
+type hookedKeeper struct {
+	ContainerKeeper
+	hooks *Hooks
+}
+
+func (k *hookedKeeper) Add(c Container) error {
+	c, err := k.hooks.runSync(EVENT_GENERATED, c)
+	if err != nil {
+		return err
+	}
+	if err := k.ContainerKeeper.Add(c); err != nil {
+		return err
+	}
+	k.hooks.emit(EVENT_GENERATED, c, "")
+	return nil
+}
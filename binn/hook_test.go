@@ -0,0 +1,164 @@
+package binn
+
+import (
+	"fmt"
+	"time"
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func collectEvents(h *Hooks, types ...EventType) chan Event {
+	ch := make(chan Event, 2048)
+	for _, typ := range types {
+		h.On(typ, func(ev Event) {
+			ch <- ev
+		})
+	}
+	return ch
+}
+
+func waitEvent(t *testing.T, ch chan Event) Event {
+	select {
+	case ev := <- ch:
+		return ev
+	case <- time.After(time.Second):
+		assert.Fail(t, "no event")
+		return Event{}
+	}
+}
+
+func TestSyncHookVetoesAndMutatesReceivedContainers(t *testing.T) {
+	cfg := DefaultConfig()
+	storage := NewContainerStorage(false, 0, nil)
+	engine := NewEngine(cfg, storage)
+	events := collectEvents(engine.GetHooks(), EVENT_ACCEPTED, EVENT_REJECTED)
+
+	engine.GetHooks().OnSync(EVENT_RECEIVED, func(ctx context.Context, c Container) (Container, error) {
+		if c.Message().Text == "spam" {
+			return nil, fmt.Errorf("this message is spam")
+		}
+		return NewBottle(c.ID(), c.Message().Text + "!", nil), nil
+	})
+
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	engine.Run(ctx)
+	defer cancelFunc()
+
+	engine.GetInChan() <- NewBottle("1", "spam", nil)
+	ev := waitEvent(t, events)
+	assert.Equal(t, EVENT_REJECTED, ev.Type)
+	assert.Equal(t, "this message is spam", ev.Reason)
+
+	engine.GetInChan() <- NewBottle("2", "Hello", nil)
+	ev = waitEvent(t, events)
+	assert.Equal(t, EVENT_ACCEPTED, ev.Type)
+	assert.Equal(t, 1, storage.Len())
+	assert.Equal(t, "Hello!", storage.List(0, 1)[0].Message().Text)
+}
+
+func TestSyncHookVetoRejectsDeliveredContainer(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.SetDeliveryCycle(time.Duration(1) * time.Millisecond)
+	storage := NewContainerStorage(false, 0, nil)
+	storage.SetAuditLog(DefaultAuditLog())
+	_ = storage.Add(NewBottle("", "Hello", nil))
+	id := storage.List(0, 1)[0].ID()
+	engine := NewEngine(cfg, storage)
+	events := collectEvents(engine.GetHooks(), EVENT_DELIVERED, EVENT_REJECTED)
+
+	engine.GetHooks().OnSync(EVENT_DELIVERED, func(ctx context.Context, c Container) (Container, error) {
+		return nil, fmt.Errorf("this message is withheld")
+	})
+
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	engine.Run(ctx)
+	defer cancelFunc()
+
+	ev := waitEvent(t, events)
+	assert.Equal(t, EVENT_REJECTED, ev.Type)
+	assert.Equal(t, id, ev.Container.ID())
+	lineage := storage.AuditLog().Lineage(id)
+	assert.Equal(t, AUDIT_REJECTED, lineage[len(lineage) - 1].Type)
+	assert.Equal(t, "this message is withheld", lineage[len(lineage) - 1].Reason)
+}
+
+func TestSyncHookExceedingTimeoutIsSkipped(t *testing.T) {
+	h := NewHooks(time.Duration(10) * time.Millisecond, 1)
+	h.OnSync(EVENT_DELIVERED, func(ctx context.Context, c Container) (Container, error) {
+		<- ctx.Done()
+		return nil, fmt.Errorf("too late")
+	})
+	h.OnSync(EVENT_DELIVERED, func(ctx context.Context, c Container) (Container, error) {
+		panic("broken hook")
+	})
+
+	b := NewBottle("1", "Hello", nil)
+	c, err := h.runSync(EVENT_DELIVERED, b)
+	assert.Nil(t, err)
+	assert.Equal(t, b, c)
+}
+
+func TestSyncHookIsOnlyForVetoableEvents(t *testing.T) {
+	h := DefaultHooks()
+	noop := func(ctx context.Context, c Container) (Container, error) { return nil, nil }
+	assert.Nil(t, h.OnSync(EVENT_GENERATED, noop))
+	assert.NotNil(t, h.OnSync(EVENT_EVICTED, noop))
+}
+
+func TestAsyncHooksObserveEngineEvents(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.SetDeliveryCycle(time.Duration(10) * time.Millisecond)
+	cfg.SetGenerateCycle(time.Duration(10) * time.Millisecond)
+	idStorage := DefaultIDStorage()
+	storage := NewContainerStorage(true, time.Duration(10) * time.Minute, idStorage)
+	engine := NewEngine(cfg, storage)
+	engine.SetGenerateContainerHandler(func(cs ContainerKeeper) error {
+		id := GenerateID()
+		idStorage.Add(id, time.Now().Add(time.Minute))
+		return cs.Add(NewBottle(id, "", nil))
+	})
+	events := collectEvents(engine.GetHooks(), EVENT_GENERATED, EVENT_DELIVERED)
+
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	engine.Run(ctx)
+	defer cancelFunc()
+
+	assert.Equal(t, EVENT_GENERATED, waitEvent(t, events).Type)
+	go func() {
+		<- engine.GetOutChan()
+	}()
+	for {
+		if ev := waitEvent(t, events); ev.Type != EVENT_GENERATED {
+			assert.Equal(t, EVENT_DELIVERED, ev.Type)
+			break
+		}
+	}
+}
+
+func TestAsyncHooksObserveEvictions(t *testing.T) {
+	storage := NewContainerStorage(false, 0, nil)
+	engine := NewEngine(DefaultConfig(), storage)
+	events := collectEvents(engine.GetHooks(), EVENT_EVICTED)
+
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	engine.Run(ctx)
+	defer cancelFunc()
+
+	for i := 0; i <= MAX_CONTAINER_STORAGE_NUM_CONTAINER; i++ {
+		storage.Add(NewBottle("", fmt.Sprint(i), nil))
+	}
+	ev := waitEvent(t, events)
+	assert.Equal(t, "0", ev.Container.Message().Text)
+	assert.Equal(t, "storage is full", ev.Reason)
+}
+
+func TestAsyncHookQueueDropsWhenFull(t *testing.T) {
+	h := NewHooks(DEFAULT_HOOK_TIMEOUT, 1)
+	h.On(EVENT_ACCEPTED, func(ev Event) {})
+	h.emit(EVENT_ACCEPTED, NewBottle("1", "", nil), "")
+	h.emit(EVENT_ACCEPTED, NewBottle("2", "", nil), "")
+	h.emit(EVENT_REJECTED, NewBottle("3", "", nil), "")
+	assert.Equal(t, uint64(1), h.Dropped())
+}
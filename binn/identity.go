@@ -0,0 +1,54 @@
+package binn
+
+const (
+	SCOPE_READ = "read"
+	SCOPE_THROW = "throw"
+	SCOPE_ADMIN = "admin"
+)
+
+type Identity struct {
+	Subject string
+	Method  string
+	Scopes  []string
+}
+
+func NewIdentity(subject string, method string, scopes ...string) *Identity {
+	return &Identity{
+		Subject: subject,
+		Method:  method,
+		Scopes:  scopes,
+	}
+}
+
+func AnonymousIdentity() *Identity {
+	return NewIdentity("", "anonymous", SCOPE_READ, SCOPE_THROW)
+}
+
+func (i *Identity) HasScope(scope string) bool {
+	if i == nil {
+		return false
+	}
+	for _, s := range i.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+func (i *Identity) Anonymous() bool {
+	return i == nil || i.Subject == ""
+}
+
+// Identified is implemented by containers which know who threw them,
+// the identity is never carried over to the delivered container
+type Identified interface {
+	Identity() *Identity
+}
+
+func identityOf(c Container) *Identity {
+	if i, ok := c.(Identified); ok {
+		return i.Identity()
+	}
+	return nil
+}
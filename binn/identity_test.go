@@ -0,0 +1,28 @@
+package binn
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIdentityHasScope(t *testing.T) {
+	i := NewIdentity("alice", "api_key", SCOPE_READ)
+
+	assert.True(t, i.HasScope(SCOPE_READ))
+	assert.False(t, i.HasScope(SCOPE_ADMIN))
+	assert.False(t, i.Anonymous())
+
+	var none *Identity
+	assert.False(t, none.HasScope(SCOPE_READ))
+	assert.True(t, none.Anonymous())
+}
+
+func TestAnonymousIdentity(t *testing.T) {
+	i := AnonymousIdentity()
+
+	assert.True(t, i.Anonymous())
+	assert.True(t, i.HasScope(SCOPE_READ))
+	assert.True(t, i.HasScope(SCOPE_THROW))
+	assert.False(t, i.HasScope(SCOPE_ADMIN))
+}
@@ -0,0 +1,386 @@
+// Package keepertest runs the behaviour every ContainerKeeper shares
+// against a storage backend, run it with -race too
+package keepertest
+
+import (
+	"io"
+	"fmt"
+	"bytes"
+	"sync"
+	"time"
+	"strings"
+	"testing"
+
+	"github.com/binn/binn"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	EXPIRATION = time.Duration(10) * time.Minute
+	NUM_WORKERS = 8
+	NUM_BOTTLES = 200
+)
+
+// Harness is a keeper under test
+type Harness struct {
+	Keeper binn.ContainerKeeper
+	// Issue adds a id the keeper accepts once
+	Issue func(id string, e time.Time) error
+	// Capacity is the most containers the keeper holds,
+	// binn.MAX_CONTAINER_STORAGE_NUM_CONTAINER when zero
+	Capacity int
+	// Unordered keepers may deliver and evict containers in any order
+	Unordered bool
+	// DropsAttachments keepers share containers with servers which can
+	// not reach their blobs so they keep no attachments
+	DropsAttachments bool
+	// FailCommit makes every write of the keeper fail with err before it
+	// commits and nil lets them commit again, nil for keepers without
+	// transactions
+	FailCommit func(err error)
+	// Check asserts the state kept by the keeper is consistent,
+	// it runs after every case when set
+	Check func(t *testing.T)
+}
+
+// Migrator is implemented by keepers filled from a snapshot file once
+type Migrator interface {
+	Migrate(r io.Reader) error
+}
+
+// Factory returns a empty keeper which validates ids and stamps picked
+// up containers with expiration, it is called once for every case
+type Factory func(t *testing.T, expiration time.Duration) *Harness
+
+// Run runs every case against keepers made by f
+func Run(t *testing.T, f Factory) {
+	cases := []struct {
+		name string
+		run  func(t *testing.T, h *Harness)
+	}{
+		{ "Empty", testEmpty },
+		{ "Validation", testValidation },
+		{ "Rotation", testRotation },
+		{ "Stamping", testStamping },
+		{ "Message", testMessage },
+		{ "Capacity", testCapacity },
+		{ "Truncation", testTruncation },
+		{ "ConcurrentDelivery", testConcurrentDelivery },
+		{ "ConcurrentReply", testConcurrentReply },
+		{ "FailedCommit", testFailedCommit },
+		{ "Sweep", testSweep },
+		{ "Migrate", testMigrate },
+		{ "MigrateQuarantined", testMigrateQuarantined },
+	}
+	for _, c := range cases {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			h := f(t, EXPIRATION)
+			if h.Capacity == 0 {
+				h.Capacity = binn.MAX_CONTAINER_STORAGE_NUM_CONTAINER
+			}
+			c.run(t, h)
+			if h.Check != nil {
+				h.Check(t)
+			}
+		})
+	}
+}
+
+// throw issues a id and adds a bottle with it
+func (h *Harness) throw(t *testing.T, text string) {
+	id := binn.GenerateID()
+	require.Nil(t, h.Issue(id, time.Now().Add(time.Minute)))
+	require.Nil(t, h.Keeper.Add(binn.NewBottle(id, text, nil)))
+}
+
+// drain picks up every container
+func (h *Harness) drain() []binn.Container {
+	containers := []binn.Container{}
+	for {
+		c, err := h.Keeper.Get()
+		if err != nil {
+			return containers
+		}
+		containers = append(containers, c)
+	}
+}
+
+func testEmpty(t *testing.T, h *Harness) {
+	c, err := h.Keeper.Get()
+	assert.NotNil(t, err)
+	assert.Nil(t, c)
+}
+
+func testValidation(t *testing.T, h *Harness) {
+	assert.NotNil(t, h.Keeper.Add(binn.NewBottle("unknown", "hello", nil)))
+
+	require.Nil(t, h.Issue("expired", time.Now().Add(-time.Minute)))
+	assert.NotNil(t, h.Keeper.Add(binn.NewBottle("expired", "hello", nil)))
+
+	require.Nil(t, h.Issue("once", time.Now().Add(time.Minute)))
+	assert.NotNil(t, h.Issue("once", time.Now().Add(time.Minute)))
+	assert.Nil(t, h.Keeper.Add(binn.NewBottle("once", "hello", nil)))
+	assert.NotNil(t, h.Keeper.Add(binn.NewBottle("once", "hello", nil)))
+	assert.Equal(t, 1, len(h.drain()))
+}
+
+func testRotation(t *testing.T, h *Harness) {
+	require.Nil(t, h.Issue("thrown", time.Now().Add(time.Minute)))
+	require.Nil(t, h.Keeper.Add(binn.NewBottle("thrown", "hello", nil)))
+
+	c, err := h.Keeper.Get()
+	require.Nil(t, err)
+	assert.NotEqual(t, "thrown", c.ID())
+	assert.Equal(t, "hello", c.Message().Text)
+
+	// the rotated id replies once
+	assert.NotNil(t, h.Keeper.Add(binn.NewBottle("thrown", "reply", nil)))
+	assert.Nil(t, h.Keeper.Add(binn.NewBottle(c.ID(), "reply", nil)))
+	assert.NotNil(t, h.Keeper.Add(binn.NewBottle(c.ID(), "reply", nil)))
+
+	reply, err := h.Keeper.Get()
+	require.Nil(t, err)
+	assert.Equal(t, "reply", reply.Message().Text)
+	assert.NotEqual(t, c.ID(), reply.ID())
+}
+
+func testStamping(t *testing.T, h *Harness) {
+	past := time.Now().Add(-time.Hour)
+	id := binn.GenerateID()
+	require.Nil(t, h.Issue(id, time.Now().Add(time.Minute)))
+	require.Nil(t, h.Keeper.Add(binn.NewBottle(id, "hello", &past)))
+
+	c, err := h.Keeper.Get()
+	require.Nil(t, err)
+	require.NotNil(t, c.ExpiredAt())
+	assert.WithinDuration(t, time.Now().Add(EXPIRATION), *c.ExpiredAt(), time.Duration(5) * time.Second)
+}
+
+// testMessage checks every field of a message survives the rotation
+func testMessage(t *testing.T, h *Harness) {
+	id := binn.GenerateID()
+	require.Nil(t, h.Issue(id, time.Now().Add(time.Minute)))
+	m := &binn.Message{
+		Text:      "hello",
+		Language:  "pt-BR",
+		Tags:      []string{ "Calm", "sea", "calm" },
+		Signature: "sailor",
+		Hops:      2,
+		Metadata:  map[string]string{ "client": "test" },
+		Attachments: []binn.Attachment{ { ID: "doodle.png", ContentType: "image/png", Size: 42 } },
+	}
+	before := time.Now()
+	require.Nil(t, h.Keeper.Add(binn.NewBottleWithMessage(id, m, nil)))
+
+	c, err := h.Keeper.Get()
+	require.Nil(t, err)
+	got := c.Message()
+	assert.Equal(t, "hello", got.Text)
+	assert.Equal(t, "pt-BR", got.Language)
+	assert.Equal(t, []string{ "calm", "sea" }, got.Tags)
+	assert.Equal(t, "sailor", got.Signature)
+	assert.Equal(t, 2, got.Hops)
+	assert.Equal(t, map[string]string{ "client": "test" }, got.Metadata)
+	if h.DropsAttachments {
+		assert.Empty(t, got.Attachments)
+	} else {
+		assert.Equal(t, m.Attachments, got.Attachments)
+	}
+	require.NotNil(t, got.CreatedAt)
+	assert.WithinDuration(t, before, *got.CreatedAt, time.Duration(5) * time.Second)
+
+	// a bottle without the new fields reads back without them
+	h.throw(t, "plain")
+	c, err = h.Keeper.Get()
+	require.Nil(t, err)
+	assert.Equal(t, "", c.Message().Language)
+	assert.Nil(t, c.Message().Tags)
+	assert.Nil(t, c.Message().Metadata)
+	assert.Nil(t, c.Message().Attachments)
+}
+
+func testCapacity(t *testing.T, h *Harness) {
+	for i := 0; i < h.Capacity + 3; i++ {
+		h.throw(t, fmt.Sprint(i))
+	}
+	containers := h.drain()
+	assert.Equal(t, h.Capacity, len(containers))
+	if h.Unordered {
+		return
+	}
+	// the oldest are evicted and the rest come in order
+	for i, c := range containers {
+		assert.Equal(t, fmt.Sprint(i + 3), c.Message().Text)
+	}
+}
+
+func testTruncation(t *testing.T, h *Harness) {
+	h.throw(t, strings.Repeat("a", binn.MAX_MESSAGE_TEXT_LENGTH + 10))
+	h.throw(t, strings.Repeat("b", binn.MAX_MESSAGE_TEXT_LENGTH))
+
+	texts := map[string]bool{}
+	for _, c := range h.drain() {
+		texts[c.Message().Text] = true
+	}
+	assert.True(t, texts[strings.Repeat("a", binn.MAX_MESSAGE_TEXT_LENGTH)])
+	assert.True(t, texts[strings.Repeat("b", binn.MAX_MESSAGE_TEXT_LENGTH)])
+}
+
+// testConcurrentDelivery throws and picks up at once, every bottle
+// is delivered exactly once
+func testConcurrentDelivery(t *testing.T, h *Harness) {
+	mux := &sync.Mutex{}
+	seen := map[string]int{}
+	pick := func() bool {
+		c, err := h.Keeper.Get()
+		if err != nil {
+			return false
+		}
+		mux.Lock()
+		seen[c.Message().Text]++
+		mux.Unlock()
+		return true
+	}
+
+	wg := &sync.WaitGroup{}
+	for w := 0; w < NUM_WORKERS; w++ {
+		wg.Add(2)
+		go func(w int) {
+			defer wg.Done()
+			for i := w; i < NUM_BOTTLES; i += NUM_WORKERS {
+				id := binn.GenerateID()
+				assert.Nil(t, h.Issue(id, time.Now().Add(time.Minute)))
+				assert.Nil(t, h.Keeper.Add(binn.NewBottle(id, fmt.Sprint(i), nil)))
+			}
+		}(w)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < NUM_BOTTLES / NUM_WORKERS; i++ {
+				pick()
+			}
+		}()
+	}
+	wg.Wait()
+	for pick() {
+	}
+
+	assert.Equal(t, NUM_BOTTLES, len(seen))
+	for text, n := range seen {
+		assert.Equal(t, 1, n, text)
+	}
+}
+
+// testConcurrentReply replies to every bottle from several goroutines
+// at once, only one reply per id is accepted
+func testConcurrentReply(t *testing.T, h *Harness) {
+	for i := 0; i < NUM_BOTTLES / NUM_WORKERS; i++ {
+		h.throw(t, fmt.Sprint(i))
+	}
+	delivered := h.drain()
+	require.Equal(t, NUM_BOTTLES / NUM_WORKERS, len(delivered))
+
+	mux := &sync.Mutex{}
+	accepted := map[string]int{}
+	wg := &sync.WaitGroup{}
+	for _, c := range delivered {
+		for w := 0; w < NUM_WORKERS; w++ {
+			wg.Add(1)
+			go func(id string) {
+				defer wg.Done()
+				if h.Keeper.Add(binn.NewBottle(id, "reply", nil)) == nil {
+					mux.Lock()
+					accepted[id]++
+					mux.Unlock()
+				}
+			}(c.ID())
+		}
+	}
+	wg.Wait()
+
+	assert.Equal(t, len(delivered), len(accepted))
+	for id, n := range accepted {
+		assert.Equal(t, 1, n, id)
+	}
+	assert.Equal(t, len(delivered), len(h.drain()))
+}
+
+// testFailedCommit adds with a id whose commit fails, the id is kept
+// so the bottle can be thrown again
+func testFailedCommit(t *testing.T, h *Harness) {
+	if h.FailCommit == nil {
+		t.Skip("this keeper has no transactions")
+	}
+	require.Nil(t, h.Issue("id", time.Now().Add(time.Minute)))
+
+	h.FailCommit(fmt.Errorf("crash"))
+	assert.NotNil(t, h.Keeper.Add(binn.NewBottle("id", "hello", nil)))
+	h.FailCommit(nil)
+
+	assert.Equal(t, 0, len(h.drain()))
+	assert.Nil(t, h.Keeper.Add(binn.NewBottle("id", "hello", nil)))
+	assert.Equal(t, 1, len(h.drain()))
+}
+
+// testSweep forgets a expired id which a throw refused, and only it
+func testSweep(t *testing.T, h *Harness) {
+	s, ok := h.Keeper.(binn.Sweeper)
+	if !ok {
+		t.Skip("this keeper does not sweep")
+	}
+	require.Nil(t, h.Issue("expired", time.Now().Add(-time.Minute)))
+	require.Nil(t, h.Issue("valid", time.Now().Add(time.Minute)))
+	assert.NotNil(t, h.Keeper.Add(binn.NewBottle("expired", "hello", nil)))
+
+	assert.Equal(t, 1, s.Sweep())
+	assert.Equal(t, 0, s.Sweep())
+	assert.NotNil(t, h.Keeper.Add(binn.NewBottle("expired", "hello", nil)))
+	assert.Nil(t, h.Keeper.Add(binn.NewBottle("valid", "hello", nil)))
+}
+
+// snapshotOf returns a snapshot of a ocean holding text thrown with id,
+// other is issued but not used
+func snapshotOf(t *testing.T, quarantined bool) []byte {
+	ids := binn.DefaultIDStorage()
+	cs := binn.NewContainerStorage(true, 0, ids)
+	ids.Add("id", time.Now().Add(time.Minute))
+	ids.Add("other", time.Now().Add(time.Minute))
+	require.Nil(t, cs.Add(binn.NewBottle("id", "hello", nil)))
+	if quarantined {
+		require.Nil(t, cs.Quarantine(cs.List(0, 1)[0].ID()))
+	}
+	buf := &bytes.Buffer{}
+	require.Nil(t, cs.Snapshot(buf))
+	return buf.Bytes()
+}
+
+// testMigrate fills a new keeper from a snapshot once, the issued ids
+// of the snapshot are used like any other
+func testMigrate(t *testing.T, h *Harness) {
+	m, ok := h.Keeper.(Migrator)
+	if !ok {
+		t.Skip("this keeper does not migrate")
+	}
+	snapshot := snapshotOf(t, false)
+	require.Nil(t, m.Migrate(bytes.NewReader(snapshot)))
+	assert.NotNil(t, m.Migrate(bytes.NewReader(snapshot)))
+
+	assert.Nil(t, h.Keeper.Add(binn.NewBottle("other", "reply", nil)))
+	texts := []string{}
+	for _, c := range h.drain() {
+		texts = append(texts, c.Message().Text)
+	}
+	assert.ElementsMatch(t, []string{ "hello", "reply" }, texts)
+}
+
+// testMigrateQuarantined refuses quarantined containers a keeper without
+// a quarantine would deliver
+func testMigrateQuarantined(t *testing.T, h *Harness) {
+	m, ok := h.Keeper.(Migrator)
+	if !ok {
+		t.Skip("this keeper does not migrate")
+	}
+	assert.Equal(t, binn.ErrQuarantineUnsupported, m.Migrate(bytes.NewReader(snapshotOf(t, true))))
+	assert.Equal(t, 0, len(h.drain()))
+}
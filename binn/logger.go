@@ -0,0 +1,319 @@
+package binn
+
+import (
+	"io"
+	"os"
+	"fmt"
+	"sync"
+	"time"
+	"bytes"
+	"context"
+	"strconv"
+	"strings"
+	"encoding/json"
+)
+
+type Level int
+
+const (
+	LEVEL_DEBUG Level = iota
+	LEVEL_INFO
+	LEVEL_WARN
+	LEVEL_ERROR
+)
+
+const (
+	LOG_FORMAT_LOGFMT = "logfmt"
+	LOG_FORMAT_JSON = "json"
+)
+
+const redactedText = "[redacted]"
+
+type contextKey string
+
+const (
+	requestIDContextKey = contextKey("request_id")
+	loggerContextKey = contextKey("logger")
+)
+
+type Field struct {
+	Key   string
+	Value interface{}
+}
+
+// Logger writes leveled structured records as logfmt or json lines,
+// it is passed through configs and contexts instead of a global
+type Logger struct {
+	w      io.Writer
+	mux    *sync.Mutex
+	level  Level
+	format string
+	redact bool
+	fields []Field
+}
+
+func F(key string, value interface{}) Field {
+	return Field{ Key: key, Value: value }
+}
+
+func NewLogger(w io.Writer, level Level, format string, redact bool) *Logger {
+	return &Logger{
+		w:      w,
+		mux:    &sync.Mutex{},
+		level:  level,
+		format: format,
+		redact: redact,
+		fields: []Field{},
+	}
+}
+
+func DefaultLogger() *Logger {
+	return NewLogger(os.Stderr, LEVEL_INFO, LOG_FORMAT_LOGFMT, false)
+}
+
+func (l Level) String() string {
+	switch l {
+	case LEVEL_DEBUG:
+		return "debug"
+	case LEVEL_INFO:
+		return "info"
+	case LEVEL_WARN:
+		return "warn"
+	case LEVEL_ERROR:
+		return "error"
+	default:
+		return strconv.Itoa(int(l))
+	}
+}
+
+func ParseLevel(s string) (Level, error) {
+	switch strings.ToLower(s) {
+	case "debug":
+		return LEVEL_DEBUG, nil
+	case "", "info":
+		return LEVEL_INFO, nil
+	case "warn", "warning":
+		return LEVEL_WARN, nil
+	case "error":
+		return LEVEL_ERROR, nil
+	default:
+		return LEVEL_INFO, fmt.Errorf("log level (%#v) is unknown", s)
+	}
+}
+
+func ParseLogFormat(s string) (string, error) {
+	switch s {
+	case "", LOG_FORMAT_LOGFMT:
+		return LOG_FORMAT_LOGFMT, nil
+	case LOG_FORMAT_JSON:
+		return LOG_FORMAT_JSON, nil
+	default:
+		return "", fmt.Errorf("log format (%#v) is unknown", s)
+	}
+}
+
+// String describes the settings of l, loggers with the same
+// settings are treated as unchanged on reload
+func (l *Logger) String() string {
+	return fmt.Sprintf("level=%s format=%s redact=%t", l.level, l.format, l.redact)
+}
+
+func (l *Logger) Level() Level {
+	return l.level
+}
+
+func (l *Logger) clone() *Logger {
+	c := *l
+	c.fields = append([]Field{}, l.fields...)
+	return &c
+}
+
+func (l *Logger) With(fields ...Field) *Logger {
+	c := l.clone()
+	c.fields = append(c.fields, fields...)
+	return c
+}
+
+func (l *Logger) WithLevel(level Level) *Logger {
+	c := l.clone()
+	c.level = level
+	return c
+}
+
+// WithContext adds the request id and trace id of ctx to the records of the returned logger
+func (l *Logger) WithContext(ctx context.Context) *Logger {
+	if id := RequestIDFrom(ctx); id != "" {
+		l = l.With(F("request_id", id))
+	}
+	if sc := SpanContextFrom(ctx); sc.IsValid() {
+		l = l.With(F("trace_id", sc.TraceID().String()))
+	}
+	return l
+}
+
+// Redact hides the text of a message when redaction is enabled
+func (l *Logger) Redact(text string) string {
+	if l.redact {
+		return redactedText
+	}
+	return text
+}
+
+func (l *Logger) Enabled(level Level) bool {
+	return level >= l.level
+}
+
+func (l *Logger) Debug(msg string, fields ...Field) {
+	l.Log(LEVEL_DEBUG, msg, fields...)
+}
+
+func (l *Logger) Info(msg string, fields ...Field) {
+	l.Log(LEVEL_INFO, msg, fields...)
+}
+
+func (l *Logger) Warn(msg string, fields ...Field) {
+	l.Log(LEVEL_WARN, msg, fields...)
+}
+
+func (l *Logger) Error(msg string, fields ...Field) {
+	l.Log(LEVEL_ERROR, msg, fields...)
+}
+
+func (l *Logger) Log(level Level, msg string, fields ...Field) {
+	if !l.Enabled(level) {
+		return
+	}
+
+	all := make([]Field, 0, 3 + len(l.fields) + len(fields))
+	all = append(all,
+		F("time", time.Now().UTC().Format(time.RFC3339Nano)),
+		F("level", level.String()),
+		F("msg", msg),
+	)
+	all = append(all, l.fields...)
+	all = append(all, fields...)
+
+	var buf bytes.Buffer
+	if l.format == LOG_FORMAT_JSON {
+		writeJSONRecord(&buf, all)
+	} else {
+		writeLogfmtRecord(&buf, all)
+	}
+
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	l.w.Write(buf.Bytes())
+}
+
+func fieldValue(v interface{}) interface{} {
+	switch x := v.(type) {
+	case error:
+		return x.Error()
+	case time.Duration:
+		return x.String()
+	case time.Time:
+		return x.Format(time.RFC3339Nano)
+	case fmt.Stringer:
+		return x.String()
+	default:
+		return v
+	}
+}
+
+func writeJSONRecord(buf *bytes.Buffer, fields []Field) {
+	buf.WriteByte('{')
+	for i, f := range fields {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		key, _ := json.Marshal(f.Key)
+		buf.Write(key)
+		buf.WriteByte(':')
+		value, err := json.Marshal(fieldValue(f.Value))
+		if err != nil {
+			value, _ = json.Marshal(fmt.Sprint(f.Value))
+		}
+		buf.Write(value)
+	}
+	buf.WriteString("}\n")
+}
+
+func writeLogfmtRecord(buf *bytes.Buffer, fields []Field) {
+	for i, f := range fields {
+		if i > 0 {
+			buf.WriteByte(' ')
+		}
+		buf.WriteString(f.Key)
+		buf.WriteByte('=')
+		s := fmt.Sprint(fieldValue(f.Value))
+		if s == "" || strings.ContainsAny(s, " =\"\\\n\t") {
+			s = strconv.Quote(s)
+		}
+		buf.WriteString(s)
+	}
+	buf.WriteByte('\n')
+}
+
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDContextKey, id)
+}
+
+func RequestIDFrom(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDContextKey).(string)
+	return id
+}
+
+func WithLogger(ctx context.Context, l *Logger) context.Context {
+	return context.WithValue(ctx, loggerContextKey, l)
+}
+
+// LoggerFrom returns the logger of ctx or the default logger
+func LoggerFrom(ctx context.Context) *Logger {
+	if l, ok := ctx.Value(loggerContextKey).(*Logger); ok {
+		return l
+	}
+	return defaultLogger
+}
+
+var defaultLogger = DefaultLogger()
+
+// Contextual is implemented by containers which carry the context
+// of the request they were thrown in across the engine
+type Contextual interface {
+	Context() context.Context
+}
+
+func ContextOf(c Container) context.Context {
+	if cc, ok := c.(Contextual); ok && cc.Context() != nil {
+		return cc.Context()
+	}
+	return context.Background()
+}
+
+func setContextOf(c Container, ctx context.Context) {
+	if cc, ok := c.(interface{ SetContext(context.Context) }); ok {
+		cc.SetContext(ctx)
+	}
+}
+
+type detachedContext struct {
+	context.Context
+}
+
+func (detachedContext) Deadline() (time.Time, bool) {
+	return time.Time{}, false
+}
+
+func (detachedContext) Done() <-chan struct{} {
+	return nil
+}
+
+func (detachedContext) Err() error {
+	return nil
+}
+
+// Detach returns a context with the values of ctx which is never canceled,
+// so a container keeps them after its request has finished
+func Detach(ctx context.Context) context.Context {
+	return detachedContext{ ctx }
+}
@@ -0,0 +1,88 @@
+package binn
+
+import (
+	"time"
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+	"encoding/json"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoggerLogfmt(t *testing.T) {
+	var buf bytes.Buffer
+	logger := NewLogger(&buf, LEVEL_INFO, LOG_FORMAT_LOGFMT, false).With(F("component", "engine"))
+
+	logger.Debug("hidden")
+	logger.Info("add a container", F("id", "1"), F("message", "Hello World"), F("cycle", time.Second))
+
+	line := buf.String()
+	assert.NotContains(t, line, "hidden")
+	assert.Contains(t, line, "level=info msg=\"add a container\" component=engine id=1 message=\"Hello World\" cycle=1s\n")
+	assert.True(t, strings.HasPrefix(line, "time="))
+}
+
+func TestLoggerJSON(t *testing.T) {
+	var buf bytes.Buffer
+	logger := NewLogger(&buf, LEVEL_DEBUG, LOG_FORMAT_JSON, false)
+
+	logger.Warn("failed", F("error", assert.AnError), F("count", 2))
+
+	var record map[string]interface{}
+	err := json.Unmarshal(buf.Bytes(), &record)
+	assert.Nil(t, err)
+	assert.Equal(t, "warn", record["level"])
+	assert.Equal(t, "failed", record["msg"])
+	assert.Equal(t, assert.AnError.Error(), record["error"])
+	assert.Equal(t, 2.0, record["count"])
+}
+
+func TestLoggerRedact(t *testing.T) {
+	logger := NewLogger(&bytes.Buffer{}, LEVEL_INFO, LOG_FORMAT_LOGFMT, true)
+	assert.Equal(t, "[redacted]", logger.Redact("secret"))
+
+	logger = NewLogger(&bytes.Buffer{}, LEVEL_INFO, LOG_FORMAT_LOGFMT, false)
+	assert.Equal(t, "secret", logger.Redact("secret"))
+}
+
+func TestLoggerWithContext(t *testing.T) {
+	var buf bytes.Buffer
+	logger := NewLogger(&buf, LEVEL_INFO, LOG_FORMAT_LOGFMT, false)
+	ctx := WithRequestID(context.Background(), "req-1")
+
+	logger.WithContext(ctx).Info("hello")
+
+	assert.Contains(t, buf.String(), "request_id=req-1")
+}
+
+func TestDetachKeepsValues(t *testing.T) {
+	ctx, cancelFunc := context.WithCancel(WithRequestID(context.Background(), "req-1"))
+	detached := Detach(ctx)
+	cancelFunc()
+
+	assert.Nil(t, detached.Err())
+	assert.Equal(t, "req-1", RequestIDFrom(detached))
+}
+
+func TestParseLevel(t *testing.T) {
+	level, err := ParseLevel("DEBUG")
+	assert.Nil(t, err)
+	assert.Equal(t, LEVEL_DEBUG, level)
+
+	_, err = ParseLevel("verbose")
+	assert.EqualError(t, err, "log level (\"verbose\") is unknown")
+}
+
+func TestStorageLogsRequestID(t *testing.T) {
+	var buf bytes.Buffer
+	storage := NewContainerStorage(false, 0, nil)
+	storage.SetLogger(NewLogger(&buf, LEVEL_DEBUG, LOG_FORMAT_LOGFMT, false))
+
+	b := NewBottle("1", "Hello", nil)
+	b.SetContext(WithRequestID(context.Background(), "req-1"))
+	_ = storage.Add(b)
+
+	assert.Contains(t, buf.String(), "msg=\"store a container\" request_id=req-1 id=1")
+}
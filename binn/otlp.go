@@ -0,0 +1,48 @@
+package binn
+
+import (
+	"fmt"
+	"time"
+	"context"
+	"strings"
+	"net/url"
+
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.12.0"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+)
+
+const (
+	OTLP_TRACES_PATH = "/v1/traces"
+	DEFAULT_OTLP_FLUSH_INTERVAL = 5 * time.Second
+)
+
+// NewOTLPTracer exports spans in batches to a collector over OTLP/HTTP,
+// endpoint is the base url of the collector like http://localhost:4318,
+// the returned func flushes the spans left and stops the exporter
+func NewOTLPTracer(ctx context.Context, endpoint string, serviceName string, headers map[string]string, flushInterval time.Duration) (*Tracer, func(ctx context.Context) error, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+		return nil, nil, fmt.Errorf("this otlp endpoint (%#v) is invalid", endpoint)
+	}
+
+	opts := []otlptracehttp.Option{
+		otlptracehttp.WithEndpoint(u.Host),
+		otlptracehttp.WithURLPath(strings.TrimSuffix(u.Path, "/") + OTLP_TRACES_PATH),
+		otlptracehttp.WithHeaders(headers),
+	}
+	if u.Scheme == "http" {
+		opts = append(opts, otlptracehttp.WithInsecure())
+	}
+	exporter, err := otlptracehttp.New(ctx, opts...)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter, sdktrace.WithBatchTimeout(flushInterval)),
+		sdktrace.WithResource(resource.NewWithAttributes(semconv.SchemaURL, semconv.ServiceNameKey.String(serviceName))),
+	)
+	return NewTracer(tp), tp.Shutdown, nil
+}
@@ -0,0 +1,61 @@
+package binn
+
+import (
+	"io"
+	"time"
+	"context"
+	"testing"
+	"net/http"
+	"net/http/httptest"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+	coltracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+)
+
+func TestOTLPTracerSendsSpans(t *testing.T) {
+	received := make(chan *coltracepb.ExportTraceServiceRequest, 1)
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/otlp" + OTLP_TRACES_PATH, r.URL.Path)
+		assert.Equal(t, "application/x-protobuf", r.Header.Get("Content-Type"))
+		assert.Equal(t, "secret", r.Header.Get("X-Token"))
+
+		body, _ := io.ReadAll(r.Body)
+		req := &coltracepb.ExportTraceServiceRequest{}
+		assert.Nil(t, proto.Unmarshal(body, req))
+		received <- req
+	}))
+	defer collector.Close()
+
+	tracer, shutdown, err := NewOTLPTracer(context.Background(), collector.URL + "/otlp/", "binn",
+		map[string]string{ "X-Token": "secret" }, time.Hour)
+	require.Nil(t, err)
+
+	ctx, root := tracer.Start(context.Background(), "bottle.throw", SPAN_KIND_SERVER)
+	_, child := StartSpan(ctx, "storage.add", SPAN_KIND_INTERNAL)
+	child.SetError(assert.AnError)
+	child.End()
+	root.End()
+
+	require.Nil(t, shutdown(context.Background()))
+	req := <- received
+
+	rs := req.ResourceSpans[0]
+	assert.Equal(t, "service.name", rs.Resource.Attributes[0].Key)
+	assert.Equal(t, "binn", rs.Resource.Attributes[0].Value.GetStringValue())
+
+	spans := rs.ScopeSpans[0].Spans
+	assert.Equal(t, INSTRUMENTATION_SCOPE, rs.ScopeSpans[0].Scope.Name)
+	assert.Equal(t, 2, len(spans))
+	assert.Equal(t, "storage.add", spans[0].Name)
+	assert.Equal(t, spans[1].SpanId, spans[0].ParentSpanId)
+	assert.Equal(t, 0, len(spans[1].ParentSpanId))
+}
+
+func TestNewOTLPTracerRejectsInvalidEndpoint(t *testing.T) {
+	for _, endpoint := range []string{ "localhost:4318", "ftp://localhost:4318", "http://" } {
+		_, _, err := NewOTLPTracer(context.Background(), endpoint, "binn", nil, time.Second)
+		assert.NotNil(t, err, endpoint)
+	}
+}
@@ -0,0 +1,175 @@
+package binn
+
+import (
+	"fmt"
+	"context"
+	"sync"
+	"time"
+	"sync/atomic"
+)
+
+var ErrQueueFull = fmt.Errorf("this engine queue is full")
+
+// MAX_PENDING bounds the returned containers waiting to be delivered again
+const MAX_PENDING = 1024
+
+// QueueStats reports the saturation of the queues between server and engine
+type QueueStats struct {
+	InLen         int
+	InCap         int
+	OutLen        int
+	OutCap        int
+	Pending       int
+	Enqueued      uint64
+	Dropped       uint64
+	Rejected      uint64
+	Returned      uint64
+	Subscribers   int64
+	SlowConsumers uint64
+}
+
+// queueState keeps counters first for atomic alignment on 32 bit platforms
+type queueState struct {
+	enqueued      uint64
+	dropped       uint64
+	rejected      uint64
+	returned      uint64
+	slowConsumers uint64
+	subscribers   int64
+	pending       []Container
+	mux           *sync.Mutex
+}
+
+func newQueueState() *queueState {
+	return &queueState{
+		pending: []Container{},
+		mux:     &sync.Mutex{},
+	}
+}
+
+// Enqueue pushes c to inCh following the overflow policy of the config,
+// a dropped container is not an error so the thrower can not tell
+func (e *Engine) Enqueue(c Container) error {
+	return e.enqueue(context.Background(), c)
+}
+
+// enqueue is Enqueue which also stops blocking when ctx is done,
+// a dropped submission is told ErrQueueFull
+func (e *Engine) enqueue(ctx context.Context, c Container) error {
+	switch e.cfg.Overflow() {
+	case OVERFLOW_DROP_NEWEST:
+		select {
+		case e.inCh <- c:
+		default:
+			atomic.AddUint64(&e.queue.dropped, 1)
+			if s, ok := c.(*submission); ok {
+				s.result <- ErrQueueFull
+			}
+			return nil
+		}
+	case OVERFLOW_DROP_OLDEST:
+	Loop:
+		for {
+			select {
+			case e.inCh <- c:
+				break Loop
+			default:
+			}
+			select {
+			case old := <- e.inCh:
+				atomic.AddUint64(&e.queue.dropped, 1)
+				if s, ok := old.(*submission); ok {
+					s.result <- ErrQueueFull
+				}
+			default:
+			}
+		}
+	case OVERFLOW_REJECT:
+		select {
+		case e.inCh <- c:
+		default:
+			atomic.AddUint64(&e.queue.rejected, 1)
+			return ErrQueueFull
+		}
+	default:
+		t := time.NewTimer(e.cfg.EnqueueTimeout())
+		defer t.Stop()
+		select {
+		case e.inCh <- c:
+		case <- t.C:
+			atomic.AddUint64(&e.queue.rejected, 1)
+			return ErrQueueFull
+		case <- ctx.Done():
+			return ctx.Err()
+		}
+	}
+	atomic.AddUint64(&e.queue.enqueued, 1)
+	return nil
+}
+
+// Return gives back a delivered container which no subscriber received,
+// it is delivered again before any container of the storage.
+// Returned containers are bounded by MAX_PENDING, beyond it drop-oldest
+// drops the oldest returned container and the other policies drop c
+func (e *Engine) Return(c Container) {
+	e.queue.mux.Lock()
+	defer e.queue.mux.Unlock()
+	atomic.AddUint64(&e.queue.returned, 1)
+	if len(e.queue.pending) >= MAX_PENDING {
+		atomic.AddUint64(&e.queue.dropped, 1)
+		if e.cfg.Overflow() != OVERFLOW_DROP_OLDEST {
+			e.logger().Warn("drop a returned container", F("id", c.ID()), F("pending", len(e.queue.pending)))
+			return
+		}
+		e.logger().Warn("drop a returned container", F("id", e.queue.pending[0].ID()), F("pending", len(e.queue.pending)))
+		e.queue.pending = e.queue.pending[1:]
+	}
+	e.queue.pending = append(e.queue.pending, c)
+}
+
+func (e *Engine) next() (Container, error) {
+	e.queue.mux.Lock()
+	if len(e.queue.pending) > 0 {
+		c := e.queue.pending[0]
+		e.queue.pending = e.queue.pending[1:]
+		e.queue.mux.Unlock()
+		return c, nil
+	}
+	e.queue.mux.Unlock()
+	return e.storage.Get()
+}
+
+// Subscribe counts a stream receiving from outCh,
+// the returned func is called with whether it was a slow consumer
+func (e *Engine) Subscribe() func(slow bool) {
+	atomic.AddInt64(&e.queue.subscribers, 1)
+	var once sync.Once
+	return func(slow bool) {
+		once.Do(func() {
+			atomic.AddInt64(&e.queue.subscribers, -1)
+			if slow {
+				atomic.AddUint64(&e.queue.slowConsumers, 1)
+			}
+		})
+	}
+}
+
+func (e *Engine) QueueStats() QueueStats {
+	e.queue.mux.Lock()
+	pending := len(e.queue.pending)
+	e.queue.mux.Unlock()
+
+	return QueueStats{
+		InLen:         len(e.inCh),
+		InCap:         cap(e.inCh),
+		OutLen:        len(e.outCh),
+		OutCap:        cap(e.outCh),
+		Pending:       pending,
+		Enqueued:      atomic.LoadUint64(&e.queue.enqueued),
+		Dropped:       atomic.LoadUint64(&e.queue.dropped),
+		Rejected:      atomic.LoadUint64(&e.queue.rejected),
+		Returned:      atomic.LoadUint64(&e.queue.returned),
+		Subscribers:   atomic.LoadInt64(&e.queue.subscribers),
+		SlowConsumers: atomic.LoadUint64(&e.queue.slowConsumers),
+	}
+}
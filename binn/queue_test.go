@@ -0,0 +1,108 @@
+package binn
+
+import (
+	"fmt"
+	"time"
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newQueueTestEngine(p OverflowPolicy) *Engine {
+	cfg := DefaultConfig()
+	cfg.SetInQueueSize(1)
+	cfg.SetOverflow(p)
+	cfg.SetEnqueueTimeout(time.Duration(10) * time.Millisecond)
+	return NewEngine(cfg, NewContainerStorage(false, 0, nil))
+}
+
+func TestEnqueueDropNewest(t *testing.T) {
+	engine := newQueueTestEngine(OVERFLOW_DROP_NEWEST)
+	assert.Nil(t, engine.Enqueue(NewBottle("1", "", nil)))
+	assert.Nil(t, engine.Enqueue(NewBottle("2", "", nil)))
+
+	assert.Equal(t, "1", (<- engine.GetInChan()).ID())
+	stats := engine.QueueStats()
+	assert.Equal(t, uint64(1), stats.Enqueued)
+	assert.Equal(t, uint64(1), stats.Dropped)
+}
+
+func TestEnqueueDropOldest(t *testing.T) {
+	engine := newQueueTestEngine(OVERFLOW_DROP_OLDEST)
+	s := &submission{ Container: NewBottle("1", "", nil), result: make(chan error, 1) }
+	engine.GetInChan() <- s
+	assert.Nil(t, engine.Enqueue(NewBottle("2", "", nil)))
+
+	assert.Equal(t, ErrQueueFull, <- s.result)
+	assert.Equal(t, "2", (<- engine.GetInChan()).ID())
+	assert.Equal(t, uint64(1), engine.QueueStats().Dropped)
+}
+
+func TestEnqueueRejectAndBlock(t *testing.T) {
+	for _, p := range []OverflowPolicy{ OVERFLOW_REJECT, OVERFLOW_BLOCK } {
+		engine := newQueueTestEngine(p)
+		assert.Nil(t, engine.Enqueue(NewBottle("1", "", nil)))
+		assert.Equal(t, ErrQueueFull, engine.Enqueue(NewBottle("2", "", nil)), p)
+		assert.Equal(t, uint64(1), engine.QueueStats().Rejected, p)
+	}
+}
+
+func TestParseOverflowPolicy(t *testing.T) {
+	p, err := ParseOverflowPolicy("")
+	assert.Nil(t, err)
+	assert.Equal(t, OVERFLOW_BLOCK, p)
+	p, err = ParseOverflowPolicy("Drop-Oldest")
+	assert.Nil(t, err)
+	assert.Equal(t, OVERFLOW_DROP_OLDEST, p)
+	_, err = ParseOverflowPolicy("spill")
+	assert.NotNil(t, err)
+}
+
+func TestReturnedContainerIsDeliveredFirst(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.SetDeliveryCycle(time.Duration(10) * time.Millisecond)
+	storage := NewContainerStorage(false, 0, nil)
+	storage.Add(NewBottle("", "stored", nil))
+	engine := NewEngine(cfg, storage)
+	engine.Return(NewBottle("1", "returned", nil))
+
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	engine.Run(ctx)
+	defer cancelFunc()
+
+	assert.Equal(t, "returned", (<- engine.GetOutChan()).Message().Text)
+	assert.Equal(t, "stored", (<- engine.GetOutChan()).Message().Text)
+	assert.Equal(t, uint64(1), engine.QueueStats().Returned)
+}
+
+func TestReturnedContainersAreBounded(t *testing.T) {
+	for _, policy := range []OverflowPolicy{ OVERFLOW_BLOCK, OVERFLOW_DROP_OLDEST } {
+		cfg := DefaultConfig()
+		cfg.SetOverflow(policy)
+		engine := NewEngine(cfg, NewContainerStorage(false, 0, nil))
+		for i := 0; i <= MAX_PENDING; i++ {
+			engine.Return(NewBottle(fmt.Sprint(i), "returned", nil))
+		}
+
+		stats := engine.QueueStats()
+		assert.Equal(t, MAX_PENDING, stats.Pending, policy)
+		assert.Equal(t, uint64(1), stats.Dropped, policy)
+		c, _ := engine.next()
+		if policy == OVERFLOW_DROP_OLDEST {
+			assert.Equal(t, "1", c.ID())
+		} else {
+			assert.Equal(t, "0", c.ID())
+		}
+	}
+}
+
+func TestSubscribeCountsSubscribers(t *testing.T) {
+	engine := DefaultEngine()
+	unsubscribe := engine.Subscribe()
+	assert.Equal(t, int64(1), engine.QueueStats().Subscribers)
+	unsubscribe(true)
+	unsubscribe(true)
+	assert.Equal(t, int64(0), engine.QueueStats().Subscribers)
+	assert.Equal(t, uint64(1), engine.QueueStats().SlowConsumers)
+}
@@ -0,0 +1,354 @@
+package binn
+
+import (
+	"io"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+	"context"
+	"hash/fnv"
+	"sync/atomic"
+)
+
+const DEFAULT_NUM_SHARDS = 16
+
+// ShardedContainerStorage spreads containers over shards locked on their
+// own, Add fills the shards in turn and Get starts at a rotating shard and
+// steals from the next ones when it is empty, so containers are only
+// delivered in order within a shard
+type ShardedContainerStorage struct {
+	shards     []*containerShard
+	idStorage  *StripedIDStorage
+	validation bool
+	expiration time.Duration
+	addCursor  uint32
+	getCursor  uint32
+	logger     *Logger
+	onEvict    func(c Container)
+	mux        *sync.RWMutex
+}
+
+type containerShard struct {
+	containers []Container
+	capacity   int
+	mux        *sync.Mutex
+}
+
+// StripedIDStorage is a IDStorage whose ids are spread over stripes
+// by their hash so ids on different stripes never wait for each other
+type StripedIDStorage struct {
+	stripes []*IDStorage
+}
+
+func NewShardedContainerStorage(n int, v bool, e time.Duration, s *StripedIDStorage) *ShardedContainerStorage {
+	if n < 1 {
+		n = 1
+	}
+	capacity := (MAX_CONTAINER_STORAGE_NUM_CONTAINER + n - 1) / n
+	shards := make([]*containerShard, n)
+	for i := range shards {
+		shards[i] = &containerShard{
+			containers: []Container{},
+			capacity:   capacity,
+			mux:        &sync.Mutex{},
+		}
+	}
+	return &ShardedContainerStorage{
+		shards:     shards,
+		idStorage:  s,
+		validation: v,
+		expiration: e,
+		logger:     DefaultLogger(),
+		mux:        &sync.RWMutex{},
+	}
+}
+
+func (cs *ShardedContainerStorage) SetLogger(l *Logger) {
+	cs.mux.Lock()
+	defer cs.mux.Unlock()
+	cs.logger = l
+}
+
+func (cs *ShardedContainerStorage) SetEvictHandler(f func(c Container)) {
+	cs.mux.Lock()
+	defer cs.mux.Unlock()
+	cs.onEvict = f
+}
+
+// evicted reports c dropped from a full shard like ContainerStorage
+func (cs *ShardedContainerStorage) evicted(c Container) {
+	cs.mux.RLock()
+	logger, onEvict := cs.logger, cs.onEvict
+	cs.mux.RUnlock()
+	logger.Debug("evict a container", F("id", c.ID()))
+	if onEvict != nil {
+		onEvict(c)
+	}
+}
+
+func DefaultShardedContainerStorage() *ShardedContainerStorage {
+	return NewShardedContainerStorage(DEFAULT_NUM_SHARDS, true, 0, NewStripedIDStorage(DEFAULT_NUM_SHARDS))
+}
+
+func (cs *ShardedContainerStorage) Get() (Container, error) {
+	n := len(cs.shards)
+	start := int(atomic.AddUint32(&cs.getCursor, 1) % uint32(n))
+	for i := 0; i < n; i++ {
+		shard := cs.shards[(start + i) % n]
+		shard.mux.Lock()
+		if len(shard.containers) == 0 {
+			shard.mux.Unlock()
+			continue
+		}
+		c := shard.containers[0]
+		shard.containers = shard.containers[1:]
+		shard.mux.Unlock()
+
+		return cs.stamp(c), nil
+	}
+	return nil, fmt.Errorf("this storage has no containers")
+}
+
+// GetMatching picks up the oldest container match accepts in the first
+// shard which has one, starting at a rotating shard like Get
+func (cs *ShardedContainerStorage) GetMatching(match func(c Container) bool) (Container, error) {
+	n := len(cs.shards)
+	start := int(atomic.AddUint32(&cs.getCursor, 1) % uint32(n))
+	for i := 0; i < n; i++ {
+		shard := cs.shards[(start + i) % n]
+		shard.mux.Lock()
+		for j, c := range shard.containers {
+			if match(c) {
+				shard.containers = append(shard.containers[:j:j], shard.containers[j + 1:]...)
+				shard.mux.Unlock()
+				return cs.stamp(c), nil
+			}
+		}
+		shard.mux.Unlock()
+	}
+	return nil, fmt.Errorf("this storage has no matching containers")
+}
+
+func (cs *ShardedContainerStorage) stamp(c Container) Container {
+	d := time.Now().Add(time.Duration(MAX_EXPIRATION_HOUR) * time.Hour)
+	if cs.expiration != 0 {
+		d = time.Now().Add(cs.expiration)
+	}
+	nb := NewBottleWithMessage(c.ID(), c.Message(), &d)
+	if cc, ok := c.(Contextual); ok && cc.Context() != nil {
+		nb.SetContext(cc.Context())
+	}
+	if cs.validation {
+		cs.idStorage.Update(nb.ID(), d)
+	}
+	return nb
+}
+
+func (cs *ShardedContainerStorage) Add(c Container) error {
+	if cs.validation {
+		if err := cs.idStorage.Use(c.ID()); err != nil {
+			return err
+		}
+	}
+
+	newID := GenerateID()
+	if cs.validation {
+		cs.idStorage.Add(newID, time.Now().Add(time.Duration(MAX_EXPIRATION_HOUR) * time.Hour))
+	}
+	nb := NewBottleWithMessage(newID, c.Message().Stored(time.Now()), c.ExpiredAt())
+	if sc := SpanContextFrom(ContextOf(c)); sc.IsValid() {
+		nb.SetContext(ContextWithSpanContext(context.Background(), sc))
+	}
+
+	shard := cs.shards[int(atomic.AddUint32(&cs.addCursor, 1) % uint32(len(cs.shards)))]
+	shard.mux.Lock()
+	var evicted Container
+	if len(shard.containers) >= shard.capacity {
+		evicted = shard.containers[0]
+		shard.containers = shard.containers[1:]
+	}
+	shard.containers = append(shard.containers, nb)
+	shard.mux.Unlock()
+
+	if evicted != nil {
+		cs.evicted(evicted)
+	}
+	return nil
+}
+
+// Issue adds id to the issued ids, it does nothing without validation
+func (cs *ShardedContainerStorage) Issue(id string, e time.Time) error {
+	if !cs.validation {
+		return nil
+	}
+	return cs.idStorage.Add(id, e)
+}
+
+func (cs *ShardedContainerStorage) Ping() error {
+	return nil
+}
+
+func (cs *ShardedContainerStorage) Len() int {
+	n := 0
+	for _, shard := range cs.shards {
+		shard.mux.Lock()
+		n += len(shard.containers)
+		shard.mux.Unlock()
+	}
+	return n
+}
+
+func (cs *ShardedContainerStorage) all() []Container {
+	containers := []Container{}
+	for _, shard := range cs.shards {
+		shard.mux.Lock()
+		containers = append(containers, shard.containers...)
+		shard.mux.Unlock()
+	}
+	return containers
+}
+
+// Sweep forgets issued ids which have expired like ContainerStorage.Sweep
+func (cs *ShardedContainerStorage) Sweep() int {
+	if !cs.validation || cs.idStorage == nil {
+		return 0
+	}
+	keep := map[string]bool{}
+	for _, c := range cs.all() {
+		keep[c.ID()] = true
+	}
+	return len(cs.idStorage.Sweep(time.Now(), keep))
+}
+
+func (cs *ShardedContainerStorage) Snapshot(w io.Writer) error {
+	s := &Snapshot{
+		CreatedAt:   time.Now(),
+		Containers:  cs.all(),
+		Quarantined: []Container{},
+		IDs:         []IssuedID{},
+	}
+	if cs.validation && cs.idStorage != nil {
+		s.IDs = cs.idStorage.List(0, cs.idStorage.Len())
+	}
+	return WriteSnapshot(w, s)
+}
+
+// Restore spreads the containers of the snapshot over the shards in turn,
+// the shards have no quarantine so a snapshot with one is refused
+func (cs *ShardedContainerStorage) Restore(r io.Reader) error {
+	s, err := ReadSnapshot(r)
+	if err != nil {
+		return err
+	}
+	if len(s.Quarantined) > 0 {
+		return ErrQuarantineUnsupported
+	}
+	containers := s.Containers
+	if len(containers) > MAX_CONTAINER_STORAGE_NUM_CONTAINER {
+		return fmt.Errorf("snapshot has too many containers")
+	}
+
+	for _, shard := range cs.shards {
+		shard.mux.Lock()
+	}
+	for _, shard := range cs.shards {
+		shard.containers = []Container{}
+	}
+	for i, c := range containers {
+		shard := cs.shards[i % len(cs.shards)]
+		shard.containers = append(shard.containers, c)
+	}
+	if cs.validation && cs.idStorage != nil {
+		cs.idStorage.Replace(s.IDs)
+	}
+	for _, shard := range cs.shards {
+		shard.mux.Unlock()
+	}
+	return nil
+}
+
+func NewStripedIDStorage(n int) *StripedIDStorage {
+	if n < 1 {
+		n = 1
+	}
+	stripes := make([]*IDStorage, n)
+	for i := range stripes {
+		stripes[i] = DefaultIDStorage()
+	}
+	return &StripedIDStorage{ stripes: stripes }
+}
+
+func (s *StripedIDStorage) stripe(id string) *IDStorage {
+	h := fnv.New32a()
+	h.Write([]byte(id))
+	return s.stripes[h.Sum32() % uint32(len(s.stripes))]
+}
+
+func (s *StripedIDStorage) Add(id string, e time.Time) error {
+	return s.stripe(id).Add(id, e)
+}
+
+func (s *StripedIDStorage) Use(id string) error {
+	return s.stripe(id).Use(id)
+}
+
+func (s *StripedIDStorage) Update(id string, e time.Time) error {
+	return s.stripe(id).Update(id, e)
+}
+
+func (s *StripedIDStorage) Revoke(id string) error {
+	return s.stripe(id).Revoke(id)
+}
+
+func (s *StripedIDStorage) Len() int {
+	n := 0
+	for _, stripe := range s.stripes {
+		n += stripe.Len()
+	}
+	return n
+}
+
+func (s *StripedIDStorage) List(offset int, limit int) []IssuedID {
+	ids := []IssuedID{}
+	for _, stripe := range s.stripes {
+		ids = append(ids, stripe.List(0, stripe.Len())...)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		if ids[i].ExpiredAt.Equal(ids[j].ExpiredAt) {
+			return ids[i].ID < ids[j].ID
+		}
+		return ids[i].ExpiredAt.Before(ids[j].ExpiredAt)
+	})
+
+	if offset < 0 || offset >= len(ids) || limit <= 0 {
+		return []IssuedID{}
+	}
+	end := offset + limit
+	if end > len(ids) {
+		end = len(ids)
+	}
+	return ids[offset:end]
+}
+
+func (s *StripedIDStorage) Sweep(now time.Time, keep map[string]bool) []IssuedID {
+	expired := []IssuedID{}
+	for _, stripe := range s.stripes {
+		expired = append(expired, stripe.Sweep(now, keep)...)
+	}
+	sort.Slice(expired, func(i, j int) bool {
+		return expired[i].ExpiredAt.Before(expired[j].ExpiredAt)
+	})
+	return expired
+}
+
+func (s *StripedIDStorage) Replace(ids []IssuedID) {
+	parts := make(map[*IDStorage][]IssuedID, len(s.stripes))
+	for _, id := range ids {
+		stripe := s.stripe(id.ID)
+		parts[stripe] = append(parts[stripe], id)
+	}
+	for _, stripe := range s.stripes {
+		stripe.Replace(parts[stripe])
+	}
+}
@@ -0,0 +1,191 @@
+package binn
+
+import (
+	"sync"
+	"time"
+	"bytes"
+	"strconv"
+	"testing"
+	"sync/atomic"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestShardedStorageGetAndAdd(t *testing.T) {
+	ids := NewStripedIDStorage(4)
+	cs := NewShardedContainerStorage(4, true, time.Duration(10) * time.Minute, ids)
+
+	_, err := cs.Get()
+	assert.NotNil(t, err)
+	assert.NotNil(t, cs.Add(NewBottle("unknown", "hello", nil)))
+
+	for i := 0; i < 8; i++ {
+		id := GenerateID()
+		require.Nil(t, ids.Add(id, time.Now().Add(time.Minute)))
+		require.Nil(t, cs.Add(NewBottle(id, "hello", nil)))
+		assert.NotNil(t, cs.Add(NewBottle(id, "hello", nil)))
+	}
+	assert.Equal(t, 8, cs.Len())
+	assert.Equal(t, 8, ids.Len())
+
+	// every shard is drained by stealing
+	for i := 0; i < 8; i++ {
+		c, err := cs.Get()
+		require.Nil(t, err)
+		assert.Equal(t, "hello", c.Message().Text)
+		assert.WithinDuration(t, time.Now().Add(time.Duration(10) * time.Minute), *c.ExpiredAt(), time.Second)
+		assert.Nil(t, cs.Add(NewBottle(c.ID(), "reply", nil)))
+	}
+	assert.Equal(t, 8, cs.Len())
+}
+
+func TestShardedStorageCapacity(t *testing.T) {
+	cs := NewShardedContainerStorage(3, false, 0, nil)
+	for i := 0; i < MAX_CONTAINER_STORAGE_NUM_CONTAINER + 10; i++ {
+		assert.Nil(t, cs.Add(NewBottle("", "hello", nil)))
+	}
+	assert.LessOrEqual(t, cs.Len(), MAX_CONTAINER_STORAGE_NUM_CONTAINER + 2)
+	assert.GreaterOrEqual(t, cs.Len(), MAX_CONTAINER_STORAGE_NUM_CONTAINER)
+}
+
+func TestShardedStorageReportsEvictions(t *testing.T) {
+	cs := NewShardedContainerStorage(1, false, 0, nil)
+	evicted := []Container{}
+	cs.SetEvictHandler(func(c Container) {
+		evicted = append(evicted, c)
+	})
+	for i := 0; i < MAX_CONTAINER_STORAGE_NUM_CONTAINER + 2; i++ {
+		assert.Nil(t, cs.Add(NewBottle("", strconv.Itoa(i), nil)))
+	}
+	require.Equal(t, 2, len(evicted))
+	assert.Equal(t, "0", evicted[0].Message().Text)
+	assert.Equal(t, "1", evicted[1].Message().Text)
+}
+
+func TestShardedStorageConcurrentDeliversOnce(t *testing.T) {
+	cs := NewShardedContainerStorage(8, false, 0, nil)
+	for i := 0; i < 800; i++ {
+		require.Nil(t, cs.Add(NewBottle("", "hello", nil)))
+	}
+
+	mux := &sync.Mutex{}
+	seen := map[string]int{}
+	wg := &sync.WaitGroup{}
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				c, err := cs.Get()
+				if err != nil {
+					return
+				}
+				mux.Lock()
+				seen[c.ID()]++
+				mux.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	assert.Equal(t, 800, len(seen))
+	for id, n := range seen {
+		assert.Equal(t, 1, n, id)
+	}
+}
+
+func TestShardedStorageSnapshot(t *testing.T) {
+	ids := NewStripedIDStorage(4)
+	cs := NewShardedContainerStorage(4, true, 0, ids)
+	for i := 0; i < 5; i++ {
+		id := GenerateID()
+		ids.Add(id, time.Now().Add(time.Minute))
+		require.Nil(t, cs.Add(NewBottle(id, "hello", nil)))
+	}
+
+	buf := &bytes.Buffer{}
+	require.Nil(t, cs.Snapshot(buf))
+	restoredIDs := NewStripedIDStorage(2)
+	restored := NewShardedContainerStorage(2, true, 0, restoredIDs)
+	require.Nil(t, restored.Restore(buf))
+	assert.Equal(t, 5, restored.Len())
+	assert.Equal(t, 5, restoredIDs.Len())
+	for i, id := range ids.List(0, 10) {
+		assert.Equal(t, id.ID, restoredIDs.List(0, 10)[i].ID)
+		assert.True(t, id.ExpiredAt.Equal(restoredIDs.List(0, 10)[i].ExpiredAt))
+	}
+}
+
+func TestShardedStorageRefusesQuarantinedSnapshot(t *testing.T) {
+	cs := NewContainerStorage(false, 0, nil)
+	require.Nil(t, cs.Add(NewBottle("", "hello", nil)))
+	require.Nil(t, cs.Add(NewBottle("", "spam", nil)))
+	require.Nil(t, cs.Quarantine(cs.List(0, 2)[1].ID()))
+	buf := &bytes.Buffer{}
+	require.Nil(t, cs.Snapshot(buf))
+
+	sharded := NewShardedContainerStorage(2, false, 0, nil)
+	assert.Equal(t, ErrQuarantineUnsupported, sharded.Restore(buf))
+	assert.Equal(t, 0, sharded.Len())
+}
+
+func TestStripedIDStorageSweep(t *testing.T) {
+	s := NewStripedIDStorage(4)
+	now := time.Now()
+	s.Add("a", now.Add(-time.Minute))
+	s.Add("b", now.Add(-time.Minute))
+	s.Add("c", now.Add(time.Minute))
+
+	expired := s.Sweep(now, map[string]bool{ "b": true })
+	assert.Equal(t, 1, len(expired))
+	assert.Equal(t, "a", expired[0].ID)
+	assert.Equal(t, 2, s.Len())
+	assert.NotNil(t, s.Revoke("a"))
+	assert.Nil(t, s.Revoke("b"))
+}
+
+// benchmarkKeeper throws and picks up bottles from every goroutine,
+// run with -cpu 1,4,16 to compare contention
+func benchmarkKeeper(b *testing.B, cs ContainerKeeper) {
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			cs.Add(NewBottle("", "hello", nil))
+			cs.Get()
+		}
+	})
+}
+
+func BenchmarkContainerStorage(b *testing.B) {
+	benchmarkKeeper(b, NewContainerStorage(false, 0, nil))
+}
+
+func BenchmarkShardedContainerStorage(b *testing.B) {
+	benchmarkKeeper(b, NewShardedContainerStorage(DEFAULT_NUM_SHARDS, false, 0, nil))
+}
+
+type idKeeper interface {
+	Add(id string, e time.Time) error
+	Use(id string) error
+}
+
+// benchmarkIDs numbers ids itself since GenerateID is serialized on its own
+func benchmarkIDs(b *testing.B, s idKeeper) {
+	e := time.Now().Add(time.Hour)
+	var n uint64
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			id := strconv.FormatUint(atomic.AddUint64(&n, 1), 10)
+			s.Add(id, e)
+			s.Use(id)
+		}
+	})
+}
+
+func BenchmarkIDStorage(b *testing.B) {
+	benchmarkIDs(b, DefaultIDStorage())
+}
+
+func BenchmarkStripedIDStorage(b *testing.B) {
+	benchmarkIDs(b, NewStripedIDStorage(DEFAULT_NUM_SHARDS))
+}
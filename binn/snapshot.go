@@ -0,0 +1,183 @@
+package binn
+
+import (
+	"io"
+	"fmt"
+	"time"
+	"bufio"
+	"encoding/json"
+)
+
+const (
+	SNAPSHOT_VERSION = 1
+	MAX_SNAPSHOT_LINE_LENGTH = 1024 * 1024
+)
+
+const (
+	snapshotRecordHeader      = "header"
+	snapshotRecordContainer   = "container"
+	snapshotRecordQuarantined = "quarantined"
+	snapshotRecordID          = "id"
+)
+
+// ErrQuarantineUnsupported is returned when a snapshot with quarantined
+// containers is restored into a storage without a quarantine, they
+// would be delivered otherwise
+var ErrQuarantineUnsupported = fmt.Errorf("this storage can not keep quarantined containers")
+
+type Snapshotter interface {
+	Snapshot(w io.Writer) error
+	Restore(r io.Reader) error
+}
+
+type Snapshot struct {
+	Version     int
+	CreatedAt   time.Time
+	Containers  []Container
+	Quarantined []Container
+	IDs         []IssuedID
+}
+
+// snapshotRecord is a line of a snapshot stream, the first line is
+// a header and unknown fields are ignored so fields can be added
+// without a new version
+//
+// CreatedAt of the header is when the snapshot was taken and
+// CreatedAt of a container is when its message was stored first
+type snapshotRecord struct {
+	Type      string            `json:"type"`
+	Version   int               `json:"version,omitempty"`
+	CreatedAt *time.Time        `json:"created_at,omitempty"`
+	ID        string            `json:"id,omitempty"`
+	Text      string            `json:"text,omitempty"`
+	ExpiredAt *time.Time        `json:"expired_at,omitempty"`
+	Language  string            `json:"language,omitempty"`
+	Tags      []string          `json:"tags,omitempty"`
+	Signature string            `json:"signature,omitempty"`
+	Hops      int               `json:"hops,omitempty"`
+	Metadata  map[string]string `json:"metadata,omitempty"`
+	Attachments []Attachment    `json:"attachments,omitempty"`
+}
+
+func containerToRecord(t string, c Container) *snapshotRecord {
+	m := c.Message()
+	return &snapshotRecord{
+		Type:      t,
+		CreatedAt: m.CreatedAt,
+		ID:        c.ID(),
+		Text:      m.Text,
+		ExpiredAt: c.ExpiredAt(),
+		Language:  m.Language,
+		Tags:      m.Tags,
+		Signature: m.Signature,
+		Hops:      m.Hops,
+		Metadata:  m.Metadata,
+		Attachments: m.Attachments,
+	}
+}
+
+func recordToContainer(r *snapshotRecord) Container {
+	return NewBottleWithMessage(r.ID, &Message{
+		Text:      r.Text,
+		CreatedAt: r.CreatedAt,
+		Language:  r.Language,
+		Tags:      r.Tags,
+		Signature: r.Signature,
+		Hops:      r.Hops,
+		Metadata:  r.Metadata,
+		Attachments: r.Attachments,
+	}, r.ExpiredAt)
+}
+
+func WriteSnapshot(w io.Writer, s *Snapshot) error {
+	bw := bufio.NewWriter(w)
+	enc := json.NewEncoder(bw)
+
+	createdAt := s.CreatedAt
+	if err := enc.Encode(&snapshotRecord{
+		Type:      snapshotRecordHeader,
+		Version:   SNAPSHOT_VERSION,
+		CreatedAt: &createdAt,
+	}); err != nil {
+		return err
+	}
+	for _, c := range s.Containers {
+		if err := enc.Encode(containerToRecord(snapshotRecordContainer, c)); err != nil {
+			return err
+		}
+	}
+	for _, c := range s.Quarantined {
+		if err := enc.Encode(containerToRecord(snapshotRecordQuarantined, c)); err != nil {
+			return err
+		}
+	}
+	for _, id := range s.IDs {
+		expiredAt := id.ExpiredAt
+		if err := enc.Encode(&snapshotRecord{
+			Type:      snapshotRecordID,
+			ID:        id.ID,
+			ExpiredAt: &expiredAt,
+		}); err != nil {
+			return err
+		}
+	}
+
+	return bw.Flush()
+}
+
+func ReadSnapshot(r io.Reader) (*Snapshot, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), MAX_SNAPSHOT_LINE_LENGTH)
+
+	s := &Snapshot{
+		Containers:  []Container{},
+		Quarantined: []Container{},
+		IDs:         []IssuedID{},
+	}
+	for n := 1; scanner.Scan(); n++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+
+		var rec snapshotRecord
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			return nil, fmt.Errorf("snapshot line %d is invalid format, %s", n, err)
+		}
+
+		if s.Version == 0 {
+			if rec.Type != snapshotRecordHeader {
+				return nil, fmt.Errorf("snapshot has no header")
+			}
+			if rec.Version < 1 || rec.Version > SNAPSHOT_VERSION {
+				return nil, fmt.Errorf("snapshot version %d is not supported", rec.Version)
+			}
+			s.Version = rec.Version
+			if rec.CreatedAt != nil {
+				s.CreatedAt = *rec.CreatedAt
+			}
+			continue
+		}
+
+		switch rec.Type {
+		case snapshotRecordContainer:
+			s.Containers = append(s.Containers, recordToContainer(&rec))
+		case snapshotRecordQuarantined:
+			s.Quarantined = append(s.Quarantined, recordToContainer(&rec))
+		case snapshotRecordID:
+			if rec.ExpiredAt == nil {
+				return nil, fmt.Errorf("snapshot line %d has no expiration", n)
+			}
+			s.IDs = append(s.IDs, IssuedID{ ID: rec.ID, ExpiredAt: *rec.ExpiredAt })
+		default:
+			return nil, fmt.Errorf("snapshot line %d has unknown type %#v", n, rec.Type)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if s.Version == 0 {
+		return nil, fmt.Errorf("snapshot has no header")
+	}
+
+	return s, nil
+}
@@ -0,0 +1,92 @@
+package binn
+
+import (
+	"time"
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSnapshotAndRestore(t *testing.T) {
+	idStorage := DefaultIDStorage()
+	storage := NewContainerStorage(true, 0, idStorage)
+	c1, _ := storage.Inject(NewBottle("", "first", nil))
+	c2, _ := storage.Inject(NewBottle("", "second", nil))
+	_ = storage.Quarantine(c2.ID())
+
+	var buf bytes.Buffer
+	err := storage.Snapshot(&buf)
+	assert.Nil(t, err)
+
+	restoredIDStorage := DefaultIDStorage()
+	restored := NewContainerStorage(true, 0, restoredIDStorage)
+	err = restored.Restore(&buf)
+	assert.Nil(t, err)
+
+	assert.Equal(t, 1, restored.Len())
+	assert.Equal(t, c1.ID(), restored.List(0, 1)[0].ID())
+	assert.Equal(t, c2.ID(), restored.Quarantined()[0].ID())
+	assert.Equal(t, 2, restoredIDStorage.Len())
+}
+
+func TestReadSnapshot(t *testing.T) {
+	stream := `{"type":"header","version":1,"created_at":"2022-05-29T22:24:00Z"}
+{"type":"container","id":"1","text":"Hello","expired_at":"2022-05-30T22:24:00Z","future":"ignored"}
+{"type":"id","id":"1","expired_at":"2022-05-30T22:24:00Z"}
+`
+	s, err := ReadSnapshot(strings.NewReader(stream))
+
+	assert.Nil(t, err)
+	assert.Equal(t, 1, s.Version)
+	assert.Equal(t, time.Date(2022, 5, 29, 22, 24, 0, 0, time.UTC), s.CreatedAt)
+	assert.Equal(t, "Hello", s.Containers[0].Message().Text)
+	assert.Equal(t, "1", s.IDs[0].ID)
+}
+
+func TestReadSnapshotUnsupportedVersion(t *testing.T) {
+	_, err := ReadSnapshot(strings.NewReader(`{"type":"header","version":2}`))
+	assert.EqualError(t, err, "snapshot version 2 is not supported")
+
+	_, err = ReadSnapshot(strings.NewReader(`{"type":"container","id":"1"}`))
+	assert.EqualError(t, err, "snapshot has no header")
+}
+
+func TestRestoreInvalidSnapshotKeepsStorage(t *testing.T) {
+	storage := NewContainerStorage(false, 0, nil)
+	_, _ = storage.Inject(NewBottle("", "Hello", nil))
+
+	err := storage.Restore(strings.NewReader(`{"type":"header","version":1}
+{"type":"container","id":"1","text":"Hello"}
+not json
+`))
+
+	assert.Error(t, err)
+	assert.Equal(t, "Hello", storage.List(0, 1)[0].Message().Text)
+}
+
+func TestSnapshotKeepsMessage(t *testing.T) {
+	createdAt := time.Date(2022, 5, 29, 22, 24, 0, 0, time.UTC)
+	s := &Snapshot{
+		CreatedAt:   time.Now(),
+		Containers:  []Container{ NewBottleWithMessage("1", &Message{
+			Text:      "hello",
+			CreatedAt: &createdAt,
+			Language:  "en",
+			Tags:      []string{ "calm" },
+			Signature: "sailor",
+			Hops:      1,
+			Metadata:  map[string]string{ "k": "v" },
+			Attachments: []Attachment{ { ID: "a.png", ContentType: "image/png", Size: 1 } },
+		}, nil) },
+		Quarantined: []Container{},
+		IDs:         []IssuedID{},
+	}
+	var buf bytes.Buffer
+	assert.Nil(t, WriteSnapshot(&buf, s))
+
+	restored, err := ReadSnapshot(&buf)
+	assert.Nil(t, err)
+	assert.Equal(t, s.Containers[0].Message(), restored.Containers[0].Message())
+}
@@ -1,9 +1,13 @@
 package binn
 
 import (
+	"io"
 	"fmt"
 	"time"
 	"sync"
+	"sort"
+	"context"
+	"math/rand"
 
 	"github.com/google/uuid"
 )
@@ -20,12 +24,45 @@ type ContainerKeeper interface {
 	Add(Container) error
 }
 
+type ContainerAdmin interface {
+	Len() int
+	List(offset int, limit int) []Container
+	Find(id string) (Container, error)
+	Delete(id string) (Container, error)
+	Inject(c Container) (Container, error)
+	Quarantine(id string) error
+	Quarantined() []Container
+	Release(id string) error
+	IDAdmin() IDAdmin
+}
+
+type IDAdmin interface {
+	Len() int
+	List(offset int, limit int) []IssuedID
+	Revoke(id string) error
+}
+
+// Sweeper is implemented by storages forgetting expired ids on their own
+type Sweeper interface {
+	Sweep() int
+}
+
+type IssuedID struct {
+	ID        string
+	ExpiredAt time.Time
+}
+
 type ContainerStorage struct {
 	containers []Container
+	quarantine []Container
 	idStorage  *IDStorage
 	mux        *sync.Mutex
 	validation bool
 	expiration time.Duration
+	logger     *Logger
+	audit      *AuditLog
+	onEvict    func(c Container)
+	onSink     func(c Container, reason string)
 }
 
 type IDStorage struct {
@@ -36,10 +73,12 @@ type IDStorage struct {
 func NewContainerStorage(v bool, e time.Duration, s *IDStorage) *ContainerStorage {
 	return &ContainerStorage{
 		containers: []Container{},
+		quarantine: []Container{},
 		idStorage:  s,
 		mux:        &sync.Mutex{},
 		validation: v,
 		expiration:	e,
+		logger:     DefaultLogger(),
 	}
 }
 
@@ -54,6 +93,36 @@ func DefaultIDStorage() *IDStorage {
 	}
 }
 
+func (cs *ContainerStorage) SetLogger(l *Logger) {
+	cs.mux.Lock()
+	defer cs.mux.Unlock()
+	cs.logger = l
+}
+
+func (cs *ContainerStorage) SetAuditLog(a *AuditLog) {
+	cs.mux.Lock()
+	defer cs.mux.Unlock()
+	cs.audit = a
+}
+
+func (cs *ContainerStorage) SetEvictHandler(f func(c Container)) {
+	cs.mux.Lock()
+	defer cs.mux.Unlock()
+	cs.onEvict = f
+}
+
+func (cs *ContainerStorage) SetSinkHandler(f func(c Container, reason string)) {
+	cs.mux.Lock()
+	defer cs.mux.Unlock()
+	cs.onSink = f
+}
+
+func (cs *ContainerStorage) AuditLog() *AuditLog {
+	cs.mux.Lock()
+	defer cs.mux.Unlock()
+	return cs.audit
+}
+
 func (cs *ContainerStorage) Get() (Container, error) {
 	cs.mux.Lock()
 	defer cs.mux.Unlock()
@@ -61,53 +130,403 @@ func (cs *ContainerStorage) Get() (Container, error) {
 	if len(cs.containers) == 0 {
 		return nil, fmt.Errorf("this storage has no containers")
 	}
-	c := cs.containers[0]
-	cs.containers = cs.containers[1:]
+	return cs.pickUp(0), nil
+}
+
+// GetMatching picks up the oldest container match accepts
+func (cs *ContainerStorage) GetMatching(match func(c Container) bool) (Container, error) {
+	cs.mux.Lock()
+	defer cs.mux.Unlock()
+
+	for i, c := range cs.containers {
+		if match(c) {
+			return cs.pickUp(i), nil
+		}
+	}
+	return nil, fmt.Errorf("this storage has no matching containers")
+}
+
+// pickUp removes the i th container and stamps it with a expiration
+func (cs *ContainerStorage) pickUp(i int) Container {
+	c := cs.containers[i]
+	if i == 0 {
+		cs.containers = cs.containers[1:]
+	} else {
+		cs.containers = append(cs.containers[:i:i], cs.containers[i + 1:]...)
+	}
+	var nb *Bottle
 	if cs.expiration != 0 {
 		d := time.Now().Add(cs.expiration)
-		c = NewBottle(c.ID(), c.Message().Text, &d);
+		nb = NewBottleWithMessage(c.ID(), c.Message(), &d);
 	} else {
 		d := time.Now().Add(time.Duration(MAX_EXPIRATION_HOUR) * time.Hour)
-		c = NewBottle(c.ID(), c.Message().Text, &d)
+		nb = NewBottleWithMessage(c.ID(), c.Message(), &d)
+	}
+	if cc, ok := c.(Contextual); ok && cc.Context() != nil {
+		nb.SetContext(cc.Context())
 	}
+	c = nb
 
 	if cs.validation {
 		cs.idStorage.Update(c.ID(), *c.ExpiredAt())
 	}
+	cs.audit.Record(AuditEvent{ Type: AUDIT_DELIVERED, ID: c.ID() })
 
-	return c, nil
+	return c
 }
 
 func (cs *ContainerStorage) Add(c Container) error {
 	cs.mux.Lock()
 	defer cs.mux.Unlock()
 
+	ctx, span := StartSpan(ContextOf(c), "storage.add", SPAN_KIND_INTERNAL)
+	defer span.End()
+	span.SetMessage(c, "")
+	span.SetAttributes(F("binn.storage.validation", cs.validation))
+
+	logger := cs.logger.WithContext(ctx)
+	client := cs.audit.HashClient(identityOf(c))
 	if cs.validation {
 		if err := cs.idStorage.Use(c.ID()); err != nil {
+			logger.Debug("reject a container", F("id", c.ID()), F("error", err))
+			cs.audit.Record(AuditEvent{
+				Type:      AUDIT_REJECTED,
+				ID:        c.ID(),
+				Client:    client,
+				Reason:    err.Error(),
+				RequestID: RequestIDFrom(ctx),
+			})
+			span.AddEvent("reject", F("reason", err.Error()))
+			span.SetError(err)
 			return err
 		}
 	}
 
 	if len(cs.containers) >= MAX_CONTAINER_STORAGE_NUM_CONTAINER {
+		logger.Debug("evict a container", F("id", cs.containers[0].ID()))
+		span.AddEvent("evict", F("messaging.message_id", cs.containers[0].ID()))
+		cs.audit.Record(AuditEvent{ Type: AUDIT_EVICTED, ID: cs.containers[0].ID(), Reason: "storage is full" })
+		if cs.onEvict != nil {
+			cs.onEvict(cs.containers[0])
+		}
 		cs.containers = cs.containers[1:]
 	}
 
-	messageText := c.Message().Text
 	if len(c.Message().Text) > MAX_MESSAGE_TEXT_LENGTH {
-		messageText = c.Message().Text[:MAX_MESSAGE_TEXT_LENGTH]
+		span.AddEvent("truncate", F("length", len(c.Message().Text)))
 	}
+	message := c.Message().Stored(time.Now())
 
 	newID := GenerateID()
 	if cs.validation {
 		cs.idStorage.Add(newID, time.Now().Add(time.Duration(MAX_EXPIRATION_HOUR) * time.Hour))
 	}
 
-	c = NewBottle(newID, messageText, c.ExpiredAt())
+	logger.Debug("store a container", F("id", c.ID()), F("new_id", newID))
+	event := AUDIT_CREATED
+	if cs.audit.Known(c.ID()) {
+		event = AUDIT_RETURNED
+	}
+	cs.audit.Record(AuditEvent{
+		Type:      event,
+		ID:        c.ID(),
+		NewID:     newID,
+		Client:    client,
+		RequestID: RequestIDFrom(ctx),
+	})
+	span.SetAttributes(F("binn.message.new_id", newID))
+	nb := NewBottleWithMessage(newID, message, c.ExpiredAt())
+	// keep only the trace context so delivery joins the trace of the throw
+	if span != nil {
+		nb.SetContext(ContextWithSpanContext(context.Background(), span.SpanContext()))
+	}
+	c = nb
 	cs.containers = append(cs.containers, c)
 	
 	return nil
 }
 
+// Issue adds id to the issued ids, it does nothing without validation
+func (cs *ContainerStorage) Issue(id string, e time.Time) error {
+	if !cs.validation {
+		return nil
+	}
+	return cs.idStorage.Add(id, e)
+}
+
+func (cs *ContainerStorage) Ping() error {
+	cs.mux.Lock()
+	defer cs.mux.Unlock()
+	return nil
+}
+
+func (cs *ContainerStorage) Len() int {
+	cs.mux.Lock()
+	defer cs.mux.Unlock()
+	return len(cs.containers)
+}
+
+func (cs *ContainerStorage) List(offset int, limit int) []Container {
+	cs.mux.Lock()
+	defer cs.mux.Unlock()
+	return paginate(cs.containers, offset, limit)
+}
+
+func (cs *ContainerStorage) Find(id string) (Container, error) {
+	cs.mux.Lock()
+	defer cs.mux.Unlock()
+
+	if i := indexOf(cs.containers, id); i >= 0 {
+		return cs.containers[i], nil
+	}
+	return nil, fmt.Errorf("this container (%#v) is not in storage", id)
+}
+
+func (cs *ContainerStorage) Delete(id string) (Container, error) {
+	cs.mux.Lock()
+	defer cs.mux.Unlock()
+
+	i := indexOf(cs.containers, id)
+	if i < 0 {
+		return nil, fmt.Errorf("this container (%#v) is not in storage", id)
+	}
+	c := cs.containers[i]
+	cs.containers = append(cs.containers[:i:i], cs.containers[i+1:]...)
+
+	if cs.validation {
+		cs.idStorage.Revoke(id)
+	}
+	cs.audit.Record(AuditEvent{ Type: AUDIT_SUNK, ID: id, Reason: "deleted" })
+	if cs.onSink != nil {
+		cs.onSink(c, "deleted")
+	}
+
+	return c, nil
+}
+
+// Inject adds c like Add but without using its ID,
+// so operators can put a bottle into the ocean directly
+func (cs *ContainerStorage) Inject(c Container) (Container, error) {
+	cs.mux.Lock()
+	defer cs.mux.Unlock()
+
+	if len(cs.containers) >= MAX_CONTAINER_STORAGE_NUM_CONTAINER {
+		return nil, fmt.Errorf("this storage is full")
+	}
+
+	newID := GenerateID()
+	if cs.validation {
+		cs.idStorage.Add(newID, time.Now().Add(time.Duration(MAX_EXPIRATION_HOUR) * time.Hour))
+	}
+
+	c = NewBottleWithMessage(newID, c.Message().Stored(time.Now()), c.ExpiredAt())
+	cs.containers = append(cs.containers, c)
+	cs.audit.Record(AuditEvent{ Type: AUDIT_CREATED, NewID: newID, Reason: "injected" })
+
+	return c, nil
+}
+
+func (cs *ContainerStorage) Quarantine(id string) error {
+	cs.mux.Lock()
+	defer cs.mux.Unlock()
+
+	i := indexOf(cs.containers, id)
+	if i < 0 {
+		return fmt.Errorf("this container (%#v) is not in storage", id)
+	}
+	if len(cs.quarantine) >= MAX_CONTAINER_STORAGE_NUM_CONTAINER {
+		return fmt.Errorf("this storage has too many quarantined containers")
+	}
+	cs.quarantine = append(cs.quarantine, cs.containers[i])
+	cs.containers = append(cs.containers[:i:i], cs.containers[i+1:]...)
+
+	return nil
+}
+
+func (cs *ContainerStorage) Quarantined() []Container {
+	cs.mux.Lock()
+	defer cs.mux.Unlock()
+	return paginate(cs.quarantine, 0, len(cs.quarantine))
+}
+
+func (cs *ContainerStorage) Release(id string) error {
+	cs.mux.Lock()
+	defer cs.mux.Unlock()
+
+	i := indexOf(cs.quarantine, id)
+	if i < 0 {
+		return fmt.Errorf("this container (%#v) is not quarantined", id)
+	}
+	if len(cs.containers) >= MAX_CONTAINER_STORAGE_NUM_CONTAINER {
+		return fmt.Errorf("this storage is full")
+	}
+	cs.containers = append(cs.containers, cs.quarantine[i])
+	cs.quarantine = append(cs.quarantine[:i:i], cs.quarantine[i+1:]...)
+
+	return nil
+}
+
+// Sweep forgets issued ids which have expired, a bottle whose id
+// expires before it is thrown back has sunk
+func (cs *ContainerStorage) Sweep() int {
+	cs.mux.Lock()
+	defer cs.mux.Unlock()
+
+	if !cs.validation || cs.idStorage == nil {
+		return 0
+	}
+	// ids of bottles still in the ocean are stamped again on delivery
+	keep := map[string]bool{}
+	for _, c := range cs.containers {
+		keep[c.ID()] = true
+	}
+	for _, c := range cs.quarantine {
+		keep[c.ID()] = true
+	}
+	expired := cs.idStorage.Sweep(time.Now(), keep)
+	for _, id := range expired {
+		cs.audit.Record(AuditEvent{ Type: AUDIT_SUNK, ID: id.ID, Reason: "expired" })
+		if cs.onSink != nil {
+			expiredAt := id.ExpiredAt
+			cs.onSink(NewBottle(id.ID, "", &expiredAt), "expired")
+		}
+	}
+	return len(expired)
+}
+
+// Take removes up to n random containers which skip does not match,
+// their ids stay issued until they are Drifted or Requeued
+func (cs *ContainerStorage) Take(n int, skip func(c Container) bool) []Container {
+	cs.mux.Lock()
+	defer cs.mux.Unlock()
+
+	candidates := []int{}
+	for i, c := range cs.containers {
+		if !skip(c) {
+			candidates = append(candidates, i)
+		}
+	}
+	rand.Shuffle(len(candidates), func(i, j int) {
+		candidates[i], candidates[j] = candidates[j], candidates[i]
+	})
+	if len(candidates) > n {
+		candidates = candidates[:n]
+	}
+
+	taken := make(map[int]bool, len(candidates))
+	for _, i := range candidates {
+		taken[i] = true
+	}
+	took := []Container{}
+	kept := make([]Container, 0, len(cs.containers) - len(candidates))
+	for i, c := range cs.containers {
+		if taken[i] {
+			took = append(took, c)
+		} else {
+			kept = append(kept, c)
+		}
+	}
+	cs.containers = kept
+	return took
+}
+
+// Requeue puts containers taken by Take back to the head of the storage
+func (cs *ContainerStorage) Requeue(containers []Container) {
+	cs.mux.Lock()
+	defer cs.mux.Unlock()
+
+	cs.containers = append(append([]Container{}, containers...), cs.containers...)
+	if n := len(cs.containers) - MAX_CONTAINER_STORAGE_NUM_CONTAINER; n > 0 {
+		for _, c := range cs.containers[:n] {
+			cs.audit.Record(AuditEvent{ Type: AUDIT_EVICTED, ID: c.ID(), Reason: "storage is full" })
+			if cs.onEvict != nil {
+				cs.onEvict(c)
+			}
+		}
+		cs.containers = cs.containers[n:]
+	}
+}
+
+// Drifted forgets c taken by Take after it has left for peer
+func (cs *ContainerStorage) Drifted(c Container, peer string) {
+	cs.mux.Lock()
+	defer cs.mux.Unlock()
+
+	if cs.validation {
+		cs.idStorage.Revoke(c.ID())
+	}
+	cs.audit.Record(AuditEvent{ Type: AUDIT_DRIFTED, ID: c.ID(), Reason: peer })
+}
+
+func (cs *ContainerStorage) IDAdmin() IDAdmin {
+	if !cs.validation || cs.idStorage == nil {
+		return nil
+	}
+	return cs.idStorage
+}
+
+func (cs *ContainerStorage) Snapshot(w io.Writer) error {
+	cs.mux.Lock()
+	s := &Snapshot{
+		CreatedAt:   time.Now(),
+		Containers:  paginate(cs.containers, 0, len(cs.containers)),
+		Quarantined: paginate(cs.quarantine, 0, len(cs.quarantine)),
+		IDs:         []IssuedID{},
+	}
+	if cs.validation && cs.idStorage != nil {
+		s.IDs = cs.idStorage.List(0, cs.idStorage.Len())
+	}
+	cs.mux.Unlock()
+
+	return WriteSnapshot(w, s)
+}
+
+// Restore replaces every container and issued id with the snapshot
+// read from r, nothing is replaced if the snapshot is invalid
+func (cs *ContainerStorage) Restore(r io.Reader) error {
+	s, err := ReadSnapshot(r)
+	if err != nil {
+		return err
+	}
+	if len(s.Containers) > MAX_CONTAINER_STORAGE_NUM_CONTAINER ||
+		len(s.Quarantined) > MAX_CONTAINER_STORAGE_NUM_CONTAINER {
+		return fmt.Errorf("snapshot has too many containers")
+	}
+
+	cs.mux.Lock()
+	defer cs.mux.Unlock()
+
+	cs.containers = s.Containers
+	cs.quarantine = s.Quarantined
+	if cs.validation && cs.idStorage != nil {
+		cs.idStorage.Replace(s.IDs)
+	}
+
+	return nil
+}
+
+func indexOf(containers []Container, id string) int {
+	for i, c := range containers {
+		if c.ID() == id {
+			return i
+		}
+	}
+	return -1
+}
+
+func paginate(containers []Container, offset int, limit int) []Container {
+	if offset < 0 || offset >= len(containers) || limit <= 0 {
+		return []Container{}
+	}
+	end := offset + limit
+	if end > len(containers) {
+		end = len(containers)
+	}
+	page := make([]Container, end - offset)
+	copy(page, containers[offset:end])
+	return page
+}
+
 func (s *IDStorage) Add(id string, e time.Time) error {
 	s.mux.Lock()
 	defer s.mux.Unlock()
@@ -148,6 +567,78 @@ func (s *IDStorage) Update(id string, e time.Time) error {
 	return nil
 }
 
+func (s *IDStorage) Len() int {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	return len(s.ids)
+}
+
+func (s *IDStorage) List(offset int, limit int) []IssuedID {
+	s.mux.Lock()
+	ids := make([]IssuedID, 0, len(s.ids))
+	for id, e := range s.ids {
+		ids = append(ids, IssuedID{ ID: id, ExpiredAt: e })
+	}
+	s.mux.Unlock()
+
+	sort.Slice(ids, func(i, j int) bool {
+		if ids[i].ExpiredAt.Equal(ids[j].ExpiredAt) {
+			return ids[i].ID < ids[j].ID
+		}
+		return ids[i].ExpiredAt.Before(ids[j].ExpiredAt)
+	})
+
+	if offset < 0 || offset >= len(ids) || limit <= 0 {
+		return []IssuedID{}
+	}
+	end := offset + limit
+	if end > len(ids) {
+		end = len(ids)
+	}
+	return ids[offset:end]
+}
+
+func (s *IDStorage) Revoke(id string) error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	if _, ok := s.ids[id]; !ok {
+		return fmt.Errorf("this id (%#v) is not in storage", id)
+	}
+	delete(s.ids, id)
+
+	return nil
+}
+
+// Sweep removes and returns the ids expired at now except ids in keep
+func (s *IDStorage) Sweep(now time.Time, keep map[string]bool) []IssuedID {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	expired := []IssuedID{}
+	for id, e := range s.ids {
+		if now.After(e) && !keep[id] {
+			expired = append(expired, IssuedID{ ID: id, ExpiredAt: e })
+			delete(s.ids, id)
+		}
+	}
+	sort.Slice(expired, func(i, j int) bool {
+		return expired[i].ExpiredAt.Before(expired[j].ExpiredAt)
+	})
+	return expired
+}
+
+func (s *IDStorage) Replace(ids []IssuedID) {
+	m := make(map[string]time.Time, len(ids))
+	for _, id := range ids {
+		m[id.ID] = id.ExpiredAt
+	}
+
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.ids = m
+}
+
 func GenerateID() string {
 	uuidObj, _ := uuid.NewUUID()
 	return uuidObj.String()
@@ -180,3 +180,90 @@ et ultrices posuere cubilia curae;`
 func TestGenerateID(t *testing.T) {
 	_ = GenerateID()
 }
+
+func TestListContainersFromStorage(t *testing.T) {
+	containerStorage := NewContainerStorage(false, 0, nil)
+	for i := 0; i < 5; i++ {
+		_ = containerStorage.Add(NewBottle("", fmt.Sprintf("%d", i), nil))
+	}
+
+	page := containerStorage.List(1, 2)
+
+	assert.Equal(t, 5, containerStorage.Len())
+	assert.Equal(t, 2, len(page))
+	assert.Equal(t, "1", page[0].Message().Text)
+	assert.Equal(t, "2", page[1].Message().Text)
+	assert.Empty(t, containerStorage.List(5, 2))
+}
+
+func TestFindAndDeleteContainerFromStorage(t *testing.T) {
+	idStorage := DefaultIDStorage()
+	containerStorage := NewContainerStorage(true, 0, idStorage)
+	c, _ := containerStorage.Inject(NewBottle("", "This is a Test Message", nil))
+
+	found, err := containerStorage.Find(c.ID())
+	assert.Nil(t, err)
+	assert.Equal(t, "This is a Test Message", found.Message().Text)
+
+	_, err = containerStorage.Delete(c.ID())
+	assert.Nil(t, err)
+	assert.Equal(t, 0, containerStorage.Len())
+
+	err = idStorage.Use(c.ID())
+	assert.Error(t, err)
+
+	_, err = containerStorage.Find(c.ID())
+	assert.Error(t, err)
+}
+
+func TestQuarantineContainerInStorage(t *testing.T) {
+	containerStorage := NewContainerStorage(false, 0, nil)
+	c, _ := containerStorage.Inject(NewBottle("", "This is a Test Message", nil))
+
+	err := containerStorage.Quarantine(c.ID())
+	assert.Nil(t, err)
+
+	_, err = containerStorage.Get()
+	assert.EqualError(t, err, "this storage has no containers")
+	assert.Equal(t, 1, len(containerStorage.Quarantined()))
+
+	err = containerStorage.Release(c.ID())
+	assert.Nil(t, err)
+
+	bottle, _ := containerStorage.Get()
+	assert.Equal(t, "This is a Test Message", bottle.Message().Text)
+}
+
+func TestListAndRevokeID(t *testing.T) {
+	idStorage := DefaultIDStorage()
+	_ = idStorage.Add("b", time.Now().Add(time.Duration(2)*time.Minute))
+	_ = idStorage.Add("a", time.Now().Add(time.Duration(1)*time.Minute))
+
+	ids := idStorage.List(0, 10)
+	assert.Equal(t, 2, len(ids))
+	assert.Equal(t, "a", ids[0].ID)
+
+	err := idStorage.Revoke("a")
+	assert.Nil(t, err)
+	assert.Equal(t, 1, idStorage.Len())
+	assert.Error(t, idStorage.Revoke("a"))
+}
+
+func TestSweepExpiredIDs(t *testing.T) {
+	audit := DefaultAuditLog()
+	idStorage := DefaultIDStorage()
+	storage := NewContainerStorage(true, time.Duration(10) * time.Minute, idStorage)
+	storage.SetAuditLog(audit)
+
+	idStorage.Add("1", time.Now().Add(time.Minute))
+	assert.Nil(t, storage.Add(NewBottle("1", "", nil)))
+	c := storage.List(0, 1)[0]
+	idStorage.Add("2", time.Now().Add(-time.Minute))
+	idStorage.Update(c.ID(), time.Now().Add(-time.Minute))
+
+	// the id of a stored bottle is kept until it is delivered
+	assert.Equal(t, 1, storage.Sweep())
+	assert.Equal(t, 1, idStorage.Len())
+	assert.Equal(t, AUDIT_SUNK, audit.Lineage("2")[0].Type)
+	assert.Equal(t, "expired", audit.Lineage("2")[0].Reason)
+}
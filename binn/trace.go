@@ -0,0 +1,195 @@
+package binn
+
+import (
+	"fmt"
+	"context"
+	"net/http"
+
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/attribute"
+	semconv "go.opentelemetry.io/otel/semconv/v1.12.0"
+)
+
+type SpanKind = trace.SpanKind
+
+const (
+	SPAN_KIND_INTERNAL = trace.SpanKindInternal
+	SPAN_KIND_SERVER   = trace.SpanKindServer
+	SPAN_KIND_CLIENT   = trace.SpanKindClient
+	SPAN_KIND_PRODUCER = trace.SpanKindProducer
+	SPAN_KIND_CONSUMER = trace.SpanKindConsumer
+)
+
+const (
+	INSTRUMENTATION_SCOPE = "github.com/binn/binn"
+	// a bottle is a message of the messaging semantic conventions,
+	// the ocean is the queue it passes through
+	MESSAGING_SYSTEM = "binn"
+	MESSAGING_DESTINATION = "ocean"
+)
+
+const tracerContextKey = contextKey("tracer")
+
+// Tracer starts OpenTelemetry spans of the instrumentation scope of binn
+type Tracer struct {
+	tracer trace.Tracer
+}
+
+// Span is a unit of traced work, every method is safe on a nil span
+// so code can trace unconditionally when no tracer is configured
+type Span struct {
+	span trace.Span
+}
+
+func NewTracer(tp trace.TracerProvider) *Tracer {
+	return &Tracer{
+		tracer: tp.Tracer(INSTRUMENTATION_SCOPE),
+	}
+}
+
+// Start begins a span which is a child of the span or the remote
+// span context of ctx, a nil tracer starts nothing
+func (t *Tracer) Start(ctx context.Context, name string, kind SpanKind) (context.Context, *Span) {
+	if t == nil {
+		return ctx, nil
+	}
+	ctx, s := t.tracer.Start(ctx, name, trace.WithSpanKind(kind))
+	return WithTracer(ctx, t), &Span{ span: s }
+}
+
+// StartSpan starts a span with the tracer of ctx
+func StartSpan(ctx context.Context, name string, kind SpanKind) (context.Context, *Span) {
+	return TracerFrom(ctx).Start(ctx, name, kind)
+}
+
+func attributesOf(fields []Field) []attribute.KeyValue {
+	kvs := make([]attribute.KeyValue, 0, len(fields))
+	for _, f := range fields {
+		switch v := f.Value.(type) {
+		case bool:
+			kvs = append(kvs, attribute.Bool(f.Key, v))
+		case int:
+			kvs = append(kvs, attribute.Int(f.Key, v))
+		case int64:
+			kvs = append(kvs, attribute.Int64(f.Key, v))
+		case float64:
+			kvs = append(kvs, attribute.Float64(f.Key, v))
+		case string:
+			kvs = append(kvs, attribute.String(f.Key, v))
+		default:
+			kvs = append(kvs, attribute.String(f.Key, fmt.Sprint(v)))
+		}
+	}
+	return kvs
+}
+
+func (s *Span) SpanContext() trace.SpanContext {
+	if s == nil {
+		return trace.SpanContext{}
+	}
+	return s.span.SpanContext()
+}
+
+func (s *Span) SetAttributes(fields ...Field) {
+	if s == nil {
+		return
+	}
+	s.span.SetAttributes(attributesOf(fields)...)
+}
+
+// SetMessage records c with the messaging semantic conventions
+func (s *Span) SetMessage(c Container, operation string) {
+	if s == nil {
+		return
+	}
+	kvs := []attribute.KeyValue{
+		semconv.MessagingSystemKey.String(MESSAGING_SYSTEM),
+		semconv.MessagingDestinationKey.String(MESSAGING_DESTINATION),
+		semconv.MessagingDestinationKindQueue,
+		semconv.MessagingMessageIDKey.String(c.ID()),
+		semconv.MessagingMessagePayloadSizeBytesKey.Int(len(c.Message().Text)),
+	}
+	if operation != "" {
+		kvs = append(kvs, semconv.MessagingOperationKey.String(operation))
+	}
+	s.span.SetAttributes(kvs...)
+}
+
+// SetHTTPRequest records r with the http semantic conventions,
+// route is the pattern r was routed by
+func (s *Span) SetHTTPRequest(r *http.Request, route string) {
+	if s == nil {
+		return
+	}
+	s.span.SetAttributes(semconv.HTTPServerAttributesFromHTTPRequest("", route, r)...)
+}
+
+// SetHTTPStatus records the status of the response, a server error fails the span
+func (s *Span) SetHTTPStatus(status int) {
+	if s == nil {
+		return
+	}
+	s.span.SetAttributes(semconv.HTTPAttributesFromHTTPStatusCode(status)...)
+	if status >= 500 {
+		s.span.SetStatus(codes.Error, http.StatusText(status))
+	}
+}
+
+func (s *Span) AddEvent(name string, fields ...Field) {
+	if s == nil {
+		return
+	}
+	s.span.AddEvent(name, trace.WithAttributes(attributesOf(fields)...))
+}
+
+func (s *Span) SetError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.span.RecordError(err)
+	s.span.SetStatus(codes.Error, err.Error())
+}
+
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+	s.span.End()
+}
+
+// SpanFrom returns the recording span of ctx, nil when there is none
+func SpanFrom(ctx context.Context) *Span {
+	s := trace.SpanFromContext(ctx)
+	if !s.IsRecording() {
+		return nil
+	}
+	return &Span{ span: s }
+}
+
+// SpanContextFrom returns the span context of the span of ctx
+// or the span context put by ContextWithSpanContext
+func SpanContextFrom(ctx context.Context) trace.SpanContext {
+	return trace.SpanContextFromContext(ctx)
+}
+
+// ContextWithSpanContext puts a span context kept on a stored container
+// as the parent of new spans
+func ContextWithSpanContext(ctx context.Context, sc trace.SpanContext) context.Context {
+	if !sc.IsValid() {
+		return ctx
+	}
+	return trace.ContextWithSpanContext(ctx, sc)
+}
+
+func WithTracer(ctx context.Context, t *Tracer) context.Context {
+	if t == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, tracerContextKey, t)
+}
+
+func TracerFrom(ctx context.Context) *Tracer {
+	t, _ := ctx.Value(tracerContextKey).(*Tracer)
+	return t
+}
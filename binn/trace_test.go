@@ -0,0 +1,102 @@
+package binn
+
+import (
+	"time"
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func newTestTracer() (*Tracer, *tracetest.SpanRecorder) {
+	recorder := tracetest.NewSpanRecorder()
+	return NewTracer(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))), recorder
+}
+
+func TestTracerStartsChildSpans(t *testing.T) {
+	tracer, recorder := newTestTracer()
+
+	ctx, root := tracer.Start(context.Background(), "root", SPAN_KIND_SERVER)
+	_, child := StartSpan(ctx, "child", SPAN_KIND_INTERNAL)
+	child.AddEvent("evict", F("messaging.message_id", "1"))
+	child.End()
+	root.End()
+	root.End()
+
+	spans := recorder.Ended()
+	assert.Equal(t, 2, len(spans))
+	assert.Equal(t, "child", spans[0].Name())
+	assert.Equal(t, root.SpanContext().TraceID(), spans[0].SpanContext().TraceID())
+	assert.Equal(t, root.SpanContext().SpanID(), spans[0].Parent().SpanID())
+	assert.Equal(t, "evict", spans[0].Events()[0].Name)
+	assert.Equal(t, INSTRUMENTATION_SCOPE, spans[0].InstrumentationLibrary().Name)
+	assert.False(t, spans[1].Parent().IsValid())
+}
+
+func TestNilTracerIsNoop(t *testing.T) {
+	ctx, span := StartSpan(context.Background(), "noop", SPAN_KIND_INTERNAL)
+	assert.Nil(t, span)
+	assert.Equal(t, context.Background(), ctx)
+	assert.Nil(t, SpanFrom(ctx))
+
+	span.SetAttributes(F("key", "value"))
+	span.SetMessage(NewBottle("1", "Hello", nil), "")
+	span.SetError(assert.AnError)
+	span.End()
+}
+
+func TestSpanFollowsMessagingConventions(t *testing.T) {
+	tracer, recorder := newTestTracer()
+	_, span := tracer.Start(context.Background(), "engine.receive", SPAN_KIND_CONSUMER)
+	span.SetMessage(NewBottle("1", "Hello", nil), "process")
+	span.End()
+
+	attributes := map[string]interface{}{}
+	for _, kv := range recorder.Ended()[0].Attributes() {
+		attributes[string(kv.Key)] = kv.Value.AsInterface()
+	}
+	assert.Equal(t, MESSAGING_SYSTEM, attributes["messaging.system"])
+	assert.Equal(t, MESSAGING_DESTINATION, attributes["messaging.destination"])
+	assert.Equal(t, "1", attributes["messaging.message_id"])
+	assert.Equal(t, "process", attributes["messaging.operation"])
+	assert.Equal(t, int64(5), attributes["messaging.message_payload_size_bytes"])
+}
+
+func TestStorageAddSpanRecordsRejection(t *testing.T) {
+	tracer, recorder := newTestTracer()
+	ctx, span := tracer.Start(context.Background(), "bottle.throw", SPAN_KIND_SERVER)
+
+	storage := NewContainerStorage(true, time.Duration(10) * time.Minute, DefaultIDStorage())
+	b := NewBottle("1", "Hello", nil)
+	b.SetContext(ctx)
+	assert.NotNil(t, storage.Add(b))
+	span.End()
+
+	spans := recorder.Ended()
+	assert.Equal(t, "storage.add", spans[0].Name())
+	assert.Equal(t, codes.Error, spans[0].Status().Code)
+	assert.Equal(t, "reject", spans[0].Events()[0].Name)
+	assert.Equal(t, span.SpanContext().SpanID(), spans[0].Parent().SpanID())
+}
+
+func TestEngineTracesWithConfigTracer(t *testing.T) {
+	tracer, recorder := newTestTracer()
+	cfg := DefaultConfig()
+	cfg.SetTracer(tracer)
+	engine := NewEngine(cfg, NewContainerStorage(false, 0, nil))
+
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	engine.Run(ctx)
+	defer cancelFunc()
+
+	// a container thrown without a tracer is traced like its delivery
+	assert.Nil(t, engine.Submit(context.Background(), NewBottle("1", "Hello", nil)))
+	names := []string{}
+	for _, s := range recorder.Ended() {
+		names = append(names, s.Name())
+	}
+	assert.Equal(t, []string{ "storage.add", "engine.receive" }, names)
+}
@@ -0,0 +1,425 @@
+package binn
+
+import (
+	"fmt"
+	"sync"
+	"time"
+	"bytes"
+	"context"
+	"strconv"
+	"strings"
+	"net/http"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+)
+
+type WebhookEvent string
+
+const (
+	WEBHOOK_THROWN    WebhookEvent = "bottle.thrown"
+	WEBHOOK_DELIVERED WebhookEvent = "bottle.delivered"
+	WEBHOOK_SUNK      WebhookEvent = "bottle.sunk"
+)
+
+const (
+	DEFAULT_WEBHOOK_MAX_ATTEMPTS = 5
+	DEFAULT_WEBHOOK_BACKOFF = time.Second
+	DEFAULT_WEBHOOK_MAX_BACKOFF = time.Minute
+	DEFAULT_WEBHOOK_WORKERS = 4
+	DEFAULT_WEBHOOK_QUEUE_SIZE = 1024
+	DEFAULT_DEAD_LETTER_SIZE = 1000
+	WEBHOOK_SIGNATURE_HEADER = "X-Binn-Signature"
+	WEBHOOK_TIMESTAMP_HEADER = "X-Binn-Timestamp"
+	WEBHOOK_EVENT_HEADER = "X-Binn-Event"
+	WEBHOOK_DELIVERY_HEADER = "X-Binn-Delivery"
+)
+
+var ErrWebhookQueueFull = fmt.Errorf("this webhook queue is full")
+
+var webhookEvents = map[EventType]WebhookEvent{
+	EVENT_ACCEPTED:  WEBHOOK_THROWN,
+	EVENT_DELIVERED: WEBHOOK_DELIVERED,
+	EVENT_SUNK:      WEBHOOK_SUNK,
+}
+
+type WebhookSubscription struct {
+	URL    string
+	Secret string
+	Events []WebhookEvent
+}
+
+func (s *WebhookSubscription) subscribes(ev WebhookEvent) bool {
+	if len(s.Events) == 0 {
+		return true
+	}
+	for _, e := range s.Events {
+		if e == ev {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseWebhookSubscriptions parses "url;secret;event|event" items,
+// events are thrown, delivered and sunk and all of them when omitted
+func ParseWebhookSubscriptions(items []string) ([]*WebhookSubscription, error) {
+	subs := []*WebhookSubscription{}
+	for _, item := range items {
+		parts := strings.Split(item, ";")
+		if len(parts) < 2 || len(parts) > 3 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("this webhook (%#v) is invalid format", item)
+		}
+		sub := &WebhookSubscription{ URL: parts[0], Secret: parts[1], Events: []WebhookEvent{} }
+		if len(parts) == 3 && parts[2] != "" {
+			for _, name := range strings.Split(parts[2], "|") {
+				ev := WebhookEvent("bottle." + name)
+				switch ev {
+				case WEBHOOK_THROWN, WEBHOOK_DELIVERED, WEBHOOK_SUNK:
+				default:
+					return nil, fmt.Errorf("this webhook event (%#v) is unknown", name)
+				}
+				sub.Events = append(sub.Events, ev)
+			}
+		}
+		subs = append(subs, sub)
+	}
+	return subs, nil
+}
+
+type WebhookBottle struct {
+	ID        string     `json:"id"`
+	Text      string     `json:"text"`
+	ExpiredAt *time.Time `json:"expired_at,omitempty"`
+	CreatedAt *time.Time `json:"created_at,omitempty"`
+	Language  string     `json:"language,omitempty"`
+	Tags      []string   `json:"tags,omitempty"`
+	Hops      int        `json:"hops,omitempty"`
+}
+
+type WebhookPayload struct {
+	ID     string         `json:"id"`
+	Event  WebhookEvent   `json:"event"`
+	Time   time.Time      `json:"time"`
+	Bottle *WebhookBottle `json:"bottle"`
+	Reason string         `json:"reason,omitempty"`
+}
+
+// DeadLetter is a payload which could not be delivered to URL
+type DeadLetter struct {
+	Payload  *WebhookPayload
+	URL      string
+	Attempts int
+	Error    string
+	FailedAt time.Time
+}
+
+type DeadLetterStore interface {
+	Put(d *DeadLetter) error
+	List() []*DeadLetter
+	Take(id string) (*DeadLetter, error)
+}
+
+// MemoryDeadLetterStore keeps the latest dead letters up to its size
+type MemoryDeadLetterStore struct {
+	letters []*DeadLetter
+	size    int
+	mux     *sync.Mutex
+}
+
+func NewMemoryDeadLetterStore(size int) *MemoryDeadLetterStore {
+	return &MemoryDeadLetterStore{
+		letters: []*DeadLetter{},
+		size:    size,
+		mux:     &sync.Mutex{},
+	}
+}
+
+func (s *MemoryDeadLetterStore) Put(d *DeadLetter) error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.letters = append(s.letters, d)
+	if len(s.letters) > s.size {
+		s.letters = s.letters[len(s.letters) - s.size:]
+	}
+	return nil
+}
+
+func (s *MemoryDeadLetterStore) List() []*DeadLetter {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	return append([]*DeadLetter{}, s.letters...)
+}
+
+func (s *MemoryDeadLetterStore) Take(id string) (*DeadLetter, error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	for i, d := range s.letters {
+		if d.Payload.ID == id {
+			s.letters = append(s.letters[:i:i], s.letters[i+1:]...)
+			return d, nil
+		}
+	}
+	return nil, fmt.Errorf("this dead letter (%#v) is not in store", id)
+}
+
+// SignWebhook returns the signature of body sent at timestamp
+func SignWebhook(secret string, timestamp string, body []byte) string {
+	h := hmac.New(sha256.New, []byte(secret))
+	h.Write([]byte(timestamp))
+	h.Write([]byte("."))
+	h.Write(body)
+	return "sha256=" + hex.EncodeToString(h.Sum(nil))
+}
+
+// VerifyWebhook checks a signature made by SignWebhook,
+// receivers should also reject stale timestamps
+func VerifyWebhook(secret string, timestamp string, body []byte, signature string) bool {
+	return hmac.Equal([]byte(SignWebhook(secret, timestamp, body)), []byte(signature))
+}
+
+type webhookDelivery struct {
+	sub     *WebhookSubscription
+	payload *WebhookPayload
+}
+
+// Webhooks posts signed payloads of engine events to subscriptions,
+// retrying with exponential backoff before giving up to the dead letters
+type Webhooks struct {
+	subs        []*WebhookSubscription
+	client      *http.Client
+	queue       chan *webhookDelivery
+	workers     int
+	maxAttempts int
+	backoff     time.Duration
+	maxBackoff  time.Duration
+	deadLetters DeadLetterStore
+	dropped     uint64
+	logger      *Logger
+	mux         *sync.RWMutex
+	// serializes redeliveries so a letter is not queued twice
+	redeliverMux *sync.Mutex
+}
+
+func NewWebhooks(subs []*WebhookSubscription) *Webhooks {
+	return &Webhooks{
+		subs:        subs,
+		client:      &http.Client{ Timeout: 10 * time.Second },
+		queue:       make(chan *webhookDelivery, DEFAULT_WEBHOOK_QUEUE_SIZE),
+		workers:     DEFAULT_WEBHOOK_WORKERS,
+		maxAttempts: DEFAULT_WEBHOOK_MAX_ATTEMPTS,
+		backoff:     DEFAULT_WEBHOOK_BACKOFF,
+		maxBackoff:  DEFAULT_WEBHOOK_MAX_BACKOFF,
+		deadLetters: NewMemoryDeadLetterStore(DEFAULT_DEAD_LETTER_SIZE),
+		logger:      DefaultLogger(),
+		mux:         &sync.RWMutex{},
+		redeliverMux: &sync.Mutex{},
+	}
+}
+
+func (w *Webhooks) SetRetry(maxAttempts int, backoff time.Duration, maxBackoff time.Duration) {
+	w.mux.Lock()
+	defer w.mux.Unlock()
+	w.maxAttempts = maxAttempts
+	w.backoff = backoff
+	w.maxBackoff = maxBackoff
+}
+
+func (w *Webhooks) SetDeadLetterStore(s DeadLetterStore) {
+	w.mux.Lock()
+	defer w.mux.Unlock()
+	w.deadLetters = s
+}
+
+func (w *Webhooks) DeadLetters() DeadLetterStore {
+	w.mux.RLock()
+	defer w.mux.RUnlock()
+	return w.deadLetters
+}
+
+func (w *Webhooks) SetLogger(l *Logger) {
+	w.mux.Lock()
+	defer w.mux.Unlock()
+	w.logger = l
+}
+
+func (w *Webhooks) Subscriptions() []*WebhookSubscription {
+	w.mux.RLock()
+	defer w.mux.RUnlock()
+	return append([]*WebhookSubscription{}, w.subs...)
+}
+
+// Dropped returns the number of deliveries dropped because the queue was full
+func (w *Webhooks) Dropped() uint64 {
+	w.mux.RLock()
+	defer w.mux.RUnlock()
+	return w.dropped
+}
+
+// Register subscribes w to the events of h
+func (w *Webhooks) Register(h *Hooks) {
+	for typ, ev := range webhookEvents {
+		ev := ev
+		h.On(typ, func(e Event) {
+			w.Notify(ev, e.Container, e.Reason, e.Time)
+		})
+	}
+}
+
+// Notify queues a payload of c for every subscription of ev
+func (w *Webhooks) Notify(ev WebhookEvent, c Container, reason string, t time.Time) {
+	payload := &WebhookPayload{
+		ID:     GenerateID(),
+		Event:  ev,
+		Time:   t,
+		Bottle: &WebhookBottle{
+			ID:        c.ID(),
+			Text:      c.Message().Text,
+			ExpiredAt: c.ExpiredAt(),
+			CreatedAt: c.Message().CreatedAt,
+			Language:  c.Message().Language,
+			Tags:      c.Message().Tags,
+			Hops:      c.Message().Hops,
+		},
+		Reason: reason,
+	}
+	for _, sub := range w.Subscriptions() {
+		if sub.subscribes(ev) {
+			w.enqueue(&webhookDelivery{ sub: sub, payload: payload })
+		}
+	}
+}
+
+func (w *Webhooks) enqueue(d *webhookDelivery) bool {
+	select {
+	case w.queue <- d:
+		return true
+	default:
+		w.mux.Lock()
+		w.dropped++
+		w.mux.Unlock()
+		return false
+	}
+}
+
+// Redeliver queues a dead letter again, the letter stays in the store
+// until it is queued so a full queue does not lose it
+func (w *Webhooks) Redeliver(id string) error {
+	w.redeliverMux.Lock()
+	defer w.redeliverMux.Unlock()
+
+	var d *DeadLetter
+	for _, letter := range w.DeadLetters().List() {
+		if letter.Payload.ID == id {
+			d = letter
+			break
+		}
+	}
+	if d == nil {
+		return fmt.Errorf("this dead letter (%#v) is not in store", id)
+	}
+	for _, sub := range w.Subscriptions() {
+		if sub.URL == d.URL {
+			if !w.enqueue(&webhookDelivery{ sub: sub, payload: d.Payload }) {
+				return ErrWebhookQueueFull
+			}
+			_, err := w.DeadLetters().Take(id)
+			return err
+		}
+	}
+	return fmt.Errorf("this webhook (%#v) is not subscribed", d.URL)
+}
+
+// Run delivers queued payloads with workers until ctx is done
+func (w *Webhooks) Run(ctx context.Context) {
+	for i := 0; i < w.workers; i++ {
+		go func() {
+			for {
+				select {
+				case <- ctx.Done():
+					return
+				case d := <- w.queue:
+					w.deliver(ctx, d)
+				}
+			}
+		}()
+	}
+}
+
+func (w *Webhooks) deliver(ctx context.Context, d *webhookDelivery) {
+	w.mux.RLock()
+	maxAttempts, backoff, maxBackoff, logger := w.maxAttempts, w.backoff, w.maxBackoff, w.logger
+	w.mux.RUnlock()
+
+	var err error
+	attempts := 0
+	for attempts < maxAttempts {
+		attempts++
+		if err = w.send(ctx, d); err == nil {
+			return
+		}
+		if attempts == maxAttempts {
+			break
+		}
+
+		logger.Debug("retry a webhook",
+			F("url", d.sub.URL),
+			F("delivery", d.payload.ID),
+			F("attempt", attempts),
+			F("backoff", backoff),
+			F("error", err),
+		)
+		select {
+		case <- ctx.Done():
+			attempts = maxAttempts
+		case <- time.After(backoff):
+		}
+		backoff *= 2
+		if backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+
+	logger.Warn("give up a webhook",
+		F("url", d.sub.URL),
+		F("delivery", d.payload.ID),
+		F("attempts", attempts),
+		F("error", err),
+	)
+	w.DeadLetters().Put(&DeadLetter{
+		Payload:  d.payload,
+		URL:      d.sub.URL,
+		Attempts: attempts,
+		Error:    err.Error(),
+		FailedAt: time.Now(),
+	})
+}
+
+func (w *Webhooks) send(ctx context.Context, d *webhookDelivery) error {
+	body, err := json.Marshal(d.payload)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, d.sub.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(WEBHOOK_TIMESTAMP_HEADER, timestamp)
+	req.Header.Set(WEBHOOK_SIGNATURE_HEADER, SignWebhook(d.sub.Secret, timestamp, body))
+	req.Header.Set(WEBHOOK_EVENT_HEADER, string(d.payload.Event))
+	req.Header.Set(WEBHOOK_DELIVERY_HEADER, d.payload.ID)
+
+	res, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode / 100 != 2 {
+		return fmt.Errorf("this webhook (%#v) responded status %d", d.sub.URL, res.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,163 @@
+package binn
+
+import (
+	"io"
+	"time"
+	"context"
+	"testing"
+	"net/http"
+	"sync/atomic"
+	"encoding/json"
+	"net/http/httptest"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type webhookStandIn struct {
+	server   *httptest.Server
+	payloads chan *WebhookPayload
+	calls    int32
+}
+
+// newWebhookStandIn answers failures times with 500 before accepting payloads
+func newWebhookStandIn(t *testing.T, secret string, failures int32) *webhookStandIn {
+	s := &webhookStandIn{ payloads: make(chan *WebhookPayload, 16) }
+	s.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&s.calls, 1) <= failures {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		body, _ := io.ReadAll(r.Body)
+		if !VerifyWebhook(secret, r.Header.Get(WEBHOOK_TIMESTAMP_HEADER), body, r.Header.Get(WEBHOOK_SIGNATURE_HEADER)) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		var p WebhookPayload
+		assert.Nil(t, json.Unmarshal(body, &p))
+		assert.Equal(t, string(p.Event), r.Header.Get(WEBHOOK_EVENT_HEADER))
+		assert.Equal(t, p.ID, r.Header.Get(WEBHOOK_DELIVERY_HEADER))
+		s.payloads <- &p
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	return s
+}
+
+func (s *webhookStandIn) wait(t *testing.T) *WebhookPayload {
+	select {
+	case p := <- s.payloads:
+		return p
+	case <- time.After(time.Second):
+		assert.Fail(t, "no webhook")
+		return nil
+	}
+}
+
+func TestWebhookIsSentOnThrow(t *testing.T) {
+	standIn := newWebhookStandIn(t, "secret", 0)
+	defer standIn.server.Close()
+
+	storage := NewContainerStorage(false, 0, nil)
+	engine := NewEngine(DefaultConfig(), storage)
+	webhooks := NewWebhooks([]*WebhookSubscription{
+		{ URL: standIn.server.URL, Secret: "secret", Events: []WebhookEvent{ WEBHOOK_THROWN } },
+	})
+	webhooks.Register(engine.GetHooks())
+
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	defer cancelFunc()
+	webhooks.Run(ctx)
+	engine.Run(ctx)
+
+	engine.GetInChan() <- NewBottle("1", "Hello", nil)
+	p := standIn.wait(t)
+	assert.Equal(t, WEBHOOK_THROWN, p.Event)
+	assert.Equal(t, "1", p.Bottle.ID)
+	assert.Equal(t, "Hello", p.Bottle.Text)
+
+	storage.Delete(storage.List(0, 1)[0].ID())
+	select {
+	case <- standIn.payloads:
+		assert.Fail(t, "unsubscribed event is sent")
+	case <- time.After(time.Duration(50) * time.Millisecond):
+	}
+}
+
+func TestWebhookRetriesWithBackoff(t *testing.T) {
+	standIn := newWebhookStandIn(t, "secret", 2)
+	defer standIn.server.Close()
+
+	webhooks := NewWebhooks([]*WebhookSubscription{ { URL: standIn.server.URL, Secret: "secret" } })
+	webhooks.SetRetry(3, time.Millisecond, time.Duration(2) * time.Millisecond)
+
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	defer cancelFunc()
+	webhooks.Run(ctx)
+
+	webhooks.Notify(WEBHOOK_SUNK, NewBottle("1", "", nil), "expired", time.Now())
+	p := standIn.wait(t)
+	assert.Equal(t, "expired", p.Reason)
+	assert.Equal(t, int32(3), atomic.LoadInt32(&standIn.calls))
+	assert.Equal(t, 0, len(webhooks.DeadLetters().List()))
+}
+
+func TestWebhookGivesUpToDeadLetters(t *testing.T) {
+	standIn := newWebhookStandIn(t, "other", 0)
+	defer standIn.server.Close()
+
+	webhooks := NewWebhooks([]*WebhookSubscription{ { URL: standIn.server.URL, Secret: "secret" } })
+	webhooks.SetRetry(2, time.Millisecond, time.Millisecond)
+
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	defer cancelFunc()
+	webhooks.Run(ctx)
+
+	webhooks.Notify(WEBHOOK_DELIVERED, NewBottle("1", "", nil), "", time.Now())
+	for i := 0; i < 100 && len(webhooks.DeadLetters().List()) == 0; i++ {
+		time.Sleep(time.Duration(1) * time.Millisecond)
+	}
+
+	letters := webhooks.DeadLetters().List()
+	if assert.Equal(t, 1, len(letters)) {
+		assert.Equal(t, 2, letters[0].Attempts)
+		assert.Equal(t, standIn.server.URL, letters[0].URL)
+		assert.Contains(t, letters[0].Error, "401")
+
+		assert.Nil(t, webhooks.Redeliver(letters[0].Payload.ID))
+		assert.NotNil(t, webhooks.Redeliver(letters[0].Payload.ID))
+	}
+}
+
+func TestRedeliverKeepsDeadLetterWhenQueueIsFull(t *testing.T) {
+	url := "https://example.com/hook"
+	webhooks := NewWebhooks([]*WebhookSubscription{ { URL: url, Secret: "secret" } })
+	webhooks.queue = make(chan *webhookDelivery, 1)
+	webhooks.queue <- &webhookDelivery{}
+
+	payload := &WebhookPayload{ ID: "1", Event: WEBHOOK_SUNK }
+	webhooks.DeadLetters().Put(&DeadLetter{ Payload: payload, URL: url })
+
+	assert.Equal(t, ErrWebhookQueueFull, webhooks.Redeliver("1"))
+	assert.Equal(t, 1, len(webhooks.DeadLetters().List()))
+
+	<- webhooks.queue
+	assert.Nil(t, webhooks.Redeliver("1"))
+	assert.Equal(t, 0, len(webhooks.DeadLetters().List()))
+	assert.Equal(t, payload, (<- webhooks.queue).payload)
+}
+
+func TestParseWebhookSubscriptions(t *testing.T) {
+	subs, err := ParseWebhookSubscriptions([]string{
+		"https://example.com/hook;secret;thrown|sunk",
+		"https://example.com/all;secret",
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, []WebhookEvent{ WEBHOOK_THROWN, WEBHOOK_SUNK }, subs[0].Events)
+	assert.False(t, subs[0].subscribes(WEBHOOK_DELIVERED))
+	assert.True(t, subs[1].subscribes(WEBHOOK_DELIVERED))
+
+	for _, item := range []string{"https://example.com/hook", ";secret", "https://example.com/hook;secret;lost"} {
+		_, err := ParseWebhookSubscriptions([]string{ item })
+		assert.NotNil(t, err, item)
+	}
+}
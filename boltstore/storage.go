@@ -0,0 +1,378 @@
+package boltstore
+
+import (
+	"io"
+	"fmt"
+	"time"
+	"bytes"
+	"encoding/json"
+	"encoding/binary"
+
+	"github.com/binn/binn"
+	bolt "go.etcd.io/bbolt"
+)
+
+var ErrNotEmpty = fmt.Errorf("this storage is not empty")
+
+var (
+	bucketContainers = []byte("containers")
+	bucketStored     = []byte("stored")
+	bucketIDs        = []byte("ids")
+	bucketExpiry     = []byte("expiry")
+	bucketMeta       = []byte("meta")
+	keyCount         = []byte("count")
+)
+
+// record is a container kept in the containers bucket under its sequence
+type record struct {
+	ID        string     `json:"id"`
+	binn.Message
+	ExpiredAt *time.Time `json:"expired_at,omitempty"`
+}
+
+// Storage is a ContainerKeeper kept in a bolt file, a throw and a pick up
+// each commit the buckets of containers and ids in a single bolt Update
+//
+// containers holds records by sequence, stored maps the id of a stored
+// container to its sequence, ids maps a issued id to its expiration
+// and expiry indexes ids by expiration so Sweep only reads expired ids
+type Storage struct {
+	db         *bolt.DB
+	validation bool
+	expiration time.Duration
+	// beforeCommit runs inside every bolt Update before it commits,
+	// a error rolls back the buckets touched by the Update
+	beforeCommit func() error
+}
+
+// Open opens or creates the bolt file at path
+func Open(path string, v bool, e time.Duration) (*Storage, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{ Timeout: time.Second })
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{ bucketContainers, bucketStored, bucketIDs, bucketExpiry, bucketMeta } {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &Storage{ db: db, validation: v, expiration: e }, nil
+}
+
+func (s *Storage) Close() error {
+	return s.db.Close()
+}
+
+func (s *Storage) update(f func(tx *bolt.Tx) error) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		if err := f(tx); err != nil {
+			return err
+		}
+		if s.beforeCommit != nil {
+			return s.beforeCommit()
+		}
+		return nil
+	})
+}
+
+func itob(v uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, v)
+	return b
+}
+
+func expiryKey(id string, e time.Time) []byte {
+	return append(itob(uint64(e.UnixNano())), id...)
+}
+
+func count(tx *bolt.Tx) int {
+	v := tx.Bucket(bucketMeta).Get(keyCount)
+	if v == nil {
+		return 0
+	}
+	return int(binary.BigEndian.Uint64(v))
+}
+
+func setCount(tx *bolt.Tx, n int) error {
+	return tx.Bucket(bucketMeta).Put(keyCount, itob(uint64(n)))
+}
+
+func issue(tx *bolt.Tx, id string, e time.Time) error {
+	ids := tx.Bucket(bucketIDs)
+	if old := ids.Get([]byte(id)); old != nil {
+		if err := tx.Bucket(bucketExpiry).Delete(expiryKey(id, time.Unix(0, int64(binary.BigEndian.Uint64(old))))); err != nil {
+			return err
+		}
+	}
+	if err := ids.Put([]byte(id), itob(uint64(e.UnixNano()))); err != nil {
+		return err
+	}
+	return tx.Bucket(bucketExpiry).Put(expiryKey(id, e), []byte{})
+}
+
+func revoke(tx *bolt.Tx, id string) error {
+	ids := tx.Bucket(bucketIDs)
+	v := ids.Get([]byte(id))
+	if v == nil {
+		return fmt.Errorf("this id (%#v) is not in storage", id)
+	}
+	if err := tx.Bucket(bucketExpiry).Delete(expiryKey(id, time.Unix(0, int64(binary.BigEndian.Uint64(v))))); err != nil {
+		return err
+	}
+	return ids.Delete([]byte(id))
+}
+
+func use(tx *bolt.Tx, id string, now time.Time) error {
+	v := tx.Bucket(bucketIDs).Get([]byte(id))
+	if v == nil {
+		return fmt.Errorf("this id (%#v) is invalid", id)
+	}
+	if now.After(time.Unix(0, int64(binary.BigEndian.Uint64(v)))) {
+		return fmt.Errorf("this id (%#v) is expired", id)
+	}
+	return revoke(tx, id)
+}
+
+func push(tx *bolt.Tx, r *record) error {
+	containers := tx.Bucket(bucketContainers)
+	seq, err := containers.NextSequence()
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	if err := containers.Put(itob(seq), data); err != nil {
+		return err
+	}
+	if err := tx.Bucket(bucketStored).Put([]byte(r.ID), itob(seq)); err != nil {
+		return err
+	}
+	return setCount(tx, count(tx) + 1)
+}
+
+// pop removes the oldest container
+func pop(tx *bolt.Tx) (*record, error) {
+	k, v := tx.Bucket(bucketContainers).Cursor().First()
+	if k == nil {
+		return nil, fmt.Errorf("this storage has no containers")
+	}
+	var r record
+	if err := json.Unmarshal(v, &r); err != nil {
+		return nil, err
+	}
+	if err := tx.Bucket(bucketContainers).Delete(k); err != nil {
+		return nil, err
+	}
+	if err := tx.Bucket(bucketStored).Delete([]byte(r.ID)); err != nil {
+		return nil, err
+	}
+	return &r, setCount(tx, count(tx) - 1)
+}
+
+func (s *Storage) Get() (binn.Container, error) {
+	var c binn.Container
+	err := s.update(func(tx *bolt.Tx) error {
+		r, err := pop(tx)
+		if err != nil {
+			return err
+		}
+
+		e := time.Now().Add(time.Duration(binn.MAX_EXPIRATION_HOUR) * time.Hour)
+		if s.expiration != 0 {
+			e = time.Now().Add(s.expiration)
+		}
+		if s.validation && tx.Bucket(bucketIDs).Get([]byte(r.ID)) != nil {
+			if err := issue(tx, r.ID, e); err != nil {
+				return err
+			}
+		}
+		c = binn.NewBottleWithMessage(r.ID, &r.Message, &e)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (s *Storage) Add(c binn.Container) error {
+	return s.update(func(tx *bolt.Tx) error {
+		now := time.Now()
+		if s.validation {
+			if err := use(tx, c.ID(), now); err != nil {
+				return err
+			}
+		}
+
+		if count(tx) >= binn.MAX_CONTAINER_STORAGE_NUM_CONTAINER {
+			if _, err := pop(tx); err != nil {
+				return err
+			}
+		}
+
+		newID := binn.GenerateID()
+		if s.validation {
+			if err := issue(tx, newID, now.Add(time.Duration(binn.MAX_EXPIRATION_HOUR) * time.Hour)); err != nil {
+				return err
+			}
+		}
+		return push(tx, &record{ ID: newID, Message: *c.Message().Stored(now), ExpiredAt: c.ExpiredAt() })
+	})
+}
+
+// Issue adds id to the issued ids
+func (s *Storage) Issue(id string, e time.Time) error {
+	return s.update(func(tx *bolt.Tx) error {
+		if tx.Bucket(bucketIDs).Get([]byte(id)) != nil {
+			return fmt.Errorf("this id (%#v) is already added", id)
+		}
+		return issue(tx, id, e)
+	})
+}
+
+func (s *Storage) Len() int {
+	n := 0
+	s.db.View(func(tx *bolt.Tx) error {
+		n = count(tx)
+		return nil
+	})
+	return n
+}
+
+func (s *Storage) Ping() error {
+	return s.db.View(func(tx *bolt.Tx) error {
+		if tx.Bucket(bucketContainers) == nil {
+			return fmt.Errorf("this storage has no containers bucket")
+		}
+		return nil
+	})
+}
+
+// Sweep forgets expired ids through the expiry index, ids of stored
+// containers are kept since Get stamps them again
+func (s *Storage) Sweep() int {
+	if !s.validation {
+		return 0
+	}
+	n := 0
+	err := s.update(func(tx *bolt.Tx) error {
+		n = 0
+		now := itob(uint64(time.Now().UnixNano()))
+		stored := tx.Bucket(bucketStored)
+		expired := [][]byte{}
+		c := tx.Bucket(bucketExpiry).Cursor()
+		for k, _ := c.First(); k != nil && bytes.Compare(k[:8], now) < 0; k, _ = c.Next() {
+			if stored.Get(k[8:]) == nil {
+				expired = append(expired, append([]byte{}, k[8:]...))
+			}
+		}
+		for _, id := range expired {
+			if err := revoke(tx, string(id)); err != nil {
+				return err
+			}
+			n++
+		}
+		return nil
+	})
+	if err != nil {
+		return 0
+	}
+	return n
+}
+
+func (s *Storage) Snapshot(w io.Writer) error {
+	snapshot := &binn.Snapshot{
+		CreatedAt:   time.Now(),
+		Containers:  []binn.Container{},
+		Quarantined: []binn.Container{},
+		IDs:         []binn.IssuedID{},
+	}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		err := tx.Bucket(bucketContainers).ForEach(func(k, v []byte) error {
+			var r record
+			if err := json.Unmarshal(v, &r); err != nil {
+				return err
+			}
+			snapshot.Containers = append(snapshot.Containers, binn.NewBottleWithMessage(r.ID, &r.Message, r.ExpiredAt))
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		return tx.Bucket(bucketExpiry).ForEach(func(k, v []byte) error {
+			snapshot.IDs = append(snapshot.IDs, binn.IssuedID{
+				ID:        string(k[8:]),
+				ExpiredAt: time.Unix(0, int64(binary.BigEndian.Uint64(k[:8]))),
+			})
+			return nil
+		})
+	})
+	if err != nil {
+		return err
+	}
+	return binn.WriteSnapshot(w, snapshot)
+}
+
+// Restore recreates the buckets from the snapshot read from r in one Update,
+// there is no quarantine bucket so a snapshot with one is refused
+func (s *Storage) Restore(r io.Reader) error {
+	snapshot, err := binn.ReadSnapshot(r)
+	if err != nil {
+		return err
+	}
+	if len(snapshot.Quarantined) > 0 {
+		return binn.ErrQuarantineUnsupported
+	}
+	containers := snapshot.Containers
+	if len(containers) > binn.MAX_CONTAINER_STORAGE_NUM_CONTAINER {
+		return fmt.Errorf("snapshot has too many containers")
+	}
+
+	return s.update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{ bucketContainers, bucketStored, bucketIDs, bucketExpiry } {
+			if err := tx.DeleteBucket(name); err != nil {
+				return err
+			}
+			if _, err := tx.CreateBucket(name); err != nil {
+				return err
+			}
+		}
+		if err := setCount(tx, 0); err != nil {
+			return err
+		}
+		for _, c := range containers {
+			if err := push(tx, &record{ ID: c.ID(), Message: *c.Message(), ExpiredAt: c.ExpiredAt() }); err != nil {
+				return err
+			}
+		}
+		for _, id := range snapshot.IDs {
+			if err := issue(tx, id.ID, id.ExpiredAt); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Migrate restores a snapshot only while the bolt file has neither
+// containers nor ids, so it runs once on the first start with a new file
+func (s *Storage) Migrate(r io.Reader) error {
+	empty := true
+	s.db.View(func(tx *bolt.Tx) error {
+		empty = count(tx) == 0 && tx.Bucket(bucketIDs).Stats().KeyN == 0
+		return nil
+	})
+	if !empty {
+		return ErrNotEmpty
+	}
+	return s.Restore(r)
+}
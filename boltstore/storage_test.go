@@ -0,0 +1,143 @@
+package boltstore
+
+import (
+	"os"
+	"fmt"
+	"time"
+	"bufio"
+	"strings"
+	"testing"
+	"os/exec"
+	"path/filepath"
+
+	"github.com/binn/binn"
+	"github.com/binn/binn/keepertest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	bolt "go.etcd.io/bbolt"
+)
+
+func openTestStorage(t *testing.T) (*Storage, string) {
+	path := filepath.Join(t.TempDir(), "binn.db")
+	s, err := Open(path, true, time.Duration(10) * time.Minute)
+	require.Nil(t, err)
+	t.Cleanup(func() { s.Close() })
+	return s, path
+}
+
+// checkConsistency asserts every bucket agrees with the others
+func checkConsistency(t *testing.T, s *Storage) {
+	require.Nil(t, s.db.View(func(tx *bolt.Tx) error {
+		containers := tx.Bucket(bucketContainers).Stats().KeyN
+		assert.Equal(t, count(tx), containers)
+		assert.Equal(t, containers, tx.Bucket(bucketStored).Stats().KeyN)
+		assert.Equal(t, tx.Bucket(bucketIDs).Stats().KeyN, tx.Bucket(bucketExpiry).Stats().KeyN)
+		return tx.Bucket(bucketStored).ForEach(func(id, seq []byte) error {
+			assert.NotNil(t, tx.Bucket(bucketContainers).Get(seq), string(id))
+			assert.NotNil(t, tx.Bucket(bucketIDs).Get(id), string(id))
+			return nil
+		})
+	}))
+}
+
+// failCommit fails every Update of s with err, nil commits them again
+func failCommit(s *Storage, err error) {
+	s.beforeCommit = nil
+	if err != nil {
+		s.beforeCommit = func() error { return err }
+	}
+}
+
+func TestReadOldRecord(t *testing.T) {
+	s, _ := openTestStorage(t)
+	require.Nil(t, s.update(func(tx *bolt.Tx) error {
+		if err := push(tx, &record{ ID: "old" }); err != nil {
+			return err
+		}
+		// records written before messages had more fields
+		return tx.Bucket(bucketContainers).Put(itob(1), []byte(`{"id":"old","text":"hello"}`))
+	}))
+	c, err := s.Get()
+	require.Nil(t, err)
+	assert.Equal(t, "hello", c.Message().Text)
+	assert.Nil(t, c.Message().CreatedAt)
+}
+
+// TestCrashHelper throws bottles and blocks before committing the add of
+// the last one until it is killed, it only runs as the child process of
+// TestCrashMidTransaction
+func TestCrashHelper(t *testing.T) {
+	path := os.Getenv("BOLTSTORE_CRASH_DB")
+	if path == "" {
+		t.Skip("only run by TestCrashMidTransaction")
+	}
+	s, err := Open(path, true, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; ; i++ {
+		id := binn.GenerateID()
+		if err := s.Issue(id, time.Now().Add(time.Minute)); err != nil {
+			t.Fatal(err)
+		}
+		if i == CRASH_AFTER {
+			s.beforeCommit = func() error {
+				fmt.Println("in transaction")
+				select {}
+			}
+		}
+		if err := s.Add(binn.NewBottle(id, "hello", nil)); err != nil {
+			t.Fatal(err)
+		}
+		fmt.Println("committed")
+	}
+}
+
+// CRASH_AFTER bottles are committed before the child blocks
+const CRASH_AFTER = 5
+
+func TestCrashMidTransaction(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "binn.db")
+	cmd := exec.Command(os.Args[0], "-test.run=^TestCrashHelper$")
+	cmd.Env = append(os.Environ(), "BOLTSTORE_CRASH_DB=" + path)
+	out, err := cmd.StdoutPipe()
+	require.Nil(t, err)
+	require.Nil(t, cmd.Start())
+
+	// the child is killed only once it is blocked inside the update of a add
+	committed := 0
+	blocked := false
+	scanner := bufio.NewScanner(out)
+	for !blocked && scanner.Scan() {
+		switch strings.TrimSpace(scanner.Text()) {
+		case "committed":
+			committed++
+		case "in transaction":
+			blocked = true
+		}
+	}
+	require.True(t, blocked)
+	require.Nil(t, cmd.Process.Kill())
+	cmd.Wait()
+
+	s, err := Open(path, true, 0)
+	require.Nil(t, err)
+	defer s.Close()
+	assert.Equal(t, CRASH_AFTER, committed)
+	assert.Equal(t, committed, s.Len())
+	checkConsistency(t, s)
+}
+
+func TestConformance(t *testing.T) {
+	keepertest.Run(t, func(t *testing.T, e time.Duration) *keepertest.Harness {
+		s, err := Open(filepath.Join(t.TempDir(), "binn.db"), true, e)
+		require.Nil(t, err)
+		t.Cleanup(func() { s.Close() })
+		return &keepertest.Harness{
+			Keeper:     s,
+			Issue:      s.Issue,
+			FailCommit: func(err error) { failCommit(s, err) },
+			Check:      func(t *testing.T) { checkConsistency(t, s) },
+		}
+	})
+}
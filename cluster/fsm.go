@@ -0,0 +1,216 @@
+package cluster
+
+import (
+	"io"
+	"fmt"
+	"time"
+	"sync"
+	"encoding/json"
+
+	"github.com/binn/binn"
+	"github.com/hashicorp/raft"
+)
+
+const (
+	OP_ADD   = "add"
+	OP_GET   = "get"
+	OP_ISSUE = "issue"
+	OP_SWEEP = "sweep"
+)
+
+// command is a entry of the raft log, every time used by fsm is taken
+// from the command so all nodes apply it to the same state
+type command struct {
+	Op        string        `json:"op"`
+	ID        string        `json:"id,omitempty"`
+	NewID     string        `json:"new_id,omitempty"`
+	Message   *binn.Message `json:"message,omitempty"`
+	ExpiredAt *time.Time    `json:"expired_at,omitempty"`
+	Time      time.Time     `json:"time"`
+}
+
+// result is returned by fsm.Apply and sent back to a forwarding node
+type result struct {
+	ID        string        `json:"id,omitempty"`
+	Message   *binn.Message `json:"message,omitempty"`
+	ExpiredAt *time.Time    `json:"expired_at,omitempty"`
+	Count     int           `json:"count,omitempty"`
+	Error     string        `json:"error,omitempty"`
+}
+
+func (r *result) err() error {
+	if r.Error == "" {
+		return nil
+	}
+	return fmt.Errorf("%s", r.Error)
+}
+
+// fsm is the replicated container queue and issued id set
+type fsm struct {
+	containers []binn.Container
+	ids        map[string]time.Time
+	mux        *sync.Mutex
+	validation bool
+	expiration time.Duration
+}
+
+func newFSM(v bool, e time.Duration) *fsm {
+	return &fsm{
+		containers: []binn.Container{},
+		ids:        make(map[string]time.Time),
+		mux:        &sync.Mutex{},
+		validation: v,
+		expiration: e,
+	}
+}
+
+func (f *fsm) Apply(l *raft.Log) interface{} {
+	var cmd command
+	if err := json.Unmarshal(l.Data, &cmd); err != nil {
+		return &result{ Error: fmt.Sprintf("this command is invalid format, %s", err) }
+	}
+
+	f.mux.Lock()
+	defer f.mux.Unlock()
+
+	switch cmd.Op {
+	case OP_ADD:
+		return f.add(&cmd)
+	case OP_GET:
+		return f.get(&cmd)
+	case OP_ISSUE:
+		if cmd.ExpiredAt == nil {
+			return &result{ Error: fmt.Sprintf("this id (%#v) has no expiration", cmd.ID) }
+		}
+		if _, ok := f.ids[cmd.ID]; ok {
+			return &result{ Error: fmt.Sprintf("this id (%#v) is already added", cmd.ID) }
+		}
+		f.ids[cmd.ID] = *cmd.ExpiredAt
+		return &result{ ID: cmd.ID }
+	case OP_SWEEP:
+		return f.sweep(&cmd)
+	default:
+		return &result{ Error: fmt.Sprintf("this command (%#v) is unknown", cmd.Op) }
+	}
+}
+
+func (f *fsm) add(cmd *command) *result {
+	if f.validation {
+		e, ok := f.ids[cmd.ID]
+		if !ok {
+			return &result{ Error: fmt.Sprintf("this id (%#v) is invalid", cmd.ID) }
+		}
+		if cmd.Time.After(e) {
+			return &result{ Error: fmt.Sprintf("this id (%#v) is expired", cmd.ID) }
+		}
+		delete(f.ids, cmd.ID)
+	}
+
+	if len(f.containers) >= binn.MAX_CONTAINER_STORAGE_NUM_CONTAINER {
+		f.containers = f.containers[1:]
+	}
+
+	m := cmd.Message
+	if m == nil {
+		m = &binn.Message{}
+	}
+	if f.validation {
+		f.ids[cmd.NewID] = cmd.Time.Add(time.Duration(binn.MAX_EXPIRATION_HOUR) * time.Hour)
+	}
+	// attachments are kept in the blob store of the node they were thrown to
+	m = m.Stored(cmd.Time)
+	m.Attachments = nil
+	f.containers = append(f.containers, binn.NewBottleWithMessage(cmd.NewID, m, cmd.ExpiredAt))
+
+	return &result{ ID: cmd.NewID }
+}
+
+func (f *fsm) get(cmd *command) *result {
+	if len(f.containers) == 0 {
+		return &result{ Error: "this storage has no containers" }
+	}
+	c := f.containers[0]
+	f.containers = f.containers[1:]
+
+	e := cmd.Time.Add(time.Duration(binn.MAX_EXPIRATION_HOUR) * time.Hour)
+	if f.expiration != 0 {
+		e = cmd.Time.Add(f.expiration)
+	}
+	if _, ok := f.ids[c.ID()]; ok && f.validation {
+		f.ids[c.ID()] = e
+	}
+
+	return &result{ ID: c.ID(), Message: c.Message(), ExpiredAt: &e }
+}
+
+func (f *fsm) sweep(cmd *command) *result {
+	keep := make(map[string]bool, len(f.containers))
+	for _, c := range f.containers {
+		keep[c.ID()] = true
+	}
+	n := 0
+	for id, e := range f.ids {
+		if cmd.Time.After(e) && !keep[id] {
+			delete(f.ids, id)
+			n++
+		}
+	}
+	return &result{ Count: n }
+}
+
+func (f *fsm) len() int {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	return len(f.containers)
+}
+
+func (f *fsm) Snapshot() (raft.FSMSnapshot, error) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+
+	s := &binn.Snapshot{
+		CreatedAt:   time.Now(),
+		Containers:  make([]binn.Container, len(f.containers)),
+		Quarantined: []binn.Container{},
+		IDs:         make([]binn.IssuedID, 0, len(f.ids)),
+	}
+	copy(s.Containers, f.containers)
+	for id, e := range f.ids {
+		s.IDs = append(s.IDs, binn.IssuedID{ ID: id, ExpiredAt: e })
+	}
+	return &fsmSnapshot{ s }, nil
+}
+
+// Restore replaces the state with a snapshot written by binn.WriteSnapshot
+func (f *fsm) Restore(rc io.ReadCloser) error {
+	defer rc.Close()
+
+	s, err := binn.ReadSnapshot(rc)
+	if err != nil {
+		return err
+	}
+	ids := make(map[string]time.Time, len(s.IDs))
+	for _, id := range s.IDs {
+		ids[id.ID] = id.ExpiredAt
+	}
+
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	f.containers = s.Containers
+	f.ids = ids
+	return nil
+}
+
+type fsmSnapshot struct {
+	snapshot *binn.Snapshot
+}
+
+func (s *fsmSnapshot) Persist(sink raft.SnapshotSink) error {
+	if err := binn.WriteSnapshot(sink, s.snapshot); err != nil {
+		sink.Cancel()
+		return err
+	}
+	return sink.Close()
+}
+
+func (s *fsmSnapshot) Release() {}
@@ -0,0 +1,504 @@
+package cluster
+
+import (
+	"io"
+	"os"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+	"bytes"
+	"strings"
+	"net/url"
+	"path/filepath"
+	"net/http"
+	"crypto/hmac"
+	"encoding/json"
+
+	"github.com/binn/binn"
+	"github.com/hashicorp/raft"
+	"github.com/hashicorp/go-hclog"
+	raftboltdb "github.com/hashicorp/raft-boltdb/v2"
+)
+
+const (
+	DEFAULT_APPLY_TIMEOUT = 5 * time.Second
+	MAX_COMMAND_SIZE = 64 * 1024
+	CLUSTER_SECRET_HEADER = "X-Binn-Cluster-Secret"
+	DEFAULT_API_ADDR = "127.0.0.1:7001"
+	RAFT_LOG_FILE = "raft.db"
+	RAFT_SNAPSHOTS_RETAINED = 2
+)
+
+var (
+	errNotLeader = fmt.Errorf("this node is not the leader")
+	errNoLeader  = fmt.Errorf("this cluster has no leader")
+)
+
+// Peer is a member of the cluster, APIURL serves the forwarded commands
+type Peer struct {
+	ID       string
+	RaftAddr string
+	APIURL   string
+}
+
+type Config struct {
+	id               string
+	raftAddr         string
+	peers            []Peer
+	validation       bool
+	expiration       time.Duration
+	secret           string
+	dataDir          string
+	applyTimeout     time.Duration
+	heartbeatTimeout time.Duration
+	logOutput        io.Writer
+	logger           *binn.Logger
+}
+
+type Node struct {
+	cfg       *Config
+	raft      *raft.Raft
+	fsm       *fsm
+	logs      raft.LogStore
+	stable    raft.StableStore
+	snapshots raft.SnapshotStore
+	closeLogs func() error
+	transport *raft.NetworkTransport
+	peers     map[string]Peer
+	mux       *sync.RWMutex
+	client    *http.Client
+}
+
+func NewConfig(id string, raftAddr string) *Config {
+	return &Config{
+		id:           id,
+		raftAddr:     raftAddr,
+		peers:        []Peer{},
+		validation:   true,
+		applyTimeout: DEFAULT_APPLY_TIMEOUT,
+		logOutput:    os.Stderr,
+		logger:       binn.DefaultLogger(),
+	}
+}
+
+// ParsePeers parses items formatted as "id;raft_addr;api_url"
+func ParsePeers(items []string) ([]Peer, error) {
+	peers := []Peer{}
+	for _, item := range items {
+		parts := strings.Split(item, ";")
+		if len(parts) != 3 || parts[0] == "" || parts[1] == "" || parts[2] == "" {
+			return nil, fmt.Errorf("this peer (%#v) is invalid format", item)
+		}
+		peers = append(peers, Peer{
+			ID:       parts[0],
+			RaftAddr: parts[1],
+			APIURL:   strings.TrimRight(parts[2], "/"),
+		})
+	}
+	return peers, nil
+}
+
+func (c *Config) SetPeers(peers []Peer) {
+	c.peers = peers
+}
+
+// SetStorage sets how the replicated storage validates ids, it must be
+// the same on every node
+func (c *Config) SetStorage(v bool, e time.Duration) {
+	c.validation = v
+	c.expiration = e
+}
+
+// SetSecret sets the secret every node sends with a forwarded command,
+// a node refuses to start without it
+func (c *Config) SetSecret(s string) {
+	c.secret = s
+}
+
+// SetDataDir keeps the raft log and snapshots in dir so a restarted node
+// recovers its state, without it they are kept in memory
+func (c *Config) SetDataDir(dir string) {
+	c.dataDir = dir
+}
+
+func (c *Config) SetApplyTimeout(d time.Duration) {
+	c.applyTimeout = d
+}
+
+// SetHeartbeatTimeout overrides the raft heartbeat and election timeout
+func (c *Config) SetHeartbeatTimeout(d time.Duration) {
+	c.heartbeatTimeout = d
+}
+
+// SetLogOutput sets where the raft library writes its own log
+func (c *Config) SetLogOutput(w io.Writer) {
+	c.logOutput = w
+}
+
+func (c *Config) SetLogger(l *binn.Logger) {
+	c.logger = l
+}
+
+// NewNode starts raft on the address of cfg, the node waits as a
+// follower until Bootstrap is called on any node of the cluster
+func NewNode(cfg *Config) (*Node, error) {
+	if cfg.secret == "" {
+		return nil, fmt.Errorf("this cluster node (%#v) has no secret", cfg.id)
+	}
+	n := &Node{
+		cfg:    cfg,
+		fsm:    newFSM(cfg.validation, cfg.expiration),
+		peers:  make(map[string]Peer),
+		mux:    &sync.RWMutex{},
+		client: &http.Client{ Timeout: cfg.applyTimeout },
+	}
+	n.SetPeers(cfg.peers)
+
+	var advertise net.Addr
+	if p, ok := n.peer(cfg.id); ok {
+		addr, err := net.ResolveTCPAddr("tcp", p.RaftAddr)
+		if err != nil {
+			return nil, err
+		}
+		advertise = addr
+	}
+	transport, err := raft.NewTCPTransport(cfg.raftAddr, advertise, 3, 10*time.Second, cfg.logOutput)
+	if err != nil {
+		return nil, err
+	}
+	n.transport = transport
+
+	rc := raft.DefaultConfig()
+	rc.LocalID = raft.ServerID(cfg.id)
+	rc.Logger = hclog.New(&hclog.LoggerOptions{
+		Name:   "raft",
+		Level:  hclog.Warn,
+		Output: cfg.logOutput,
+	})
+	if cfg.heartbeatTimeout != 0 {
+		rc.HeartbeatTimeout = cfg.heartbeatTimeout
+		rc.ElectionTimeout = cfg.heartbeatTimeout
+		rc.LeaderLeaseTimeout = cfg.heartbeatTimeout / 2
+	}
+
+	if err := n.openStores(); err != nil {
+		transport.Close()
+		return nil, err
+	}
+	r, err := raft.NewRaft(rc, n.fsm, n.logs, n.stable, n.snapshots, transport)
+	if err != nil {
+		n.closeLogs()
+		transport.Close()
+		return nil, err
+	}
+	n.raft = r
+
+	return n, nil
+}
+
+// openStores keeps the log in a bolt file and the snapshots in files
+// of the data dir, a node without a data dir forgets its state on restart
+func (n *Node) openStores() error {
+	if n.cfg.dataDir == "" {
+		store := raft.NewInmemStore()
+		n.logs, n.stable, n.snapshots = store, store, raft.NewInmemSnapshotStore()
+		n.closeLogs = func() error { return nil }
+		return nil
+	}
+
+	if err := os.MkdirAll(n.cfg.dataDir, 0700); err != nil {
+		return err
+	}
+	snapshots, err := raft.NewFileSnapshotStore(n.cfg.dataDir, RAFT_SNAPSHOTS_RETAINED, n.cfg.logOutput)
+	if err != nil {
+		return err
+	}
+	store, err := raftboltdb.NewBoltStore(filepath.Join(n.cfg.dataDir, RAFT_LOG_FILE))
+	if err != nil {
+		return err
+	}
+	n.logs, n.stable, n.snapshots = store, store, snapshots
+	n.closeLogs = store.Close
+	return nil
+}
+
+func (n *Node) ID() string {
+	return n.cfg.id
+}
+
+// RaftAddr returns the address raft listens on
+func (n *Node) RaftAddr() string {
+	return string(n.transport.LocalAddr())
+}
+
+// APIAddr is the address the api should listen on, the host and port of
+// the api url this node is known by to its peers so the api stays on the
+// network of the cluster, DEFAULT_API_ADDR when it is not among the peers
+func (n *Node) APIAddr() string {
+	p, ok := n.peer(n.cfg.id)
+	if !ok {
+		return DEFAULT_API_ADDR
+	}
+	u, err := url.Parse(p.APIURL)
+	if err != nil || u.Host == "" {
+		return DEFAULT_API_ADDR
+	}
+	if u.Port() != "" {
+		return u.Host
+	}
+	if u.Scheme == "https" {
+		return net.JoinHostPort(u.Hostname(), "443")
+	}
+	return net.JoinHostPort(u.Hostname(), "80")
+}
+
+func (n *Node) SetPeers(peers []Peer) {
+	n.mux.Lock()
+	defer n.mux.Unlock()
+	n.peers = make(map[string]Peer, len(peers))
+	for _, p := range peers {
+		n.peers[p.ID] = p
+	}
+}
+
+func (n *Node) peer(id string) (Peer, bool) {
+	n.mux.RLock()
+	defer n.mux.RUnlock()
+	p, ok := n.peers[id]
+	return p, ok
+}
+
+// Bootstrap forms the cluster from the peers, it does nothing when
+// the node already has a state so every node can call it on start
+func (n *Node) Bootstrap() error {
+	ok, err := raft.HasExistingState(n.logs, n.stable, n.snapshots)
+	if err != nil {
+		return err
+	}
+	if ok {
+		return nil
+	}
+
+	n.mux.RLock()
+	servers := make([]raft.Server, 0, len(n.peers))
+	for _, p := range n.peers {
+		servers = append(servers, raft.Server{
+			ID:      raft.ServerID(p.ID),
+			Address: raft.ServerAddress(p.RaftAddr),
+		})
+	}
+	n.mux.RUnlock()
+
+	err = n.raft.BootstrapCluster(raft.Configuration{ Servers: servers }).Error()
+	if err != nil && err != raft.ErrCantBootstrap {
+		return err
+	}
+	return nil
+}
+
+func (n *Node) IsLeader() bool {
+	return n.raft.State() == raft.Leader
+}
+
+// Leader returns the id of the current leader or "" while electing
+func (n *Node) Leader() string {
+	_, id := n.raft.LeaderWithID()
+	return string(id)
+}
+
+func (n *Node) Shutdown() error {
+	err := n.raft.Shutdown().Error()
+	n.transport.Close()
+	if cerr := n.closeLogs(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func (n *Node) Get() (binn.Container, error) {
+	// an empty replica skips the log, a lagging replica only delays a
+	// delivery until the next cycle
+	if n.fsm.len() == 0 {
+		return nil, fmt.Errorf("this storage has no containers")
+	}
+
+	r, err := n.apply(&command{ Op: OP_GET, Time: time.Now() })
+	if err != nil {
+		return nil, err
+	}
+	if err := r.err(); err != nil {
+		return nil, err
+	}
+	m := r.Message
+	if m == nil {
+		m = &binn.Message{}
+	}
+	return binn.NewBottleWithMessage(r.ID, m, r.ExpiredAt), nil
+}
+
+func (n *Node) Add(c binn.Container) error {
+	r, err := n.apply(&command{
+		Op:        OP_ADD,
+		ID:        c.ID(),
+		NewID:     binn.GenerateID(),
+		Message:   c.Message(),
+		ExpiredAt: c.ExpiredAt(),
+		Time:      time.Now(),
+	})
+	if err != nil {
+		return err
+	}
+	return r.err()
+}
+
+// Issue adds id to the issued ids of the cluster
+func (n *Node) Issue(id string, e time.Time) error {
+	r, err := n.apply(&command{ Op: OP_ISSUE, ID: id, ExpiredAt: &e, Time: time.Now() })
+	if err != nil {
+		return err
+	}
+	return r.err()
+}
+
+// Len returns the number of containers in the replica of this node
+func (n *Node) Len() int {
+	return n.fsm.len()
+}
+
+// Sweep is only done by the leader so the log gets one entry per cycle
+func (n *Node) Sweep() int {
+	if !n.IsLeader() {
+		return 0
+	}
+	r, err := n.apply(&command{ Op: OP_SWEEP, Time: time.Now() })
+	if err != nil {
+		n.cfg.logger.Warn("failed to sweep expired ids", binn.F("error", err))
+		return 0
+	}
+	return r.Count
+}
+
+func (n *Node) Ping() error {
+	if n.Leader() == "" {
+		return errNoLeader
+	}
+	return nil
+}
+
+// apply commits cmd through the leader, it retries only while no node
+// has accepted cmd so a command is never applied twice
+func (n *Node) apply(cmd *command) (*result, error) {
+	data, err := json.Marshal(cmd)
+	if err != nil {
+		return nil, err
+	}
+
+	deadline := time.Now().Add(n.cfg.applyTimeout)
+	for {
+		r, err := n.applyOnce(data)
+		if (err != errNotLeader && err != errNoLeader) || time.Now().After(deadline) {
+			return r, err
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func (n *Node) applyOnce(data []byte) (*result, error) {
+	if n.IsLeader() {
+		return n.applyLocal(data)
+	}
+
+	id := n.Leader()
+	if id == "" {
+		return nil, errNoLeader
+	}
+	p, ok := n.peer(id)
+	if !ok {
+		return nil, fmt.Errorf("this leader (%#v) is not in peers", id)
+	}
+	return n.forward(p, data)
+}
+
+func (n *Node) applyLocal(data []byte) (*result, error) {
+	f := n.raft.Apply(data, n.cfg.applyTimeout)
+	if err := f.Error(); err != nil {
+		if err == raft.ErrNotLeader {
+			return nil, errNotLeader
+		}
+		return nil, err
+	}
+	r, ok := f.Response().(*result)
+	if !ok {
+		return nil, fmt.Errorf("this response (%#v) is unknown", f.Response())
+	}
+	return r, nil
+}
+
+func (n *Node) forward(p Peer, data []byte) (*result, error) {
+	req, err := http.NewRequest(http.MethodPost, p.APIURL + "/cluster/apply", bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(CLUSTER_SECRET_HEADER, n.cfg.secret)
+
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusMisdirectedRequest:
+		return nil, errNotLeader
+	default:
+		return nil, fmt.Errorf("leader (%#v) responded %d", p.ID, resp.StatusCode)
+	}
+
+	var r result
+	if err := json.NewDecoder(resp.Body).Decode(&r); err != nil {
+		return nil, err
+	}
+	return &r, nil
+}
+
+// Handler serves the commands forwarded by the other nodes
+func (n *Node) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/cluster/apply", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		if !hmac.Equal([]byte(r.Header.Get(CLUSTER_SECRET_HEADER)), []byte(n.cfg.secret)) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if !n.IsLeader() {
+			w.WriteHeader(http.StatusMisdirectedRequest)
+			return
+		}
+
+		data, err := io.ReadAll(io.LimitReader(r.Body, MAX_COMMAND_SIZE))
+		if err != nil || !json.Valid(data) {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		res, err := n.applyLocal(data)
+		if err == errNotLeader {
+			w.WriteHeader(http.StatusMisdirectedRequest)
+			return
+		}
+		if err != nil {
+			n.cfg.logger.Warn("failed to apply a forwarded command", binn.F("error", err))
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(res)
+	})
+	return mux
+}
@@ -0,0 +1,281 @@
+package cluster
+
+import (
+	"io"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+	"testing"
+	"net/http/httptest"
+
+	"github.com/binn/binn"
+	"github.com/binn/binn/keepertest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type testCluster struct {
+	nodes   []*Node
+	servers []*httptest.Server
+}
+
+// newTestCluster runs n nodes over loopback and waits for a leader
+func newTestCluster(t *testing.T, n int) *testCluster {
+	tc := &testCluster{}
+	peers := []Peer{}
+	for i := 0; i < n; i++ {
+		cfg := NewConfig(fmt.Sprintf("node%d", i), "127.0.0.1:0")
+		cfg.SetStorage(true, time.Duration(10) * time.Minute)
+		cfg.SetSecret("secret")
+		cfg.SetHeartbeatTimeout(time.Duration(200) * time.Millisecond)
+		cfg.SetLogOutput(io.Discard)
+		node, err := NewNode(cfg)
+		require.Nil(t, err)
+		srv := httptest.NewServer(node.Handler())
+
+		tc.nodes = append(tc.nodes, node)
+		tc.servers = append(tc.servers, srv)
+		peers = append(peers, Peer{ ID: node.ID(), RaftAddr: node.RaftAddr(), APIURL: srv.URL })
+	}
+	for _, node := range tc.nodes {
+		node.SetPeers(peers)
+	}
+	require.Nil(t, tc.nodes[0].Bootstrap())
+	tc.waitLeader(t)
+
+	t.Cleanup(func() {
+		for i := range tc.nodes {
+			tc.kill(i)
+		}
+	})
+	return tc
+}
+
+func (tc *testCluster) waitLeader(t *testing.T) *Node {
+	deadline := time.Now().Add(time.Duration(10) * time.Second)
+	for time.Now().Before(deadline) {
+		for _, node := range tc.nodes {
+			if node != nil && node.IsLeader() {
+				return node
+			}
+		}
+		time.Sleep(time.Duration(20) * time.Millisecond)
+	}
+	t.Fatal("cluster has no leader")
+	return nil
+}
+
+func (tc *testCluster) kill(i int) {
+	if tc.nodes[i] == nil {
+		return
+	}
+	tc.nodes[i].Shutdown()
+	tc.servers[i].Close()
+	tc.nodes[i] = nil
+}
+
+// throw issues a id on one node and adds a bottle on another
+func (tc *testCluster) throw(t *testing.T, i int, text string) {
+	id := binn.GenerateID()
+	node := tc.nodes[i % len(tc.nodes)]
+	require.Nil(t, node.Issue(id, time.Now().Add(time.Minute)))
+	require.Nil(t, tc.nodes[(i + 1) % len(tc.nodes)].Add(binn.NewBottle(id, text, nil)))
+}
+
+func (tc *testCluster) waitLen(t *testing.T, n int) {
+	assert.Eventually(t, func() bool {
+		for _, node := range tc.nodes {
+			if node != nil && node.Len() != n {
+				return false
+			}
+		}
+		return true
+	}, time.Duration(5) * time.Second, time.Duration(20) * time.Millisecond)
+}
+
+func TestClusterDeliversExactlyOnce(t *testing.T) {
+	tc := newTestCluster(t, 3)
+	for i := 0; i < 30; i++ {
+		tc.throw(t, i, fmt.Sprintf("bottle %d", i))
+	}
+	tc.waitLen(t, 30)
+
+	mux := &sync.Mutex{}
+	delivered := map[string]int{}
+	wg := &sync.WaitGroup{}
+	for _, node := range tc.nodes {
+		wg.Add(1)
+		go func(node *Node) {
+			defer wg.Done()
+			for {
+				c, err := node.Get()
+				if err != nil {
+					if node.Len() == 0 {
+						return
+					}
+					continue
+				}
+				mux.Lock()
+				delivered[c.Message().Text]++
+				mux.Unlock()
+			}
+		}(node)
+	}
+	wg.Wait()
+
+	assert.Equal(t, 30, len(delivered))
+	for text, n := range delivered {
+		assert.Equal(t, 1, n, text)
+	}
+}
+
+func TestClusterSurvivesLeaderKill(t *testing.T) {
+	tc := newTestCluster(t, 3)
+	for i := 0; i < 5; i++ {
+		tc.throw(t, i, fmt.Sprintf("bottle %d", i))
+	}
+	tc.waitLen(t, 5)
+
+	leader := tc.waitLeader(t)
+	for i, node := range tc.nodes {
+		if node == leader {
+			tc.kill(i)
+		}
+	}
+	survivor := tc.waitLeader(t)
+	assert.NotEqual(t, leader, survivor)
+
+	for i := 0; i < 5; i++ {
+		c, err := survivor.Get()
+		require.Nil(t, err)
+		assert.Equal(t, fmt.Sprintf("bottle %d", i), c.Message().Text)
+		assert.NotNil(t, c.ExpiredAt())
+	}
+	_, err := survivor.Get()
+	assert.NotNil(t, err)
+}
+
+func TestClusterValidatesIDs(t *testing.T) {
+	tc := newTestCluster(t, 3)
+	assert.NotNil(t, tc.nodes[1].Add(binn.NewBottle("unknown", "hello", nil)))
+
+	tc.throw(t, 0, "hello")
+	tc.waitLen(t, 1)
+	c, err := tc.nodes[2].Get()
+	require.Nil(t, err)
+
+	// the id of a delivered bottle can be used once from any node
+	assert.Nil(t, tc.nodes[0].Add(binn.NewBottle(c.ID(), "reply", nil)))
+	assert.NotNil(t, tc.nodes[1].Add(binn.NewBottle(c.ID(), "reply", nil)))
+}
+
+func TestClusterDropsAttachments(t *testing.T) {
+	tc := newTestCluster(t, 3)
+	id := binn.GenerateID()
+	require.Nil(t, tc.nodes[0].Issue(id, time.Now().Add(time.Minute)))
+	m := &binn.Message{ Text: "a doodle", Attachments: []binn.Attachment{ { ID: "doodle.png", ContentType: "image/png", Size: 2048 } } }
+	require.Nil(t, tc.nodes[1].Add(binn.NewBottleWithMessage(id, m, nil)))
+	tc.waitLen(t, 1)
+
+	// the blob is only on the node the bottle was thrown to
+	c, err := tc.nodes[2].Get()
+	require.Nil(t, err)
+	assert.Equal(t, "a doodle", c.Message().Text)
+	assert.Empty(t, c.Message().Attachments)
+}
+
+func TestClusterRejectsWrongSecret(t *testing.T) {
+	tc := newTestCluster(t, 3)
+	leader := tc.waitLeader(t)
+	for i, node := range tc.nodes {
+		if node != leader {
+			node.cfg.SetSecret("wrong")
+			err := node.Issue(binn.GenerateID(), time.Now().Add(time.Minute))
+			assert.NotNil(t, err, i)
+		}
+	}
+}
+
+func TestNewNodeRequiresSecret(t *testing.T) {
+	cfg := NewConfig("node0", "127.0.0.1:0")
+	cfg.SetLogOutput(io.Discard)
+	_, err := NewNode(cfg)
+	assert.NotNil(t, err)
+}
+
+func TestNodeRecoversStateFromDataDir(t *testing.T) {
+	// the raft address is kept in the configuration of the log,
+	// so the restarted node must listen on the same one
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	raftAddr := l.Addr().String()
+	l.Close()
+
+	dir := t.TempDir()
+	start := func() *Node {
+		cfg := NewConfig("node0", raftAddr)
+		cfg.SetPeers([]Peer{ { ID: "node0", RaftAddr: raftAddr, APIURL: "http://127.0.0.1:7001" } })
+		cfg.SetStorage(true, time.Duration(10) * time.Minute)
+		cfg.SetSecret("secret")
+		cfg.SetDataDir(dir)
+		cfg.SetHeartbeatTimeout(time.Duration(200) * time.Millisecond)
+		cfg.SetLogOutput(io.Discard)
+		node, err := NewNode(cfg)
+		require.Nil(t, err)
+		require.Nil(t, node.Bootstrap())
+		tc := &testCluster{ nodes: []*Node{ node } }
+		tc.waitLeader(t)
+		return node
+	}
+
+	node := start()
+	id := binn.GenerateID()
+	require.Nil(t, node.Issue(id, time.Now().Add(time.Minute)))
+	require.Nil(t, node.Add(binn.NewBottle(id, "hello", nil)))
+	require.Nil(t, node.Shutdown())
+
+	node = start()
+	defer node.Shutdown()
+	deadline := time.Now().Add(time.Duration(5) * time.Second)
+	for node.Len() != 1 && time.Now().Before(deadline) {
+		time.Sleep(time.Duration(20) * time.Millisecond)
+	}
+	assert.Equal(t, 1, node.Len())
+	c, err := node.Get()
+	require.Nil(t, err)
+	assert.Equal(t, "hello", c.Message().Text)
+}
+
+func TestAPIAddrFollowsPeerURL(t *testing.T) {
+	node := &Node{ cfg: NewConfig("a", ""), mux: &sync.RWMutex{} }
+	assert.Equal(t, DEFAULT_API_ADDR, node.APIAddr())
+
+	for url, addr := range map[string]string{
+		"http://10.0.0.1:7001": "10.0.0.1:7001",
+		"http://10.0.0.1": "10.0.0.1:80",
+		"https://node-a.internal": "node-a.internal:443",
+	} {
+		node.SetPeers([]Peer{ { ID: "a", RaftAddr: "10.0.0.1:7000", APIURL: url } })
+		assert.Equal(t, addr, node.APIAddr(), url)
+	}
+}
+
+// TestConformance runs against the leader, a follower may not have
+// applied the last throw when it is asked for a bottle
+func TestConformance(t *testing.T) {
+	keepertest.Run(t, func(t *testing.T, e time.Duration) *keepertest.Harness {
+		require.Equal(t, time.Duration(10) * time.Minute, e)
+		leader := newTestCluster(t, 3).waitLeader(t)
+		return &keepertest.Harness{ Keeper: leader, Issue: leader.Issue, DropsAttachments: true }
+	})
+}
+
+func TestParsePeers(t *testing.T) {
+	peers, err := ParsePeers([]string{ "a;127.0.0.1:7000;http://127.0.0.1:7001/" })
+	assert.Nil(t, err)
+	assert.Equal(t, []Peer{ { ID: "a", RaftAddr: "127.0.0.1:7000", APIURL: "http://127.0.0.1:7001" } }, peers)
+
+	_, err = ParsePeers([]string{ "a;127.0.0.1:7000" })
+	assert.NotNil(t, err)
+}
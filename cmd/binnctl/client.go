@@ -0,0 +1,282 @@
+package main
+
+import (
+	"io"
+	"os"
+	"fmt"
+	"time"
+	"bytes"
+	"bufio"
+	"context"
+	"net/url"
+	"net/http"
+	"path/filepath"
+	"mime/multipart"
+	"encoding/json"
+
+	"github.com/binn/server"
+)
+
+type Client struct {
+	baseURL    string
+	token      string
+	httpClient *http.Client
+}
+
+func NewClient(baseURL string, token string) *Client {
+	return &Client{
+		baseURL:    baseURL,
+		token:      token,
+		httpClient: &http.Client{},
+	}
+}
+
+func (c *Client) newRequest(ctx context.Context, method string, path string, body interface{}) (*http.Request, error) {
+	var r io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		r = bytes.NewReader(b)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, c.baseURL + path, r)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer " + c.token)
+	}
+	return req, nil
+}
+
+// do sends a request and decodes a json response into out,
+// a response with an unexpected status is returned as an error
+func (c *Client) do(ctx context.Context, method string, path string, body interface{}, status int, out interface{}) error {
+	req, err := c.newRequest(ctx, method, path, body)
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != status {
+		var er server.ErrorResponse
+		if b, _ := io.ReadAll(resp.Body); json.Unmarshal(b, &er) == nil && er.Error != "" {
+			return fmt.Errorf("%s %s: %d %s", method, path, resp.StatusCode, er.Error)
+		}
+		return fmt.Errorf("%s %s: %d %s", method, path, resp.StatusCode, http.StatusText(resp.StatusCode))
+	}
+
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// Stream calls f for every bottle sent on the stream until
+// ctx is done, f returns an error or n bottles are received
+func (c *Client) Stream(ctx context.Context, n int, f func(*server.ResponseBottle) error) error {
+	return c.StreamFiltered(ctx, n, nil, f)
+}
+
+// StreamFiltered is Stream receiving only bottles matching the
+// lang, tag and exclude_tag parameters of filter
+func (c *Client) StreamFiltered(ctx context.Context, n int, filter url.Values, f func(*server.ResponseBottle) error) error {
+	path := "/api/bottle"
+	if len(filter) > 0 {
+		path += "?" + filter.Encode()
+	}
+	req, err := c.newRequest(ctx, http.MethodGet, path, nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET /api/bottle: %d %s", resp.StatusCode, http.StatusText(resp.StatusCode))
+	}
+
+	r := bufio.NewReader(resp.Body)
+	for received := 0; n <= 0 || received < n; {
+		sm, err := server.ReadSSEMessage(r)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		if sm.Event != "bottle" {
+			continue
+		}
+
+		var b server.ResponseBottle
+		if err := json.Unmarshal([]byte(sm.Data), &b); err != nil {
+			return err
+		}
+		if err := f(&b); err != nil {
+			return err
+		}
+		received++
+	}
+
+	return nil
+}
+
+func (c *Client) Throw(ctx context.Context, id string, text string) error {
+	req := &server.RequestBottle{
+		ID:      id,
+		Message: &server.RequestMessage{ Text: text },
+	}
+	return c.do(ctx, http.MethodPost, "/api/bottle", req, http.StatusNoContent, nil)
+}
+
+// ThrowWithAttachments throws a bottle with the files at paths attached
+// as a multipart request
+func (c *Client) ThrowWithAttachments(ctx context.Context, id string, text string, paths []string) error {
+	body := &bytes.Buffer{}
+	mw := multipart.NewWriter(body)
+	part, err := mw.CreateFormField("bottle")
+	if err != nil {
+		return err
+	}
+	req := &server.RequestBottle{
+		ID:      id,
+		Message: &server.RequestMessage{ Text: text },
+	}
+	if err := json.NewEncoder(part).Encode(req); err != nil {
+		return err
+	}
+	for _, path := range paths {
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		part, err := mw.CreateFormFile("attachment", filepath.Base(path))
+		if err == nil {
+			_, err = io.Copy(part, f)
+		}
+		f.Close()
+		if err != nil {
+			return err
+		}
+	}
+	if err := mw.Close(); err != nil {
+		return err
+	}
+
+	r, err := http.NewRequestWithContext(ctx, http.MethodPost, c.baseURL + "/api/bottle", body)
+	if err != nil {
+		return err
+	}
+	r.Header.Set("Content-Type", mw.FormDataContentType())
+	if c.token != "" {
+		r.Header.Set("Authorization", "Bearer " + c.token)
+	}
+	resp, err := c.httpClient.Do(r)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNoContent {
+		var er server.ErrorResponse
+		if b, _ := io.ReadAll(resp.Body); json.Unmarshal(b, &er) == nil && er.Error != "" {
+			return fmt.Errorf("POST /api/bottle: %d %s", resp.StatusCode, er.Error)
+		}
+		return fmt.Errorf("POST /api/bottle: %d %s", resp.StatusCode, http.StatusText(resp.StatusCode))
+	}
+	return nil
+}
+
+func (c *Client) Engine(ctx context.Context) (*server.EngineStateResponse, error) {
+	var res server.EngineStateResponse
+	err := c.do(ctx, http.MethodGet, "/admin/engine", nil, http.StatusOK, &res)
+	return &res, err
+}
+
+func (c *Client) Reload(ctx context.Context) (*server.ReloadResponse, error) {
+	var res server.ReloadResponse
+	err := c.do(ctx, http.MethodPost, "/admin/reload", nil, http.StatusOK, &res)
+	return &res, err
+}
+
+func (c *Client) ListContainers(ctx context.Context, offset int, limit int) (*server.ContainerListResponse, error) {
+	var res server.ContainerListResponse
+	path := fmt.Sprintf("/admin/containers?offset=%d&limit=%d", offset, limit)
+	err := c.do(ctx, http.MethodGet, path, nil, http.StatusOK, &res)
+	return &res, err
+}
+
+func (c *Client) GetContainer(ctx context.Context, id string) (*server.ResponseBottle, error) {
+	var res server.ResponseBottle
+	err := c.do(ctx, http.MethodGet, "/admin/containers/" + url.PathEscape(id), nil, http.StatusOK, &res)
+	return &res, err
+}
+
+func (c *Client) DeleteContainer(ctx context.Context, id string) error {
+	return c.do(ctx, http.MethodDelete, "/admin/containers/" + url.PathEscape(id), nil, http.StatusNoContent, nil)
+}
+
+func (c *Client) InjectContainer(ctx context.Context, text string, expiredAt *time.Time) (*server.ResponseBottle, error) {
+	req := &server.RequestBottle{
+		Message:   &server.RequestMessage{ Text: text },
+		ExpiredAt: expiredAt,
+	}
+	var res server.ResponseBottle
+	err := c.do(ctx, http.MethodPost, "/admin/containers", req, http.StatusCreated, &res)
+	return &res, err
+}
+
+func (c *Client) QuarantineContainer(ctx context.Context, id string) error {
+	path := "/admin/containers/" + url.PathEscape(id) + "/quarantine"
+	return c.do(ctx, http.MethodPost, path, nil, http.StatusNoContent, nil)
+}
+
+func (c *Client) ListQuarantine(ctx context.Context) (*server.ContainerListResponse, error) {
+	var res server.ContainerListResponse
+	err := c.do(ctx, http.MethodGet, "/admin/quarantine", nil, http.StatusOK, &res)
+	return &res, err
+}
+
+func (c *Client) ReleaseContainer(ctx context.Context, id string) error {
+	path := "/admin/quarantine/" + url.PathEscape(id) + "/release"
+	return c.do(ctx, http.MethodPost, path, nil, http.StatusNoContent, nil)
+}
+
+func (c *Client) ListIDs(ctx context.Context, offset int, limit int) (*server.IDListResponse, error) {
+	var res server.IDListResponse
+	path := fmt.Sprintf("/admin/ids?offset=%d&limit=%d", offset, limit)
+	err := c.do(ctx, http.MethodGet, path, nil, http.StatusOK, &res)
+	return &res, err
+}
+
+func (c *Client) RevokeID(ctx context.Context, id string) error {
+	return c.do(ctx, http.MethodDelete, "/admin/ids/" + url.PathEscape(id), nil, http.StatusNoContent, nil)
+}
+
+func (c *Client) ListAudit(ctx context.Context, offset int, limit int) (*server.AuditListResponse, error) {
+	var res server.AuditListResponse
+	path := fmt.Sprintf("/admin/audit?offset=%d&limit=%d", offset, limit)
+	err := c.do(ctx, http.MethodGet, path, nil, http.StatusOK, &res)
+	return &res, err
+}
+
+func (c *Client) Lineage(ctx context.Context, id string) (*server.AuditListResponse, error) {
+	var res server.AuditListResponse
+	err := c.do(ctx, http.MethodGet, "/admin/audit/" + url.PathEscape(id), nil, http.StatusOK, &res)
+	return &res, err
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"os"
+	"time"
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+	"path/filepath"
+	"net/http/httptest"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/binn/binn"
+	"github.com/binn/server"
+)
+
+func newTestServer(deliveryCycle time.Duration) (*httptest.Server, *binn.ContainerStorage, *binn.IDStorage, context.CancelFunc) {
+	ecfg := binn.DefaultConfig()
+	ecfg.SetDeliveryCycle(deliveryCycle)
+	scfg := server.NewConfig(10, false)
+	scfg.SetAdminToken("secret")
+
+	idStorage := binn.DefaultIDStorage()
+	storage := binn.NewContainerStorage(true, time.Duration(10)*time.Minute, idStorage)
+	engine := binn.NewEngine(ecfg, storage)
+
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	engine.Run(ctx)
+
+	srv := httptest.NewServer(server.NewServer(engine, "", scfg).Handler)
+	return srv, storage, idStorage, func() {
+		srv.Close()
+		cancelFunc()
+	}
+}
+
+func TestStreamAndThrow(t *testing.T) {
+	srv, storage, _, closeFunc := newTestServer(time.Duration(1) * time.Millisecond)
+	defer closeFunc()
+
+	_, _ = storage.Inject(binn.NewBottle("", "Hello", nil))
+
+	client := NewClient(srv.URL, "secret")
+	ctx, cancelFunc := context.WithTimeout(context.Background(), time.Duration(1) * time.Second)
+	defer cancelFunc()
+
+	var received *server.ResponseBottle
+	err := client.Stream(ctx, 1, func(b *server.ResponseBottle) error {
+		received = b
+		return nil
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, "Hello", received.Message.Text)
+
+	err = client.Throw(ctx, received.ID, "Hello again")
+	assert.Nil(t, err)
+}
+
+func TestAdminCommands(t *testing.T) {
+	srv, storage, _, closeFunc := newTestServer(time.Duration(10) * time.Minute)
+	defer closeFunc()
+
+	c, _ := storage.Inject(binn.NewBottle("", "Hello", nil))
+
+	var out bytes.Buffer
+	err := run(context.Background(),
+		[]string{"-server", srv.URL, "-token", "secret", "admin", "get", c.ID()},
+		strings.NewReader(""), &out)
+	assert.Nil(t, err)
+	assert.Contains(t, out.String(), "message:    Hello")
+
+	out.Reset()
+	err = run(context.Background(),
+		[]string{"-server", srv.URL, "-token", "secret", "-json", "admin", "delete", c.ID()},
+		strings.NewReader(""), &out)
+	assert.Nil(t, err)
+	assert.Equal(t, "{\"result\":\"deleted " + c.ID() + "\"}\n", out.String())
+	assert.Equal(t, 0, storage.Len())
+
+	err = run(context.Background(),
+		[]string{"-server", srv.URL, "-token", "wrong", "admin", "engine"},
+		strings.NewReader(""), &out)
+	assert.Error(t, err)
+}
+
+func TestExportAndImport(t *testing.T) {
+	src, srcStorage, _, closeSrc := newTestServer(time.Duration(10) * time.Minute)
+	defer closeSrc()
+	dst, dstStorage, dstIDStorage, closeDst := newTestServer(time.Duration(10) * time.Minute)
+	defer closeDst()
+
+	_, _ = srcStorage.Inject(binn.NewBottle("", "first", nil))
+	_, _ = srcStorage.Inject(binn.NewBottle("", "second", nil))
+
+	var ocean bytes.Buffer
+	err := NewClient(src.URL, "secret").Export(context.Background(), &ocean)
+	assert.Nil(t, err)
+
+	err = NewClient(dst.URL, "secret").Import(context.Background(), &ocean)
+	assert.Nil(t, err)
+
+	assert.Equal(t, srcStorage.List(0, 10), dstStorage.List(0, 10))
+	assert.Equal(t, 2, dstIDStorage.Len())
+}
+
+func TestThrowWithAttachments(t *testing.T) {
+	ecfg := binn.DefaultConfig()
+	storage := binn.NewContainerStorage(true, time.Duration(10)*time.Minute, binn.DefaultIDStorage())
+	engine := binn.NewEngine(ecfg, storage)
+	blobs, err := binn.NewFileBlobStore(t.TempDir())
+	assert.Nil(t, err)
+	scfg := server.NewConfig(10, false)
+	scfg.SetAttachments(server.NewAttachments(blobs, []byte("secret"), 1024))
+
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	defer cancelFunc()
+	engine.Run(ctx)
+	srv := httptest.NewServer(server.NewServer(engine, "", scfg).Handler)
+	defer srv.Close()
+
+	c, _ := storage.Inject(binn.NewBottle("", "Hello", nil))
+	path := filepath.Join(t.TempDir(), "doodle.gif")
+	assert.Nil(t, os.WriteFile(path, []byte("GIF89a"), 0600))
+
+	var out bytes.Buffer
+	err = run(ctx, []string{"-server", srv.URL, "throw", "-id", c.ID(), "-attach", path, "Hello again"},
+		strings.NewReader(""), &out)
+	assert.Nil(t, err)
+
+	for i := 0; i < 100 && storage.Len() < 2; i++ {
+		time.Sleep(time.Duration(1) * time.Millisecond)
+	}
+	reply := storage.List(1, 1)
+	if assert.Equal(t, 1, len(reply)) {
+		assert.Equal(t, "Hello again", reply[0].Message().Text)
+		assert.Equal(t, "image/gif", reply[0].Message().Attachments[0].ContentType)
+	}
+
+	err = run(ctx, []string{"-server", srv.URL, "throw", "-id", c.ID(), "-attach", path + ".missing", "Hello"},
+		strings.NewReader(""), &out)
+	assert.NotNil(t, err)
+}
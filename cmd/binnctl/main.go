@@ -0,0 +1,339 @@
+package main
+
+import (
+	"io"
+	"os"
+	"fmt"
+	"flag"
+	"strings"
+	"context"
+	"net/url"
+	"os/signal"
+)
+
+const usage = `usage: binnctl [-server URL] [-token TOKEN] [-json] COMMAND [ARGS]
+
+commands:
+  stream [-n N] [-lang L] [-tag T] [-exclude-tag T]
+                                receive bottles from the ocean
+  throw -id ID [-attach FILE] TEXT
+                                throw a bottle back with a received id
+  export [-o FILE]              write a snapshot of the ocean
+  import [-i FILE]              replace the ocean with a snapshot
+  admin engine                  show the engine state
+  admin reload                  reload the server config
+  admin containers [-offset N] [-limit N]
+  admin get ID
+  admin delete ID
+  admin inject TEXT
+  admin quarantine ID
+  admin quarantined
+  admin release ID
+  admin ids [-offset N] [-limit N]
+  admin revoke ID
+  admin audit [-offset N] [-limit N]
+  admin lineage ID              show every event of the bottle which had ID
+`
+
+func getenv(key string, defaultValue string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return defaultValue
+}
+
+func main() {
+	ctx, cancelFunc := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer cancelFunc()
+
+	if err := run(ctx, os.Args[1:], os.Stdin, os.Stdout); err != nil {
+		fmt.Fprintf(os.Stderr, "binnctl: %s\n", err)
+		os.Exit(1)
+	}
+}
+
+func run(ctx context.Context, args []string, stdin io.Reader, stdout io.Writer) error {
+	fs := flag.NewFlagSet("binnctl", flag.ContinueOnError)
+	fs.Usage = func() { fmt.Fprint(fs.Output(), usage) }
+	serverURL := fs.String("server", getenv("BINN_SERVER", "http://localhost:8080"), "base url of the binn server")
+	token := fs.String("token", os.Getenv("BINN_ADMIN_TOKEN"), "admin token")
+	asJSON := fs.Bool("json", false, "print json instead of text")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return fmt.Errorf("command is required")
+	}
+
+	client := NewClient(strings.TrimRight(*serverURL, "/"), *token)
+	printer := NewPrinter(stdout, *asJSON)
+
+	cmd, args := fs.Arg(0), fs.Args()[1:]
+	switch cmd {
+	case "stream":
+		return runStream(ctx, client, printer, args)
+	case "throw":
+		return runThrow(ctx, client, printer, args, stdin)
+	case "export":
+		return runExport(ctx, client, printer, args, stdout)
+	case "import":
+		return runImport(ctx, client, printer, args, stdin)
+	case "admin":
+		return runAdmin(ctx, client, printer, args)
+	default:
+		fs.Usage()
+		return fmt.Errorf("unknown command %#v", cmd)
+	}
+}
+
+// fileList is a flag given once for every file
+type fileList []string
+
+func (l *fileList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *fileList) Set(path string) error {
+	*l = append(*l, path)
+	return nil
+}
+
+func runStream(ctx context.Context, client *Client, printer *Printer, args []string) error {
+	fs := flag.NewFlagSet("stream", flag.ContinueOnError)
+	n := fs.Int("n", 0, "stop after n bottles, 0 streams forever")
+	lang := fs.String("lang", "", "comma separated languages to receive")
+	tag := fs.String("tag", "", "comma separated tags to receive")
+	excludeTag := fs.String("exclude-tag", "", "comma separated tags not to receive")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	filter := url.Values{}
+	for key, v := range map[string]string{ "lang": *lang, "tag": *tag, "exclude_tag": *excludeTag } {
+		if v != "" {
+			filter.Set(key, v)
+		}
+	}
+	return client.StreamFiltered(ctx, *n, filter, printer.Bottle)
+}
+
+func runThrow(ctx context.Context, client *Client, printer *Printer, args []string, stdin io.Reader) error {
+	fs := flag.NewFlagSet("throw", flag.ContinueOnError)
+	id := fs.String("id", "", "id of a received bottle")
+	attachments := &fileList{}
+	fs.Var(attachments, "attach", "file to attach, repeat for more files")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *id == "" {
+		return fmt.Errorf("-id is required")
+	}
+
+	text := strings.Join(fs.Args(), " ")
+	if text == "" || text == "-" {
+		b, err := io.ReadAll(stdin)
+		if err != nil {
+			return err
+		}
+		text = strings.TrimRight(string(b), "\n")
+	}
+
+	throw := client.Throw
+	if len(*attachments) > 0 {
+		throw = func(ctx context.Context, id string, text string) error {
+			return client.ThrowWithAttachments(ctx, id, text, *attachments)
+		}
+	}
+	if err := throw(ctx, *id, text); err != nil {
+		return err
+	}
+	return printer.Done("threw a bottle")
+}
+
+func runExport(ctx context.Context, client *Client, printer *Printer, args []string, stdout io.Writer) error {
+	fs := flag.NewFlagSet("export", flag.ContinueOnError)
+	path := fs.String("o", "-", "output file, - writes to stdout")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if *path == "-" {
+		return client.Export(ctx, stdout)
+	}
+
+	f, err := os.Create(*path)
+	if err != nil {
+		return err
+	}
+	err = client.Export(ctx, f)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return printer.Done("exported to %s", *path)
+}
+
+func runImport(ctx context.Context, client *Client, printer *Printer, args []string, stdin io.Reader) error {
+	fs := flag.NewFlagSet("import", flag.ContinueOnError)
+	path := fs.String("i", "-", "input file, - reads from stdin")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	r := stdin
+	if *path != "-" {
+		f, err := os.Open(*path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+
+	if err := client.Import(ctx, r); err != nil {
+		return err
+	}
+	return printer.Done("imported")
+}
+
+func parsePageFlags(name string, args []string) (int, int, error) {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	offset := fs.Int("offset", 0, "index of the first item")
+	limit := fs.Int("limit", 50, "number of items")
+	if err := fs.Parse(args); err != nil {
+		return 0, 0, err
+	}
+	return *offset, *limit, nil
+}
+
+func runAdmin(ctx context.Context, client *Client, printer *Printer, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("admin command is required")
+	}
+
+	cmd, args := args[0], args[1:]
+	arg := func() (string, error) {
+		if len(args) != 1 {
+			return "", fmt.Errorf("admin %s requires one argument", cmd)
+		}
+		return args[0], nil
+	}
+
+	switch cmd {
+	case "engine":
+		res, err := client.Engine(ctx)
+		if err != nil {
+			return err
+		}
+		return printer.Engine(res)
+	case "reload":
+		res, err := client.Reload(ctx)
+		if err != nil {
+			return err
+		}
+		return printer.Reload(res)
+	case "containers":
+		offset, limit, err := parsePageFlags(cmd, args)
+		if err != nil {
+			return err
+		}
+		res, err := client.ListContainers(ctx, offset, limit)
+		if err != nil {
+			return err
+		}
+		return printer.Bottles(res)
+	case "get":
+		id, err := arg()
+		if err != nil {
+			return err
+		}
+		res, err := client.GetContainer(ctx, id)
+		if err != nil {
+			return err
+		}
+		return printer.Bottle(res)
+	case "delete":
+		id, err := arg()
+		if err != nil {
+			return err
+		}
+		if err := client.DeleteContainer(ctx, id); err != nil {
+			return err
+		}
+		return printer.Done("deleted %s", id)
+	case "inject":
+		res, err := client.InjectContainer(ctx, strings.Join(args, " "), nil)
+		if err != nil {
+			return err
+		}
+		return printer.Bottle(res)
+	case "quarantine":
+		id, err := arg()
+		if err != nil {
+			return err
+		}
+		if err := client.QuarantineContainer(ctx, id); err != nil {
+			return err
+		}
+		return printer.Done("quarantined %s", id)
+	case "quarantined":
+		res, err := client.ListQuarantine(ctx)
+		if err != nil {
+			return err
+		}
+		return printer.Bottles(res)
+	case "release":
+		id, err := arg()
+		if err != nil {
+			return err
+		}
+		if err := client.ReleaseContainer(ctx, id); err != nil {
+			return err
+		}
+		return printer.Done("released %s", id)
+	case "ids":
+		offset, limit, err := parsePageFlags(cmd, args)
+		if err != nil {
+			return err
+		}
+		res, err := client.ListIDs(ctx, offset, limit)
+		if err != nil {
+			return err
+		}
+		return printer.IDs(res)
+	case "revoke":
+		id, err := arg()
+		if err != nil {
+			return err
+		}
+		if err := client.RevokeID(ctx, id); err != nil {
+			return err
+		}
+		return printer.Done("revoked %s", id)
+	case "audit":
+		offset, limit, err := parsePageFlags(cmd, args)
+		if err != nil {
+			return err
+		}
+		res, err := client.ListAudit(ctx, offset, limit)
+		if err != nil {
+			return err
+		}
+		return printer.Audit(res)
+	case "lineage":
+		id, err := arg()
+		if err != nil {
+			return err
+		}
+		res, err := client.Lineage(ctx, id)
+		if err != nil {
+			return err
+		}
+		return printer.Audit(res)
+	default:
+		return fmt.Errorf("unknown admin command %#v", cmd)
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"io"
+	"fmt"
+	"context"
+	"net/http"
+)
+
+// Export writes the snapshot of the ocean to w as ndjson
+func (c *Client) Export(ctx context.Context, w io.Writer) error {
+	req, err := c.newRequest(ctx, http.MethodGet, "/admin/snapshot", nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET /admin/snapshot: %d %s", resp.StatusCode, http.StatusText(resp.StatusCode))
+	}
+
+	_, err = io.Copy(w, resp.Body)
+	return err
+}
+
+// Import replaces the ocean with the snapshot read from r
+func (c *Client) Import(ctx context.Context, r io.Reader) error {
+	req, err := c.newRequest(ctx, http.MethodPut, "/admin/snapshot", nil)
+	if err != nil {
+		return err
+	}
+	req.Body = io.NopCloser(r)
+	req.Header.Set("Content-Type", "application/x-ndjson")
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNoContent {
+		return fmt.Errorf("PUT /admin/snapshot: %d %s", resp.StatusCode, http.StatusText(resp.StatusCode))
+	}
+	return nil
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"io"
+	"fmt"
+	"time"
+	"strings"
+	"encoding/json"
+
+	"github.com/binn/server"
+)
+
+type Printer struct {
+	w    io.Writer
+	json bool
+}
+
+func NewPrinter(w io.Writer, asJSON bool) *Printer {
+	return &Printer{
+		w:    w,
+		json: asJSON,
+	}
+}
+
+func (p *Printer) printJSON(v interface{}) error {
+	return json.NewEncoder(p.w).Encode(v)
+}
+
+func formatTime(t *time.Time) string {
+	if t == nil {
+		return "-"
+	}
+	return t.Format(time.RFC3339)
+}
+
+func (p *Printer) Bottle(b *server.ResponseBottle) error {
+	if p.json {
+		return p.printJSON(b)
+	}
+
+	text := ""
+	if b.Message != nil {
+		text = b.Message.Text
+	}
+	if _, err := fmt.Fprintf(p.w, "id:         %s\nexpired at: %s\n", b.ID, formatTime(b.ExpiredAt)); err != nil {
+		return err
+	}
+	if m := b.Message; m != nil {
+		if m.CreatedAt != nil {
+			fmt.Fprintf(p.w, "created at: %s\n", formatTime(m.CreatedAt))
+		}
+		if m.Language != "" {
+			fmt.Fprintf(p.w, "language:   %s\n", m.Language)
+		}
+		if len(m.Tags) != 0 {
+			fmt.Fprintf(p.w, "tags:       %s\n", strings.Join(m.Tags, ", "))
+		}
+		if m.Signature != "" {
+			fmt.Fprintf(p.w, "signature:  %s\n", m.Signature)
+		}
+		if m.Hops != 0 {
+			fmt.Fprintf(p.w, "hops:       %d\n", m.Hops)
+		}
+		for _, a := range m.Attachments {
+			fmt.Fprintf(p.w, "attachment: %s %d bytes %s\n", a.ContentType, a.Size, a.URL)
+		}
+	}
+	_, err := fmt.Fprintf(p.w, "message:    %s\n\n", text)
+	return err
+}
+
+func (p *Printer) Bottles(res *server.ContainerListResponse) error {
+	if p.json {
+		return p.printJSON(res)
+	}
+
+	for _, b := range res.Containers {
+		if err := p.Bottle(b); err != nil {
+			return err
+		}
+	}
+	_, err := fmt.Fprintf(p.w, "%d-%d of %d containers\n",
+		res.Offset, res.Offset + len(res.Containers), res.Total)
+	return err
+}
+
+func (p *Printer) IDs(res *server.IDListResponse) error {
+	if p.json {
+		return p.printJSON(res)
+	}
+
+	for _, id := range res.IDs {
+		if _, err := fmt.Fprintf(p.w, "%s\t%s\n", id.ID, formatTime(&id.ExpiredAt)); err != nil {
+			return err
+		}
+	}
+	_, err := fmt.Fprintf(p.w, "%d-%d of %d ids\n",
+		res.Offset, res.Offset + len(res.IDs), res.Total)
+	return err
+}
+
+func (p *Printer) Audit(res *server.AuditListResponse) error {
+	if p.json {
+		return p.printJSON(res)
+	}
+
+	for _, e := range res.Events {
+		if _, err := fmt.Fprintf(p.w, "%d\t%s\t%s\t%s -> %s\t%s\n",
+			e.Seq, formatTime(&e.Time), e.Type, e.ID, e.NewID, e.Reason); err != nil {
+			return err
+		}
+	}
+	_, err := fmt.Fprintf(p.w, "%d-%d of %d events\n",
+		res.Offset, res.Offset + len(res.Events), res.Total)
+	return err
+}
+
+func (p *Printer) Engine(res *server.EngineStateResponse) error {
+	if p.json {
+		return p.printJSON(res)
+	}
+
+	_, err := fmt.Fprintf(p.w, `running:            %t
+seed:               %d
+delivery cycle sec: %f
+validation:         %t
+generate cycle sec: %f
+debug:              %t
+containers:         %d
+quarantined:        %d
+ids:                %d
+in queue:           %d
+out queue:          %d
+`,
+		res.Running,
+		res.Config.Seed,
+		res.Config.DeliveryCycleSec,
+		res.Config.Validation,
+		res.Config.GenerateCycleSec,
+		res.Config.Debug,
+		res.Containers,
+		res.Quarantined,
+		res.IDs,
+		res.InQueue,
+		res.OutQueue,
+	)
+	return err
+}
+
+func (p *Printer) Reload(res *server.ReloadResponse) error {
+	if p.json {
+		return p.printJSON(res)
+	}
+
+	for _, change := range res.Changes {
+		if _, err := fmt.Fprintln(p.w, change); err != nil {
+			return err
+		}
+	}
+	_, err := fmt.Fprintf(p.w, "%d changes\n", len(res.Changes))
+	return err
+}
+
+func (p *Printer) Done(format string, v ...interface{}) error {
+	if p.json {
+		return p.printJSON(map[string]string{ "result": fmt.Sprintf(format, v...) })
+	}
+
+	_, err := fmt.Fprintf(p.w, format + "\n", v...)
+	return err
+}
@@ -1,14 +1,27 @@
 package main
 
 import (
+	"io"
 	"os"
 	"fmt"
+	"log"
 	"time"
+	"bufio"
+	"strings"
 	"context"
 	"strconv"
+	"syscall"
+	"net/http"
+	"os/signal"
 
 	"github.com/binn/server"
 	"github.com/binn/binn"
+	"github.com/binn/cluster"
+	"github.com/binn/boltstore"
+	"github.com/binn/sqlstore"
+	"github.com/binn/redisstore"
+	_ "modernc.org/sqlite"
+	"go.opentelemetry.io/otel"
 )
 
 func printEngineConfig(cfg *binn.Config) {
@@ -18,12 +31,17 @@ func printEngineConfig(cfg *binn.Config) {
 	fmt.Printf("\t%s: %t\n", "Enable validation", cfg.Validation())
 	fmt.Printf("\t%s: %f\n", "Generate cycle sec", cfg.GenerateCycle().Seconds())
 	fmt.Printf("\t%s: %t\n", "Enable debug", cfg.Debug())
+	fmt.Printf("\t%s: %s\n", "Logger", cfg.Logger())
 }
 
 func printServerConfig(cfg *server.Config) {
 	fmt.Printf("%s:\n", "Server")
 	fmt.Printf("\t%s: %d\n", "Send empty sec", cfg.SendEmptySec())
 	fmt.Printf("\t%s: %t\n", "Enable debug", cfg.Debug())
+	fmt.Printf("\t%s: %t\n", "Admin token", cfg.AdminToken() != "")
+	fmt.Printf("\t%s: %t\n", "Local admin", cfg.LocalAdmin())
+	fmt.Printf("\t%s: %t\n", "Enable auth", cfg.Auth() != nil)
+	fmt.Printf("\t%s: %t\n", "Enable attachments", cfg.Attachments() != nil)
 }
 
 func loadEnvAsInt(key string, defaultValue int) int {
@@ -46,38 +64,608 @@ func loadEnvAsBool(key string, defaultValue bool) bool {
 	return v
 }
 
-func loadEngineConfigFromEnv() *binn.Config {
+func loadEnvAsList(key string, defaultValue []string) []string {
+	s := os.Getenv(key)
+	if s == "" {
+		return defaultValue
+	}
+	v := []string{}
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			v = append(v, item)
+		}
+	}
+	return v
+}
+
+// loadEnvFile sets every KEY=VALUE line of the file at path
+// as an environment variable, it is reread on SIGHUP
+func loadEnvFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		kv := strings.SplitN(line, "=", 2)
+		if len(kv) != 2 {
+			return fmt.Errorf("%s:%d: invalid line %#v", path, n, line)
+		}
+		key := strings.TrimSpace(kv[0])
+		value := strings.Trim(strings.TrimSpace(kv[1]), "\"'")
+		if err := os.Setenv(key, value); err != nil {
+			return err
+		}
+	}
+
+	return scanner.Err()
+}
+
+func restoreSnapshotFile(path string, storage binn.Snapshotter) error {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return storage.Restore(f)
+}
+
+type migrator interface {
+	Migrate(r io.Reader) error
+}
+
+// migrateSnapshotFile moves the ocean of a snapshot file into a new bolt
+// file or database, it does nothing once they have been used
+func migrateSnapshotFile(path string, storage migrator) error {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	err = storage.Migrate(f)
+	if err != nil && err != boltstore.ErrNotEmpty && err != sqlstore.ErrNotEmpty && err != redisstore.ErrNotEmpty {
+		return err
+	}
+	return nil
+}
+
+// saveSnapshotFile writes to a temporary file and renames it,
+// so a crash while saving never leaves a broken snapshot
+func saveSnapshotFile(path string, storage binn.Snapshotter) error {
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if err := storage.Snapshot(f); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, path)
+}
+
+func loadConfigFromEnv() (*binn.Config, *server.Config, error) {
+	logger, err := loadLoggerFromEnv()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	ecfg, err := loadEngineConfigFromEnv()
+	if err != nil {
+		return nil, nil, err
+	}
+	ecfg.SetLogger(logger.With(binn.F("component", "engine")))
+
+	scfg, err := loadServerConfigFromEnv()
+	if err != nil {
+		return nil, nil, err
+	}
+	scfg.SetLogger(logger.With(binn.F("component", "server")))
+
+	return ecfg, scfg, nil
+}
+
+// storageLogger derives the storage logger from the engine logger,
+// so it follows the engine debug setting
+func storageLogger(ecfg *binn.Config) *binn.Logger {
+	base, err := loadLoggerFromEnv()
+	if err != nil {
+		return ecfg.Logger()
+	}
+	return base.WithLevel(ecfg.Logger().Level()).With(binn.F("component", "storage"))
+}
+
+func reloadConfig(engine *binn.Engine, scfg *server.Config, storage *binn.ContainerStorage) ([]string, error) {
+	if path := os.Getenv("BINN_CONFIG_FILE"); path != "" {
+		if err := loadEnvFile(path); err != nil {
+			return nil, err
+		}
+	}
+
+	necfg, nscfg, err := loadConfigFromEnv()
+	if err != nil {
+		return nil, err
+	}
+
+	// the tracer is created once at startup and survives reloads
+	necfg.SetTracer(engine.GetConfig().Tracer())
+	nscfg.SetTracer(scfg.Tracer())
+	nscfg.SetWebhooks(scfg.Webhooks())
+	nscfg.SetFederation(scfg.Federation())
+	nscfg.SetAttachments(scfg.Attachments())
+
+	changes, err := engine.Reload(necfg)
+	if err != nil {
+		return nil, err
+	}
+	changes = append(changes, scfg.Update(nscfg)...)
+	storage.SetLogger(storageLogger(engine.GetConfig()))
+	if sharded, ok := engine.GetStorage().(*binn.ShardedContainerStorage); ok {
+		sharded.SetLogger(storageLogger(engine.GetConfig()))
+	}
+
+	logger := scfg.Logger()
+	ecfg := engine.GetConfig()
+	if ecfg.InQueueSize() != necfg.InQueueSize() || ecfg.OutQueueSize() != necfg.OutQueueSize() {
+		logger.Warn("queue sizes are applied on restart",
+			binn.F("in_queue_size", necfg.InQueueSize()),
+			binn.F("out_queue_size", necfg.OutQueueSize()),
+		)
+	}
+	for _, change := range changes {
+		logger.Info("reload config", binn.F("change", change))
+	}
+	return changes, nil
+}
+
+// loadTracerFromEnv returns a nil tracer unless BINN_OTLP_ENDPOINT is set,
+// shutdown flushes the spans left
+func loadTracerFromEnv(ctx context.Context) (*binn.Tracer, func(ctx context.Context) error, error) {
+	endpoint := os.Getenv("BINN_OTLP_ENDPOINT")
+	if endpoint == "" {
+		return nil, nil, nil
+	}
+	serviceName := os.Getenv("BINN_SERVICE_NAME")
+	if serviceName == "" {
+		serviceName = "binn"
+	}
+
+	headers := map[string]string{}
+	for _, header := range loadEnvAsList("BINN_OTLP_HEADERS", []string{}) {
+		kv := strings.SplitN(header, "=", 2)
+		if len(kv) == 2 {
+			headers[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+		}
+	}
+	flushInterval := time.Duration(loadEnvAsInt("BINN_OTLP_FLUSH_SEC", 5)) * time.Second
+	return binn.NewOTLPTracer(ctx, endpoint, serviceName, headers, flushInterval)
+}
+
+// auditConfigured tells whether a audit env was set, the audit log is on by default
+func auditConfigured() bool {
+	for _, key := range []string{ "BINN_AUDIT_MAX_EVENTS", "BINN_AUDIT_RETENTION_HOUR", "BINN_AUDIT_SALT", "BINN_AUDIT_FILE" } {
+		if os.Getenv(key) != "" {
+			return true
+		}
+	}
+	return false
+}
+
+func loadAuditLogFromEnv() (*binn.AuditLog, *os.File, error) {
+	maxEvents := loadEnvAsInt("BINN_AUDIT_MAX_EVENTS", binn.DEFAULT_AUDIT_MAX_EVENTS)
+	if maxEvents <= 0 {
+		return nil, nil, nil
+	}
+	maxAge := time.Duration(loadEnvAsInt("BINN_AUDIT_RETENTION_HOUR", int(binn.DEFAULT_AUDIT_MAX_AGE / time.Hour))) * time.Hour
+
+	// without a configured salt client hashes only correlate within one process
+	salt := os.Getenv("BINN_AUDIT_SALT")
+	if salt == "" {
+		salt = binn.GenerateID()
+	}
+	audit := binn.NewAuditLog(maxEvents, maxAge, salt)
+
+	path := os.Getenv("BINN_AUDIT_FILE")
+	if path == "" {
+		return audit, nil, nil
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, nil, err
+	}
+	audit.SetWriter(f)
+	return audit, f, nil
+}
+
+func loadWebhooksFromEnv() (*binn.Webhooks, error) {
+	items := loadEnvAsList("BINN_WEBHOOKS", []string{})
+	if len(items) == 0 {
+		return nil, nil
+	}
+	subs, err := binn.ParseWebhookSubscriptions(items)
+	if err != nil {
+		return nil, err
+	}
+
+	webhooks := binn.NewWebhooks(subs)
+	webhooks.SetRetry(
+		loadEnvAsInt("BINN_WEBHOOK_MAX_ATTEMPTS", binn.DEFAULT_WEBHOOK_MAX_ATTEMPTS),
+		time.Duration(loadEnvAsInt("BINN_WEBHOOK_BACKOFF_SEC", 1)) * time.Second,
+		time.Duration(loadEnvAsInt("BINN_WEBHOOK_MAX_BACKOFF_SEC", 60)) * time.Second,
+	)
+	return webhooks, nil
+}
+
+// loadClusterFromEnv returns nil unless BINN_CLUSTER_NODE_ID is set,
+// every node must be given the same peers
+func loadClusterFromEnv(logger *binn.Logger) (*cluster.Node, error) {
+	id := os.Getenv("BINN_CLUSTER_NODE_ID")
+	if id == "" {
+		return nil, nil
+	}
+	peers, err := cluster.ParsePeers(loadEnvAsList("BINN_CLUSTER_PEERS", []string{}))
+	if err != nil {
+		return nil, err
+	}
+
+	raftAddr := os.Getenv("BINN_CLUSTER_RAFT_ADDR")
+	if raftAddr == "" {
+		raftAddr = ":7000"
+	}
+	cfg := cluster.NewConfig(id, raftAddr)
+	cfg.SetPeers(peers)
+	cfg.SetStorage(true, time.Duration(10)*time.Minute)
+	cfg.SetSecret(os.Getenv("BINN_CLUSTER_SECRET"))
+	dataDir := os.Getenv("BINN_CLUSTER_DATA_DIR")
+	if dataDir == "" {
+		dataDir = "raft"
+	}
+	cfg.SetDataDir(dataDir)
+	cfg.SetLogger(logger)
+
+	node, err := cluster.NewNode(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if err := node.Bootstrap(); err != nil {
+		node.Shutdown()
+		return nil, err
+	}
+	return node, nil
+}
+
+func loadFederationFromEnv(storage binn.Drifter) (*binn.Federation, error) {
+	name := os.Getenv("BINN_FEDERATION_NAME")
+	if name == "" {
+		return nil, nil
+	}
+	peers, err := binn.ParseFederationPeers(loadEnvAsList("BINN_FEDERATION_PEERS", []string{}))
+	if err != nil {
+		return nil, err
+	}
+
+	federation := binn.NewFederation(name, peers, storage)
+	federation.SetCycle(time.Duration(loadEnvAsInt("BINN_FEDERATION_CYCLE_SEC", 300)) * time.Second)
+	federation.SetSample(loadEnvAsInt("BINN_FEDERATION_SAMPLE", binn.DEFAULT_FEDERATION_SAMPLE))
+	for _, peer := range loadEnvAsList("BINN_FEDERATION_DEFEDERATED", []string{}) {
+		if err := federation.Defederate(peer); err != nil {
+			return nil, err
+		}
+	}
+	return federation, nil
+}
+
+// loadAttachmentsFromEnv returns nil unless BINN_ATTACHMENT_DIR is set
+func loadAttachmentsFromEnv() (*server.Attachments, error) {
+	dir := os.Getenv("BINN_ATTACHMENT_DIR")
+	if dir == "" {
+		return nil, nil
+	}
+	store, err := binn.NewFileBlobStore(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	// without a configured secret urls are only valid within one process
+	secret := os.Getenv("BINN_ATTACHMENT_SECRET")
+	if secret == "" {
+		secret = binn.GenerateID()
+	}
+	maxSize := loadEnvAsInt("BINN_ATTACHMENT_MAX_SIZE", server.DEFAULT_ATTACHMENT_MAX_SIZE)
+	attachments := server.NewAttachments(store, []byte(secret), int64(maxSize))
+	attachments.SetSweepCycle(time.Duration(loadEnvAsInt("BINN_ATTACHMENT_SWEEP_SEC", 60)) * time.Second)
+	return attachments, nil
+}
+
+func loadLoggerFromEnv() (*binn.Logger, error) {
+	level, err := binn.ParseLevel(os.Getenv("BINN_LOG_LEVEL"))
+	if err != nil {
+		return nil, err
+	}
+	format, err := binn.ParseLogFormat(os.Getenv("BINN_LOG_FORMAT"))
+	if err != nil {
+		return nil, err
+	}
+	redact := loadEnvAsBool("BINN_LOG_REDACT_MESSAGES", false)
+	return binn.NewLogger(os.Stderr, level, format, redact), nil
+}
+
+func loadEngineConfigFromEnv() (*binn.Config, error) {
 	seed := loadEnvAsInt("BINN_SEED", 42)
 	deliveryCycleSec := loadEnvAsInt("BINN_DELIVERY_CYCLE_SEC", 20)
 	enableValidation := loadEnvAsBool("BINN_ENABLE_VALIDATION", true)
 	generateCycleSec := loadEnvAsInt("BINN_GENERATE_CYCLE_SEC", 20)
 	enableDebug := loadEnvAsBool("BINN_ENGINE_ENABLE_DEBUG", true)
 	
-	return binn.NewConfig(seed, time.Duration(deliveryCycleSec) * time.Second, enableValidation,
+	cfg := binn.NewConfig(seed, time.Duration(deliveryCycleSec) * time.Second, enableValidation,
 		time.Duration(generateCycleSec) * time.Second, enableDebug)
+
+	overflow, err := binn.ParseOverflowPolicy(os.Getenv("BINN_OVERFLOW_POLICY"))
+	if err != nil {
+		return nil, err
+	}
+	cfg.SetOverflow(overflow)
+	cfg.SetEnqueueTimeout(time.Duration(loadEnvAsInt("BINN_ENQUEUE_TIMEOUT_MS", 5000)) * time.Millisecond)
+	cfg.SetInQueueSize(loadEnvAsInt("BINN_IN_QUEUE_SIZE", binn.DEFAULT_IN_QUEUE_SIZE))
+	cfg.SetOutQueueSize(loadEnvAsInt("BINN_OUT_QUEUE_SIZE", binn.DEFAULT_OUT_QUEUE_SIZE))
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+func loadAuthFromEnv() (*server.Auth, error) {
+	apiKeys := os.Getenv("BINN_API_KEYS")
+	hs256Secret := os.Getenv("BINN_JWT_HS256_SECRET")
+	rs256KeyFile := os.Getenv("BINN_JWT_RS256_PUBLIC_KEY_FILE")
+	if apiKeys == "" && hs256Secret == "" && rs256KeyFile == "" {
+		return nil, nil
+	}
+
+	auth := server.NewAuth()
+	if err := auth.ParseAPIKeys(apiKeys); err != nil {
+		return nil, err
+	}
+	if hs256Secret != "" {
+		auth.SetHS256Key([]byte(hs256Secret))
+	}
+	if rs256KeyFile != "" {
+		data, err := os.ReadFile(rs256KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		key, err := server.ParseRSAPublicKey(data)
+		if err != nil {
+			return nil, err
+		}
+		auth.SetRS256Key(key)
+	}
+	auth.SetIssuer(os.Getenv("BINN_JWT_ISSUER"))
+	auth.SetAudience(os.Getenv("BINN_JWT_AUDIENCE"))
+	if loadEnvAsBool("BINN_AUTH_REQUIRED", false) {
+		auth.Require()
+	}
+
+	return auth, nil
+}
+
+func loadCORSFromEnv() (*server.CORS, error) {
+	origins := loadEnvAsList("BINN_CORS_ALLOWED_ORIGINS", []string{"*"})
+	methods := loadEnvAsList("BINN_CORS_ALLOWED_METHODS", []string{"GET", "POST"})
+	headers := loadEnvAsList("BINN_CORS_ALLOWED_HEADERS", []string{"Authorization", "Content-Type", "X-API-Key"})
+	credentials := loadEnvAsBool("BINN_CORS_ALLOW_CREDENTIALS", false)
+	if credentials {
+		for _, origin := range origins {
+			if origin == "*" {
+				return nil, fmt.Errorf("BINN_CORS_ALLOW_CREDENTIALS needs BINN_CORS_ALLOWED_ORIGINS without *")
+			}
+		}
+	}
+	maxAgeSec := loadEnvAsInt("BINN_CORS_MAX_AGE_SEC", 600)
+	return server.NewCORS(origins, methods, headers, credentials, time.Duration(maxAgeSec) * time.Second), nil
+}
+
+func loadTLSConfigFromEnv() (*server.TLSConfig, error) {
+	certFile := os.Getenv("BINN_TLS_CERT_FILE")
+	keyFile := os.Getenv("BINN_TLS_KEY_FILE")
+	if certFile == "" && keyFile == "" {
+		return nil, nil
+	}
+	if certFile == "" || keyFile == "" {
+		return nil, fmt.Errorf("both BINN_TLS_CERT_FILE and BINN_TLS_KEY_FILE are required")
+	}
+
+	minVersion, err := server.ParseTLSVersion(os.Getenv("BINN_TLS_MIN_VERSION"))
+	if err != nil {
+		return nil, err
+	}
+	return server.NewTLSConfig(certFile, keyFile, minVersion, os.Getenv("BINN_TLS_CIPHER_POLICY")), nil
 }
 
-func loadServerConfigFromEnv() *server.Config {
+func loadServerConfigFromEnv() (*server.Config, error) {
 	sendEmptySec := loadEnvAsInt("BINN_SEND_EMPTY_SEC", 29)
 	enableDebug := loadEnvAsBool("BINN_SERVER_ENABLE_DEBUG", true)
-	return server.NewConfig(sendEmptySec, enableDebug)
+	cfg := server.NewConfig(sendEmptySec, enableDebug)
+	cfg.SetAdminToken(os.Getenv("BINN_ADMIN_TOKEN"))
+	cfg.SetLocalAdmin(loadEnvAsBool("BINN_ADMIN_ALLOW_LOCAL", false))
+	cfg.SetRevealThrowResult(loadEnvAsBool("BINN_SERVER_REVEAL_THROW_RESULT", false))
+	if err := cfg.SetSubscriberBuffer(loadEnvAsInt("BINN_SUBSCRIBER_BUFFER", server.DEFAULT_SUBSCRIBER_BUFFER)); err != nil {
+		return nil, err
+	}
+	cfg.SetSlowConsumerTimeout(time.Duration(loadEnvAsInt("BINN_SLOW_CONSUMER_SEC", 30)) * time.Second)
+
+	auth, err := loadAuthFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	cfg.SetAuth(auth)
+	cors, err := loadCORSFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	cfg.SetCORS(cors)
+
+	return cfg, nil
 }
 
 func main() {
-	ecfg := loadEngineConfigFromEnv()
-	scfg := loadServerConfigFromEnv()
+	if path := os.Getenv("BINN_CONFIG_FILE"); path != "" {
+		if err := loadEnvFile(path); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	ecfg, scfg, err := loadConfigFromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+	logger := scfg.Logger()
 
 	idStorage := binn.DefaultIDStorage()
 	storage := binn.NewContainerStorage(true, time.Duration(10)*time.Minute, idStorage)
+	storage.SetLogger(storageLogger(ecfg))
+
+	audit, auditFile, err := loadAuditLogFromEnv()
+	if err != nil {
+		log.Fatalf("failed to open audit log: %s", err)
+	}
+	if audit != nil {
+		audit.SetLogger(logger)
+		storage.SetAuditLog(audit)
+	}
+	if auditFile != nil {
+		defer auditFile.Close()
+	}
+
+	node, err := loadClusterFromEnv(logger.With(binn.F("component", "cluster")))
+	if err != nil {
+		log.Fatalf("failed to start cluster node: %s", err)
+	}
+
+	var keeper binn.ContainerKeeper = storage
+	var snapshotter binn.Snapshotter = storage
+	issue := idStorage.Add
+	if shards := loadEnvAsInt("BINN_STORAGE_SHARDS", 0); shards > 1 {
+		stripedIDs := binn.NewStripedIDStorage(shards)
+		sharded := binn.NewShardedContainerStorage(shards, true, time.Duration(10)*time.Minute, stripedIDs)
+		sharded.SetLogger(storageLogger(ecfg))
+		keeper = sharded
+		snapshotter = sharded
+		issue = stripedIDs.Add
+	}
+	// a bolt file is durable by itself and only reads a snapshot file once
+	if path := os.Getenv("BINN_BOLT_FILE"); path != "" {
+		bs, err := boltstore.Open(path, true, time.Duration(10)*time.Minute)
+		if err != nil {
+			log.Fatalf("failed to open bolt file: %s", err)
+		}
+		defer bs.Close()
+		if snapshotFile := os.Getenv("BINN_SNAPSHOT_FILE"); snapshotFile != "" {
+			if err := migrateSnapshotFile(snapshotFile, bs); err != nil {
+				log.Fatalf("failed to migrate snapshot: %s", err)
+			}
+		}
+		keeper = bs
+		snapshotter = nil
+		issue = bs.Issue
+	}
+	if dsn := os.Getenv("BINN_SQL_DSN"); dsn != "" {
+		driver := os.Getenv("BINN_SQL_DRIVER")
+		if driver == "" {
+			driver = "sqlite"
+		}
+		ss, err := sqlstore.Open(driver, dsn, true, time.Duration(10)*time.Minute)
+		if err != nil {
+			log.Fatalf("failed to open sql storage: %s", err)
+		}
+		defer ss.Close()
+		if snapshotFile := os.Getenv("BINN_SNAPSHOT_FILE"); snapshotFile != "" {
+			if err := migrateSnapshotFile(snapshotFile, ss); err != nil {
+				log.Fatalf("failed to migrate snapshot: %s", err)
+			}
+		}
+		keeper = ss
+		snapshotter = nil
+		issue = ss.Issue
+	}
+	if url := os.Getenv("BINN_REDIS_URL"); url != "" {
+		prefix := os.Getenv("BINN_REDIS_PREFIX")
+		if prefix == "" {
+			prefix = redisstore.DEFAULT_PREFIX
+		}
+		rs, err := redisstore.Open(url, prefix, true, time.Duration(10)*time.Minute)
+		if err != nil {
+			log.Fatalf("failed to open redis storage: %s", err)
+		}
+		defer rs.Close()
+		if snapshotFile := os.Getenv("BINN_SNAPSHOT_FILE"); snapshotFile != "" {
+			if err := migrateSnapshotFile(snapshotFile, rs); err != nil {
+				log.Fatalf("failed to migrate snapshot: %s", err)
+			}
+		}
+		keeper = rs
+		snapshotter = nil
+		issue = rs.Issue
+	}
+	// the replicated storage of a cluster replaces snapshot files
+	if node != nil {
+		defer node.Shutdown()
+		keeper = node
+		snapshotter = nil
+		issue = node.Issue
+	}
+	// only the default storage records to the audit log
+	if audit != nil && keeper != binn.ContainerKeeper(storage) {
+		if auditConfigured() {
+			log.Fatal("audit log is only supported by the default storage")
+		}
+		logger.Info("audit log is disabled since it needs the default storage")
+	}
+
+	snapshotFile := os.Getenv("BINN_SNAPSHOT_FILE")
+	if snapshotter == nil {
+		snapshotFile = ""
+	}
+	if snapshotFile != "" {
+		if err := restoreSnapshotFile(snapshotFile, snapshotter); err != nil {
+			log.Fatalf("failed to restore snapshot: %s", err)
+		}
+	}
 
 	engine := binn.NewEngine(
 		ecfg,
-		storage,
+		keeper,
 	)
 
 	engine.SetGenerateContainerHandler(func(cs binn.ContainerKeeper) error {
+		// only the leader generates so a cluster does not multiply empty bottles
+		if node != nil && !node.IsLeader() {
+			return nil
+		}
 		id := binn.GenerateID()
-		err := idStorage.Add(id, time.Now().Add(time.Duration(10)*time.Minute))
+		err := issue(id, time.Now().Add(time.Duration(10)*time.Minute))
 		if err != nil {
 			return err
 		}
@@ -89,9 +677,71 @@ func main() {
 	})
 
 	ctx, cancelFunc := context.WithCancel(context.Background())
-	engine.Run(ctx)
 	defer cancelFunc()
 
+	tracer, shutdownTracer, err := loadTracerFromEnv(ctx)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if tracer != nil {
+		otel.SetErrorHandler(otel.ErrorHandlerFunc(func(err error) {
+			logger.Warn("failed to export spans", binn.F("error", err))
+		}))
+		ecfg.SetTracer(tracer)
+		scfg.SetTracer(tracer)
+	}
+
+	webhooks, err := loadWebhooksFromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if webhooks != nil {
+		webhooks.SetLogger(logger)
+		webhooks.Register(engine.GetHooks())
+		scfg.SetWebhooks(webhooks)
+		webhooks.Run(ctx)
+	}
+
+	attachments, err := loadAttachmentsFromEnv()
+	if err != nil {
+		log.Fatalf("failed to open attachment dir: %s", err)
+	}
+	if attachments != nil {
+		attachments.SetLogger(logger.With(binn.F("component", "attachments")))
+		attachments.Register(engine.GetHooks())
+		scfg.SetAttachments(attachments)
+		attachments.Run(ctx)
+	}
+
+	federation, err := loadFederationFromEnv(storage)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if federation != nil {
+		if keeper != binn.ContainerKeeper(storage) {
+			log.Fatal("federation is only supported by the default storage")
+		}
+		federation.SetLogger(logger.With(binn.F("component", "federation")))
+		scfg.SetFederation(federation)
+		federation.Run(ctx)
+	}
+
+	engine.Run(ctx)
+
+	scfg.SetReloadFunc(func() ([]string, error) {
+		return reloadConfig(engine, scfg, storage)
+	})
+
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGHUP)
+	go func() {
+		for range sigCh {
+			if _, err := reloadConfig(engine, scfg, storage); err != nil {
+				logger.Error("failed to reload config", binn.F("error", err))
+			}
+		}
+	}()
+
 	port := os.Getenv("PORT")
 	if port == "" {
 		port = "8080"
@@ -101,6 +751,82 @@ func main() {
 	printServerConfig(scfg)
 
 	srv := server.NewServer(engine, fmt.Sprintf(":%s", port), scfg)
-	srv.ListenAndServe()
-	defer srv.Close()
+	servers := []*http.Server{srv}
+
+	tlsCfg, err := loadTLSConfigFromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if tlsCfg != nil {
+		reloader, err := server.NewCertReloader(tlsCfg.CertFile(), tlsCfg.KeyFile())
+		if err != nil {
+			log.Fatalf("failed to load certificate: %s", err)
+		}
+		reloader.SetLogger(logger)
+		go reloader.Watch(ctx, time.Duration(loadEnvAsInt("BINN_TLS_RELOAD_SEC", 30)) * time.Second)
+
+		if srv.TLSConfig, err = tlsCfg.Build(reloader); err != nil {
+			log.Fatal(err)
+		}
+
+		if redirectPort := os.Getenv("BINN_TLS_REDIRECT_PORT"); redirectPort != "" {
+			redirect := server.NewRedirectServer(fmt.Sprintf(":%s", redirectPort), port)
+			servers = append(servers, redirect)
+			go func() {
+				if err := redirect.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+					logger.Error("redirect server stopped", binn.F("error", err))
+				}
+			}()
+		}
+	}
+
+	if node != nil {
+		apiAddr := os.Getenv("BINN_CLUSTER_API_ADDR")
+		if apiAddr == "" {
+			apiAddr = node.APIAddr()
+		}
+		clusterSrv := &http.Server{ Addr: apiAddr, Handler: node.Handler() }
+		servers = append(servers, clusterSrv)
+		go func() {
+			if err := clusterSrv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				logger.Error("cluster server stopped", binn.F("error", err))
+			}
+		}()
+	}
+
+	stopCh := make(chan os.Signal, 1)
+	signal.Notify(stopCh, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<- stopCh
+		// stop being ready so the orchestrator moves clients away before closing
+		engine.Drain()
+		time.Sleep(time.Duration(loadEnvAsInt("BINN_DRAIN_SEC", 0)) * time.Second)
+		// event streams never become idle, so close them instead of shutting down
+		for _, s := range servers {
+			s.Close()
+		}
+	}()
+
+	if tlsCfg != nil {
+		err = srv.ListenAndServeTLS("", "")
+	} else {
+		err = srv.ListenAndServe()
+	}
+	if err != nil && err != http.ErrServerClosed {
+		logger.Error("server stopped", binn.F("error", err))
+	}
+
+	if shutdownTracer != nil {
+		shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), binn.DEFAULT_OTLP_FLUSH_INTERVAL)
+		if err := shutdownTracer(shutdownCtx); err != nil {
+			logger.Warn("failed to export spans", binn.F("error", err))
+		}
+		shutdownCancel()
+	}
+
+	if snapshotFile != "" {
+		if err := saveSnapshotFile(snapshotFile, snapshotter); err != nil {
+			log.Fatalf("failed to save snapshot: %s", err)
+		}
+	}
 }
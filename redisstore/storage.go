@@ -0,0 +1,303 @@
+package redisstore
+
+import (
+	"io"
+	"fmt"
+	"time"
+	"context"
+	"encoding/json"
+
+	"github.com/binn/binn"
+	"github.com/go-redis/redis/v8"
+)
+
+const DEFAULT_PREFIX = "binn:"
+
+var ErrNotEmpty = fmt.Errorf("this storage is not empty")
+
+// record is a container kept in the containers list
+type record struct {
+	ID        string     `json:"id"`
+	binn.Message
+	ExpiredAt *time.Time `json:"expired_at,omitempty"`
+}
+
+// getScript pops the oldest container and stamps its id again
+//
+// KEYS[1] containers
+// ARGV[1] id key prefix, ARGV[2] validation, ARGV[3] expiration in
+// unix milliseconds, ARGV[4] ttl in milliseconds
+var getScript = redis.NewScript(`
+local v = redis.call('LPOP', KEYS[1])
+if not v then
+	return false
+end
+if ARGV[2] == '1' then
+	local key = ARGV[1] .. cjson.decode(v)['id']
+	if redis.call('EXISTS', key) == 1 then
+		redis.call('SET', key, ARGV[3], 'PX', ARGV[4])
+	end
+end
+return v
+`)
+
+// addScript uses the id of the container, evicts the oldest container
+// when the list is full, pushes the record and issues its new id
+//
+// ids of stored containers have no ttl until Get stamps them, a evicted
+// container gets its ttl back so its id expires like any other
+//
+// KEYS[1] containers, KEYS[2] used id, KEYS[3] new id
+// ARGV[1] validation, ARGV[2] now in unix milliseconds, ARGV[3] record,
+// ARGV[4] new id expiration, ARGV[5] max containers, ARGV[6] id key prefix
+var addScript = redis.NewScript(`
+local now = tonumber(ARGV[2])
+if ARGV[1] == '1' then
+	local e = redis.call('GET', KEYS[2])
+	if not e then
+		return redis.error_reply('invalid')
+	end
+	if tonumber(e) < now then
+		return redis.error_reply('expired')
+	end
+	redis.call('DEL', KEYS[2])
+end
+if redis.call('LLEN', KEYS[1]) >= tonumber(ARGV[5]) then
+	local evicted = redis.call('LPOP', KEYS[1])
+	if ARGV[1] == '1' then
+		local key = ARGV[6] .. cjson.decode(evicted)['id']
+		local e = redis.call('GET', key)
+		if e then
+			local ttl = tonumber(e) - now
+			if ttl > 0 then
+				redis.call('PEXPIRE', key, ttl)
+			else
+				redis.call('DEL', key)
+			end
+		end
+	end
+end
+redis.call('RPUSH', KEYS[1], ARGV[3])
+if ARGV[1] == '1' then
+	redis.call('SET', KEYS[3], ARGV[4])
+end
+return 1
+`)
+
+// Storage is a ContainerKeeper kept in a redis compatible server, so
+// stateless processes behind a load balancer share one ocean
+//
+// containers are a list of json records under {prefix}containers and
+// a issued id is a key {prefix}id:{id} holding its expiration in unix
+// milliseconds with a ttl, expired ids are forgotten by the server
+type Storage struct {
+	client     redis.UniversalClient
+	prefix     string
+	validation bool
+	expiration time.Duration
+}
+
+func NewStorage(client redis.UniversalClient, prefix string, v bool, e time.Duration) *Storage {
+	return &Storage{
+		client:     client,
+		prefix:     prefix,
+		validation: v,
+		expiration: e,
+	}
+}
+
+// Open connects to a redis url like redis://:password@localhost:6379/0
+func Open(url string, prefix string, v bool, e time.Duration) (*Storage, error) {
+	opt, err := redis.ParseURL(url)
+	if err != nil {
+		return nil, err
+	}
+	return NewStorage(redis.NewClient(opt), prefix, v, e), nil
+}
+
+func (s *Storage) Close() error {
+	return s.client.Close()
+}
+
+func (s *Storage) containersKey() string {
+	return s.prefix + "containers"
+}
+
+// migratedKey is claimed by the one process which migrates a snapshot
+func (s *Storage) migratedKey() string {
+	return s.prefix + "migrated"
+}
+
+func (s *Storage) idPrefix() string {
+	return s.prefix + "id:"
+}
+
+func (s *Storage) idKey(id string) string {
+	return s.idPrefix() + id
+}
+
+func millis(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
+func flag(v bool) string {
+	if v {
+		return "1"
+	}
+	return "0"
+}
+
+func (s *Storage) Get() (binn.Container, error) {
+	e := time.Now().Add(time.Duration(binn.MAX_EXPIRATION_HOUR) * time.Hour)
+	if s.expiration != 0 {
+		e = time.Now().Add(s.expiration)
+	}
+	v, err := getScript.Run(context.Background(), s.client,
+		[]string{ s.containersKey() },
+		s.idPrefix(), flag(s.validation), millis(e), int64(time.Until(e) / time.Millisecond),
+	).Text()
+	if err == redis.Nil {
+		return nil, fmt.Errorf("this storage has no containers")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var r record
+	if err := json.Unmarshal([]byte(v), &r); err != nil {
+		return nil, err
+	}
+	return binn.NewBottleWithMessage(r.ID, &r.Message, &e), nil
+}
+
+func (s *Storage) Add(c binn.Container) error {
+	now := time.Now()
+	newID := binn.GenerateID()
+	data, err := json.Marshal(&record{ ID: newID, Message: *c.Message().Stored(now), ExpiredAt: c.ExpiredAt() })
+	if err != nil {
+		return err
+	}
+
+	err = addScript.Run(context.Background(), s.client,
+		[]string{ s.containersKey(), s.idKey(c.ID()), s.idKey(newID) },
+		flag(s.validation), millis(now), data,
+		millis(now.Add(time.Duration(binn.MAX_EXPIRATION_HOUR) * time.Hour)),
+		binn.MAX_CONTAINER_STORAGE_NUM_CONTAINER, s.idPrefix(),
+	).Err()
+	if err != nil {
+		switch err.Error() {
+		case "invalid", "expired":
+			return fmt.Errorf("this id (%#v) is %s", c.ID(), err.Error())
+		}
+		return err
+	}
+	return nil
+}
+
+// Issue adds id to the issued ids, a id which is already expired
+// is never seen again
+func (s *Storage) Issue(id string, e time.Time) error {
+	ttl := time.Until(e)
+	if ttl < time.Millisecond {
+		return nil
+	}
+	ok, err := s.client.SetNX(context.Background(), s.idKey(id), millis(e), ttl).Result()
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("this id (%#v) is already added", id)
+	}
+	return nil
+}
+
+func (s *Storage) Len() int {
+	n, err := s.client.LLen(context.Background(), s.containersKey()).Result()
+	if err != nil {
+		return 0
+	}
+	return int(n)
+}
+
+func (s *Storage) Ping() error {
+	return s.client.Ping(context.Background()).Err()
+}
+
+func (s *Storage) empty(ctx context.Context) (bool, error) {
+	n, err := s.client.LLen(ctx, s.containersKey()).Result()
+	if err != nil || n != 0 {
+		return false, err
+	}
+	var cursor uint64
+	for {
+		keys, next, err := s.client.Scan(ctx, cursor, s.idPrefix() + "*", 100).Result()
+		if err != nil || len(keys) != 0 {
+			return false, err
+		}
+		if next == 0 {
+			return true, nil
+		}
+		cursor = next
+	}
+}
+
+// Migrate pushes the snapshot read from r in one MULTI while no key of the
+// prefix exists yet, the first process to claim the migrated key with SETNX
+// is the only one which pushes it, there is no quarantine key so a snapshot
+// with one is refused
+func (s *Storage) Migrate(r io.Reader) error {
+	snapshot, err := binn.ReadSnapshot(r)
+	if err != nil {
+		return err
+	}
+	if len(snapshot.Quarantined) > 0 {
+		return binn.ErrQuarantineUnsupported
+	}
+	containers := snapshot.Containers
+	if len(containers) > binn.MAX_CONTAINER_STORAGE_NUM_CONTAINER {
+		return fmt.Errorf("snapshot has too many containers")
+	}
+
+	ctx := context.Background()
+	empty, err := s.empty(ctx)
+	if err != nil {
+		return err
+	}
+	if !empty {
+		return ErrNotEmpty
+	}
+	claimed, err := s.client.SetNX(ctx, s.migratedKey(), millis(time.Now()), 0).Result()
+	if err != nil {
+		return err
+	}
+	if !claimed {
+		return ErrNotEmpty
+	}
+
+	stored := map[string]bool{}
+	_, err = s.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, c := range containers {
+			data, err := json.Marshal(&record{ ID: c.ID(), Message: *c.Message(), ExpiredAt: c.ExpiredAt() })
+			if err != nil {
+				return err
+			}
+			pipe.RPush(ctx, s.containersKey(), data)
+			stored[c.ID()] = true
+		}
+		for _, id := range snapshot.IDs {
+			if stored[id.ID] {
+				pipe.Set(ctx, s.idKey(id.ID), millis(id.ExpiredAt), 0)
+				continue
+			}
+			if ttl := time.Until(id.ExpiredAt); ttl >= time.Millisecond {
+				pipe.Set(ctx, s.idKey(id.ID), millis(id.ExpiredAt), ttl)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		// a failed migration lets the next process try again
+		s.client.Del(ctx, s.migratedKey())
+	}
+	return err
+}
@@ -0,0 +1,179 @@
+package redisstore
+
+import (
+	"fmt"
+	"sync"
+	"time"
+	"sync/atomic"
+	"bytes"
+	"testing"
+
+	"github.com/binn/binn"
+	"github.com/binn/binn/keepertest"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func openTestStorage(t *testing.T) (*Storage, *miniredis.Miniredis) {
+	m := miniredis.RunT(t)
+	s, err := Open("redis://" + m.Addr(), DEFAULT_PREFIX, true, time.Duration(10) * time.Minute)
+	require.Nil(t, err)
+	t.Cleanup(func() { s.Close() })
+	return s, m
+}
+
+func TestPickedUpIDGetsTTL(t *testing.T) {
+	s, m := openTestStorage(t)
+	require.Nil(t, s.Ping())
+	require.Nil(t, s.Issue("first", time.Now().Add(time.Minute)))
+	require.Nil(t, s.Add(binn.NewBottle("first", "hello", nil)))
+	assert.False(t, m.Exists(s.idKey("first")))
+
+	c, err := s.Get()
+	require.Nil(t, err)
+	assert.InDelta(t, float64(10 * time.Minute), float64(m.TTL(s.idKey(c.ID()))), float64(time.Second))
+
+	require.Nil(t, s.Add(binn.NewBottle(c.ID(), "reply", nil)))
+	assert.False(t, m.Exists(s.idKey(c.ID())))
+}
+
+func TestStoredIDHasNoTTL(t *testing.T) {
+	s, m := openTestStorage(t)
+	require.Nil(t, s.Issue("id", time.Now().Add(time.Minute)))
+	require.Nil(t, s.Add(binn.NewBottle("id", "hello", nil)))
+
+	// the id of a stored bottle survives until it is picked up
+	m.FastForward(time.Duration(binn.MAX_EXPIRATION_HOUR + 1) * time.Hour)
+	c, err := s.Get()
+	require.Nil(t, err)
+	assert.True(t, m.Exists(s.idKey(c.ID())))
+}
+
+func TestExpiredID(t *testing.T) {
+	s, m := openTestStorage(t)
+	require.Nil(t, s.Issue("expired", time.Now().Add(time.Minute)))
+	m.FastForward(time.Duration(2) * time.Minute)
+	assert.NotNil(t, s.Add(binn.NewBottle("expired", "hello", nil)))
+
+	// the server forgets a key on its ttl, the value guards against a late expiry
+	m.Set(s.idKey("late"), fmt.Sprint(millis(time.Now().Add(-time.Minute))))
+	err := s.Add(binn.NewBottle("late", "hello", nil))
+	require.NotNil(t, err)
+	assert.Contains(t, err.Error(), "expired")
+	assert.True(t, m.Exists(s.idKey("late")))
+
+	assert.Nil(t, s.Issue("past", time.Now().Add(-time.Minute)))
+	assert.False(t, m.Exists(s.idKey("past")))
+}
+
+func TestEvictedIDExpiresAgain(t *testing.T) {
+	s, m := openTestStorage(t)
+	for i := 0; i < binn.MAX_CONTAINER_STORAGE_NUM_CONTAINER + 3; i++ {
+		id := binn.GenerateID()
+		require.Nil(t, s.Issue(id, time.Now().Add(time.Minute)))
+		require.Nil(t, s.Add(binn.NewBottle(id, fmt.Sprint(i), nil)))
+	}
+
+	// ids of stored bottles have no ttl, the evicted ones get theirs back
+	ttls := 0
+	for _, key := range m.Keys() {
+		if m.TTL(key) > 0 {
+			ttls++
+		}
+	}
+	assert.Equal(t, 3, ttls)
+}
+
+func TestSharedStorageDeliversOnce(t *testing.T) {
+	s, m := openTestStorage(t)
+	s.validation = false
+	for i := 0; i < 200; i++ {
+		require.Nil(t, s.Add(binn.NewBottle("", "hello", nil)))
+	}
+
+	mux := &sync.Mutex{}
+	seen := map[string]int{}
+	wg := &sync.WaitGroup{}
+	// every goroutine is a process of its own with its own connections
+	for i := 0; i < 8; i++ {
+		other, err := Open("redis://" + m.Addr(), DEFAULT_PREFIX, false, 0)
+		require.Nil(t, err)
+		defer other.Close()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				c, err := other.Get()
+				if err != nil {
+					return
+				}
+				mux.Lock()
+				seen[c.ID()]++
+				mux.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	assert.Equal(t, 200, len(seen))
+	for id, n := range seen {
+		assert.Equal(t, 1, n, id)
+	}
+}
+
+func TestMigrateKeepsTTLOfUnusedIDs(t *testing.T) {
+	ids := binn.DefaultIDStorage()
+	old := binn.NewContainerStorage(true, 0, ids)
+	ids.Add("id", time.Now().Add(time.Minute))
+	ids.Add("other", time.Now().Add(time.Minute))
+	require.Nil(t, old.Add(binn.NewBottle("id", "hello", nil)))
+	buf := &bytes.Buffer{}
+	require.Nil(t, old.Snapshot(buf))
+
+	s, m := openTestStorage(t)
+	require.Nil(t, s.Migrate(buf))
+	stored := old.List(0, 1)[0].ID()
+	assert.True(t, m.Exists(s.idKey(stored)))
+	assert.Equal(t, time.Duration(0), m.TTL(s.idKey(stored)))
+	assert.True(t, m.TTL(s.idKey("other")) > 0)
+}
+
+func TestConcurrentMigrateImportsOnce(t *testing.T) {
+	old := binn.NewContainerStorage(false, 0, nil)
+	require.Nil(t, old.Add(binn.NewBottle("", "hello", nil)))
+	buf := &bytes.Buffer{}
+	require.Nil(t, old.Snapshot(buf))
+	snapshot := buf.Bytes()
+
+	s, m := openTestStorage(t)
+	wg := &sync.WaitGroup{}
+	migrated := int32(0)
+	// every goroutine is a process of its own starting against the same redis
+	for i := 0; i < 8; i++ {
+		other, err := Open("redis://" + m.Addr(), DEFAULT_PREFIX, true, 0)
+		require.Nil(t, err)
+		defer other.Close()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if other.Migrate(bytes.NewReader(snapshot)) == nil {
+				atomic.AddInt32(&migrated, 1)
+			}
+		}()
+	}
+	wg.Wait()
+
+	assert.Equal(t, int32(1), migrated)
+	assert.Equal(t, 1, s.Len())
+}
+
+func TestConformance(t *testing.T) {
+	keepertest.Run(t, func(t *testing.T, e time.Duration) *keepertest.Harness {
+		m := miniredis.RunT(t)
+		s, err := Open("redis://" + m.Addr(), DEFAULT_PREFIX, true, e)
+		require.Nil(t, err)
+		t.Cleanup(func() { s.Close() })
+		return &keepertest.Harness{ Keeper: s, Issue: s.Issue }
+	})
+}
@@ -0,0 +1,647 @@
+package server
+
+import (
+	"net"
+	"fmt"
+	"time"
+	"strings"
+	"strconv"
+	"net/http"
+	"crypto/subtle"
+	"encoding/json"
+
+	"github.com/binn/binn"
+)
+
+const (
+	DEFAULT_ADMIN_PAGE_LIMIT = 50
+	MAX_ADMIN_PAGE_LIMIT = 1000
+)
+
+type ReloadResponse struct {
+	Changes []string `json:"changes"`
+}
+
+type ErrorResponse struct {
+	Error string `json:"error"`
+}
+
+type ContainerListResponse struct {
+	Containers []*ResponseBottle `json:"containers"`
+	Total      int               `json:"total"`
+	Offset     int               `json:"offset"`
+	Limit      int               `json:"limit"`
+}
+
+type IssuedIDResponse struct {
+	ID        string `json:"id"`
+	ExpiredAt time.Time `json:"expired_at"`
+}
+
+type IDListResponse struct {
+	IDs    []*IssuedIDResponse `json:"ids"`
+	Total  int                 `json:"total"`
+	Offset int                 `json:"offset"`
+	Limit  int                 `json:"limit"`
+}
+
+type AuditEventResponse struct {
+	Seq       uint64    `json:"seq"`
+	Time      time.Time `json:"time"`
+	Type      string    `json:"type"`
+	ID        string    `json:"id,omitempty"`
+	NewID     string    `json:"new_id,omitempty"`
+	Lineage   string    `json:"lineage"`
+	Client    string    `json:"client,omitempty"`
+	Reason    string    `json:"reason,omitempty"`
+	RequestID string    `json:"request_id,omitempty"`
+}
+
+type AuditListResponse struct {
+	Events []*AuditEventResponse `json:"events"`
+	Total  int                   `json:"total"`
+	Offset int                   `json:"offset"`
+	Limit  int                   `json:"limit"`
+}
+
+type DeadLetterResponse struct {
+	ID       string    `json:"id"`
+	Event    string    `json:"event"`
+	URL      string    `json:"url"`
+	Attempts int       `json:"attempts"`
+	Error    string    `json:"error"`
+	FailedAt time.Time `json:"failed_at"`
+}
+
+type DeadLetterListResponse struct {
+	DeadLetters []*DeadLetterResponse `json:"dead_letters"`
+	Dropped     uint64                `json:"dropped"`
+}
+
+type FederationPeerResponse struct {
+	Name        string `json:"name"`
+	URL         string `json:"url"`
+	Quota       int    `json:"quota"`
+	Defederated bool   `json:"defederated"`
+	Sent        uint64 `json:"sent"`
+	Received    uint64 `json:"received"`
+	Rejected    uint64 `json:"rejected"`
+	LastError   string `json:"last_error,omitempty"`
+}
+
+type FederationResponse struct {
+	Name  string                    `json:"name"`
+	Peers []*FederationPeerResponse `json:"peers"`
+}
+
+type EngineConfigResponse struct {
+	Seed             int     `json:"seed"`
+	DeliveryCycleSec float64 `json:"delivery_cycle_sec"`
+	Validation       bool    `json:"validation"`
+	GenerateCycleSec float64 `json:"generate_cycle_sec"`
+	Debug            bool    `json:"debug"`
+}
+
+type EngineStateResponse struct {
+	Running     bool                  `json:"running"`
+	Config      *EngineConfigResponse `json:"config"`
+	Containers  int                   `json:"containers"`
+	Quarantined int                   `json:"quarantined"`
+	IDs         int                   `json:"ids"`
+	InQueue     int                   `json:"in_queue"`
+	OutQueue    int                   `json:"out_queue"`
+}
+
+func writeJSON(w http.ResponseWriter, r *http.Request, status int, v interface{}) {
+	bytes, err := json.Marshal(v)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		loggerFrom(r).Error("failed to encode response", binn.F("status", http.StatusInternalServerError), binn.F("error", err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(bytes)
+}
+
+func writeError(w http.ResponseWriter, r *http.Request, status int, err error) {
+	writeJSON(w, r, status, &ErrorResponse{ Error: err.Error() })
+	loggerFrom(r).Debug("request failed", binn.F("status", status), binn.F("path", r.URL.Path), binn.F("error", err))
+}
+
+func isLoopback(r *http.Request) bool {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// isProxied tells whether a request was passed on by a proxy,
+// its remote address is the proxy and not the client
+func isProxied(r *http.Request) bool {
+	return r.Header.Get("X-Forwarded-For") != "" || r.Header.Get("Forwarded") != "" || r.Header.Get("X-Real-IP") != ""
+}
+
+// authorizeAdmin accepts the configured bearer token or an identity
+// with the admin scope, without both only local operators are accepted
+// when local admin is enabled
+func authorizeAdmin(cfg *Config, r *http.Request) bool {
+	token := cfg.AdminToken()
+	auth := cfg.Auth()
+	if token == "" && auth == nil {
+		return cfg.LocalAdmin() && isLoopback(r) && !isProxied(r)
+	}
+
+	if token != "" {
+		given := credentialFrom(r)
+		if subtle.ConstantTimeCompare([]byte(given), []byte(token)) == 1 {
+			return true
+		}
+	}
+
+	if auth != nil {
+		if id, err := auth.Authenticate(r); err == nil {
+			return id.HasScope(binn.SCOPE_ADMIN)
+		}
+	}
+
+	return false
+}
+
+func parsePage(r *http.Request) (int, int, error) {
+	offset, limit := 0, DEFAULT_ADMIN_PAGE_LIMIT
+	q := r.URL.Query()
+	if s := q.Get("offset"); s != "" {
+		v, err := strconv.Atoi(s)
+		if err != nil || v < 0 {
+			return 0, 0, fmt.Errorf("offset (%#v) is invalid", s)
+		}
+		offset = v
+	}
+	if s := q.Get("limit"); s != "" {
+		v, err := strconv.Atoi(s)
+		if err != nil || v <= 0 {
+			return 0, 0, fmt.Errorf("limit (%#v) is invalid", s)
+		}
+		limit = v
+	}
+	if limit > MAX_ADMIN_PAGE_LIMIT {
+		limit = MAX_ADMIN_PAGE_LIMIT
+	}
+	return offset, limit, nil
+}
+
+func methodNotAllowed(w http.ResponseWriter, allowed ...string) {
+	w.Header().Set("Allow", strings.Join(allowed, ", "))
+	w.WriteHeader(http.StatusMethodNotAllowed)
+}
+
+func AdminHandlerFunc(engine *binn.Engine, cfg *Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !authorizeAdmin(cfg, r) {
+			writeError(w, r, http.StatusUnauthorized, fmt.Errorf("admin request from %s is unauthorized", r.RemoteAddr))
+			return
+		}
+
+		if a := cfg.Attachments(); a != nil {
+			r = r.WithContext(withAttachments(r.Context(), a))
+		}
+		path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/admin"), "/")
+		parts := strings.Split(path, "/")
+
+		switch {
+		case path == "reload":
+			ReloadHandlerFunc(cfg)(w, r)
+		case path == "engine":
+			AdminEngineHandlerFunc(engine)(w, r)
+		case path == "snapshot":
+			AdminSnapshotHandlerFunc(engine)(w, r)
+		case parts[0] == "webhooks":
+			webhooks := cfg.Webhooks()
+			if webhooks == nil {
+				writeError(w, r, http.StatusNotImplemented, fmt.Errorf("webhooks are not configured"))
+				return
+			}
+			adminWebhooks(w, r, webhooks, parts[1:])
+		case parts[0] == "federation":
+			federation := cfg.Federation()
+			if federation == nil {
+				writeError(w, r, http.StatusNotImplemented, fmt.Errorf("federation is not configured"))
+				return
+			}
+			adminFederation(w, r, federation, parts[1:])
+		case parts[0] == "audit":
+			storage, ok := engine.GetStorage().(binn.Audited)
+			if !ok || storage.AuditLog() == nil {
+				writeError(w, r, http.StatusNotImplemented, fmt.Errorf("audit log is not configured"))
+				return
+			}
+			adminAudit(w, r, storage.AuditLog(), parts[1:])
+		case parts[0] == "containers" || parts[0] == "quarantine" || parts[0] == "ids":
+			storage, ok := engine.GetStorage().(binn.ContainerAdmin)
+			if !ok {
+				writeError(w, r, http.StatusNotImplemented, fmt.Errorf("this storage does not support administration"))
+				return
+			}
+			switch parts[0] {
+			case "containers":
+				adminContainers(w, r, storage, parts[1:])
+			case "quarantine":
+				adminQuarantine(w, r, storage, parts[1:])
+			case "ids":
+				adminIDs(w, r, storage.IDAdmin(), parts[1:])
+			}
+		default:
+			writeError(w, r, http.StatusNotFound, fmt.Errorf("%s is not found", r.URL.Path))
+		}
+	}
+}
+
+func ReloadHandlerFunc(cfg *Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			methodNotAllowed(w, http.MethodPost)
+			return
+		}
+
+		reload := cfg.ReloadFunc()
+		if reload == nil {
+			writeError(w, r, http.StatusNotImplemented, fmt.Errorf("reload is not configured"))
+			return
+		}
+
+		changes, err := reload()
+		if err != nil {
+			writeError(w, r, http.StatusInternalServerError, fmt.Errorf("failed to reload, %s", err))
+			return
+		}
+
+		writeJSON(w, r, http.StatusOK, &ReloadResponse{ Changes: changes })
+		loggerFrom(r).Info("reload config", binn.F("status", http.StatusOK), binn.F("changes", len(changes)))
+	}
+}
+
+func AdminEngineHandlerFunc(engine *binn.Engine) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			methodNotAllowed(w, http.MethodGet)
+			return
+		}
+
+		res := &EngineStateResponse{
+			Running:  engine.Running(),
+			Config:   engineConfigToResponse(engine.GetConfig()),
+			InQueue:  len(engine.GetInChan()),
+			OutQueue: len(engine.GetOutChan()),
+		}
+		if storage, ok := engine.GetStorage().(binn.ContainerAdmin); ok {
+			res.Containers = storage.Len()
+			res.Quarantined = len(storage.Quarantined())
+			if ids := storage.IDAdmin(); ids != nil {
+				res.IDs = ids.Len()
+			}
+		}
+
+		writeJSON(w, r, http.StatusOK, res)
+	}
+}
+
+func adminContainers(w http.ResponseWriter, r *http.Request, storage binn.ContainerAdmin, parts []string) {
+	switch {
+	case len(parts) == 0:
+		switch r.Method {
+		case http.MethodGet:
+			offset, limit, err := parsePage(r)
+			if err != nil {
+				writeError(w, r, http.StatusBadRequest, err)
+				return
+			}
+			res := &ContainerListResponse{
+				Containers: []*ResponseBottle{},
+				Total:      storage.Len(),
+				Offset:     offset,
+				Limit:      limit,
+			}
+			for _, c := range storage.List(offset, limit) {
+				res.Containers = append(res.Containers, containerToResponse(c))
+			}
+			writeJSON(w, r, http.StatusOK, res)
+		case http.MethodPost:
+			var req RequestBottle
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Message == nil {
+				writeError(w, r, http.StatusBadRequest, fmt.Errorf("payload is invalid format"))
+				return
+			}
+			req.ID = ""
+			c, err := storage.Inject(requestToContainer(&req))
+			if err != nil {
+				writeError(w, r, http.StatusServiceUnavailable, err)
+				return
+			}
+			writeJSON(w, r, http.StatusCreated, containerToResponse(c))
+			loggerFrom(r).Info("inject a container", binn.F("status", http.StatusCreated), binn.F("id", c.ID()))
+		default:
+			methodNotAllowed(w, http.MethodGet, http.MethodPost)
+		}
+	case len(parts) == 1:
+		switch r.Method {
+		case http.MethodGet:
+			c, err := storage.Find(parts[0])
+			if err != nil {
+				writeError(w, r, http.StatusNotFound, err)
+				return
+			}
+			writeJSON(w, r, http.StatusOK, containerToResponse(c))
+		case http.MethodDelete:
+			c, err := storage.Delete(parts[0])
+			if err != nil {
+				writeError(w, r, http.StatusNotFound, err)
+				return
+			}
+			if a := attachmentsFrom(r.Context()); a != nil {
+				a.Delete(c.Message().Attachments)
+			}
+			w.WriteHeader(http.StatusNoContent)
+			loggerFrom(r).Info("delete a container", binn.F("status", http.StatusNoContent), binn.F("id", parts[0]))
+		default:
+			methodNotAllowed(w, http.MethodGet, http.MethodDelete)
+		}
+	case len(parts) == 2 && parts[1] == "quarantine":
+		if r.Method != http.MethodPost {
+			methodNotAllowed(w, http.MethodPost)
+			return
+		}
+		if err := storage.Quarantine(parts[0]); err != nil {
+			writeError(w, r, http.StatusNotFound, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		loggerFrom(r).Info("quarantine a container", binn.F("status", http.StatusNoContent), binn.F("id", parts[0]))
+	default:
+		writeError(w, r, http.StatusNotFound, fmt.Errorf("%s is not found", r.URL.Path))
+	}
+}
+
+func adminQuarantine(w http.ResponseWriter, r *http.Request, storage binn.ContainerAdmin, parts []string) {
+	switch {
+	case len(parts) == 0:
+		if r.Method != http.MethodGet {
+			methodNotAllowed(w, http.MethodGet)
+			return
+		}
+		quarantined := storage.Quarantined()
+		res := &ContainerListResponse{
+			Containers: []*ResponseBottle{},
+			Total:      len(quarantined),
+			Offset:     0,
+			Limit:      len(quarantined),
+		}
+		for _, c := range quarantined {
+			res.Containers = append(res.Containers, containerToResponse(c))
+		}
+		writeJSON(w, r, http.StatusOK, res)
+	case len(parts) == 2 && parts[1] == "release":
+		if r.Method != http.MethodPost {
+			methodNotAllowed(w, http.MethodPost)
+			return
+		}
+		if err := storage.Release(parts[0]); err != nil {
+			writeError(w, r, http.StatusNotFound, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		loggerFrom(r).Info("release a container", binn.F("status", http.StatusNoContent), binn.F("id", parts[0]))
+	default:
+		writeError(w, r, http.StatusNotFound, fmt.Errorf("%s is not found", r.URL.Path))
+	}
+}
+
+func adminIDs(w http.ResponseWriter, r *http.Request, ids binn.IDAdmin, parts []string) {
+	if ids == nil {
+		writeError(w, r, http.StatusNotImplemented, fmt.Errorf("validation is disabled"))
+		return
+	}
+
+	switch {
+	case len(parts) == 0:
+		if r.Method != http.MethodGet {
+			methodNotAllowed(w, http.MethodGet)
+			return
+		}
+		offset, limit, err := parsePage(r)
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, err)
+			return
+		}
+		res := &IDListResponse{
+			IDs:    []*IssuedIDResponse{},
+			Total:  ids.Len(),
+			Offset: offset,
+			Limit:  limit,
+		}
+		for _, id := range ids.List(offset, limit) {
+			res.IDs = append(res.IDs, &IssuedIDResponse{
+				ID:        id.ID,
+				ExpiredAt: id.ExpiredAt,
+			})
+		}
+		writeJSON(w, r, http.StatusOK, res)
+	case len(parts) == 1:
+		if r.Method != http.MethodDelete {
+			methodNotAllowed(w, http.MethodDelete)
+			return
+		}
+		if err := ids.Revoke(parts[0]); err != nil {
+			writeError(w, r, http.StatusNotFound, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		loggerFrom(r).Info("revoke a id", binn.F("status", http.StatusNoContent), binn.F("id", parts[0]))
+	default:
+		writeError(w, r, http.StatusNotFound, fmt.Errorf("%s is not found", r.URL.Path))
+	}
+}
+
+func AdminSnapshotHandlerFunc(engine *binn.Engine) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		storage, ok := engine.GetStorage().(binn.Snapshotter)
+		if !ok {
+			writeError(w, r, http.StatusNotImplemented, fmt.Errorf("this storage does not support snapshots"))
+			return
+		}
+
+		switch r.Method {
+		case http.MethodGet:
+			w.Header().Set("Content-Type", "application/x-ndjson")
+			if err := storage.Snapshot(w); err != nil {
+				loggerFrom(r).Error("failed to write snapshot", binn.F("error", err))
+				return
+			}
+			loggerFrom(r).Info("export a snapshot", binn.F("status", http.StatusOK))
+		case http.MethodPut:
+			if err := storage.Restore(r.Body); err != nil {
+				writeError(w, r, http.StatusBadRequest, fmt.Errorf("failed to restore snapshot, %s", err))
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+			loggerFrom(r).Info("restore a snapshot", binn.F("status", http.StatusNoContent))
+		default:
+			methodNotAllowed(w, http.MethodGet, http.MethodPut)
+		}
+	}
+}
+
+func auditEventToResponse(e binn.AuditEvent) *AuditEventResponse {
+	return &AuditEventResponse{
+		Seq:       e.Seq,
+		Time:      e.Time,
+		Type:      string(e.Type),
+		ID:        e.ID,
+		NewID:     e.NewID,
+		Lineage:   e.Lineage,
+		Client:    e.Client,
+		Reason:    e.Reason,
+		RequestID: e.RequestID,
+	}
+}
+
+func adminAudit(w http.ResponseWriter, r *http.Request, audit *binn.AuditLog, parts []string) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w, http.MethodGet)
+		return
+	}
+
+	switch {
+	case len(parts) == 0:
+		offset, limit, err := parsePage(r)
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, err)
+			return
+		}
+		res := &AuditListResponse{
+			Events: []*AuditEventResponse{},
+			Total:  audit.Len(),
+			Offset: offset,
+			Limit:  limit,
+		}
+		for _, e := range audit.List(offset, limit) {
+			res.Events = append(res.Events, auditEventToResponse(e))
+		}
+		writeJSON(w, r, http.StatusOK, res)
+	case len(parts) == 1:
+		events := audit.Lineage(parts[0])
+		if len(events) == 0 {
+			writeError(w, r, http.StatusNotFound, fmt.Errorf("this lineage (%#v) is not in audit log", parts[0]))
+			return
+		}
+		res := &AuditListResponse{
+			Events: []*AuditEventResponse{},
+			Total:  len(events),
+			Limit:  len(events),
+		}
+		for _, e := range events {
+			res.Events = append(res.Events, auditEventToResponse(e))
+		}
+		writeJSON(w, r, http.StatusOK, res)
+	default:
+		writeError(w, r, http.StatusNotFound, fmt.Errorf("%s is not found", r.URL.Path))
+	}
+}
+
+func adminWebhooks(w http.ResponseWriter, r *http.Request, webhooks *binn.Webhooks, parts []string) {
+	switch {
+	case len(parts) == 1 && parts[0] == "dead-letters":
+		if r.Method != http.MethodGet {
+			methodNotAllowed(w, http.MethodGet)
+			return
+		}
+		res := &DeadLetterListResponse{
+			DeadLetters: []*DeadLetterResponse{},
+			Dropped:     webhooks.Dropped(),
+		}
+		for _, d := range webhooks.DeadLetters().List() {
+			res.DeadLetters = append(res.DeadLetters, &DeadLetterResponse{
+				ID:       d.Payload.ID,
+				Event:    string(d.Payload.Event),
+				URL:      d.URL,
+				Attempts: d.Attempts,
+				Error:    d.Error,
+				FailedAt: d.FailedAt,
+			})
+		}
+		writeJSON(w, r, http.StatusOK, res)
+	case len(parts) == 2 && parts[0] == "dead-letters":
+		if r.Method != http.MethodDelete {
+			methodNotAllowed(w, http.MethodDelete)
+			return
+		}
+		if _, err := webhooks.DeadLetters().Take(parts[1]); err != nil {
+			writeError(w, r, http.StatusNotFound, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		loggerFrom(r).Info("discard a dead letter", binn.F("status", http.StatusNoContent), binn.F("delivery", parts[1]))
+	case len(parts) == 3 && parts[0] == "dead-letters" && parts[2] == "retry":
+		if r.Method != http.MethodPost {
+			methodNotAllowed(w, http.MethodPost)
+			return
+		}
+		if err := webhooks.Redeliver(parts[1]); err != nil {
+			status := http.StatusNotFound
+			if err == binn.ErrWebhookQueueFull {
+				status = http.StatusServiceUnavailable
+			}
+			writeError(w, r, status, err)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+		loggerFrom(r).Info("redeliver a dead letter", binn.F("status", http.StatusAccepted), binn.F("delivery", parts[1]))
+	default:
+		writeError(w, r, http.StatusNotFound, fmt.Errorf("%s is not found", r.URL.Path))
+	}
+}
+
+func adminFederation(w http.ResponseWriter, r *http.Request, federation *binn.Federation, parts []string) {
+	switch {
+	case len(parts) == 0:
+		if r.Method != http.MethodGet {
+			methodNotAllowed(w, http.MethodGet)
+			return
+		}
+		res := &FederationResponse{ Name: federation.Name(), Peers: []*FederationPeerResponse{} }
+		for _, p := range federation.Peers() {
+			res.Peers = append(res.Peers, &FederationPeerResponse{
+				Name:        p.Name,
+				URL:         p.URL,
+				Quota:       p.Quota,
+				Defederated: p.Defederated,
+				Sent:        p.Sent,
+				Received:    p.Received,
+				Rejected:    p.Rejected,
+				LastError:   p.LastError,
+			})
+		}
+		writeJSON(w, r, http.StatusOK, res)
+	case len(parts) == 2 && (parts[1] == "defederate" || parts[1] == "refederate"):
+		if r.Method != http.MethodPost {
+			methodNotAllowed(w, http.MethodPost)
+			return
+		}
+		var err error
+		if parts[1] == "defederate" {
+			err = federation.Defederate(parts[0])
+		} else {
+			err = federation.Refederate(parts[0])
+		}
+		if err != nil {
+			writeError(w, r, http.StatusNotFound, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		loggerFrom(r).Info(parts[1] + " a peer", binn.F("status", http.StatusNoContent), binn.F("peer", parts[0]))
+	default:
+		writeError(w, r, http.StatusNotFound, fmt.Errorf("%s is not found", r.URL.Path))
+	}
+}
@@ -0,0 +1,293 @@
+package server
+
+import (
+	"io"
+	"time"
+	"bytes"
+	"testing"
+	"encoding/json"
+	"net/http/httptest"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/binn/binn"
+)
+
+func newAdminTestEngine() (*binn.Engine, *binn.ContainerStorage, *binn.IDStorage) {
+	cfg := binn.DefaultConfig()
+	cfg.DisableDebug()
+
+	idStorage := binn.DefaultIDStorage()
+	storage := binn.NewContainerStorage(true, time.Duration(10)*time.Minute, idStorage)
+	engine := binn.NewEngine(
+		cfg,
+		storage,
+	)
+	return engine, storage, idStorage
+}
+
+func doAdminRequest(cfg *Config, engine *binn.Engine, method string, path string, body string) (int, []byte) {
+	req := httptest.NewRequest(method, "http://example.com" + path, bytes.NewBufferString(body))
+	req.Header.Set("Authorization", "Bearer secret")
+	w := httptest.NewRecorder()
+	AdminHandlerFunc(engine, cfg)(w, req)
+
+	resp := w.Result()
+	b, _ := io.ReadAll(resp.Body)
+	return resp.StatusCode, b
+}
+
+func TestAdminUnauthorized(t *testing.T) {
+	engine, _, _ := newAdminTestEngine()
+	cfg := NewConfig(10, false)
+	cfg.SetAdminToken("secret")
+
+	req := httptest.NewRequest("GET", "http://example.com/admin/engine", nil)
+	req.Header.Set("Authorization", "Bearer wrong")
+	w := httptest.NewRecorder()
+	AdminHandlerFunc(engine, cfg)(w, req)
+
+	assert.Equal(t, 401, w.Result().StatusCode)
+}
+
+func TestAdminLoopbackWithoutToken(t *testing.T) {
+	engine, _, _ := newAdminTestEngine()
+	cfg := NewConfig(10, false)
+
+	req := httptest.NewRequest("GET", "http://example.com/admin/engine", nil)
+	req.RemoteAddr = "127.0.0.1:40000"
+	w := httptest.NewRecorder()
+	AdminHandlerFunc(engine, cfg)(w, req)
+	assert.Equal(t, 401, w.Result().StatusCode)
+
+	cfg.SetLocalAdmin(true)
+	w = httptest.NewRecorder()
+	AdminHandlerFunc(engine, cfg)(w, req)
+	assert.Equal(t, 200, w.Result().StatusCode)
+
+	// a local reverse proxy passes on requests from anywhere
+	req.Header.Set("X-Forwarded-For", "192.0.2.1")
+	w = httptest.NewRecorder()
+	AdminHandlerFunc(engine, cfg)(w, req)
+	assert.Equal(t, 401, w.Result().StatusCode)
+
+	req.Header.Del("X-Forwarded-For")
+	req.RemoteAddr = "192.0.2.1:40000"
+	w = httptest.NewRecorder()
+	AdminHandlerFunc(engine, cfg)(w, req)
+	assert.Equal(t, 401, w.Result().StatusCode)
+}
+
+func TestAdminInjectAndListContainers(t *testing.T) {
+	engine, storage, _ := newAdminTestEngine()
+	cfg := NewConfig(10, false)
+	cfg.SetAdminToken("secret")
+
+	status, body := doAdminRequest(cfg, engine, "POST", "/admin/containers",
+		"{\"id\":\"unknown\",\"message\":{\"text\":\"Injected\"}}")
+	assert.Equal(t, 201, status)
+
+	var injected ResponseBottle
+	_ = json.Unmarshal(body, &injected)
+	assert.NotEqual(t, "unknown", injected.ID)
+	assert.Equal(t, 1, storage.Len())
+
+	status, body = doAdminRequest(cfg, engine, "GET", "/admin/containers?offset=0&limit=10", "")
+	var list ContainerListResponse
+	_ = json.Unmarshal(body, &list)
+
+	assert.Equal(t, 200, status)
+	assert.Equal(t, 1, list.Total)
+	assert.Equal(t, "Injected", list.Containers[0].Message.Text)
+
+	status, body = doAdminRequest(cfg, engine, "GET", "/admin/containers/" + injected.ID, "")
+	var found ResponseBottle
+	_ = json.Unmarshal(body, &found)
+
+	assert.Equal(t, 200, status)
+	assert.Equal(t, injected.ID, found.ID)
+}
+
+func TestAdminDeleteContainer(t *testing.T) {
+	engine, storage, idStorage := newAdminTestEngine()
+	cfg := NewConfig(10, false)
+	cfg.SetAdminToken("secret")
+
+	c, _ := storage.Inject(binn.NewBottle("", "Delete me", nil))
+
+	status, _ := doAdminRequest(cfg, engine, "DELETE", "/admin/containers/" + c.ID(), "")
+	assert.Equal(t, 204, status)
+	assert.Equal(t, 0, storage.Len())
+	assert.Equal(t, 0, idStorage.Len())
+
+	status, _ = doAdminRequest(cfg, engine, "DELETE", "/admin/containers/" + c.ID(), "")
+	assert.Equal(t, 404, status)
+}
+
+func TestAdminQuarantineContainer(t *testing.T) {
+	engine, storage, _ := newAdminTestEngine()
+	cfg := NewConfig(10, false)
+	cfg.SetAdminToken("secret")
+
+	c, _ := storage.Inject(binn.NewBottle("", "Suspicious", nil))
+
+	status, _ := doAdminRequest(cfg, engine, "POST", "/admin/containers/" + c.ID() + "/quarantine", "")
+	assert.Equal(t, 204, status)
+	assert.Equal(t, 0, storage.Len())
+
+	status, body := doAdminRequest(cfg, engine, "GET", "/admin/quarantine", "")
+	var list ContainerListResponse
+	_ = json.Unmarshal(body, &list)
+	assert.Equal(t, 200, status)
+	assert.Equal(t, 1, list.Total)
+
+	status, _ = doAdminRequest(cfg, engine, "POST", "/admin/quarantine/" + c.ID() + "/release", "")
+	assert.Equal(t, 204, status)
+	assert.Equal(t, 1, storage.Len())
+}
+
+func TestAdminListAndRevokeIDs(t *testing.T) {
+	engine, _, idStorage := newAdminTestEngine()
+	cfg := NewConfig(10, false)
+	cfg.SetAdminToken("secret")
+
+	idStorage.Add(
+		"1c7a8201-cdf7-11ec-a9b3-0242ac110004",
+		time.Now().Add(time.Duration(10)*time.Minute),
+	)
+
+	status, body := doAdminRequest(cfg, engine, "GET", "/admin/ids", "")
+	var list IDListResponse
+	_ = json.Unmarshal(body, &list)
+	assert.Equal(t, 200, status)
+	assert.Equal(t, 1, list.Total)
+	assert.Equal(t, "1c7a8201-cdf7-11ec-a9b3-0242ac110004", list.IDs[0].ID)
+
+	status, _ = doAdminRequest(cfg, engine, "DELETE", "/admin/ids/1c7a8201-cdf7-11ec-a9b3-0242ac110004", "")
+	assert.Equal(t, 204, status)
+	assert.Equal(t, 0, idStorage.Len())
+}
+
+func TestAdminEngineState(t *testing.T) {
+	engine, storage, _ := newAdminTestEngine()
+	cfg := NewConfig(10, false)
+	cfg.SetAdminToken("secret")
+
+	_, _ = storage.Inject(binn.NewBottle("", "", nil))
+
+	status, body := doAdminRequest(cfg, engine, "GET", "/admin/engine", "")
+	var state EngineStateResponse
+	_ = json.Unmarshal(body, &state)
+
+	assert.Equal(t, 200, status)
+	assert.False(t, state.Running)
+	assert.Equal(t, 1, state.Containers)
+	assert.Equal(t, 1, state.IDs)
+	assert.Equal(t, 42, state.Config.Seed)
+}
+
+func TestHandleReload(t *testing.T) {
+	engine, _, _ := newAdminTestEngine()
+	cfg := NewConfig(10, false)
+	cfg.SetAdminToken("secret")
+	cfg.SetReloadFunc(func() ([]string, error) {
+		n := NewConfig(20, false)
+		n.SetAdminToken("secret")
+		return cfg.Update(n), nil
+	})
+
+	status, body := doAdminRequest(cfg, engine, "POST", "/admin/reload", "")
+
+	var rr ReloadResponse
+	if err := json.Unmarshal(body, &rr); err != nil {
+		assert.Failf(t, "failed", "%s", err)
+		return
+	}
+
+	assert.Equal(t, 200, status)
+	assert.Equal(t, []string{"send empty sec: 10 -> 20"}, rr.Changes)
+	assert.Equal(t, 20, cfg.SendEmptySec())
+}
+
+func TestAdminSnapshot(t *testing.T) {
+	engine, storage, _ := newAdminTestEngine()
+	cfg := NewConfig(10, false)
+	cfg.SetAdminToken("secret")
+
+	c, _ := storage.Inject(binn.NewBottle("", "Hello", nil))
+
+	status, snapshot := doAdminRequest(cfg, engine, "GET", "/admin/snapshot", "")
+	assert.Equal(t, 200, status)
+
+	_, _ = storage.Delete(c.ID())
+
+	status, _ = doAdminRequest(cfg, engine, "PUT", "/admin/snapshot", string(snapshot))
+	assert.Equal(t, 204, status)
+	assert.Equal(t, 1, storage.Len())
+
+	status, _ = doAdminRequest(cfg, engine, "PUT", "/admin/snapshot", "{}")
+	assert.Equal(t, 400, status)
+}
+
+func TestAdminAudit(t *testing.T) {
+	engine, storage, idStorage := newAdminTestEngine()
+	cfg := NewConfig(10, false)
+	cfg.SetAdminToken("secret")
+
+	status, _ := doAdminRequest(cfg, engine, "GET", "/admin/audit", "")
+	assert.Equal(t, 501, status)
+
+	storage.SetAuditLog(binn.DefaultAuditLog())
+	idStorage.Add("1", time.Now().Add(time.Minute))
+	storage.Add(binn.NewBottle("1", "Hello", nil))
+	c, _ := storage.Get()
+
+	status, body := doAdminRequest(cfg, engine, "GET", "/admin/audit", "")
+	assert.Equal(t, 200, status)
+	var list AuditListResponse
+	assert.Nil(t, json.Unmarshal(body, &list))
+	assert.Equal(t, 2, list.Total)
+	assert.Equal(t, "created", list.Events[0].Type)
+
+	status, body = doAdminRequest(cfg, engine, "GET", "/admin/audit/" + c.ID(), "")
+	assert.Equal(t, 200, status)
+	assert.Nil(t, json.Unmarshal(body, &list))
+	assert.Equal(t, "delivered", list.Events[1].Type)
+	assert.Equal(t, "1", list.Events[1].Lineage)
+
+	status, _ = doAdminRequest(cfg, engine, "GET", "/admin/audit/unknown", "")
+	assert.Equal(t, 404, status)
+
+	status, _ = doAdminRequest(cfg, engine, "DELETE", "/admin/audit", "")
+	assert.Equal(t, 405, status)
+}
+
+func TestAdminWebhookDeadLetters(t *testing.T) {
+	engine, _, _ := newAdminTestEngine()
+	cfg := NewConfig(10, false)
+	cfg.SetAdminToken("secret")
+
+	status, _ := doAdminRequest(cfg, engine, "GET", "/admin/webhooks/dead-letters", "")
+	assert.Equal(t, 501, status)
+
+	webhooks := binn.NewWebhooks([]*binn.WebhookSubscription{ { URL: "http://127.0.0.1:1/hook", Secret: "s" } })
+	webhooks.DeadLetters().Put(&binn.DeadLetter{
+		Payload:  &binn.WebhookPayload{ ID: "d1", Event: binn.WEBHOOK_SUNK },
+		URL:      "http://127.0.0.1:1/hook",
+		Attempts: 5,
+		Error:    "refused",
+	})
+	cfg.SetWebhooks(webhooks)
+
+	status, body := doAdminRequest(cfg, engine, "GET", "/admin/webhooks/dead-letters", "")
+	assert.Equal(t, 200, status)
+	var res DeadLetterListResponse
+	assert.Nil(t, json.Unmarshal(body, &res))
+	assert.Equal(t, "d1", res.DeadLetters[0].ID)
+	assert.Equal(t, "bottle.sunk", res.DeadLetters[0].Event)
+
+	status, _ = doAdminRequest(cfg, engine, "POST", "/admin/webhooks/dead-letters/d1/retry", "")
+	assert.Equal(t, 202, status)
+	status, _ = doAdminRequest(cfg, engine, "DELETE", "/admin/webhooks/dead-letters/d1", "")
+	assert.Equal(t, 404, status)
+}
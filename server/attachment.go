@@ -0,0 +1,460 @@
+package server
+
+import (
+	"io"
+	"os"
+	"fmt"
+	"time"
+	"bytes"
+	"sync"
+	"errors"
+	"context"
+	"strconv"
+	"strings"
+	"net/url"
+	"net/http"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/binary"
+
+	"github.com/binn/binn"
+)
+
+const (
+	DEFAULT_ATTACHMENT_MAX_SIZE = 1 << 20
+	DEFAULT_ATTACHMENT_SWEEP_CYCLE = time.Minute
+	ATTACHMENT_PATH = "/api/attachment/"
+	// MAX_BOTTLE_PART_SIZE bounds the json part of a multipart throw
+	MAX_BOTTLE_PART_SIZE = 64 << 10
+)
+
+const attachmentsContextKey = contextKey("attachments")
+
+// attachmentTypes are the sniffed content types a bottle may carry
+// with the extension of their blob key
+var attachmentTypes = map[string]string{
+	"image/jpeg":                ".jpg",
+	"image/png":                 ".png",
+	"image/gif":                 ".gif",
+	"text/plain; charset=utf-8": ".txt",
+}
+
+var (
+	ErrAttachmentTooLarge = fmt.Errorf("this attachment is too large")
+	ErrAttachmentType     = fmt.Errorf("this attachment type is not allowed")
+	ErrAttachmentBroken   = fmt.Errorf("this attachment is broken")
+)
+
+type ResponseAttachment struct {
+	ID          string `json:"id"`
+	ContentType string `json:"content_type"`
+	Size        int64  `json:"size"`
+	// URL is a path signed until the bottle expires
+	URL         string `json:"url,omitempty"`
+}
+
+// Attachments keeps the files thrown with bottles in a blob store and
+// serves them at urls signed until their bottle expires
+type Attachments struct {
+	store   binn.BlobStore
+	secret  []byte
+	maxSize int64
+	cycle   time.Duration
+	logger  *binn.Logger
+	mux     *sync.Mutex
+}
+
+func NewAttachments(store binn.BlobStore, secret []byte, maxSize int64) *Attachments {
+	return &Attachments{
+		store:   store,
+		secret:  secret,
+		maxSize: maxSize,
+		cycle:   DEFAULT_ATTACHMENT_SWEEP_CYCLE,
+		logger:  binn.DefaultLogger(),
+		mux:     &sync.Mutex{},
+	}
+}
+
+func (a *Attachments) SetLogger(l *binn.Logger) {
+	a.mux.Lock()
+	defer a.mux.Unlock()
+	a.logger = l
+}
+
+func (a *Attachments) SetSweepCycle(d time.Duration) {
+	a.mux.Lock()
+	defer a.mux.Unlock()
+	a.cycle = d
+}
+
+// MaxSize is the largest attachment in bytes
+func (a *Attachments) MaxSize() int64 {
+	return a.maxSize
+}
+
+// Save sniffs the content of r, strips the metadata of a image and puts
+// it into the blob store until its bottle is delivered
+func (a *Attachments) Save(r io.Reader) (binn.Attachment, error) {
+	data, err := io.ReadAll(io.LimitReader(r, a.maxSize + 1))
+	if err != nil {
+		return binn.Attachment{}, err
+	}
+	if int64(len(data)) > a.maxSize {
+		return binn.Attachment{}, ErrAttachmentTooLarge
+	}
+	if len(data) == 0 {
+		return binn.Attachment{}, ErrAttachmentBroken
+	}
+
+	contentType := http.DetectContentType(data)
+	ext, ok := attachmentTypes[contentType]
+	if !ok {
+		return binn.Attachment{}, ErrAttachmentType
+	}
+	switch contentType {
+	case "image/jpeg":
+		data, err = stripJPEG(data)
+	case "image/png":
+		data, err = stripPNG(data)
+	}
+	if err != nil {
+		return binn.Attachment{}, err
+	}
+
+	id := binn.GenerateID() + ext
+	expiredAt := time.Now().Add(time.Duration(binn.MAX_EXPIRATION_HOUR) * time.Hour)
+	if err := a.store.Put(id, bytes.NewReader(data), expiredAt); err != nil {
+		return binn.Attachment{}, err
+	}
+	return binn.Attachment{ ID: id, ContentType: contentType, Size: int64(len(data)) }, nil
+}
+
+// Delete removes the blobs of attachments
+func (a *Attachments) Delete(attachments []binn.Attachment) {
+	for _, at := range attachments {
+		if err := a.store.Delete(at.ID); err != nil {
+			a.mux.Lock()
+			logger := a.logger
+			a.mux.Unlock()
+			logger.Warn("failed to delete a attachment", binn.F("id", at.ID), binn.F("error", err))
+		}
+	}
+}
+
+func (a *Attachments) sign(id string, expires int64) string {
+	mac := hmac.New(sha256.New, a.secret)
+	fmt.Fprintf(mac, "%s\n%d", id, expires)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// URL is the path the attachment id is served at until expiredAt
+func (a *Attachments) URL(id string, expiredAt time.Time) string {
+	expires := expiredAt.Unix()
+	q := url.Values{}
+	q.Set("expires", strconv.FormatInt(expires, 10))
+	q.Set("signature", a.sign(id, expires))
+	return ATTACHMENT_PATH + url.PathEscape(id) + "?" + q.Encode()
+}
+
+// Verify checks a url made by URL has not expired at now
+func (a *Attachments) Verify(id string, expires string, signature string, now time.Time) error {
+	e, err := strconv.ParseInt(expires, 10, 64)
+	if err != nil {
+		return fmt.Errorf("this attachment url is invalid")
+	}
+	if !hmac.Equal([]byte(signature), []byte(a.sign(id, e))) {
+		return fmt.Errorf("this attachment url is invalid")
+	}
+	if now.Unix() > e {
+		return fmt.Errorf("this attachment url is expired")
+	}
+	return nil
+}
+
+// Register keeps blobs as long as their bottles, blobs of a delivered
+// bottle expire with it and blobs of a rejected or evicted bottle are
+// deleted at once
+func (a *Attachments) Register(h *binn.Hooks) {
+	h.On(binn.EVENT_DELIVERED, func(e binn.Event) {
+		if e.Container.ExpiredAt() == nil {
+			return
+		}
+		for _, at := range e.Container.Message().Attachments {
+			a.store.Expire(at.ID, *e.Container.ExpiredAt())
+		}
+	})
+	for _, typ := range []binn.EventType{ binn.EVENT_REJECTED, binn.EVENT_EVICTED } {
+		h.On(typ, func(e binn.Event) {
+			a.Delete(e.Container.Message().Attachments)
+		})
+	}
+}
+
+// Run sweeps expired blobs every sweep cycle until ctx is done
+func (a *Attachments) Run(ctx context.Context) {
+	a.mux.Lock()
+	cycle := a.cycle
+	a.mux.Unlock()
+
+	go func() {
+		t := time.NewTicker(cycle)
+		defer t.Stop()
+		for {
+			select {
+			case <- ctx.Done():
+				return
+			case <- t.C:
+				if n := a.store.Sweep(time.Now()); n > 0 {
+					a.mux.Lock()
+					logger := a.logger
+					a.mux.Unlock()
+					logger.Debug("sweep expired attachments", binn.F("count", n))
+				}
+			}
+		}
+	}()
+}
+
+func withAttachments(ctx context.Context, a *Attachments) context.Context {
+	return context.WithValue(ctx, attachmentsContextKey, a)
+}
+
+func attachmentsFrom(ctx context.Context) *Attachments {
+	a, _ := ctx.Value(attachmentsContextKey).(*Attachments)
+	return a
+}
+
+// stripJPEG drops the APP1 segments holding EXIF and XMP
+func stripJPEG(data []byte) ([]byte, error) {
+	if len(data) < 4 || data[0] != 0xFF || data[1] != 0xD8 {
+		return nil, ErrAttachmentBroken
+	}
+	out := bytes.NewBuffer(make([]byte, 0, len(data)))
+	out.Write(data[:2])
+	for i := 2; i < len(data); {
+		if data[i] != 0xFF || i + 1 >= len(data) {
+			return nil, ErrAttachmentBroken
+		}
+		marker := data[i + 1]
+		switch {
+		case marker == 0xFF:
+			// a fill byte
+			i++
+			continue
+		case marker == 0xD9:
+			out.Write(data[i:i + 2])
+			return out.Bytes(), nil
+		case marker == 0x01 || marker >= 0xD0 && marker <= 0xD7:
+			out.Write(data[i:i + 2])
+			i += 2
+			continue
+		}
+		if i + 4 > len(data) {
+			return nil, ErrAttachmentBroken
+		}
+		end := i + 2 + int(binary.BigEndian.Uint16(data[i + 2:]))
+		if end > len(data) {
+			return nil, ErrAttachmentBroken
+		}
+		// the entropy coded data follows the start of scan
+		if marker == 0xDA {
+			out.Write(data[i:])
+			return out.Bytes(), nil
+		}
+		if marker != 0xE1 {
+			out.Write(data[i:end])
+		}
+		i = end
+	}
+	return nil, ErrAttachmentBroken
+}
+
+var pngSignature = []byte("\x89PNG\r\n\x1a\n")
+
+// pngMetadataChunks hold EXIF and free text
+var pngMetadataChunks = map[string]bool{ "eXIf": true, "tEXt": true, "iTXt": true, "zTXt": true }
+
+// stripPNG drops the chunks holding EXIF and text
+func stripPNG(data []byte) ([]byte, error) {
+	if !bytes.HasPrefix(data, pngSignature) {
+		return nil, ErrAttachmentBroken
+	}
+	out := bytes.NewBuffer(make([]byte, 0, len(data)))
+	out.Write(pngSignature)
+	for i := len(pngSignature); i + 8 <= len(data); {
+		n := int(binary.BigEndian.Uint32(data[i:]))
+		typ := string(data[i + 4:i + 8])
+		end := i + 12 + n
+		if n < 0 || end > len(data) {
+			return nil, ErrAttachmentBroken
+		}
+		if !pngMetadataChunks[typ] {
+			out.Write(data[i:end])
+		}
+		if typ == "IEND" {
+			return out.Bytes(), nil
+		}
+		i = end
+	}
+	return nil, ErrAttachmentBroken
+}
+
+func attachmentStatus(err error) int {
+	switch err {
+	case ErrAttachmentTooLarge:
+		return http.StatusRequestEntityTooLarge
+	case ErrAttachmentType:
+		return http.StatusUnsupportedMediaType
+	case ErrAttachmentBroken:
+		return http.StatusBadRequest
+	}
+	return http.StatusInternalServerError
+}
+
+func isMultipart(r *http.Request) bool {
+	return strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data")
+}
+
+// readMultipartBottle reads a throw made of a bottle part holding the
+// json of the bottle and up to binn.MAX_MESSAGE_ATTACHMENTS attachment parts,
+// the saved attachments are deleted again when the throw is invalid
+func readMultipartBottle(w http.ResponseWriter, r *http.Request) (*binn.Bottle, bool) {
+	a := attachmentsFrom(r.Context())
+	if a == nil {
+		writeError(w, r, http.StatusUnsupportedMediaType, fmt.Errorf("attachments are not enabled"))
+		return nil, false
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, MAX_BOTTLE_PART_SIZE + binn.MAX_MESSAGE_ATTACHMENTS * (a.MaxSize() + 4096))
+
+	attachments := []binn.Attachment{}
+	fail := func(status int, err error) (*binn.Bottle, bool) {
+		a.Delete(attachments)
+		binn.SpanFrom(r.Context()).SetError(err)
+		writeError(w, r, status, err)
+		return nil, false
+	}
+
+	mr, err := r.MultipartReader()
+	if err != nil {
+		return fail(http.StatusBadRequest, err)
+	}
+	var req *RequestBottle
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fail(http.StatusBadRequest, err)
+		}
+		switch part.FormName() {
+		case "bottle":
+			body, err := io.ReadAll(io.LimitReader(part, MAX_BOTTLE_PART_SIZE + 1))
+			if err != nil {
+				return fail(http.StatusBadRequest, err)
+			}
+			if len(body) > MAX_BOTTLE_PART_SIZE {
+				return fail(http.StatusRequestEntityTooLarge, fmt.Errorf("this bottle part is too large"))
+			}
+			req = &RequestBottle{}
+			if err := json.Unmarshal(body, req); err != nil {
+				return fail(http.StatusBadRequest, err)
+			}
+		case "attachment":
+			if len(attachments) == binn.MAX_MESSAGE_ATTACHMENTS {
+				return fail(http.StatusBadRequest, fmt.Errorf("a bottle has at most %d attachments", binn.MAX_MESSAGE_ATTACHMENTS))
+			}
+			at, err := a.Save(part)
+			if err != nil {
+				return fail(attachmentStatus(err), err)
+			}
+			attachments = append(attachments, at)
+		}
+		part.Close()
+	}
+	if req == nil || req.Message == nil {
+		return fail(http.StatusBadRequest, fmt.Errorf("a bottle part is required"))
+	}
+
+	c := requestToContainer(req)
+	c.Message().Attachments = attachments
+	c.SetIdentity(IdentityFromContext(r.Context()))
+	binn.SpanFrom(r.Context()).SetMessage(c, "")
+	binn.SpanFrom(r.Context()).SetAttributes(binn.F("binn.message.attachments", len(attachments)))
+	return c, true
+}
+
+// signAttachments gives every attachment of rb a url valid until expiredAt
+func signAttachments(r *http.Request, rb *ResponseBottle, expiredAt *time.Time) {
+	a := attachmentsFrom(r.Context())
+	if a == nil || expiredAt == nil {
+		return
+	}
+	for i := range rb.Message.Attachments {
+		rb.Message.Attachments[i].URL = a.URL(rb.Message.Attachments[i].ID, *expiredAt)
+	}
+}
+
+// contentTypeOf tells the content type of a blob key by its extension
+func contentTypeOf(id string) (string, bool) {
+	for contentType, ext := range attachmentTypes {
+		if strings.HasSuffix(id, ext) {
+			return contentType, true
+		}
+	}
+	return "", false
+}
+
+// AttachmentHandlerFunc serves attachments at urls signed by Attachments.URL,
+// the signature stands in for authentication so a url works in a img tag
+func AttachmentHandlerFunc(cfg *Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if cfg.CORS().Handle(w, r) {
+			return
+		}
+		a := cfg.Attachments()
+		if a == nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			methodNotAllowed(w, http.MethodGet, http.MethodHead)
+			return
+		}
+
+		id := strings.TrimPrefix(r.URL.Path, ATTACHMENT_PATH)
+		q := r.URL.Query()
+		now := time.Now()
+		if err := a.Verify(id, q.Get("expires"), q.Get("signature"), now); err != nil {
+			writeError(w, r, http.StatusForbidden, err)
+			return
+		}
+		contentType, ok := contentTypeOf(id)
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		f, err := a.store.Open(id)
+		if errors.Is(err, os.ErrNotExist) {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			writeError(w, r, http.StatusInternalServerError, err)
+			return
+		}
+		defer f.Close()
+
+		expires, _ := strconv.ParseInt(q.Get("expires"), 10, 64)
+		w.Header().Set("Content-Type", contentType)
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		w.Header().Set("Content-Security-Policy", "default-src 'none'; sandbox")
+		w.Header().Set("Cache-Control", fmt.Sprintf("private, max-age=%d", expires - now.Unix()))
+		w.WriteHeader(http.StatusOK)
+		if r.Method == http.MethodGet {
+			io.Copy(w, f)
+		}
+	}
+}
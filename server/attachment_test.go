@@ -0,0 +1,226 @@
+package server
+
+import (
+	"io"
+	"time"
+	"bytes"
+	"bufio"
+	"image"
+	"context"
+	"strings"
+	"testing"
+	"net/http"
+	"image/png"
+	"image/jpeg"
+	"hash/crc32"
+	"encoding/json"
+	"encoding/binary"
+	"mime/multipart"
+	"net/http/httptest"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/binn/binn"
+)
+
+func testImage() image.Image {
+	return image.NewRGBA(image.Rect(0, 0, 4, 4))
+}
+
+// jpegWithEXIF puts a APP1 segment right after the start of image
+func jpegWithEXIF(t *testing.T) []byte {
+	var buf bytes.Buffer
+	require.Nil(t, jpeg.Encode(&buf, testImage(), nil))
+	payload := []byte("Exif\x00\x00GPS 35.6N 139.7E")
+	app1 := []byte{ 0xFF, 0xE1, 0, 0 }
+	binary.BigEndian.PutUint16(app1[2:], uint16(len(payload) + 2))
+	data := append([]byte{}, buf.Bytes()[:2]...)
+	data = append(data, app1...)
+	data = append(data, payload...)
+	return append(data, buf.Bytes()[2:]...)
+}
+
+// pngWithText puts a tEXt chunk right after the IHDR chunk
+func pngWithText(t *testing.T) []byte {
+	var buf bytes.Buffer
+	require.Nil(t, png.Encode(&buf, testImage()))
+	payload := []byte("Comment\x00GPS 35.6N 139.7E")
+	chunk := make([]byte, 8)
+	binary.BigEndian.PutUint32(chunk, uint32(len(payload)))
+	copy(chunk[4:], "tEXt")
+	chunk = append(chunk, payload...)
+	crc := make([]byte, 4)
+	binary.BigEndian.PutUint32(crc, crc32.ChecksumIEEE(chunk[4:]))
+	chunk = append(chunk, crc...)
+
+	ihdrEnd := len(pngSignature) + 12 + 13
+	data := append([]byte{}, buf.Bytes()[:ihdrEnd]...)
+	data = append(data, chunk...)
+	return append(data, buf.Bytes()[ihdrEnd:]...)
+}
+
+func TestStripJPEG(t *testing.T) {
+	data, err := stripJPEG(jpegWithEXIF(t))
+	require.Nil(t, err)
+	assert.False(t, bytes.Contains(data, []byte("GPS")))
+	_, err = jpeg.Decode(bytes.NewReader(data))
+	assert.Nil(t, err)
+
+	_, err = stripJPEG([]byte{ 0xFF, 0xD8, 0xFF, 0xE1, 0xFF })
+	assert.Equal(t, ErrAttachmentBroken, err)
+}
+
+func TestStripPNG(t *testing.T) {
+	data, err := stripPNG(pngWithText(t))
+	require.Nil(t, err)
+	assert.False(t, bytes.Contains(data, []byte("GPS")))
+	_, err = png.Decode(bytes.NewReader(data))
+	assert.Nil(t, err)
+
+	_, err = stripPNG(pngSignature)
+	assert.Equal(t, ErrAttachmentBroken, err)
+}
+
+func newTestAttachments(t *testing.T, maxSize int64) *Attachments {
+	store, err := binn.NewFileBlobStore(t.TempDir())
+	require.Nil(t, err)
+	return NewAttachments(store, []byte("secret"), maxSize)
+}
+
+func TestSaveAttachment(t *testing.T) {
+	a := newTestAttachments(t, 1024)
+	at, err := a.Save(bytes.NewReader(pngWithText(t)))
+	require.Nil(t, err)
+	assert.Equal(t, "image/png", at.ContentType)
+	assert.True(t, strings.HasSuffix(at.ID, ".png"))
+
+	_, err = a.Save(strings.NewReader("<html><script>alert(1)</script></html>"))
+	assert.Equal(t, ErrAttachmentType, err)
+	_, err = a.Save(bytes.NewReader(make([]byte, 1025)))
+	assert.Equal(t, ErrAttachmentTooLarge, err)
+	_, err = a.Save(strings.NewReader(""))
+	assert.Equal(t, ErrAttachmentBroken, err)
+}
+
+func TestVerifyAttachmentURL(t *testing.T) {
+	a := newTestAttachments(t, 1024)
+	expiredAt := time.Now().Add(time.Minute)
+	u := a.URL("a.png", expiredAt)
+	req := httptest.NewRequest("GET", u, nil)
+	q := req.URL.Query()
+	assert.Nil(t, a.Verify("a.png", q.Get("expires"), q.Get("signature"), time.Now()))
+	assert.NotNil(t, a.Verify("b.png", q.Get("expires"), q.Get("signature"), time.Now()))
+	assert.NotNil(t, a.Verify("a.png", q.Get("expires"), q.Get("signature"), expiredAt.Add(time.Second)))
+
+	other := NewAttachments(a.store, []byte("other"), 1024)
+	assert.NotNil(t, other.Verify("a.png", q.Get("expires"), q.Get("signature"), time.Now()))
+}
+
+func multipartBottle(t *testing.T, text string, files ...[]byte) (*bytes.Buffer, string) {
+	body := &bytes.Buffer{}
+	mw := multipart.NewWriter(body)
+	part, err := mw.CreateFormField("bottle")
+	require.Nil(t, err)
+	require.Nil(t, json.NewEncoder(part).Encode(&RequestBottle{ Message: &RequestMessage{ Text: text } }))
+	for _, f := range files {
+		part, err := mw.CreateFormFile("attachment", "file")
+		require.Nil(t, err)
+		part.Write(f)
+	}
+	require.Nil(t, mw.Close())
+	return body, mw.FormDataContentType()
+}
+
+func TestThrowAndFetchAttachment(t *testing.T) {
+	ecfg := binn.DefaultConfig()
+	ecfg.SetDeliveryCycle(time.Duration(1) * time.Millisecond)
+	storage := binn.NewContainerStorage(false, time.Duration(10) * time.Minute, nil)
+	engine := binn.NewEngine(ecfg, storage)
+	a := newTestAttachments(t, DEFAULT_ATTACHMENT_MAX_SIZE)
+	a.Register(engine.GetHooks())
+	scfg := NewConfig(10, false)
+	scfg.SetAttachments(a)
+
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	defer cancelFunc()
+	engine.Run(ctx)
+	srv := httptest.NewServer(NewServer(engine, "", scfg).Handler)
+	defer srv.Close()
+
+	body, contentType := multipartBottle(t, "a doodle", pngWithText(t))
+	resp, err := http.Post(srv.URL + "/api/bottle", contentType, body)
+	require.Nil(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+
+	reqCtx, reqCancelFunc := context.WithTimeout(ctx, time.Second)
+	defer reqCancelFunc()
+	req, _ := http.NewRequestWithContext(reqCtx, "GET", srv.URL + "/api/bottle", nil)
+	resp, err = http.DefaultClient.Do(req)
+	require.Nil(t, err)
+	sm, err := ReadSSEMessage(bufio.NewReader(resp.Body))
+	resp.Body.Close()
+	require.Nil(t, err)
+	var rb ResponseBottle
+	require.Nil(t, json.Unmarshal([]byte(sm.Data), &rb))
+	assert.Equal(t, "a doodle", rb.Message.Text)
+	require.Equal(t, 1, len(rb.Message.Attachments))
+	at := rb.Message.Attachments[0]
+	assert.Equal(t, "image/png", at.ContentType)
+	assert.True(t, strings.HasPrefix(at.URL, ATTACHMENT_PATH))
+
+	resp, err = http.Get(srv.URL + at.URL)
+	require.Nil(t, err)
+	data, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "image/png", resp.Header.Get("Content-Type"))
+	assert.Equal(t, "nosniff", resp.Header.Get("X-Content-Type-Options"))
+	assert.Equal(t, at.Size, int64(len(data)))
+	assert.False(t, bytes.Contains(data, []byte("GPS")))
+
+	resp, err = http.Get(srv.URL + strings.Replace(at.URL, "signature=", "signature=0", 1))
+	require.Nil(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+}
+
+func TestThrowRejectsAttachments(t *testing.T) {
+	engine := binn.NewEngine(binn.DefaultConfig(), binn.NewContainerStorage(false, 0, nil))
+	a := newTestAttachments(t, 1024)
+	cfg := NewConfig(10, false)
+	handler := BottleHandlerFunc(engine, cfg)
+
+	// attachments are not enabled
+	body, contentType := multipartBottle(t, "hello", []byte("hello"))
+	req := httptest.NewRequest("POST", "http://example.com/api/bottle", body)
+	req.Header.Set("Content-Type", contentType)
+	w := httptest.NewRecorder()
+	handler(w, req)
+	assert.Equal(t, http.StatusUnsupportedMediaType, w.Result().StatusCode)
+
+	cfg.SetAttachments(a)
+	files := [][]byte{}
+	for i := 0; i <= binn.MAX_MESSAGE_ATTACHMENTS; i++ {
+		files = append(files, []byte("hello"))
+	}
+	for _, c := range []struct {
+		files  [][]byte
+		status int
+	}{
+		{ files, http.StatusBadRequest },
+		{ [][]byte{ []byte("GIF89a"), bytes.Repeat([]byte("a"), 1025) }, http.StatusRequestEntityTooLarge },
+		{ [][]byte{ []byte("%PDF-1.4") }, http.StatusUnsupportedMediaType },
+	} {
+		body, contentType := multipartBottle(t, "hello", c.files...)
+		req := httptest.NewRequest("POST", "http://example.com/api/bottle", body)
+		req.Header.Set("Content-Type", contentType)
+		w := httptest.NewRecorder()
+		handler(w, req)
+		assert.Equal(t, c.status, w.Result().StatusCode)
+	}
+
+	// the attachments saved before a invalid part are deleted
+	assert.Equal(t, 0, a.store.Sweep(time.Now().Add(time.Duration(binn.MAX_EXPIRATION_HOUR + 1) * time.Hour)))
+}
@@ -0,0 +1,277 @@
+package server
+
+import (
+	"fmt"
+	"time"
+	"context"
+	"strings"
+	"net/http"
+	"crypto"
+	"crypto/rsa"
+	"crypto/hmac"
+	"crypto/x509"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/pem"
+	"encoding/json"
+	"encoding/base64"
+
+	"github.com/binn/binn"
+)
+
+type contextKey string
+
+const identityContextKey = contextKey("identity")
+
+type Auth struct {
+	apiKeys  map[string]*binn.Identity
+	hs256Key []byte
+	rs256Key *rsa.PublicKey
+	issuer   string
+	audience string
+	required bool
+}
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Typ string `json:"typ"`
+}
+
+type jwtClaims struct {
+	Subject   string          `json:"sub"`
+	Issuer    string          `json:"iss"`
+	Audience  json.RawMessage `json:"aud"`
+	ExpiresAt *int64          `json:"exp"`
+	NotBefore *int64          `json:"nbf"`
+	Scope     string          `json:"scope"`
+	Scopes    []string        `json:"scopes"`
+}
+
+func NewAuth() *Auth {
+	return &Auth{
+		apiKeys: make(map[string]*binn.Identity),
+	}
+}
+
+func hashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// AddAPIKey registers a static key, keys are kept as hashes
+// so a lookup does not compare the plain keys
+func (a *Auth) AddAPIKey(key string, subject string, scopes ...string) {
+	a.apiKeys[hashAPIKey(key)] = binn.NewIdentity(subject, "api_key", scopes...)
+}
+
+func (a *Auth) SetHS256Key(key []byte) {
+	a.hs256Key = key
+}
+
+func (a *Auth) SetRS256Key(key *rsa.PublicKey) {
+	a.rs256Key = key
+}
+
+func (a *Auth) SetIssuer(issuer string) {
+	a.issuer = issuer
+}
+
+func (a *Auth) SetAudience(audience string) {
+	a.audience = audience
+}
+
+// Require rejects requests without credentials,
+// otherwise they are served as anonymous
+func (a *Auth) Require() {
+	a.required = true
+}
+
+func (a *Auth) Required() bool {
+	return a.required
+}
+
+// ParseAPIKeys parses comma separated "subject:key:scope|scope" entries
+func (a *Auth) ParseAPIKeys(s string) error {
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		fields := strings.Split(entry, ":")
+		if len(fields) != 3 || fields[0] == "" || fields[1] == "" {
+			return fmt.Errorf("api key entry (%#v) is invalid format", fields[0])
+		}
+		scopes := strings.Split(fields[2], "|")
+		for _, scope := range scopes {
+			if scope != binn.SCOPE_READ && scope != binn.SCOPE_THROW && scope != binn.SCOPE_ADMIN {
+				return fmt.Errorf("scope (%#v) of api key for %#v is unknown", scope, fields[0])
+			}
+		}
+		a.AddAPIKey(fields[1], fields[0], scopes...)
+	}
+	return nil
+}
+
+func ParseRSAPublicKey(data []byte) (*rsa.PublicKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("public key is not pem format")
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		if rsaKey, rerr := x509.ParsePKCS1PublicKey(block.Bytes); rerr == nil {
+			return rsaKey, nil
+		}
+		return nil, err
+	}
+	rsaKey, ok := key.(*rsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("public key is not rsa")
+	}
+	return rsaKey, nil
+}
+
+func credentialFrom(r *http.Request) string {
+	if key := r.Header.Get("X-API-Key"); key != "" {
+		return key
+	}
+	auth := r.Header.Get("Authorization")
+	if strings.HasPrefix(auth, "Bearer ") {
+		return strings.TrimPrefix(auth, "Bearer ")
+	}
+	return ""
+}
+
+// Authenticate returns the identity of the credential of r,
+// a request without credentials is anonymous unless auth is required
+func (a *Auth) Authenticate(r *http.Request) (*binn.Identity, error) {
+	credential := credentialFrom(r)
+	if credential == "" {
+		if a.required {
+			return nil, fmt.Errorf("credential is required")
+		}
+		return binn.AnonymousIdentity(), nil
+	}
+
+	if strings.Count(credential, ".") == 2 {
+		return a.verifyJWT(credential)
+	}
+
+	if id, ok := a.apiKeys[hashAPIKey(credential)]; ok {
+		return id, nil
+	}
+	return nil, fmt.Errorf("api key is invalid")
+}
+
+func (a *Auth) verifyJWT(token string) (*binn.Identity, error) {
+	parts := strings.Split(token, ".")
+
+	var header jwtHeader
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("jwt header is invalid format")
+	}
+
+	signed := []byte(parts[0] + "." + parts[1])
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("jwt signature is invalid format")
+	}
+
+	// the algorithm is fixed by the configured key, never by the token alone
+	switch {
+	case header.Alg == "HS256" && a.hs256Key != nil:
+		mac := hmac.New(sha256.New, a.hs256Key)
+		mac.Write(signed)
+		if !hmac.Equal(sig, mac.Sum(nil)) {
+			return nil, fmt.Errorf("jwt signature is invalid")
+		}
+	case header.Alg == "RS256" && a.rs256Key != nil:
+		sum := sha256.Sum256(signed)
+		if err := rsa.VerifyPKCS1v15(a.rs256Key, crypto.SHA256, sum[:], sig); err != nil {
+			return nil, fmt.Errorf("jwt signature is invalid")
+		}
+	default:
+		return nil, fmt.Errorf("jwt algorithm (%#v) is not accepted", header.Alg)
+	}
+
+	var claims jwtClaims
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("jwt claims are invalid format")
+	}
+
+	now := time.Now().Unix()
+	if claims.ExpiresAt == nil || now >= *claims.ExpiresAt {
+		return nil, fmt.Errorf("jwt is expired")
+	}
+	if claims.NotBefore != nil && now < *claims.NotBefore {
+		return nil, fmt.Errorf("jwt is not valid yet")
+	}
+	if a.issuer != "" && claims.Issuer != a.issuer {
+		return nil, fmt.Errorf("jwt issuer (%#v) is invalid", claims.Issuer)
+	}
+	if a.audience != "" && !audienceContains(claims.Audience, a.audience) {
+		return nil, fmt.Errorf("jwt audience is invalid")
+	}
+	if claims.Subject == "" {
+		return nil, fmt.Errorf("jwt has no subject")
+	}
+
+	scopes := claims.Scopes
+	if claims.Scope != "" {
+		scopes = append(scopes, strings.Fields(claims.Scope)...)
+	}
+	return binn.NewIdentity(claims.Subject, "jwt", scopes...), nil
+}
+
+func decodeJWTPart(part string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+func audienceContains(raw json.RawMessage, audience string) bool {
+	var single string
+	if err := json.Unmarshal(raw, &single); err == nil {
+		return single == audience
+	}
+	var multiple []string
+	if err := json.Unmarshal(raw, &multiple); err == nil {
+		for _, aud := range multiple {
+			if aud == audience {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func WithIdentity(ctx context.Context, id *binn.Identity) context.Context {
+	return context.WithValue(ctx, identityContextKey, id)
+}
+
+func IdentityFromContext(ctx context.Context) *binn.Identity {
+	id, _ := ctx.Value(identityContextKey).(*binn.Identity)
+	return id
+}
+
+// authenticate puts the identity of r into its context, a request
+// is anonymous with read and throw scopes when no auth is configured
+func authenticate(cfg *Config, r *http.Request, scope string) (*http.Request, int, error) {
+	var id *binn.Identity
+	if auth := cfg.Auth(); auth != nil {
+		var err error
+		if id, err = auth.Authenticate(r); err != nil {
+			return r, http.StatusUnauthorized, err
+		}
+	} else {
+		id = binn.AnonymousIdentity()
+	}
+
+	if !id.HasScope(scope) {
+		return r, http.StatusForbidden, fmt.Errorf("scope %#v is required", scope)
+	}
+
+	return r.WithContext(WithIdentity(r.Context(), id)), 0, nil
+}
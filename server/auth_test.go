@@ -0,0 +1,185 @@
+package server
+
+import (
+	"time"
+	"bytes"
+	"crypto"
+	"testing"
+	"crypto/rsa"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"encoding/base64"
+	"net/http/httptest"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/binn/binn"
+)
+
+func signJWT(alg string, claims map[string]interface{}, sign func([]byte) []byte) string {
+	header, _ := json.Marshal(map[string]string{ "alg": alg, "typ": "JWT" })
+	payload, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sign([]byte(signed)))
+}
+
+func signHS256(key []byte) func([]byte) []byte {
+	return func(b []byte) []byte {
+		mac := hmac.New(sha256.New, key)
+		mac.Write(b)
+		return mac.Sum(nil)
+	}
+}
+
+func authenticateBearer(auth *Auth, credential string) (*binn.Identity, error) {
+	req := httptest.NewRequest("GET", "http://example.com/api/bottle", nil)
+	if credential != "" {
+		req.Header.Set("Authorization", "Bearer " + credential)
+	}
+	return auth.Authenticate(req)
+}
+
+func TestAuthenticateAPIKey(t *testing.T) {
+	auth := NewAuth()
+	err := auth.ParseAPIKeys("alice:k3y:read|throw, bob:s3cret:admin")
+	assert.Nil(t, err)
+
+	id, err := authenticateBearer(auth, "k3y")
+	assert.Nil(t, err)
+	assert.Equal(t, "alice", id.Subject)
+	assert.True(t, id.HasScope(binn.SCOPE_THROW))
+	assert.False(t, id.HasScope(binn.SCOPE_ADMIN))
+
+	_, err = authenticateBearer(auth, "wrong")
+	assert.EqualError(t, err, "api key is invalid")
+
+	err = auth.ParseAPIKeys("carol:key:write")
+	assert.Error(t, err)
+}
+
+func TestAuthenticateAnonymous(t *testing.T) {
+	auth := NewAuth()
+
+	id, err := authenticateBearer(auth, "")
+	assert.Nil(t, err)
+	assert.True(t, id.Anonymous())
+
+	auth.Require()
+	_, err = authenticateBearer(auth, "")
+	assert.EqualError(t, err, "credential is required")
+}
+
+func TestAuthenticateHS256(t *testing.T) {
+	key := []byte("secret")
+	auth := NewAuth()
+	auth.SetHS256Key(key)
+	auth.SetIssuer("binn")
+	auth.SetAudience("ocean")
+
+	exp := time.Now().Add(time.Duration(1) * time.Minute).Unix()
+	token := signJWT("HS256", map[string]interface{}{
+		"sub": "alice", "iss": "binn", "aud": []string{"ocean"}, "exp": exp, "scope": "read throw",
+	}, signHS256(key))
+
+	id, err := authenticateBearer(auth, token)
+	assert.Nil(t, err)
+	assert.Equal(t, "alice", id.Subject)
+	assert.Equal(t, "jwt", id.Method)
+	assert.True(t, id.HasScope(binn.SCOPE_READ))
+
+	expired := signJWT("HS256", map[string]interface{}{
+		"sub": "alice", "iss": "binn", "aud": "ocean", "exp": time.Now().Add(-time.Minute).Unix(),
+	}, signHS256(key))
+	_, err = authenticateBearer(auth, expired)
+	assert.EqualError(t, err, "jwt is expired")
+
+	forged := signJWT("HS256", map[string]interface{}{
+		"sub": "alice", "iss": "binn", "aud": "ocean", "exp": exp,
+	}, signHS256([]byte("wrong")))
+	_, err = authenticateBearer(auth, forged)
+	assert.EqualError(t, err, "jwt signature is invalid")
+
+	unsigned := signJWT("none", map[string]interface{}{
+		"sub": "alice", "exp": exp,
+	}, func([]byte) []byte { return []byte{} })
+	_, err = authenticateBearer(auth, unsigned)
+	assert.EqualError(t, err, "jwt algorithm (\"none\") is not accepted")
+}
+
+func TestAuthenticateRS256(t *testing.T) {
+	key, _ := rsa.GenerateKey(rand.Reader, 2048)
+	auth := NewAuth()
+	auth.SetRS256Key(&key.PublicKey)
+
+	exp := time.Now().Add(time.Duration(1) * time.Minute).Unix()
+	token := signJWT("RS256", map[string]interface{}{
+		"sub": "bob", "exp": exp, "scopes": []string{"admin"},
+	}, func(b []byte) []byte {
+		sum := sha256.Sum256(b)
+		sig, _ := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, sum[:])
+		return sig
+	})
+
+	id, err := authenticateBearer(auth, token)
+	assert.Nil(t, err)
+	assert.Equal(t, "bob", id.Subject)
+	assert.True(t, id.HasScope(binn.SCOPE_ADMIN))
+
+	// a HS256 token must not be verified with the public key as secret
+	confused := signJWT("HS256", map[string]interface{}{
+		"sub": "bob", "exp": exp,
+	}, signHS256(key.PublicKey.N.Bytes()))
+	_, err = authenticateBearer(auth, confused)
+	assert.EqualError(t, err, "jwt algorithm (\"HS256\") is not accepted")
+}
+
+func TestHandlePostBottleWithScope(t *testing.T) {
+	engine, _, _ := newAdminTestEngine()
+	cfg := NewConfig(10, false)
+	auth := NewAuth()
+	auth.AddAPIKey("reader", "alice", binn.SCOPE_READ)
+	auth.AddAPIKey("thrower", "bob", binn.SCOPE_THROW)
+	cfg.SetAuth(auth)
+
+	handler := BottleHandlerFunc(engine, cfg)
+
+	req := httptest.NewRequest("POST", "http://example.com/api/bottle",
+		bytes.NewBufferString("{\"id\":\"1\",\"message\":{\"text\":\"Hello\"}}"))
+	req.Header.Set("X-API-Key", "reader")
+	w := httptest.NewRecorder()
+	handler(w, req)
+	assert.Equal(t, 403, w.Result().StatusCode)
+
+	req = httptest.NewRequest("POST", "http://example.com/api/bottle",
+		bytes.NewBufferString("{\"id\":\"1\",\"message\":{\"text\":\"Hello\"}}"))
+	req.Header.Set("X-API-Key", "thrower")
+	w = httptest.NewRecorder()
+	handler(w, req)
+	assert.Equal(t, 204, w.Result().StatusCode)
+
+	c := <- engine.GetInChan()
+	assert.Equal(t, "bob", c.(binn.Identified).Identity().Subject)
+}
+
+func TestAdminWithAdminScope(t *testing.T) {
+	engine, _, _ := newAdminTestEngine()
+	cfg := NewConfig(10, false)
+	auth := NewAuth()
+	auth.AddAPIKey("admin-key", "carol", binn.SCOPE_ADMIN)
+	auth.AddAPIKey("reader", "alice", binn.SCOPE_READ)
+	cfg.SetAuth(auth)
+
+	req := httptest.NewRequest("GET", "http://example.com/admin/engine", nil)
+	req.Header.Set("X-API-Key", "admin-key")
+	w := httptest.NewRecorder()
+	AdminHandlerFunc(engine, cfg)(w, req)
+	assert.Equal(t, 200, w.Result().StatusCode)
+
+	req.Header.Set("X-API-Key", "reader")
+	req.RemoteAddr = "127.0.0.1:40000"
+	w = httptest.NewRecorder()
+	AdminHandlerFunc(engine, cfg)(w, req)
+	assert.Equal(t, 401, w.Result().StatusCode)
+}
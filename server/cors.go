@@ -0,0 +1,163 @@
+package server
+
+import (
+	"time"
+	"strings"
+	"strconv"
+	"net/http"
+
+	"github.com/binn/binn"
+)
+
+type CORS struct {
+	allowedOrigins   []string
+	allowedMethods   []string
+	allowedHeaders   []string
+	allowCredentials bool
+	maxAge           time.Duration
+}
+
+func NewCORS(origins []string, methods []string, headers []string, credentials bool, maxAge time.Duration) *CORS {
+	upperMethods := make([]string, len(methods))
+	for i, m := range methods {
+		upperMethods[i] = strings.ToUpper(m)
+	}
+	return &CORS{
+		allowedOrigins:   origins,
+		allowedMethods:   upperMethods,
+		allowedHeaders:   headers,
+		allowCredentials: credentials,
+		maxAge:           maxAge,
+	}
+}
+
+func DefaultCORS() *CORS {
+	return NewCORS(
+		[]string{"*"},
+		[]string{http.MethodGet, http.MethodPost},
+		[]string{"Authorization", "Content-Type", "X-API-Key"},
+		false,
+		time.Duration(10) * time.Minute,
+	)
+}
+
+// matchOrigin matches an exact origin, "*" or a pattern such as
+// "https://*.example.com" where "*" is one or more subdomains
+func matchOrigin(pattern string, origin string) bool {
+	if pattern == "*" {
+		return true
+	}
+
+	i := strings.Index(pattern, "*")
+	if i < 0 {
+		return strings.EqualFold(pattern, origin)
+	}
+
+	prefix, suffix := strings.ToLower(pattern[:i]), strings.ToLower(pattern[i+1:])
+	origin = strings.ToLower(origin)
+	if len(origin) <= len(prefix) + len(suffix) ||
+		!strings.HasPrefix(origin, prefix) || !strings.HasSuffix(origin, suffix) {
+		return false
+	}
+	middle := origin[len(prefix):len(origin)-len(suffix)]
+	return !strings.ContainsAny(middle, "/:")
+}
+
+func (c *CORS) AllowOrigin(origin string) bool {
+	for _, pattern := range c.allowedOrigins {
+		if matchOrigin(pattern, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *CORS) allowMethod(method string) bool {
+	for _, m := range c.allowedMethods {
+		if m == method {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *CORS) allowHeaders(requested string) bool {
+	for _, h := range strings.Split(requested, ",") {
+		h = strings.TrimSpace(h)
+		if h == "" {
+			continue
+		}
+		allowed := false
+		for _, a := range c.allowedHeaders {
+			if a == "*" || strings.EqualFold(a, h) {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return false
+		}
+	}
+	return true
+}
+
+func (c *CORS) wildcard() bool {
+	for _, pattern := range c.allowedOrigins {
+		if pattern == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// Handle sets the CORS headers of a response and answers preflight
+// requests, it returns true when the request has been answered
+func (c *CORS) Handle(w http.ResponseWriter, r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	preflight := r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != ""
+
+	if origin == "" || !c.AllowOrigin(origin) {
+		if preflight {
+			w.WriteHeader(http.StatusForbidden)
+			loggerFrom(r).Debug("origin is not allowed", binn.F("status", http.StatusForbidden), binn.F("origin", origin))
+			return true
+		}
+		return false
+	}
+
+	h := w.Header()
+	h.Add("Vary", "Origin")
+	// credentials are never allowed for any origin, so a wildcard ignores them
+	if c.wildcard() {
+		h.Set("Access-Control-Allow-Origin", "*")
+	} else {
+		h.Set("Access-Control-Allow-Origin", origin)
+		if c.allowCredentials {
+			h.Set("Access-Control-Allow-Credentials", "true")
+		}
+	}
+
+	if !preflight {
+		return false
+	}
+
+	h.Add("Vary", "Access-Control-Request-Method")
+	h.Add("Vary", "Access-Control-Request-Headers")
+	method := r.Header.Get("Access-Control-Request-Method")
+	requestedHeaders := r.Header.Get("Access-Control-Request-Headers")
+	if !c.allowMethod(method) || !c.allowHeaders(requestedHeaders) {
+		w.WriteHeader(http.StatusForbidden)
+		loggerFrom(r).Debug("preflight is not allowed", binn.F("status", http.StatusForbidden), binn.F("method", method))
+		return true
+	}
+
+	h.Set("Access-Control-Allow-Methods", strings.Join(c.allowedMethods, ", "))
+	if requestedHeaders != "" {
+		h.Set("Access-Control-Allow-Headers", requestedHeaders)
+	}
+	if c.maxAge > 0 {
+		h.Set("Access-Control-Max-Age", strconv.Itoa(int(c.maxAge.Seconds())))
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return true
+}
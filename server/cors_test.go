@@ -0,0 +1,105 @@
+package server
+
+import (
+	"time"
+	"testing"
+	"net/http/httptest"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMatchOrigin(t *testing.T) {
+	assert.True(t, matchOrigin("*", "https://example.com"))
+	assert.True(t, matchOrigin("https://example.com", "https://EXAMPLE.com"))
+	assert.False(t, matchOrigin("https://example.com", "http://example.com"))
+	assert.True(t, matchOrigin("https://*.example.com", "https://app.example.com"))
+	assert.True(t, matchOrigin("https://*.example.com", "https://a.b.example.com"))
+	assert.False(t, matchOrigin("https://*.example.com", "https://example.com"))
+	assert.False(t, matchOrigin("https://*.example.com", "https://evil.com/.example.com"))
+	assert.False(t, matchOrigin("https://*.example.com", "https://evilexample.com"))
+}
+
+func TestCORSPreflight(t *testing.T) {
+	cors := NewCORS(
+		[]string{"https://*.example.com"},
+		[]string{"GET", "POST"},
+		[]string{"Content-Type"},
+		true,
+		time.Duration(1) * time.Minute,
+	)
+
+	req := httptest.NewRequest("OPTIONS", "http://example.com/api/bottle", nil)
+	req.Header.Set("Origin", "https://app.example.com")
+	req.Header.Set("Access-Control-Request-Method", "POST")
+	req.Header.Set("Access-Control-Request-Headers", "content-type")
+	w := httptest.NewRecorder()
+
+	assert.True(t, cors.Handle(w, req))
+	resp := w.Result()
+	assert.Equal(t, 204, resp.StatusCode)
+	assert.Equal(t, "https://app.example.com", resp.Header.Get("Access-Control-Allow-Origin"))
+	assert.Equal(t, "true", resp.Header.Get("Access-Control-Allow-Credentials"))
+	assert.Equal(t, "GET, POST", resp.Header.Get("Access-Control-Allow-Methods"))
+	assert.Equal(t, "content-type", resp.Header.Get("Access-Control-Allow-Headers"))
+	assert.Equal(t, "60", resp.Header.Get("Access-Control-Max-Age"))
+
+	req.Header.Set("Access-Control-Request-Method", "DELETE")
+	w = httptest.NewRecorder()
+	assert.True(t, cors.Handle(w, req))
+	assert.Equal(t, 403, w.Result().StatusCode)
+
+	req.Header.Set("Origin", "https://evil.com")
+	req.Header.Set("Access-Control-Request-Method", "POST")
+	w = httptest.NewRecorder()
+	assert.True(t, cors.Handle(w, req))
+	assert.Equal(t, 403, w.Result().StatusCode)
+}
+
+func TestCORSWildcardNeverAllowsCredentials(t *testing.T) {
+	cors := NewCORS([]string{"*"}, []string{"GET"}, nil, true, time.Duration(1) * time.Minute)
+
+	req := httptest.NewRequest("GET", "http://example.com/api/bottle", nil)
+	req.Header.Set("Origin", "https://evil.com")
+	w := httptest.NewRecorder()
+	assert.False(t, cors.Handle(w, req))
+	resp := w.Result()
+	assert.Equal(t, "*", resp.Header.Get("Access-Control-Allow-Origin"))
+	assert.Equal(t, "", resp.Header.Get("Access-Control-Allow-Credentials"))
+}
+
+func TestCORSSimpleRequest(t *testing.T) {
+	cors := DefaultCORS()
+
+	req := httptest.NewRequest("GET", "http://example.com/api/bottle", nil)
+	req.Header.Set("Origin", "https://app.example.com")
+	w := httptest.NewRecorder()
+
+	assert.False(t, cors.Handle(w, req))
+	assert.Equal(t, "*", w.Result().Header.Get("Access-Control-Allow-Origin"))
+	assert.Equal(t, "", w.Result().Header.Get("Access-Control-Allow-Credentials"))
+
+	req.Header.Del("Origin")
+	w = httptest.NewRecorder()
+	assert.False(t, cors.Handle(w, req))
+	assert.Equal(t, "", w.Result().Header.Get("Access-Control-Allow-Origin"))
+}
+
+func TestHandleUnsupportedMethod(t *testing.T) {
+	engine, _, _ := newAdminTestEngine()
+	cfg := NewConfig(10, false)
+	handler := BottleHandlerFunc(engine, cfg)
+
+	req := httptest.NewRequest("DELETE", "http://example.com/api/bottle", nil)
+	w := httptest.NewRecorder()
+	handler(w, req)
+
+	assert.Equal(t, 405, w.Result().StatusCode)
+	assert.Equal(t, "GET, POST, OPTIONS", w.Result().Header.Get("Allow"))
+
+	req = httptest.NewRequest("OPTIONS", "http://example.com/api/bottle", nil)
+	w = httptest.NewRecorder()
+	handler(w, req)
+
+	assert.Equal(t, 204, w.Result().StatusCode)
+	assert.Equal(t, "GET, POST, OPTIONS", w.Result().Header.Get("Allow"))
+}
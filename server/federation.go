@@ -0,0 +1,67 @@
+package server
+
+import (
+	"io"
+	"fmt"
+	"net/http"
+
+	"github.com/binn/binn"
+)
+
+const MAX_FEDERATION_BODY_SIZE = 1024 * 1024
+
+// FederationInboxHandlerFunc imports bottles exported by federated peers,
+// it is not found unless federation is configured
+func FederationInboxHandlerFunc(cfg *Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		federation := cfg.Federation()
+		if federation == nil {
+			writeError(w, r, http.StatusNotFound, fmt.Errorf("%s is not found", r.URL.Path))
+			return
+		}
+		if r.Method != http.MethodPost {
+			methodNotAllowed(w, http.MethodPost)
+			return
+		}
+
+		body, err := io.ReadAll(io.LimitReader(r.Body, MAX_FEDERATION_BODY_SIZE + 1))
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, err)
+			return
+		}
+		if len(body) > MAX_FEDERATION_BODY_SIZE {
+			writeError(w, r, http.StatusRequestEntityTooLarge, fmt.Errorf("federation payload is too large"))
+			return
+		}
+
+		peer := r.Header.Get(binn.FEDERATION_PEER_HEADER)
+		res, err := federation.Receive(
+			peer,
+			r.Header.Get(binn.WEBHOOK_TIMESTAMP_HEADER),
+			r.Header.Get(binn.WEBHOOK_SIGNATURE_HEADER),
+			body,
+		)
+		switch err {
+		case nil:
+		case binn.ErrUnknownPeer, binn.ErrInvalidSignature:
+			writeError(w, r, http.StatusUnauthorized, err)
+			return
+		case binn.ErrDefederated:
+			writeError(w, r, http.StatusForbidden, err)
+			return
+		case binn.ErrReplayed:
+			writeError(w, r, http.StatusConflict, err)
+			return
+		default:
+			writeError(w, r, http.StatusBadRequest, err)
+			return
+		}
+
+		writeJSON(w, r, http.StatusOK, res)
+		loggerFrom(r).Info("import bottles",
+			binn.F("status", http.StatusOK),
+			binn.F("peer", peer),
+			binn.F("accepted", len(res.Accepted)),
+		)
+	}
+}
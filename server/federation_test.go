@@ -0,0 +1,87 @@
+package server
+
+import (
+	"time"
+	"bytes"
+	"context"
+	"strconv"
+	"testing"
+	"net/http"
+	"encoding/json"
+	"net/http/httptest"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/binn/binn"
+)
+
+func TestFederationInbox(t *testing.T) {
+	engine, storage, _ := newAdminTestEngine()
+	cfg := NewConfig(10, false)
+	cfg.SetAdminToken("secret")
+	srv := httptest.NewServer(NewServer(engine, "", cfg).Handler)
+	defer srv.Close()
+
+	post := func(peer string, key string) int {
+		body := []byte(`{"id":"` + binn.GenerateID() + `","origin":"` + peer + `","bottles":[{"text":"hello","via":["` + peer + `"]}]}`)
+		ts := strconv.FormatInt(time.Now().Unix(), 10)
+		req, _ := http.NewRequest(http.MethodPost, srv.URL + binn.FEDERATION_INBOX_PATH, bytes.NewReader(body))
+		req.Header.Set(binn.FEDERATION_PEER_HEADER, peer)
+		req.Header.Set(binn.WEBHOOK_TIMESTAMP_HEADER, ts)
+		req.Header.Set(binn.WEBHOOK_SIGNATURE_HEADER, binn.SignWebhook(key, ts, body))
+		resp, err := http.DefaultClient.Do(req)
+		require.Nil(t, err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	assert.Equal(t, http.StatusNotFound, post("a", "key"))
+
+	cfg.SetFederation(binn.NewFederation("b", []*binn.FederationPeer{ { Name: "a", Key: "key", Quota: 10 } }, storage))
+	assert.Equal(t, http.StatusUnauthorized, post("a", "wrong"))
+	assert.Equal(t, http.StatusUnauthorized, post("c", "key"))
+	assert.Equal(t, http.StatusOK, post("a", "key"))
+	assert.Equal(t, 1, storage.Len())
+
+	status, _ := doAdminRequest(cfg, engine, "POST", "/admin/federation/a/defederate", "")
+	assert.Equal(t, http.StatusNoContent, status)
+	assert.Equal(t, http.StatusForbidden, post("a", "key"))
+
+	status, b := doAdminRequest(cfg, engine, "GET", "/admin/federation", "")
+	assert.Equal(t, http.StatusOK, status)
+	var res FederationResponse
+	assert.Nil(t, json.Unmarshal(b, &res))
+	assert.Equal(t, "b", res.Name)
+	assert.True(t, res.Peers[0].Defederated)
+	assert.Equal(t, uint64(1), res.Peers[0].Received)
+
+	status, _ = doAdminRequest(cfg, engine, "POST", "/admin/federation/c/defederate", "")
+	assert.Equal(t, http.StatusNotFound, status)
+}
+
+func TestFederationBetweenServers(t *testing.T) {
+	engineA, storageA, _ := newAdminTestEngine()
+	engineB, storageB, _ := newAdminTestEngine()
+	cfgA, cfgB := NewConfig(10, false), NewConfig(10, false)
+	srvA := httptest.NewServer(NewServer(engineA, "", cfgA).Handler)
+	defer srvA.Close()
+	srvB := httptest.NewServer(NewServer(engineB, "", cfgB).Handler)
+	defer srvB.Close()
+
+	fedA := binn.NewFederation("a", []*binn.FederationPeer{ { Name: "b", URL: srvB.URL, Key: "key", Quota: 10 } }, storageA)
+	fedB := binn.NewFederation("b", []*binn.FederationPeer{ { Name: "a", URL: srvA.URL, Key: "key", Quota: 10 } }, storageB)
+	cfgA.SetFederation(fedA)
+	cfgB.SetFederation(fedB)
+
+	_, err := storageA.Inject(binn.NewBottle("", "hello", nil))
+	require.Nil(t, err)
+	fedA.Export(context.Background())
+	assert.Equal(t, 0, storageA.Len())
+	assert.Equal(t, 1, storageB.Len())
+
+	// a bottle never drifts back to a server it has visited
+	fedB.Export(context.Background())
+	assert.Equal(t, 0, storageA.Len())
+	assert.Equal(t, 1, storageB.Len())
+}
@@ -0,0 +1,156 @@
+package server
+
+import (
+	"fmt"
+	"time"
+	"net/http"
+
+	"github.com/binn/binn"
+)
+
+type ReadyResponse struct {
+	Ready  bool   `json:"ready"`
+	Reason string `json:"reason,omitempty"`
+}
+
+type LoopStatusResponse struct {
+	LastTick *time.Time `json:"last_tick"`
+	CycleSec float64    `json:"cycle_sec"`
+	Waiting  bool       `json:"waiting"`
+	Live     bool       `json:"live"`
+}
+
+type ServerConfigResponse struct {
+	SendEmptySec      int  `json:"send_empty_sec"`
+	Debug             bool `json:"debug"`
+	Auth              bool `json:"auth"`
+	RevealThrowResult bool `json:"reveal_throw_result"`
+}
+
+type QueueStatusResponse struct {
+	InLen         int     `json:"in_len"`
+	InCap         int     `json:"in_cap"`
+	InSaturation  float64 `json:"in_saturation"`
+	OutLen        int     `json:"out_len"`
+	OutCap        int     `json:"out_cap"`
+	Pending       int     `json:"pending"`
+	Enqueued      uint64  `json:"enqueued"`
+	Dropped       uint64  `json:"dropped"`
+	Rejected      uint64  `json:"rejected"`
+	Returned      uint64  `json:"returned"`
+	Subscribers   int64   `json:"subscribers"`
+	SlowConsumers uint64  `json:"slow_consumers"`
+}
+
+type StatusResponse struct {
+	Ready        bool                  `json:"ready"`
+	Reason       string                `json:"reason,omitempty"`
+	Running      bool                  `json:"running"`
+	Draining     bool                  `json:"draining"`
+	GenerateLoop *LoopStatusResponse   `json:"generate_loop"`
+	DeliveryLoop *LoopStatusResponse   `json:"delivery_loop"`
+	Containers   *int                  `json:"containers,omitempty"`
+	Queues       *QueueStatusResponse  `json:"queues"`
+	Engine       *EngineConfigResponse `json:"engine"`
+	Server       *ServerConfigResponse `json:"server"`
+}
+
+func loopToResponse(h binn.LoopHealth) *LoopStatusResponse {
+	res := &LoopStatusResponse{
+		CycleSec: h.Cycle.Seconds(),
+		Waiting:  h.Waiting,
+		Live:     h.Live,
+	}
+	if !h.LastTick.IsZero() {
+		t := h.LastTick
+		res.LastTick = &t
+	}
+	return res
+}
+
+func engineConfigToResponse(ecfg *binn.Config) *EngineConfigResponse {
+	return &EngineConfigResponse{
+		Seed:             ecfg.Seed(),
+		DeliveryCycleSec: ecfg.DeliveryCycle().Seconds(),
+		Validation:       ecfg.Validation(),
+		GenerateCycleSec: ecfg.GenerateCycle().Seconds(),
+		Debug:            ecfg.Debug(),
+	}
+}
+
+func HealthzHandlerFunc() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Write([]byte("ok\n"))
+	}
+}
+
+func ReadyzHandlerFunc(engine *binn.Engine) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ready, reason := engine.Ready()
+		status := http.StatusOK
+		if !ready {
+			status = http.StatusServiceUnavailable
+		}
+		writeJSON(w, r, status, &ReadyResponse{ Ready: ready, Reason: reason })
+	}
+}
+
+func queueToResponse(q binn.QueueStats) *QueueStatusResponse {
+	res := &QueueStatusResponse{
+		InLen:         q.InLen,
+		InCap:         q.InCap,
+		OutLen:        q.OutLen,
+		OutCap:        q.OutCap,
+		Pending:       q.Pending,
+		Enqueued:      q.Enqueued,
+		Dropped:       q.Dropped,
+		Rejected:      q.Rejected,
+		Returned:      q.Returned,
+		Subscribers:   q.Subscribers,
+		SlowConsumers: q.SlowConsumers,
+	}
+	if q.InCap > 0 {
+		res.InSaturation = float64(q.InLen) / float64(q.InCap)
+	}
+	return res
+}
+
+// StatusHandlerFunc exposes the config, so it is authorized like the admin api
+func StatusHandlerFunc(engine *binn.Engine, cfg *Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !authorizeAdmin(cfg, r) {
+			writeError(w, r, http.StatusUnauthorized, fmt.Errorf("status request from %s is unauthorized", r.RemoteAddr))
+			return
+		}
+
+		ready, reason := engine.Ready()
+		h := engine.Health()
+		res := &StatusResponse{
+			Ready:        ready,
+			Reason:       reason,
+			Running:      h.Running,
+			Draining:     h.Draining,
+			GenerateLoop: loopToResponse(h.GenerateLoop),
+			DeliveryLoop: loopToResponse(h.DeliveryLoop),
+			Queues:       queueToResponse(engine.QueueStats()),
+			Engine:       engineConfigToResponse(engine.GetConfig()),
+			Server:       &ServerConfigResponse{
+				SendEmptySec:      cfg.SendEmptySec(),
+				Debug:             cfg.Debug(),
+				Auth:              cfg.Auth() != nil,
+				RevealThrowResult: cfg.RevealThrowResult(),
+			},
+		}
+		if storage, ok := engine.GetStorage().(binn.ContainerAdmin); ok {
+			n := storage.Len()
+			res.Containers = &n
+		}
+
+		status := http.StatusOK
+		if !ready {
+			status = http.StatusServiceUnavailable
+		}
+		writeJSON(w, r, status, res)
+	}
+}
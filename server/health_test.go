@@ -0,0 +1,77 @@
+package server
+
+import (
+	"io"
+	"context"
+	"testing"
+	"encoding/json"
+	"net/http/httptest"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/binn/binn"
+)
+
+func TestHealthz(t *testing.T) {
+	w := httptest.NewRecorder()
+	HealthzHandlerFunc()(w, httptest.NewRequest("GET", "http://example.com/healthz", nil))
+
+	assert.Equal(t, 200, w.Result().StatusCode)
+}
+
+func TestReadyz(t *testing.T) {
+	engine, _, _ := newAdminTestEngine()
+	handler := ReadyzHandlerFunc(engine)
+
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest("GET", "http://example.com/readyz", nil))
+	assert.Equal(t, 503, w.Result().StatusCode)
+
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	engine.Run(ctx)
+	defer cancelFunc()
+
+	w = httptest.NewRecorder()
+	handler(w, httptest.NewRequest("GET", "http://example.com/readyz", nil))
+	assert.Equal(t, 200, w.Result().StatusCode)
+
+	engine.Drain()
+	w = httptest.NewRecorder()
+	handler(w, httptest.NewRequest("GET", "http://example.com/readyz", nil))
+	body, _ := io.ReadAll(w.Result().Body)
+
+	var res ReadyResponse
+	_ = json.Unmarshal(body, &res)
+	assert.Equal(t, 503, w.Result().StatusCode)
+	assert.Equal(t, "engine is draining", res.Reason)
+}
+
+func TestStatus(t *testing.T) {
+	engine, storage, _ := newAdminTestEngine()
+	cfg := NewConfig(10, false)
+	_, _ = storage.Inject(binn.NewBottle("", "Hello", nil))
+
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	engine.Run(ctx)
+	defer cancelFunc()
+
+	w := httptest.NewRecorder()
+	StatusHandlerFunc(engine, cfg)(w, httptest.NewRequest("GET", "http://example.com/status", nil))
+	assert.Equal(t, 401, w.Result().StatusCode)
+
+	cfg.SetAdminToken("secret")
+	req := httptest.NewRequest("GET", "http://example.com/status", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	w = httptest.NewRecorder()
+	StatusHandlerFunc(engine, cfg)(w, req)
+	body, _ := io.ReadAll(w.Result().Body)
+
+	var res StatusResponse
+	_ = json.Unmarshal(body, &res)
+	assert.Equal(t, 200, w.Result().StatusCode)
+	assert.True(t, res.Running)
+	assert.Equal(t, 1, *res.Containers)
+	assert.NotNil(t, res.DeliveryLoop.LastTick)
+	assert.True(t, res.DeliveryLoop.Live)
+	assert.Equal(t, 10, res.Server.SendEmptySec)
+}
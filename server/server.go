@@ -1,44 +1,79 @@
 package server
 
 import (
-	"os"
-	"log"
+	"io"
 	"fmt"
+	"bufio"
+	"reflect"
 	"time"
+	"sync"
+	"context"
 	"strings"
 	"net/http"
 	"io/ioutil"
+	"sync/atomic"
 	"encoding/json"
 
+	"go.opentelemetry.io/otel/propagation"
+
 	"github.com/binn/binn"
 )
 
 
-var Logger = log.New(os.Stderr, "[SERVER] ", log.LstdFlags)
-var Debug = true
 
 type Config struct{
-	sendEmptySec int
-	enableDebug  bool
+	sendEmptySec      int
+	enableDebug       bool
+	revealThrowResult bool
+	subscriberBuffer  int
+	slowConsumer      time.Duration
+	reloadFunc        ReloadFunc
+	adminToken        string
+	localAdmin        bool
+	auth              *Auth
+	cors              *CORS
+	logger            *binn.Logger
+	tracer            *binn.Tracer
+	webhooks          *binn.Webhooks
+	federation        *binn.Federation
+	attachments       *Attachments
+	mux               *sync.RWMutex
 }
 
-type responseMessage struct {
-	Text string `json:"text"`
+type ReloadFunc func() ([]string, error)
+
+// ResponseMessage fields besides Text are omitted when a bottle
+// has none, so older clients see the same json
+type ResponseMessage struct {
+	Text      string            `json:"text"`
+	CreatedAt *time.Time        `json:"created_at,omitempty"`
+	Language  string            `json:"language,omitempty"`
+	Tags      []string          `json:"tags,omitempty"`
+	Signature string            `json:"signature,omitempty"`
+	Hops      int               `json:"hops,omitempty"`
+	Metadata  map[string]string `json:"metadata,omitempty"`
+	Attachments []ResponseAttachment `json:"attachments,omitempty"`
 }
 
-type requestMessage struct {
-	Text string `json:"text"`
+// RequestMessage has no created_at and hops, they are kept by the server,
+// attachments are thrown as parts of a multipart request
+type RequestMessage struct {
+	Text      string            `json:"text"`
+	Language  string            `json:"language,omitempty"`
+	Tags      []string          `json:"tags,omitempty"`
+	Signature string            `json:"signature,omitempty"`
+	Metadata  map[string]string `json:"metadata,omitempty"`
 }
 
-type requestBottle struct {
+type RequestBottle struct {
 	ID        string           `json:"id"`
-	Message   *responseMessage `json:"message"`
+	Message   *RequestMessage  `json:"message"`
 	ExpiredAt *time.Time       `json:"expired_at"`
 }
 
-type responseBottle struct {
+type ResponseBottle struct {
 	ID        string           `json:"id"`
-	Message   *responseMessage `json:"message"`
+	Message   *ResponseMessage `json:"message"`
 	ExpiredAt *time.Time       `json:"expired_at"`
 }
 
@@ -55,63 +90,457 @@ func (s *SSEMessage) String() string {
 }
 
 const EventStreamSeparator = "\n\n"
+const MAX_REQUEST_ID_LENGTH = 128
+const DEFAULT_SUBMIT_TIMEOUT = 10 * time.Second
+const DEFAULT_SUBSCRIBER_BUFFER = 4
+const DEFAULT_SLOW_CONSUMER_TIMEOUT = 30 * time.Second
+const BOTTLE_PATH = "/api/bottle"
+
 func (s *SSEMessage) StringWithSeparator() string {
 	return fmt.Sprintf("%s%s", s.String(), EventStreamSeparator)
 }
 
+// ReadSSEMessage reads the next event from an event stream,
+// it skips the empty lines sent to keep the stream alive
+func ReadSSEMessage(r *bufio.Reader) (*SSEMessage, error) {
+	var sm *SSEMessage
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil && (err != io.EOF || line == "") {
+			if sm != nil && err == io.EOF {
+				return sm, nil
+			}
+			return nil, err
+		}
+		line = strings.TrimRight(line, "\r\n")
+
+		if line == "" {
+			if sm != nil {
+				return sm, nil
+			}
+			continue
+		}
+
+		if sm == nil {
+			sm = &SSEMessage{}
+		}
+		field, value := line, ""
+		if i := strings.Index(line, ":"); i >= 0 {
+			field, value = line[:i], strings.TrimPrefix(line[i+1:], " ")
+		}
+		switch field {
+		case "event":
+			sm.Event = value
+		case "data":
+			if sm.Data != "" {
+				sm.Data += "\n"
+			}
+			sm.Data += value
+		}
+	}
+}
+
 func NewConfig(sendEmptySec int, enableDebug bool) *Config {
 	return &Config{
-		sendEmptySec: sendEmptySec,
-		enableDebug:  enableDebug,
+		sendEmptySec:     sendEmptySec,
+		enableDebug:      enableDebug,
+		subscriberBuffer: DEFAULT_SUBSCRIBER_BUFFER,
+		slowConsumer:     DEFAULT_SLOW_CONSUMER_TIMEOUT,
+		cors:             DefaultCORS(),
+		logger:           binn.DefaultLogger(),
+		mux:              &sync.RWMutex{},
 	}
 }
 
 func (c *Config) SendEmptySec() int {
+	c.mux.RLock()
+	defer c.mux.RUnlock()
 	return c.sendEmptySec
 }
 
+func (c *Config) SetSendEmptySec(sec int) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	c.sendEmptySec = sec
+}
+
 func (c *Config) Debug() bool {
+	c.mux.RLock()
+	defer c.mux.RUnlock()
 	return c.enableDebug
 }
 
+func (c *Config) EnableDebug() {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	c.enableDebug = true
+}
+
+func (c *Config) DisableDebug() {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	c.enableDebug = false
+}
+
+// Logger returns the logger of the server,
+// debug records are enabled while debug is enabled
+func (c *Config) Logger() *binn.Logger {
+	c.mux.RLock()
+	defer c.mux.RUnlock()
+	if c.enableDebug && !c.logger.Enabled(binn.LEVEL_DEBUG) {
+		return c.logger.WithLevel(binn.LEVEL_DEBUG)
+	}
+	return c.logger
+}
+
+func (c *Config) SetLogger(l *binn.Logger) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	c.logger = l
+}
+
+func (c *Config) Tracer() *binn.Tracer {
+	c.mux.RLock()
+	defer c.mux.RUnlock()
+	return c.tracer
+}
+
+func (c *Config) SetTracer(t *binn.Tracer) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	c.tracer = t
+}
+
+func (c *Config) Webhooks() *binn.Webhooks {
+	c.mux.RLock()
+	defer c.mux.RUnlock()
+	return c.webhooks
+}
+
+func (c *Config) SetWebhooks(w *binn.Webhooks) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	c.webhooks = w
+}
+
+func (c *Config) Federation() *binn.Federation {
+	c.mux.RLock()
+	defer c.mux.RUnlock()
+	return c.federation
+}
+
+func (c *Config) SetFederation(f *binn.Federation) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	c.federation = f
+}
+
+// Attachments returns nil unless bottles may carry attachments
+func (c *Config) Attachments() *Attachments {
+	c.mux.RLock()
+	defer c.mux.RUnlock()
+	return c.attachments
+}
+
+func (c *Config) SetAttachments(a *Attachments) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	c.attachments = a
+}
+
+// RevealThrowResult reports whether a thrower is told that the bottle
+// was rejected, by default every throw is answered with 204
+func (c *Config) RevealThrowResult() bool {
+	c.mux.RLock()
+	defer c.mux.RUnlock()
+	return c.revealThrowResult
+}
+
+func (c *Config) SetRevealThrowResult(v bool) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	c.revealThrowResult = v
+}
+
+// SubscriberBuffer is the number of bottles buffered for each stream
+func (c *Config) SubscriberBuffer() int {
+	c.mux.RLock()
+	defer c.mux.RUnlock()
+	return c.subscriberBuffer
+}
+
+// SetSubscriberBuffer rejects n below 1, a stream needs room
+// for the bottle it takes while the writer is busy
+func (c *Config) SetSubscriberBuffer(n int) error {
+	if n < 1 {
+		return fmt.Errorf("this subscriber buffer (%d) is less than 1", n)
+	}
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	c.subscriberBuffer = n
+	return nil
+}
+
+// SlowConsumerTimeout is how long a stream may stall with a full buffer
+func (c *Config) SlowConsumerTimeout() time.Duration {
+	c.mux.RLock()
+	defer c.mux.RUnlock()
+	return c.slowConsumer
+}
+
+func (c *Config) SetSlowConsumerTimeout(d time.Duration) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	c.slowConsumer = d
+}
+
+func (c *Config) ReloadFunc() ReloadFunc {
+	c.mux.RLock()
+	defer c.mux.RUnlock()
+	return c.reloadFunc
+}
+
+func (c *Config) SetReloadFunc(f ReloadFunc) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	c.reloadFunc = f
+}
+
+func (c *Config) AdminToken() string {
+	c.mux.RLock()
+	defer c.mux.RUnlock()
+	return c.adminToken
+}
+
+func (c *Config) SetAdminToken(token string) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	c.adminToken = token
+}
+
+// LocalAdmin reports whether the admin api trusts requests from
+// localhost while neither a admin token nor authentication is set
+func (c *Config) LocalAdmin() bool {
+	c.mux.RLock()
+	defer c.mux.RUnlock()
+	return c.localAdmin
+}
+
+func (c *Config) SetLocalAdmin(v bool) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	c.localAdmin = v
+}
+
+func (c *Config) Auth() *Auth {
+	c.mux.RLock()
+	defer c.mux.RUnlock()
+	return c.auth
+}
+
+func (c *Config) SetAuth(a *Auth) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	c.auth = a
+}
+
+func (c *Config) CORS() *CORS {
+	c.mux.RLock()
+	defer c.mux.RUnlock()
+	return c.cors
+}
+
+func (c *Config) SetCORS(cors *CORS) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	c.cors = cors
+}
+
+// Update copies the reloadable fields of n into c and returns
+// a human readable description of each changed field
+func (c *Config) Update(n *Config) []string {
+	if c == n {
+		return []string{}
+	}
+
+	n.mux.RLock()
+	defer n.mux.RUnlock()
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	changes := []string{}
+	if c.sendEmptySec != n.sendEmptySec {
+		changes = append(changes, fmt.Sprintf("send empty sec: %d -> %d", c.sendEmptySec, n.sendEmptySec))
+		c.sendEmptySec = n.sendEmptySec
+	}
+	if c.enableDebug != n.enableDebug {
+		changes = append(changes, fmt.Sprintf("debug: %t -> %t", c.enableDebug, n.enableDebug))
+		c.enableDebug = n.enableDebug
+	}
+	if c.subscriberBuffer != n.subscriberBuffer {
+		changes = append(changes, fmt.Sprintf("subscriber buffer: %d -> %d", c.subscriberBuffer, n.subscriberBuffer))
+		c.subscriberBuffer = n.subscriberBuffer
+	}
+	if c.slowConsumer != n.slowConsumer {
+		changes = append(changes, fmt.Sprintf("slow consumer timeout: %s -> %s", c.slowConsumer, n.slowConsumer))
+		c.slowConsumer = n.slowConsumer
+	}
+	if c.revealThrowResult != n.revealThrowResult {
+		changes = append(changes, fmt.Sprintf("reveal throw result: %t -> %t", c.revealThrowResult, n.revealThrowResult))
+		c.revealThrowResult = n.revealThrowResult
+	}
+	if c.logger.String() != n.logger.String() {
+		changes = append(changes, fmt.Sprintf("logger: %s -> %s", c.logger, n.logger))
+		c.logger = n.logger
+	}
+	if c.tracer != n.tracer {
+		changes = append(changes, "tracer: changed")
+		c.tracer = n.tracer
+	}
+	if c.webhooks != n.webhooks {
+		changes = append(changes, "webhooks: changed")
+		c.webhooks = n.webhooks
+	}
+	if c.federation != n.federation {
+		changes = append(changes, "federation: changed")
+		c.federation = n.federation
+	}
+	if c.attachments != n.attachments {
+		changes = append(changes, "attachments: changed")
+		c.attachments = n.attachments
+	}
+	if c.adminToken != n.adminToken {
+		changes = append(changes, "admin token: changed")
+		c.adminToken = n.adminToken
+	}
+	if c.localAdmin != n.localAdmin {
+		changes = append(changes, fmt.Sprintf("local admin: %t -> %t", c.localAdmin, n.localAdmin))
+		c.localAdmin = n.localAdmin
+	}
+	if !reflect.DeepEqual(c.auth, n.auth) {
+		changes = append(changes, "auth: changed")
+		c.auth = n.auth
+	}
+	if !reflect.DeepEqual(c.cors, n.cors) {
+		changes = append(changes, "cors: changed")
+		c.cors = n.cors
+	}
+
+	return changes
+}
+
 func NewServer(engine *binn.Engine, addr string, cfg *Config) *http.Server {
 	mux := http.NewServeMux()
-	mux.HandleFunc("/api/bottle", BottleHandlerFunc(engine, cfg))
-	Debug = cfg.Debug()
+	mux.HandleFunc(BOTTLE_PATH, BottleHandlerFunc(engine, cfg))
+	mux.HandleFunc("/admin/", AdminHandlerFunc(engine, cfg))
+	mux.HandleFunc(ATTACHMENT_PATH, AttachmentHandlerFunc(cfg))
+	mux.HandleFunc(binn.FEDERATION_INBOX_PATH, FederationInboxHandlerFunc(cfg))
+	mux.HandleFunc("/healthz", HealthzHandlerFunc())
+	mux.HandleFunc("/readyz", ReadyzHandlerFunc(engine))
+	mux.HandleFunc("/status", StatusHandlerFunc(engine, cfg))
 
 	return &http.Server{
 		Addr: addr,
-		Handler: mux,
+		Handler: RequestMiddleware(cfg, mux),
 	}
 }
 
-func containerToResponse(c binn.Container) *responseBottle {
-	return &responseBottle{
+// validRequestID accepts a request id given by a proxy
+// only if it is short and printable
+func validRequestID(id string) bool {
+	if id == "" || len(id) > MAX_REQUEST_ID_LENGTH {
+		return false
+	}
+	for _, r := range id {
+		if r < '!' || r > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// RequestMiddleware gives every request an id and puts
+// a logger recording the id into the request context
+func RequestMiddleware(cfg *Config, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-ID")
+		if !validRequestID(id) {
+			id = binn.GenerateID()
+		}
+		w.Header().Set("X-Request-ID", id)
+
+		ctx := binn.WithRequestID(r.Context(), id)
+		ctx = propagation.TraceContext{}.Extract(ctx, propagation.HeaderCarrier(r.Header))
+		ctx = binn.WithTracer(ctx, cfg.Tracer())
+		logger := cfg.Logger().WithContext(ctx)
+		ctx = binn.WithLogger(ctx, logger)
+		logger.Debug("request",
+			binn.F("method", r.Method),
+			binn.F("path", r.URL.Path),
+			binn.F("remote_addr", r.RemoteAddr),
+		)
+
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+func containerToResponse(c binn.Container) *ResponseBottle {
+	m := c.Message()
+	var attachments []ResponseAttachment
+	for _, a := range m.Attachments {
+		attachments = append(attachments, ResponseAttachment{ ID: a.ID, ContentType: a.ContentType, Size: a.Size })
+	}
+	return &ResponseBottle{
 		ID:        c.ID(),
-		Message:   &responseMessage{
-			Text: c.Message().Text,
+		Message:   &ResponseMessage{
+			Text:      m.Text,
+			CreatedAt: m.CreatedAt,
+			Language:  m.Language,
+			Tags:      m.Tags,
+			Signature: m.Signature,
+			Hops:      m.Hops,
+			Metadata:  m.Metadata,
+			Attachments: attachments,
 		},
 		ExpiredAt: c.ExpiredAt(),
 	}
 }
 
-func requestToContainer(req *requestBottle) binn.Container {
-	return binn.NewBottle(req.ID, req.Message.Text, req.ExpiredAt)
+func requestToContainer(req *RequestBottle) *binn.Bottle {
+	return binn.NewBottleWithMessage(req.ID, &binn.Message{
+		Text:      req.Message.Text,
+		Language:  req.Message.Language,
+		Tags:      req.Message.Tags,
+		Signature: req.Message.Signature,
+		Metadata:  req.Message.Metadata,
+	}, req.ExpiredAt)
 }
 
-func logf(format string, v ...interface{}) {
-	if Debug {
-		Logger.Printf(format, v...)
-	}
+func loggerFrom(r *http.Request) *binn.Logger {
+	return binn.LoggerFrom(r.Context())
 }
 
 func BottleGetHandlerFunc(engine *binn.Engine, sendEmptySec int) http.HandlerFunc {
+	return BottleStreamHandlerFunc(engine, sendEmptySec, DEFAULT_SUBSCRIBER_BUFFER, DEFAULT_SLOW_CONSUMER_TIMEOUT)
+}
+
+// BottleStreamHandlerFunc streams bottles through a send buffer of its own,
+// a subscriber whose buffer stays full without a write for slowTimeout is
+// disconnected and its buffered bottles go back to the engine
+func BottleStreamHandlerFunc(engine *binn.Engine, sendEmptySec int, bufferSize int, slowTimeout time.Duration) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
+		filter, err := parseFilter(r)
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, err)
+			return
+		}
+		if !filter.Empty() && !engine.CanFilter() {
+			writeError(w, r, http.StatusNotImplemented, binn.ErrFilterUnsupported)
+			return
+		}
 		w.Header().Set("Content-Type", "text/event-stream; charset=utf-8")
 
-		ticker := time.NewTicker(time.Duration(sendEmptySec) * time.Second)
-
-		outCh := engine.GetOutChan()
+		logger := loggerFrom(r)
 
 		flusher, ok := w.(http.Flusher)
 		if !ok {
@@ -119,82 +548,333 @@ func BottleGetHandlerFunc(engine *binn.Engine, sendEmptySec int) http.HandlerFun
 			return
 		}
 
-		var c binn.Container;
+		unsubscribe := engine.Subscribe()
+		buf := make(chan binn.Container, bufferSize)
+		writerDone := make(chan struct{})
+		lastWrite := time.Now().UnixNano()
+
+		// the writer owns w, so the handler waits for it before returning
+		go func() {
+			defer close(writerDone)
+			ticker := time.NewTicker(time.Duration(sendEmptySec) * time.Second)
+			defer ticker.Stop()
+			for {
+				select {
+				case c, ok := <- buf:
+					if !ok {
+						return
+					}
+					if err := writeBottle(w, r, c); err != nil {
+						engine.Return(c)
+						return
+					}
+					flusher.Flush()
+					atomic.StoreInt64(&lastWrite, time.Now().UnixNano())
+				case <- ticker.C:
+					if _, err := w.Write([]byte(EventStreamSeparator)); err != nil {
+						logger.Warn("failed to write empty lines", binn.F("error", err))
+						return
+					}
+					flusher.Flush()
+					atomic.StoreInt64(&lastWrite, time.Now().UnixNano())
+				}
+			}
+		}()
+
+		if slowTimeout <= 0 {
+			slowTimeout = DEFAULT_SLOW_CONSUMER_TIMEOUT
+		}
+		check := time.NewTicker(slowTimeout / 2)
+		defer check.Stop()
+		// a filtered subscriber is served by the engine on its own
+		ctx, cancel := context.WithCancel(r.Context())
+		defer cancel()
+		var outCh <-chan binn.Container = engine.GetOutChan()
+		if !filter.Empty() {
+			outCh = engine.Matching(ctx, filter)
+		}
+		slow := false
 	Loop:
 		for {
+			// stop taking bottles while the buffer is full so they go to other subscribers
+			in := outCh
+			if len(buf) == cap(buf) {
+				in = nil
+			}
 			select {
 			case <- r.Context().Done():
 				break Loop
-			case c = <-outCh:
-				res := containerToResponse(c)
-				if bytes, err := json.Marshal(res); err == nil {
-					sm := SSEMessage{ Event: "bottle", Data: string(bytes) }
-					bytes = []byte(sm.StringWithSeparator())
-					if _, err := w.Write(bytes); err != nil {
-						w.WriteHeader(http.StatusInternalServerError)
-						logf("%d %s", http.StatusInternalServerError, "failed to write response")
-						return
-					}
-					logf("send a container(id=%#v message=%#v)", c.ID(), c.Message().Text)
-					flusher.Flush()
-				} else {
-					w.WriteHeader(http.StatusInternalServerError)
-					logf("%d %s", http.StatusInternalServerError, "failed to decode response")
-					return
+			case <- writerDone:
+				break Loop
+			case c, ok := <- in:
+				if !ok {
+					break Loop
 				}
-			case _ = <-ticker.C:
-				if _, err := w.Write([]byte(EventStreamSeparator)); err != nil {
-					w.WriteHeader(http.StatusInternalServerError)
-					logf("%d %s", http.StatusInternalServerError, "failed to write empty lines")
-					return
+				buf <- c
+			case <- check.C:
+				stalled := time.Since(time.Unix(0, atomic.LoadInt64(&lastWrite)))
+				if len(buf) == cap(buf) && stalled > slowTimeout {
+					slow = true
+					logger.Info("disconnect a slow consumer",
+						binn.F("buffered", len(buf)),
+						binn.F("stalled", stalled),
+					)
+					break Loop
 				}
-				flusher.Flush()
+			}
+		}
+
+	Drain:
+		for {
+			select {
+			case c := <- buf:
+				engine.Return(c)
 			default:
-				break
+				break Drain
 			}
 		}
-		return
+		close(buf)
+		if slow {
+			// a write stuck on a client which stopped reading only fails when
+			// the stream is aborted, the server closes a http/1 connection or
+			// resets only this http/2 stream and the writer returns its bottle
+			select {
+			case <- writerDone:
+			case <- time.After(slowTimeout):
+				unsubscribe(slow)
+				panic(http.ErrAbortHandler)
+			}
+		} else {
+			<- writerDone
+		}
+		unsubscribe(slow)
+	}
+}
+
+// queryValues reads a parameter given several times or separated by commas
+func queryValues(r *http.Request, key string) []string {
+	values := []string{}
+	for _, v := range r.URL.Query()[key] {
+		for _, s := range strings.Split(v, ",") {
+			if s = strings.TrimSpace(s); s != "" {
+				values = append(values, s)
+			}
+		}
+	}
+	return values
+}
+
+// parseFilter reads the filter of a stream from the lang, tag and
+// exclude_tag parameters
+func parseFilter(r *http.Request) (*binn.Filter, error) {
+	return binn.NewFilter(queryValues(r, "lang"), queryValues(r, "tag"), queryValues(r, "exclude_tag"))
+}
+
+func writeBottle(w http.ResponseWriter, r *http.Request, c binn.Container) error {
+	logger := loggerFrom(r)
+	_, span := binn.StartSpan(binn.WithTracer(binn.ContextOf(c), binn.TracerFrom(r.Context())), "sse.send", binn.SPAN_KIND_PRODUCER)
+	defer span.End()
+	span.SetMessage(c, "")
+	span.SetAttributes(binn.F("binn.request_id", binn.RequestIDFrom(r.Context())))
+
+	rb := containerToResponse(c)
+	signAttachments(r, rb, c.ExpiredAt())
+	bytes, err := json.Marshal(rb)
+	if err != nil {
+		span.SetError(err)
+		logger.Error("failed to encode response", binn.F("error", err))
+		return err
+	}
+	sm := SSEMessage{ Event: "bottle", Data: string(bytes) }
+	if _, err := w.Write([]byte(sm.StringWithSeparator())); err != nil {
+		span.SetError(err)
+		logger.Warn("failed to write response", binn.F("error", err))
+		return err
+	}
+	logger.Debug("send a container", binn.F("id", c.ID()), binn.F("message", logger.Redact(c.Message().Text)))
+	return nil
+}
+
+// readBottle decodes the thrown bottle of r and writes 400 when it is invalid
+func readBottle(w http.ResponseWriter, r *http.Request) (*binn.Bottle, bool) {
+	if isMultipart(r) {
+		return readMultipartBottle(w, r)
+	}
+	body, _ := ioutil.ReadAll(r.Body)
+
+	var req RequestBottle
+	if err := json.Unmarshal(body, &req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		loggerFrom(r).Debug("payload is invalid format",
+			binn.F("status", http.StatusBadRequest),
+			binn.F("payload", loggerFrom(r).Redact(string(body))),
+		)
+		binn.SpanFrom(r.Context()).SetError(err)
+		return nil, false
+	}
+	if req.Message == nil {
+		err := fmt.Errorf("a message is required")
+		binn.SpanFrom(r.Context()).SetError(err)
+		writeError(w, r, http.StatusBadRequest, err)
+		return nil, false
+	}
+
+	c := requestToContainer(&req)
+	c.SetIdentity(IdentityFromContext(r.Context()))
+	binn.SpanFrom(r.Context()).SetMessage(c, "")
+	return c, true
+}
+
+// statusWriter keeps the status written to a response for its span
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// startServerSpan starts the span of a request following the http semantic
+// conventions, end records the status written to the returned writer
+func startServerSpan(w http.ResponseWriter, r *http.Request, route string) (http.ResponseWriter, *http.Request, func()) {
+	ctx, span := binn.StartSpan(r.Context(), route, binn.SPAN_KIND_SERVER)
+	span.SetHTTPRequest(r, route)
+	sw := &statusWriter{ ResponseWriter: w, status: http.StatusOK }
+	return sw, r.WithContext(ctx), func() {
+		span.SetHTTPStatus(sw.status)
+		span.End()
 	}
 }
 
 func BottlePostHandlerFunc(engine *binn.Engine) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		body, _ := ioutil.ReadAll(r.Body)
+		w, r, end := startServerSpan(w, r, BOTTLE_PATH)
+		defer end()
+		span := binn.SpanFrom(r.Context())
 
-		var req requestBottle
-		if err := json.Unmarshal(body, &req); err != nil {
-			w.WriteHeader(http.StatusBadRequest)
-			logf("%d %s", http.StatusBadRequest, fmt.Sprintf("payload is invalid format, %s", string(body)))
+		c, ok := readBottle(w, r)
+		if !ok {
 			return
 		}
 
-		c := requestToContainer(&req)
+		// the hop through inCh is a span of its own so a bottle
+		// that never reaches the engine is visible in the trace
+		qctx, qspan := binn.StartSpan(r.Context(), "engine.enqueue", binn.SPAN_KIND_PRODUCER)
+		qspan.SetMessage(c, "")
+		c.SetContext(binn.Detach(qctx))
 
-		inCh := engine.GetInChan()
-		inCh <- c
+		err := engine.Enqueue(c)
+		qspan.SetError(err)
+		qspan.End()
 
+		logger := loggerFrom(r)
+		if err != nil {
+			span.SetError(err)
+			writeError(w, r, http.StatusServiceUnavailable, err)
+			return
+		}
 		w.WriteHeader(http.StatusNoContent)
 
-		logf(
-			"%d %s", http.StatusNoContent,
-			fmt.Sprintf("id: %#v message: %#v", c.ID(), c.Message().Text),
+		logger.Debug("receive a container",
+			binn.F("status", http.StatusNoContent),
+			binn.F("id", c.ID()),
+			binn.F("message", logger.Redact(c.Message().Text)),
 		)
 	}
 }
 
+// BottleSubmitHandlerFunc waits for the engine and tells the thrower
+// whether the bottle was accepted instead of always answering 204
+func BottleSubmitHandlerFunc(engine *binn.Engine, timeout time.Duration) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w, r, end := startServerSpan(w, r, BOTTLE_PATH)
+		defer end()
+		span := binn.SpanFrom(r.Context())
+
+		c, ok := readBottle(w, r)
+		if !ok {
+			return
+		}
+
+		qctx, qspan := binn.StartSpan(r.Context(), "engine.enqueue", binn.SPAN_KIND_PRODUCER)
+		qspan.SetMessage(c, "")
+		c.SetContext(binn.Detach(qctx))
+
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+		err := engine.Submit(ctx, c)
+		// a pending container was enqueued
+		if err != binn.ErrPending {
+			qspan.SetError(err)
+		}
+		qspan.End()
+
+		logger := loggerFrom(r)
+		switch {
+		case err == nil:
+			w.WriteHeader(http.StatusNoContent)
+			logger.Debug("receive a container",
+				binn.F("status", http.StatusNoContent),
+				binn.F("id", c.ID()),
+				binn.F("message", logger.Redact(c.Message().Text)),
+			)
+		case err == binn.ErrPending:
+			// c is queued already, answering 503 would make clients throw it twice
+			w.WriteHeader(http.StatusAccepted)
+			logger.Debug("a container is pending", binn.F("status", http.StatusAccepted), binn.F("id", c.ID()))
+		case err == binn.ErrNotRunning || err == binn.ErrQueueFull || err == context.DeadlineExceeded || err == context.Canceled:
+			span.SetError(err)
+			writeError(w, r, http.StatusServiceUnavailable, err)
+		default:
+			span.SetError(err)
+			writeError(w, r, http.StatusUnprocessableEntity, err)
+		}
+	}
+}
+
+const BottleAllowedMethods = "GET, POST, OPTIONS"
+
 func BottleHandlerFunc(engine *binn.Engine, cfg *Config) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Access-Control-Allow-Headers", "*")
-		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.Header().Set("Access-Control-Allow-Method", "GET, POST")
+		if cfg.CORS().Handle(w, r) {
+			return
+		}
 
 		var handler http.HandlerFunc
-		if (r.Method == http.MethodGet) {
-			handler = BottleGetHandlerFunc(engine, cfg.sendEmptySec)
-		} else if (r.Method == http.MethodPost) {
+		var scope string
+		switch r.Method {
+		case http.MethodGet:
+			handler = BottleStreamHandlerFunc(engine, cfg.SendEmptySec(), cfg.SubscriberBuffer(), cfg.SlowConsumerTimeout())
+			scope = binn.SCOPE_READ
+		case http.MethodPost:
 			handler = BottlePostHandlerFunc(engine)
+			if cfg.RevealThrowResult() {
+				handler = BottleSubmitHandlerFunc(engine, DEFAULT_SUBMIT_TIMEOUT)
+			}
+			scope = binn.SCOPE_THROW
+		case http.MethodOptions:
+			w.Header().Set("Allow", BottleAllowedMethods)
+			w.WriteHeader(http.StatusNoContent)
+			return
+		default:
+			w.Header().Set("Allow", BottleAllowedMethods)
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			loggerFrom(r).Debug("method is not allowed", binn.F("status", http.StatusMethodNotAllowed), binn.F("method", r.Method))
+			return
 		}
 
+		r, status, err := authenticate(cfg, r, scope)
+		if err != nil {
+			w.WriteHeader(status)
+			loggerFrom(r).Debug("request is not authorized", binn.F("status", status), binn.F("error", err))
+			return
+		}
+
+		if a := cfg.Attachments(); a != nil {
+			r = r.WithContext(withAttachments(r.Context(), a))
+		}
 		handler(w, r)
 	}
 }
@@ -3,13 +3,21 @@ package server
 import (
 	"io"
 	"time"
+	"bufio"
+	"strings"
 	"bytes"
 	"context"
 	"testing"
+	"net/http"
+	"sync/atomic"
 	"encoding/json"
 	"net/http/httptest"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
 
 	"github.com/binn/binn"
 )
@@ -18,7 +26,6 @@ func TestHandleGetBottle (t *testing.T) {
 	cfg := binn.DefaultConfig()
 	cfg.SetDeliveryCycle(time.Duration(10) * time.Millisecond)
 	cfg.DisableDebug()
-	Debug = false
 
 	idStorage := binn.DefaultIDStorage()
 	storage := binn.NewContainerStorage(true, time.Duration(10)*time.Minute, idStorage)
@@ -48,9 +55,10 @@ func TestHandleGetBottle (t *testing.T) {
 
 	time.Sleep(time.Duration(200) * time.Millisecond)
 	req := httptest.NewRequest("GET", "http://example.com/api/bottle", nil)
-	reqCtx, _ := context.WithTimeout(
+	reqCtx, reqCancelFunc := context.WithTimeout(
 		context.Background(),
 		time.Duration(10 * time.Millisecond))
+	defer reqCancelFunc()
 	req = req.WithContext(reqCtx)
 	w := httptest.NewRecorder()
 	handler(w, req)
@@ -58,7 +66,7 @@ func TestHandleGetBottle (t *testing.T) {
 	resp := w.Result()
 	body, _ := io.ReadAll(resp.Body)
 
-	var rb responseBottle
+	var rb ResponseBottle
 	if err := json.Unmarshal(body[20:], &rb); err != nil {
 		assert.Failf(t, "failed", "%w", err)
 		return
@@ -73,7 +81,6 @@ func TestHandleGetBottle (t *testing.T) {
 func TestHandlePostBottle (t *testing.T) {
 	cfg := binn.DefaultConfig()
 	cfg.DisableDebug()
-	Debug = false
 
 	idStorage := binn.DefaultIDStorage()
 	storage := binn.NewContainerStorage(true, time.Duration(10)*time.Minute, idStorage)
@@ -109,3 +116,434 @@ func TestHandlePostBottle (t *testing.T) {
 	assert.Equal(t, 204, resp.StatusCode)
 	assert.Equal(t, "Post a Bottle", gottenBottle.Message().Text)
 }
+
+func TestReadSSEMessage(t *testing.T) {
+	sm1 := SSEMessage{ Event: "bottle", Data: "{\"id\":\"1\"}" }
+	sm2 := SSEMessage{ Event: "bottle", Data: "{\"id\":\"2\"}" }
+	stream := EventStreamSeparator + sm1.StringWithSeparator() + EventStreamSeparator + sm2.String()
+	r := bufio.NewReader(strings.NewReader(stream))
+
+	got, err := ReadSSEMessage(r)
+	assert.Nil(t, err)
+	assert.Equal(t, sm1, *got)
+
+	got, err = ReadSSEMessage(r)
+	assert.Nil(t, err)
+	assert.Equal(t, sm2, *got)
+
+	_, err = ReadSSEMessage(r)
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestRequestIDIsPropagatedToStorage(t *testing.T) {
+	var buf bytes.Buffer
+	logger := binn.NewLogger(&buf, binn.LEVEL_DEBUG, binn.LOG_FORMAT_LOGFMT, false)
+
+	cfg := binn.DefaultConfig()
+	storage := binn.NewContainerStorage(false, 0, nil)
+	storage.SetLogger(logger)
+	engine := binn.NewEngine(cfg, storage)
+
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	engine.Run(ctx)
+	defer cancelFunc()
+
+	scfg := NewConfig(10, false)
+	handler := NewServer(engine, "", scfg).Handler
+
+	req := httptest.NewRequest("POST", "http://example.com/api/bottle",
+		bytes.NewBufferString("{\"id\":\"1\",\"message\":{\"text\":\"Hello\"}}"))
+	req.Header.Set("X-Request-ID", "req-1")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+
+	// wait for adding a bottle to storage, the storage lock orders the log write
+	for i := 0; i < 100 && storage.Len() == 0; i++ {
+		time.Sleep(time.Duration(1) * time.Millisecond)
+	}
+
+	assert.Equal(t, "req-1", w.Result().Header.Get("X-Request-ID"))
+	assert.Contains(t, buf.String(), "request_id=req-1")
+}
+
+func TestRequestIDIsGenerated(t *testing.T) {
+	cfg := NewConfig(10, false)
+	handler := RequestMiddleware(cfg, HealthzHandlerFunc())
+
+	req := httptest.NewRequest("GET", "http://example.com/healthz", nil)
+	req.Header.Set("X-Request-ID", "bad id\n")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+
+	id := w.Result().Header.Get("X-Request-ID")
+	assert.NotEqual(t, "", id)
+	assert.NotEqual(t, "bad id\n", id)
+}
+
+func TestTraceFollowsBottleFromThrowToDelivery(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	tracer := binn.NewTracer(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+
+	cfg := binn.DefaultConfig()
+	cfg.SetDeliveryCycle(time.Duration(10) * time.Millisecond)
+	cfg.SetTracer(tracer)
+	storage := binn.NewContainerStorage(false, 0, nil)
+	engine := binn.NewEngine(cfg, storage)
+
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	engine.Run(ctx)
+	defer cancelFunc()
+
+	scfg := NewConfig(10, false)
+	scfg.SetTracer(tracer)
+	handler := NewServer(engine, "", scfg).Handler
+
+	req := httptest.NewRequest("POST", "http://example.com/api/bottle",
+		bytes.NewBufferString("{\"id\":\"1\",\"message\":{\"text\":\"Hello\"}}"))
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	for i := 0; i < 100 && storage.Len() == 0; i++ {
+		time.Sleep(time.Duration(1) * time.Millisecond)
+	}
+
+	req = httptest.NewRequest("GET", "http://example.com/api/bottle", nil)
+	reqCtx, reqCancelFunc := context.WithTimeout(
+		context.Background(),
+		time.Duration(200 * time.Millisecond))
+	defer reqCancelFunc()
+	handler.ServeHTTP(httptest.NewRecorder(), req.WithContext(reqCtx))
+
+	names := map[string]sdktrace.ReadOnlySpan{}
+	for i := 0; i < 100 && len(names) < 6; i++ {
+		for _, s := range recorder.Ended() {
+			names[s.Name()] = s
+		}
+		time.Sleep(time.Duration(1) * time.Millisecond)
+	}
+
+	for _, name := range []string{BOTTLE_PATH, "engine.enqueue", "engine.receive", "storage.add", "engine.deliver", "sse.send"} {
+		if assert.Contains(t, names, name) {
+			assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", names[name].SpanContext().TraceID().String(), name)
+		}
+	}
+	if len(names) == 6 {
+		assert.Equal(t, "00f067aa0ba902b7", names[BOTTLE_PATH].Parent().SpanID().String())
+		assert.Equal(t, names[BOTTLE_PATH].SpanContext().SpanID(), names["engine.enqueue"].Parent().SpanID())
+		assert.Equal(t, names["engine.enqueue"].SpanContext().SpanID(), names["engine.receive"].Parent().SpanID())
+		assert.Equal(t, names["engine.receive"].SpanContext().SpanID(), names["storage.add"].Parent().SpanID())
+		assert.Equal(t, names["storage.add"].SpanContext().SpanID(), names["engine.deliver"].Parent().SpanID())
+		assert.Equal(t, names["engine.deliver"].SpanContext().SpanID(), names["sse.send"].Parent().SpanID())
+
+		attributes := map[string]interface{}{}
+		for _, kv := range names[BOTTLE_PATH].Attributes() {
+			attributes[string(kv.Key)] = kv.Value.AsInterface()
+		}
+		assert.Equal(t, "POST", attributes["http.method"])
+		assert.Equal(t, BOTTLE_PATH, attributes["http.route"])
+		assert.Equal(t, int64(http.StatusNoContent), attributes["http.status_code"])
+	}
+}
+
+func TestRevealThrowResult(t *testing.T) {
+	idStorage := binn.DefaultIDStorage()
+	storage := binn.NewContainerStorage(true, time.Duration(10)*time.Minute, idStorage)
+	engine := binn.NewEngine(binn.DefaultConfig(), storage)
+
+	scfg := NewConfig(10, false)
+	scfg.SetRevealThrowResult(true)
+	handler := NewServer(engine, "", scfg).Handler
+
+	throw := func() *http.Response {
+		req := httptest.NewRequest("POST", "http://example.com/api/bottle",
+			bytes.NewBufferString("{\"id\":\"1\",\"message\":{\"text\":\"Hello\"}}"))
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w.Result()
+	}
+
+	assert.Equal(t, 503, throw().StatusCode)
+
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	engine.Run(ctx)
+	defer cancelFunc()
+
+	idStorage.Add("1", time.Now().Add(time.Minute))
+	assert.Equal(t, 204, throw().StatusCode)
+	resp := throw()
+	body, _ := io.ReadAll(resp.Body)
+	assert.Equal(t, 422, resp.StatusCode)
+	assert.Contains(t, string(body), "is invalid")
+}
+
+func TestSubmitRecordsErrorOnEnqueueSpan(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	tracer := binn.NewTracer(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	engine := binn.NewEngine(binn.DefaultConfig(), binn.NewContainerStorage(true, 0, binn.DefaultIDStorage()))
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	engine.Run(ctx)
+	defer cancelFunc()
+
+	req := httptest.NewRequest("POST", "http://example.com/api/bottle",
+		bytes.NewBufferString("{\"id\":\"unknown\",\"message\":{\"text\":\"Hello\"}}"))
+	w := httptest.NewRecorder()
+	BottleSubmitHandlerFunc(engine, time.Second)(w, req.WithContext(binn.WithTracer(req.Context(), tracer)))
+	assert.Equal(t, http.StatusUnprocessableEntity, w.Code)
+
+	for _, s := range recorder.Ended() {
+		if s.Name() == "engine.enqueue" {
+			assert.Equal(t, codes.Error, s.Status().Code)
+			return
+		}
+	}
+	t.Fatal("no enqueue span was ended")
+}
+
+func TestSubmitAcceptsPendingBottle(t *testing.T) {
+	engine := binn.NewEngine(binn.DefaultConfig(), binn.NewContainerStorage(false, 0, nil))
+	release := make(chan struct{})
+	defer close(release)
+	engine.GetHooks().OnSync(binn.EVENT_RECEIVED, func(ctx context.Context, c binn.Container) (binn.Container, error) {
+		<- release
+		return c, nil
+	})
+
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	engine.Run(ctx)
+	defer cancelFunc()
+
+	req := httptest.NewRequest("POST", "http://example.com/api/bottle",
+		bytes.NewBufferString("{\"message\":{\"text\":\"Hello\"}}"))
+	w := httptest.NewRecorder()
+	BottleSubmitHandlerFunc(engine, time.Duration(10) * time.Millisecond)(w, req)
+	assert.Equal(t, http.StatusAccepted, w.Code)
+}
+
+func TestSubmitAnswersQueueFull(t *testing.T) {
+	cfg := binn.DefaultConfig()
+	cfg.SetInQueueSize(1)
+	cfg.SetOverflow(binn.OVERFLOW_REJECT)
+	engine := binn.NewEngine(cfg, binn.NewContainerStorage(false, 0, nil))
+	held := make(chan struct{}, 2)
+	engine.GetHooks().OnSync(binn.EVENT_RECEIVED, func(ctx context.Context, c binn.Container) (binn.Container, error) {
+		held <- struct{}{}
+		<- ctx.Done()
+		return nil, nil
+	})
+
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	engine.Run(ctx)
+	defer cancelFunc()
+
+	go engine.Submit(context.Background(), binn.NewBottle("", "held", nil))
+	<- held
+	engine.GetInChan() <- binn.NewBottle("", "queued", nil)
+
+	req := httptest.NewRequest("POST", "http://example.com/api/bottle",
+		bytes.NewBufferString("{\"message\":{\"text\":\"Hello\"}}"))
+	w := httptest.NewRecorder()
+	BottleSubmitHandlerFunc(engine, time.Second)(w, req)
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Equal(t, uint64(1), engine.QueueStats().Rejected)
+}
+
+// blockingWriter is a stream client which stops reading after the first write
+type blockingWriter struct {
+	header  http.Header
+	writes  int32
+	release chan struct{}
+	err     error
+}
+
+func (w *blockingWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *blockingWriter) Write(b []byte) (int, error) {
+	if atomic.AddInt32(&w.writes, 1) > 1 {
+		<- w.release
+		return 0, w.err
+	}
+	return len(b), nil
+}
+
+func (w *blockingWriter) WriteHeader(status int) {}
+
+func (w *blockingWriter) Flush() {}
+
+func TestSlowConsumerIsDisconnected(t *testing.T) {
+	cfg := binn.DefaultConfig()
+	cfg.SetDeliveryCycle(time.Duration(1) * time.Millisecond)
+	storage := binn.NewContainerStorage(false, 0, nil)
+	for i := 0; i < 10; i++ {
+		storage.Add(binn.NewBottle("", "Hello", nil))
+	}
+	engine := binn.NewEngine(cfg, storage)
+
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	engine.Run(ctx)
+	defer cancelFunc()
+
+	w := &blockingWriter{ header: http.Header{}, release: make(chan struct{}) }
+	handler := BottleStreamHandlerFunc(engine, 10, 2, time.Duration(20) * time.Millisecond)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		serveStream(handler, w, httptest.NewRequest("GET", "http://example.com/api/bottle", nil))
+	}()
+
+	for i := 0; i < 200 && engine.QueueStats().Returned == 0; i++ {
+		time.Sleep(time.Duration(1) * time.Millisecond)
+	}
+	close(w.release)
+	<- done
+
+	stats := engine.QueueStats()
+	assert.Equal(t, uint64(1), stats.SlowConsumers)
+	assert.Equal(t, int64(0), stats.Subscribers)
+	assert.Equal(t, uint64(2), stats.Returned)
+}
+
+func TestSubscriberBufferMustHoldABottle(t *testing.T) {
+	cfg := NewConfig(10, false)
+	assert.NotNil(t, cfg.SetSubscriberBuffer(0))
+	assert.NotNil(t, cfg.SetSubscriberBuffer(-1))
+	assert.Equal(t, DEFAULT_SUBSCRIBER_BUFFER, cfg.SubscriberBuffer())
+	assert.Nil(t, cfg.SetSubscriberBuffer(1))
+	assert.Equal(t, 1, cfg.SubscriberBuffer())
+}
+
+// serveStream recovers a aborted handler like a http.Server
+func serveStream(h http.HandlerFunc, w http.ResponseWriter, r *http.Request) {
+	defer func() {
+		if err := recover(); err != nil && err != http.ErrAbortHandler {
+			panic(err)
+		}
+	}()
+	h(w, r)
+}
+
+func TestSlowConsumerWriteIsUnblocked(t *testing.T) {
+	cfg := binn.DefaultConfig()
+	cfg.SetDeliveryCycle(time.Duration(1) * time.Millisecond)
+	storage := binn.NewContainerStorage(false, 0, nil)
+	for i := 0; i < 10; i++ {
+		storage.Add(binn.NewBottle("", "Hello", nil))
+	}
+	engine := binn.NewEngine(cfg, storage)
+
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	engine.Run(ctx)
+	defer cancelFunc()
+
+	w := &blockingWriter{ header: http.Header{}, release: make(chan struct{}), err: io.ErrClosedPipe }
+	req := httptest.NewRequest("GET", "http://example.com/api/bottle", nil)
+	assert.PanicsWithValue(t, http.ErrAbortHandler, func() {
+		BottleStreamHandlerFunc(engine, 10, 2, time.Duration(20) * time.Millisecond)(w, req)
+	})
+	stats := engine.QueueStats()
+	assert.Equal(t, uint64(1), stats.SlowConsumers)
+	assert.Equal(t, int64(0), stats.Subscribers)
+
+	// the server closes the connection of the aborted stream which fails the stuck write
+	close(w.release)
+	assert.Eventually(t, func() bool {
+		// the buffered bottles and the one stuck in the write
+		return engine.QueueStats().Returned == 3
+	}, time.Second, time.Duration(1) * time.Millisecond)
+}
+
+func TestBottleJSONIsBackwardCompatible(t *testing.T) {
+	var req RequestBottle
+	require.Nil(t, json.Unmarshal([]byte(`{"id":"1","message":{"text":"hello"},"expired_at":null}`), &req))
+	c := requestToContainer(&req)
+	assert.Equal(t, "hello", c.Message().Text)
+	assert.Nil(t, c.Message().Tags)
+
+	body, err := json.Marshal(containerToResponse(c))
+	require.Nil(t, err)
+	assert.JSONEq(t, `{"id":"1","message":{"text":"hello"},"expired_at":null}`, string(body))
+}
+
+func TestBottleJSONCarriesMessage(t *testing.T) {
+	var req RequestBottle
+	require.Nil(t, json.Unmarshal([]byte(`{"id":"1","message":{
+		"text":"hello","language":"en","tags":["calm"],"signature":"sailor",
+		"metadata":{"k":"v"},"hops":5,"created_at":"2000-01-01T00:00:00Z"
+	}}`), &req))
+	m := requestToContainer(&req).Message()
+	// hops and created_at are kept by the server
+	assert.Equal(t, 0, m.Hops)
+	assert.Nil(t, m.CreatedAt)
+
+	createdAt := time.Date(2022, 5, 29, 22, 24, 0, 0, time.UTC)
+	m.CreatedAt = &createdAt
+	m.Hops = 1
+	body, err := json.Marshal(containerToResponse(binn.NewBottleWithMessage("2", m, nil)))
+	require.Nil(t, err)
+	assert.JSONEq(t, `{"id":"2","message":{
+		"text":"hello","language":"en","tags":["calm"],"signature":"sailor",
+		"metadata":{"k":"v"},"hops":1,"created_at":"2022-05-29T22:24:00Z"
+	},"expired_at":null}`, string(body))
+}
+
+func TestThrowWithoutMessageIsBadRequest(t *testing.T) {
+	engine := binn.NewEngine(binn.DefaultConfig(), binn.NewContainerStorage(false, 0, nil))
+	for _, body := range []string{ `{"id":"1"}`, `{"id":"1","message":null}`, `null` } {
+		w := httptest.NewRecorder()
+		BottlePostHandlerFunc(engine)(w, httptest.NewRequest("POST", "http://example.com/api/bottle", bytes.NewBufferString(body)))
+		assert.Equal(t, http.StatusBadRequest, w.Code, body)
+
+		w = httptest.NewRecorder()
+		BottleSubmitHandlerFunc(engine, time.Second)(w, httptest.NewRequest("POST", "http://example.com/api/bottle", bytes.NewBufferString(body)))
+		assert.Equal(t, http.StatusBadRequest, w.Code, body)
+	}
+}
+
+func TestFilteredStreamReceivesMatchingBottles(t *testing.T) {
+	cfg := binn.DefaultConfig()
+	cfg.SetDeliveryCycle(time.Duration(1) * time.Millisecond)
+	storage := binn.NewContainerStorage(false, 0, nil)
+	storage.Add(binn.NewBottleWithMessage("", &binn.Message{ Text: "english", Language: "en" }, nil))
+	storage.Add(binn.NewBottleWithMessage("", &binn.Message{ Text: "stormy", Language: "ja", Tags: []string{ "storm" } }, nil))
+	storage.Add(binn.NewBottleWithMessage("", &binn.Message{ Text: "calm", Language: "ja-JP", Tags: []string{ "calm" } }, nil))
+	// the engine does not run so the delivery loop does not pick up bottles
+	engine := binn.NewEngine(cfg, storage)
+
+	req := httptest.NewRequest("GET", "http://example.com/api/bottle?lang=ja,ko&exclude_tag=storm", nil)
+	reqCtx, reqCancelFunc := context.WithTimeout(context.Background(), time.Duration(50) * time.Millisecond)
+	defer reqCancelFunc()
+	w := httptest.NewRecorder()
+	BottleStreamHandlerFunc(engine, 10, 2, time.Second)(w, req.WithContext(reqCtx))
+
+	r := bufio.NewReader(w.Result().Body)
+	sm, err := ReadSSEMessage(r)
+	require.Nil(t, err)
+	var rb ResponseBottle
+	require.Nil(t, json.Unmarshal([]byte(sm.Data), &rb))
+	assert.Equal(t, "calm", rb.Message.Text)
+	_, err = ReadSSEMessage(r)
+	assert.Equal(t, io.EOF, err)
+	assert.Equal(t, 2, storage.Len())
+}
+
+// unsupportedStorage is a storage which can not pick out bottles by a filter
+type unsupportedStorage struct {
+	binn.ContainerKeeper
+}
+
+func TestFilteredStreamNeedsSelector(t *testing.T) {
+	engine := binn.NewEngine(binn.DefaultConfig(), unsupportedStorage{ binn.NewContainerStorage(false, 0, nil) })
+	req := httptest.NewRequest("GET", "http://example.com/api/bottle?lang=ja", nil)
+	w := httptest.NewRecorder()
+	BottleStreamHandlerFunc(engine, 10, 2, time.Second)(w, req)
+	assert.Equal(t, http.StatusNotImplemented, w.Result().StatusCode)
+}
+
+func TestFilteredStreamRejectsTooManyValues(t *testing.T) {
+	engine := binn.NewEngine(binn.DefaultConfig(), binn.NewContainerStorage(false, 0, nil))
+	req := httptest.NewRequest("GET", "http://example.com/api/bottle?tag=a,b,c,d,e,f,g,h,i", nil)
+	w := httptest.NewRecorder()
+	BottleStreamHandlerFunc(engine, 10, 2, time.Second)(w, req)
+	assert.Equal(t, http.StatusBadRequest, w.Result().StatusCode)
+}
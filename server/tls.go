@@ -0,0 +1,201 @@
+package server
+
+import (
+	"os"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+	"context"
+	"net/http"
+	"crypto/tls"
+
+	"github.com/binn/binn"
+)
+
+const (
+	TLS_CIPHER_POLICY_DEFAULT = "default"
+	TLS_CIPHER_POLICY_INTERMEDIATE = "intermediate"
+	TLS_CIPHER_POLICY_MODERN = "modern"
+)
+
+// intermediateCipherSuites are the TLS 1.2 suites with forward secrecy,
+// TLS 1.3 suites are not configurable and always enabled
+var intermediateCipherSuites = []uint16{
+	tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305,
+	tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305,
+}
+
+type TLSConfig struct {
+	certFile     string
+	keyFile      string
+	minVersion   uint16
+	cipherPolicy string
+}
+
+type CertReloader struct {
+	certFile string
+	keyFile  string
+	cert     *tls.Certificate
+	modTime  time.Time
+	logger   *binn.Logger
+	mux      *sync.RWMutex
+}
+
+func NewTLSConfig(certFile string, keyFile string, minVersion uint16, cipherPolicy string) *TLSConfig {
+	return &TLSConfig{
+		certFile:     certFile,
+		keyFile:      keyFile,
+		minVersion:   minVersion,
+		cipherPolicy: cipherPolicy,
+	}
+}
+
+func ParseTLSVersion(s string) (uint16, error) {
+	switch s {
+	case "", "1.2":
+		return tls.VersionTLS12, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
+	default:
+		return 0, fmt.Errorf("tls version (%#v) is not supported", s)
+	}
+}
+
+func (c *TLSConfig) CertFile() string {
+	return c.certFile
+}
+
+func (c *TLSConfig) KeyFile() string {
+	return c.keyFile
+}
+
+// Build returns a tls.Config serving the certificate of reloader,
+// it offers HTTP/2 so event streams are multiplexed on one connection
+func (c *TLSConfig) Build(reloader *CertReloader) (*tls.Config, error) {
+	cfg := &tls.Config{
+		MinVersion:     c.minVersion,
+		GetCertificate: reloader.GetCertificate,
+		NextProtos:     []string{"h2", "http/1.1"},
+	}
+
+	switch c.cipherPolicy {
+	case "", TLS_CIPHER_POLICY_DEFAULT:
+	case TLS_CIPHER_POLICY_INTERMEDIATE:
+		cfg.CipherSuites = intermediateCipherSuites
+	case TLS_CIPHER_POLICY_MODERN:
+		cfg.MinVersion = tls.VersionTLS13
+	default:
+		return nil, fmt.Errorf("cipher policy (%#v) is unknown", c.cipherPolicy)
+	}
+
+	return cfg, nil
+}
+
+func NewCertReloader(certFile string, keyFile string) (*CertReloader, error) {
+	r := &CertReloader{
+		certFile: certFile,
+		keyFile:  keyFile,
+		logger:   binn.DefaultLogger(),
+		mux:      &sync.RWMutex{},
+	}
+	if _, err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *CertReloader) latestModTime() (time.Time, error) {
+	certInfo, err := os.Stat(r.certFile)
+	if err != nil {
+		return time.Time{}, err
+	}
+	keyInfo, err := os.Stat(r.keyFile)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if keyInfo.ModTime().After(certInfo.ModTime()) {
+		return keyInfo.ModTime(), nil
+	}
+	return certInfo.ModTime(), nil
+}
+
+// Reload loads the certificate again when a file has changed since
+// the last load, a broken pair keeps the current certificate
+func (r *CertReloader) Reload() (bool, error) {
+	modTime, err := r.latestModTime()
+	if err != nil {
+		return false, err
+	}
+
+	r.mux.RLock()
+	unchanged := r.cert != nil && modTime.Equal(r.modTime)
+	r.mux.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return false, err
+	}
+
+	r.mux.Lock()
+	r.cert = &cert
+	r.modTime = modTime
+	r.mux.Unlock()
+
+	return true, nil
+}
+
+func (r *CertReloader) SetLogger(l *binn.Logger) {
+	r.logger = l
+}
+
+// Watch polls the files every interval until ctx is done
+func (r *CertReloader) Watch(ctx context.Context, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <- ctx.Done():
+			return
+		case <- t.C:
+			reloaded, err := r.Reload()
+			if err != nil {
+				r.logger.Error("failed to reload certificate", binn.F("error", err))
+			} else if reloaded {
+				r.logger.Info("reload certificate", binn.F("file", r.certFile))
+			}
+		}
+	}
+}
+
+func (r *CertReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mux.RLock()
+	defer r.mux.RUnlock()
+	return r.cert, nil
+}
+
+// NewRedirectServer redirects every request to https on httpsPort
+func NewRedirectServer(addr string, httpsPort string) *http.Server {
+	return &http.Server{
+		Addr: addr,
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			host := r.Host
+			if h, _, err := net.SplitHostPort(r.Host); err == nil {
+				host = h
+			}
+			if httpsPort != "" && httpsPort != "443" {
+				host = net.JoinHostPort(host, httpsPort)
+			}
+			target := "https://" + host + r.URL.RequestURI()
+			http.Redirect(w, r, target, http.StatusPermanentRedirect)
+		}),
+	}
+}
@@ -0,0 +1,118 @@
+package server
+
+import (
+	"os"
+	"net"
+	"time"
+	"testing"
+	"math/big"
+	"net/http"
+	"crypto/tls"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"encoding/pem"
+	"path/filepath"
+	"net/http/httptest"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func writeTestCertificate(t *testing.T, dir string, serial int64) (string, string) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, _ := x509.MarshalECPrivateKey(key)
+
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{ Type: "CERTIFICATE", Bytes: der }), 0600)
+	os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{ Type: "EC PRIVATE KEY", Bytes: keyDER }), 0600)
+	return certFile, keyFile
+}
+
+func certSerial(r *CertReloader) int64 {
+	cert, _ := r.GetCertificate(nil)
+	parsed, _ := x509.ParseCertificate(cert.Certificate[0])
+	return parsed.SerialNumber.Int64()
+}
+
+func TestCertReloader(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := writeTestCertificate(t, dir, 1)
+
+	reloader, err := NewCertReloader(certFile, keyFile)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1), certSerial(reloader))
+
+	reloaded, err := reloader.Reload()
+	assert.Nil(t, err)
+	assert.False(t, reloaded)
+
+	writeTestCertificate(t, dir, 2)
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(certFile, later, later)
+
+	reloaded, err = reloader.Reload()
+	assert.Nil(t, err)
+	assert.True(t, reloaded)
+	assert.Equal(t, int64(2), certSerial(reloader))
+}
+
+func TestServeHTTP2(t *testing.T) {
+	certFile, keyFile := writeTestCertificate(t, t.TempDir(), 1)
+	reloader, _ := NewCertReloader(certFile, keyFile)
+	tlsCfg, err := NewTLSConfig(certFile, keyFile, tls.VersionTLS12, TLS_CIPHER_POLICY_INTERMEDIATE).Build(reloader)
+	assert.Nil(t, err)
+
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Proto))
+	}))
+	srv.EnableHTTP2 = true
+	srv.TLS = tlsCfg
+	srv.StartTLS()
+	defer srv.Close()
+
+	client := &http.Client{
+		Transport: &http.Transport{
+			TLSClientConfig:   &tls.Config{ InsecureSkipVerify: true },
+			ForceAttemptHTTP2: true,
+		},
+	}
+	resp, err := client.Get(srv.URL)
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer resp.Body.Close()
+
+	assert.Equal(t, 2, resp.ProtoMajor)
+}
+
+func TestBuildTLSConfigUnknownPolicy(t *testing.T) {
+	_, err := NewTLSConfig("", "", tls.VersionTLS12, "legacy").Build(&CertReloader{})
+	assert.EqualError(t, err, "cipher policy (\"legacy\") is unknown")
+
+	cfg, _ := NewTLSConfig("", "", tls.VersionTLS12, TLS_CIPHER_POLICY_MODERN).Build(&CertReloader{})
+	assert.Equal(t, uint16(tls.VersionTLS13), cfg.MinVersion)
+}
+
+func TestRedirectServer(t *testing.T) {
+	srv := NewRedirectServer(":80", "8443")
+
+	req := httptest.NewRequest("GET", "http://example.com/api/bottle?x=1", nil)
+	w := httptest.NewRecorder()
+	srv.Handler.ServeHTTP(w, req)
+
+	assert.Equal(t, 308, w.Result().StatusCode)
+	assert.Equal(t, "https://example.com:8443/api/bottle?x=1", w.Result().Header.Get("Location"))
+}
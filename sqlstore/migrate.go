@@ -0,0 +1,153 @@
+package sqlstore
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"database/sql"
+)
+
+// Dialect holds the statements which differ between databases
+type Dialect struct {
+	Name string
+	// Serial is the column type of a auto incremented primary key
+	Serial string
+	// Dequeue deletes the oldest container, concurrent callers must
+	// never delete the same row
+	Dequeue string
+	// Numbered placeholders are written as $1 instead of ?
+	Numbered bool
+	// SingleWriter databases lock the whole file for a write, one
+	// connection queues writers instead of failing them as busy
+	SingleWriter bool
+	// LockContainers serializes adders until they commit so the count
+	// of a full storage sees the rows of the others, empty when writers
+	// are serialized already
+	LockContainers string
+}
+
+var SQLite = &Dialect{
+	Name:         "sqlite",
+	Serial:       "INTEGER PRIMARY KEY AUTOINCREMENT",
+	// sqlite serializes writers, so the oldest row is never taken twice
+	Dequeue:      `DELETE FROM binn_containers
+		WHERE seq = (SELECT seq FROM binn_containers ORDER BY seq LIMIT 1)`,
+	SingleWriter: true,
+}
+
+var Postgres = &Dialect{
+	Name:     "postgres",
+	Serial:   "BIGSERIAL PRIMARY KEY",
+	Dequeue:  `DELETE FROM binn_containers
+		WHERE seq = (SELECT seq FROM binn_containers ORDER BY seq LIMIT 1 FOR UPDATE SKIP LOCKED)`,
+	Numbered: true,
+	// a adder counts under READ COMMITTED, which does not see rows of
+	// concurrent adders, so they wait for each other on the meta row
+	LockContainers: `SELECT name FROM binn_meta WHERE name = 'containers' FOR UPDATE`,
+}
+
+// DialectOf returns the dialect of a database/sql driver name
+func DialectOf(driver string) (*Dialect, error) {
+	switch driver {
+	case "sqlite", "sqlite3":
+		return SQLite, nil
+	case "postgres", "pgx":
+		return Postgres, nil
+	default:
+		return nil, fmt.Errorf("this driver (%#v) is not supported", driver)
+	}
+}
+
+// rebind replaces ? with $1, $2 ... for numbered dialects
+func (d *Dialect) rebind(query string) string {
+	if !d.Numbered {
+		return query
+	}
+	var b strings.Builder
+	n := 0
+	for _, r := range query {
+		if r == '?' {
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// migrations are applied in order and recorded in binn_schema_migrations,
+// a applied migration must never change
+var migrations = []func(d *Dialect) []string{
+	func(d *Dialect) []string {
+		return []string{
+			`CREATE TABLE binn_containers (
+				seq ` + d.Serial + `,
+				id TEXT NOT NULL UNIQUE,
+				text TEXT NOT NULL,
+				expired_at_ns BIGINT
+			)`,
+			`CREATE TABLE binn_ids (
+				id TEXT PRIMARY KEY,
+				expired_at_ns BIGINT NOT NULL
+			)`,
+			`CREATE INDEX binn_ids_expired_at_ns ON binn_ids (expired_at_ns)`,
+		}
+	},
+	// tags and metadata are json
+	func(d *Dialect) []string {
+		return []string{
+			`ALTER TABLE binn_containers ADD COLUMN created_at_ns BIGINT`,
+			`ALTER TABLE binn_containers ADD COLUMN language TEXT NOT NULL DEFAULT ''`,
+			`ALTER TABLE binn_containers ADD COLUMN tags TEXT NOT NULL DEFAULT ''`,
+			`ALTER TABLE binn_containers ADD COLUMN signature TEXT NOT NULL DEFAULT ''`,
+			`ALTER TABLE binn_containers ADD COLUMN hops INTEGER NOT NULL DEFAULT 0`,
+			`ALTER TABLE binn_containers ADD COLUMN metadata TEXT NOT NULL DEFAULT ''`,
+		}
+	},
+	func(d *Dialect) []string {
+		return []string{
+			`ALTER TABLE binn_containers ADD COLUMN attachments TEXT NOT NULL DEFAULT ''`,
+		}
+	},
+	// rows locked to serialize writers
+	func(d *Dialect) []string {
+		return []string{
+			`CREATE TABLE binn_meta (name TEXT PRIMARY KEY)`,
+			`INSERT INTO binn_meta (name) VALUES ('containers')`,
+		}
+	},
+}
+
+// MigrateSchema applies every migration which has not been applied to db
+// and returns the schema version
+func MigrateSchema(db *sql.DB, d *Dialect) (int, error) {
+	if _, err := db.Exec(`CREATE TABLE IF NOT EXISTS binn_schema_migrations (version INTEGER PRIMARY KEY)`); err != nil {
+		return 0, err
+	}
+
+	version := 0
+	if err := db.QueryRow(`SELECT COALESCE(MAX(version), 0) FROM binn_schema_migrations`).Scan(&version); err != nil {
+		return 0, err
+	}
+	for ; version < len(migrations); version++ {
+		tx, err := db.Begin()
+		if err != nil {
+			return version, err
+		}
+		for _, stmt := range migrations[version](d) {
+			if _, err := tx.Exec(stmt); err != nil {
+				tx.Rollback()
+				return version, fmt.Errorf("migration %d failed, %s", version + 1, err)
+			}
+		}
+		if _, err := tx.Exec(d.rebind(`INSERT INTO binn_schema_migrations (version) VALUES (?)`), version + 1); err != nil {
+			tx.Rollback()
+			return version, err
+		}
+		if err := tx.Commit(); err != nil {
+			return version, err
+		}
+	}
+	return version, nil
+}
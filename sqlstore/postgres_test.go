@@ -0,0 +1,118 @@
+//go:build postgres
+// +build postgres
+
+package sqlstore
+
+import (
+	"os"
+	"sync"
+	"time"
+	"testing"
+
+	"github.com/binn/binn"
+	"github.com/binn/binn/keepertest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	_ "github.com/lib/pq"
+)
+
+// the postgres tests run with -tags postgres against an empty database
+// named by BINN_TEST_POSTGRES_DSN, their tables are dropped before each test
+//
+//   BINN_TEST_POSTGRES_DSN=postgres://binn@localhost/binn_test?sslmode=disable go test -tags postgres ./sqlstore
+func openPostgresStorage(t *testing.T, v bool, e time.Duration) *Storage {
+	dsn := os.Getenv("BINN_TEST_POSTGRES_DSN")
+	if dsn == "" {
+		t.Skip("BINN_TEST_POSTGRES_DSN is not set")
+	}
+	s, err := Open("postgres", dsn, v, e)
+	require.Nil(t, err)
+	_, err = s.db.Exec(`DROP TABLE binn_containers, binn_ids, binn_meta, binn_schema_migrations`)
+	require.Nil(t, err)
+	require.Nil(t, s.Close())
+
+	s, err = Open("postgres", dsn, v, e)
+	require.Nil(t, err)
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func TestPostgresConformance(t *testing.T) {
+	keepertest.Run(t, func(t *testing.T, e time.Duration) *keepertest.Harness {
+		s := openPostgresStorage(t, true, e)
+		return &keepertest.Harness{
+			Keeper:     s,
+			Issue:      s.Issue,
+			FailCommit: func(err error) { failCommit(s, err) },
+			Check:      func(t *testing.T) { checkConsistency(t, s) },
+		}
+	})
+}
+
+// TestPostgresConcurrentAddKeepsCapacity adds from several connections
+// to a full storage, none of them sees the rows of the others uncommitted
+func TestPostgresConcurrentAddKeepsCapacity(t *testing.T) {
+	s := openPostgresStorage(t, false, 0)
+	for i := 0; i < binn.MAX_CONTAINER_STORAGE_NUM_CONTAINER; i++ {
+		require.Nil(t, s.Add(binn.NewBottle("", "hello", nil)))
+	}
+
+	wg := &sync.WaitGroup{}
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				assert.Nil(t, s.Add(binn.NewBottle("", "more", nil)))
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, binn.MAX_CONTAINER_STORAGE_NUM_CONTAINER, s.Len())
+}
+
+// TestPostgresServersShareDatabase picks up from several storages on their
+// own connection pools, SKIP LOCKED hands every row to one of them
+func TestPostgresServersShareDatabase(t *testing.T) {
+	s := openPostgresStorage(t, false, 0)
+	for i := 0; i < 200; i++ {
+		require.Nil(t, s.Add(binn.NewBottle("", "hello", nil)))
+	}
+
+	mux := &sync.Mutex{}
+	seen := map[string]int{}
+	pick := func(s *Storage) bool {
+		c, err := s.Get()
+		if err != nil {
+			return false
+		}
+		mux.Lock()
+		seen[c.ID()]++
+		mux.Unlock()
+		return true
+	}
+
+	wg := &sync.WaitGroup{}
+	for i := 0; i < 4; i++ {
+		server, err := Open("postgres", os.Getenv("BINN_TEST_POSTGRES_DSN"), false, 0)
+		require.Nil(t, err)
+		defer server.Close()
+		for w := 0; w < 4; w++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for pick(server) {
+				}
+			}()
+		}
+	}
+	wg.Wait()
+	// a picker stops when every row left is locked by another one
+	for pick(s) {
+	}
+
+	assert.Equal(t, 200, len(seen))
+	for id, n := range seen {
+		assert.Equal(t, 1, n, id)
+	}
+}
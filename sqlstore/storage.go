@@ -0,0 +1,412 @@
+package sqlstore
+
+import (
+	"io"
+	"fmt"
+	"time"
+	"database/sql"
+	"encoding/json"
+
+	"github.com/binn/binn"
+)
+
+var ErrNotEmpty = fmt.Errorf("this storage is not empty")
+
+// querier is a *sql.DB or a *sql.Tx
+type querier interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+}
+
+// Storage is a ContainerKeeper kept in a sql database, Add deletes the used
+// id and inserts the row of the container in the same *sql.Tx, Get deletes
+// the row and stamps its id in another
+//
+// binn_containers holds containers in the order they were added and
+// binn_ids holds issued ids with their expiration in unix nanoseconds
+type Storage struct {
+	db         *sql.DB
+	dialect    *Dialect
+	validation bool
+	expiration time.Duration
+	// beforeCommit runs before Commit of every *sql.Tx,
+	// a error makes update roll the statements back
+	beforeCommit func() error
+}
+
+// Open connects to dsn with a registered database/sql driver and
+// migrates the schema to the latest version
+func Open(driver string, dsn string, v bool, e time.Duration) (*Storage, error) {
+	d, err := DialectOf(driver)
+	if err != nil {
+		return nil, err
+	}
+	db, err := sql.Open(driver, dsn)
+	if err != nil {
+		return nil, err
+	}
+	if d.SingleWriter {
+		db.SetMaxOpenConns(1)
+	}
+	if _, err := MigrateSchema(db, d); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &Storage{ db: db, dialect: d, validation: v, expiration: e }, nil
+}
+
+func (s *Storage) Close() error {
+	return s.db.Close()
+}
+
+func (s *Storage) update(f func(tx *sql.Tx) error) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	if err := f(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if s.beforeCommit != nil {
+		if err := s.beforeCommit(); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func nanos(e *time.Time) sql.NullInt64 {
+	if e == nil {
+		return sql.NullInt64{}
+	}
+	return sql.NullInt64{ Int64: e.UnixNano(), Valid: true }
+}
+
+func timeOf(n sql.NullInt64) *time.Time {
+	if !n.Valid {
+		return nil
+	}
+	t := time.Unix(0, n.Int64)
+	return &t
+}
+
+func (s *Storage) exec(q querier, query string, args ...interface{}) (sql.Result, error) {
+	return q.Exec(s.dialect.rebind(query), args...)
+}
+
+func (s *Storage) issue(q querier, id string, e time.Time) error {
+	if _, err := s.exec(q, `DELETE FROM binn_ids WHERE id = ?`, id); err != nil {
+		return err
+	}
+	_, err := s.exec(q, `INSERT INTO binn_ids (id, expired_at_ns) VALUES (?, ?)`, id, e.UnixNano())
+	return err
+}
+
+// use revokes id, a expired id is kept so the caller rolls back
+func (s *Storage) use(q querier, id string, now time.Time) error {
+	var e int64
+	err := q.QueryRow(s.dialect.rebind(`DELETE FROM binn_ids WHERE id = ? RETURNING expired_at_ns`), id).Scan(&e)
+	if err == sql.ErrNoRows {
+		return fmt.Errorf("this id (%#v) is invalid", id)
+	}
+	if err != nil {
+		return err
+	}
+	if now.After(time.Unix(0, e)) {
+		return fmt.Errorf("this id (%#v) is expired", id)
+	}
+	return nil
+}
+
+// containerColumns are read and written in this order by push and scanContainer
+const containerColumns = `id, text, expired_at_ns, created_at_ns, language, tags, signature, hops, metadata, attachments`
+
+// encodeJSON stores a empty value as ''
+func encodeJSON(v interface{}, empty bool) (string, error) {
+	if empty {
+		return "", nil
+	}
+	data, err := json.Marshal(v)
+	return string(data), err
+}
+
+func (s *Storage) push(q querier, id string, m *binn.Message, e *time.Time) error {
+	tags, err := encodeJSON(m.Tags, len(m.Tags) == 0)
+	if err != nil {
+		return err
+	}
+	metadata, err := encodeJSON(m.Metadata, len(m.Metadata) == 0)
+	if err != nil {
+		return err
+	}
+	attachments, err := encodeJSON(m.Attachments, len(m.Attachments) == 0)
+	if err != nil {
+		return err
+	}
+	_, err = s.exec(q, `INSERT INTO binn_containers (` + containerColumns + `) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		id, m.Text, nanos(e), nanos(m.CreatedAt), m.Language, tags, m.Signature, m.Hops, metadata, attachments)
+	return err
+}
+
+type row interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanContainer(r row) (binn.Container, error) {
+	var id, text, language, tags, signature, metadata, attachments string
+	var e, createdAt sql.NullInt64
+	var hops int
+	if err := r.Scan(&id, &text, &e, &createdAt, &language, &tags, &signature, &hops, &metadata, &attachments); err != nil {
+		return nil, err
+	}
+	m := &binn.Message{
+		Text:      text,
+		CreatedAt: timeOf(createdAt),
+		Language:  language,
+		Signature: signature,
+		Hops:      hops,
+	}
+	if tags != "" {
+		if err := json.Unmarshal([]byte(tags), &m.Tags); err != nil {
+			return nil, err
+		}
+	}
+	if metadata != "" {
+		if err := json.Unmarshal([]byte(metadata), &m.Metadata); err != nil {
+			return nil, err
+		}
+	}
+	if attachments != "" {
+		if err := json.Unmarshal([]byte(attachments), &m.Attachments); err != nil {
+			return nil, err
+		}
+	}
+	return binn.NewBottleWithMessage(id, m, timeOf(e)), nil
+}
+
+// pop removes the oldest container which no other transaction holds
+func (s *Storage) pop(q querier) (binn.Container, error) {
+	c, err := scanContainer(q.QueryRow(s.dialect.rebind(s.dialect.Dequeue + ` RETURNING ` + containerColumns)))
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("this storage has no containers")
+	}
+	return c, err
+}
+
+func count(q querier) (int, error) {
+	n := 0
+	err := q.QueryRow(`SELECT COUNT(*) FROM binn_containers`).Scan(&n)
+	return n, err
+}
+
+func (s *Storage) Get() (binn.Container, error) {
+	var c binn.Container
+	err := s.update(func(tx *sql.Tx) error {
+		stored, err := s.pop(tx)
+		if err != nil {
+			return err
+		}
+
+		e := time.Now().Add(time.Duration(binn.MAX_EXPIRATION_HOUR) * time.Hour)
+		if s.expiration != 0 {
+			e = time.Now().Add(s.expiration)
+		}
+		if s.validation {
+			if _, err := s.exec(tx, `UPDATE binn_ids SET expired_at_ns = ? WHERE id = ?`, e.UnixNano(), stored.ID()); err != nil {
+				return err
+			}
+		}
+		c = binn.NewBottleWithMessage(stored.ID(), stored.Message(), &e)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (s *Storage) Add(c binn.Container) error {
+	return s.update(func(tx *sql.Tx) error {
+		now := time.Now()
+		if s.validation {
+			if err := s.use(tx, c.ID(), now); err != nil {
+				return err
+			}
+		}
+
+		if s.dialect.LockContainers != "" {
+			var name string
+			if err := tx.QueryRow(s.dialect.LockContainers).Scan(&name); err != nil {
+				return err
+			}
+		}
+		n, err := count(tx)
+		if err != nil {
+			return err
+		}
+		if n >= binn.MAX_CONTAINER_STORAGE_NUM_CONTAINER {
+			if _, err := s.pop(tx); err != nil {
+				return err
+			}
+		}
+
+		newID := binn.GenerateID()
+		if s.validation {
+			if err := s.issue(tx, newID, now.Add(time.Duration(binn.MAX_EXPIRATION_HOUR) * time.Hour)); err != nil {
+				return err
+			}
+		}
+		return s.push(tx, newID, c.Message().Stored(now), c.ExpiredAt())
+	})
+}
+
+// Issue adds id to the issued ids
+func (s *Storage) Issue(id string, e time.Time) error {
+	return s.update(func(tx *sql.Tx) error {
+		n := 0
+		if err := tx.QueryRow(s.dialect.rebind(`SELECT COUNT(*) FROM binn_ids WHERE id = ?`), id).Scan(&n); err != nil {
+			return err
+		}
+		if n != 0 {
+			return fmt.Errorf("this id (%#v) is already added", id)
+		}
+		return s.issue(tx, id, e)
+	})
+}
+
+func (s *Storage) Len() int {
+	n, err := count(s.db)
+	if err != nil {
+		return 0
+	}
+	return n
+}
+
+func (s *Storage) Ping() error {
+	return s.db.Ping()
+}
+
+// Sweep forgets expired ids, ids of stored containers are kept since
+// Get stamps them again
+func (s *Storage) Sweep() int {
+	if !s.validation {
+		return 0
+	}
+	res, err := s.exec(s.db, `DELETE FROM binn_ids WHERE expired_at_ns < ?
+		AND id NOT IN (SELECT id FROM binn_containers)`, time.Now().UnixNano())
+	if err != nil {
+		return 0
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0
+	}
+	return int(n)
+}
+
+func (s *Storage) Snapshot(w io.Writer) error {
+	snapshot := &binn.Snapshot{
+		CreatedAt:   time.Now(),
+		Containers:  []binn.Container{},
+		Quarantined: []binn.Container{},
+		IDs:         []binn.IssuedID{},
+	}
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(`SELECT ` + containerColumns + ` FROM binn_containers ORDER BY seq`)
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		c, err := scanContainer(rows)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		snapshot.Containers = append(snapshot.Containers, c)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	rows, err = tx.Query(`SELECT id, expired_at_ns FROM binn_ids ORDER BY expired_at_ns, id`)
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var id string
+		var e int64
+		if err := rows.Scan(&id, &e); err != nil {
+			rows.Close()
+			return err
+		}
+		snapshot.IDs = append(snapshot.IDs, binn.IssuedID{ ID: id, ExpiredAt: time.Unix(0, e) })
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	return binn.WriteSnapshot(w, snapshot)
+}
+
+// Restore empties both tables and inserts the rows of the snapshot read
+// from r in one *sql.Tx, the schema has no quarantine table so a
+// snapshot with one is refused
+func (s *Storage) Restore(r io.Reader) error {
+	snapshot, err := binn.ReadSnapshot(r)
+	if err != nil {
+		return err
+	}
+	if len(snapshot.Quarantined) > 0 {
+		return binn.ErrQuarantineUnsupported
+	}
+	containers := snapshot.Containers
+	if len(containers) > binn.MAX_CONTAINER_STORAGE_NUM_CONTAINER {
+		return fmt.Errorf("snapshot has too many containers")
+	}
+
+	return s.update(func(tx *sql.Tx) error {
+		if _, err := tx.Exec(`DELETE FROM binn_containers`); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(`DELETE FROM binn_ids`); err != nil {
+			return err
+		}
+		for _, c := range containers {
+			if err := s.push(tx, c.ID(), c.Message(), c.ExpiredAt()); err != nil {
+				return err
+			}
+		}
+		for _, id := range snapshot.IDs {
+			if err := s.issue(tx, id.ID, id.ExpiredAt); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Migrate restores a snapshot only while binn_containers and binn_ids
+// have no rows, so a database shared by several servers is filled once
+func (s *Storage) Migrate(r io.Reader) error {
+	containers, err := count(s.db)
+	if err != nil {
+		return err
+	}
+	ids := 0
+	if err := s.db.QueryRow(`SELECT COUNT(*) FROM binn_ids`).Scan(&ids); err != nil {
+		return err
+	}
+	if containers != 0 || ids != 0 {
+		return ErrNotEmpty
+	}
+	return s.Restore(r)
+}
@@ -0,0 +1,98 @@
+package sqlstore
+
+import (
+	"time"
+	"testing"
+	"database/sql"
+	"path/filepath"
+
+	"github.com/binn/binn/keepertest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	_ "modernc.org/sqlite"
+)
+
+func openTestStorage(t *testing.T) (*Storage, string) {
+	path := filepath.Join(t.TempDir(), "binn.sqlite")
+	s, err := Open("sqlite", path, true, time.Duration(10) * time.Minute)
+	require.Nil(t, err)
+	t.Cleanup(func() { s.Close() })
+	return s, path
+}
+
+// checkConsistency asserts every stored container has a issued id
+func checkConsistency(t *testing.T, s *Storage) {
+	orphans := 0
+	require.Nil(t, s.db.QueryRow(`SELECT COUNT(*) FROM binn_containers
+		WHERE id NOT IN (SELECT id FROM binn_ids)`).Scan(&orphans))
+	assert.Equal(t, 0, orphans)
+}
+
+// failCommit fails every transaction of s with err, nil commits them again
+func failCommit(s *Storage, err error) {
+	s.beforeCommit = nil
+	if err != nil {
+		s.beforeCommit = func() error { return err }
+	}
+}
+
+func TestMigrateSchema(t *testing.T) {
+	_, path := openTestStorage(t)
+
+	// reopening finds every migration applied
+	s, err := Open("sqlite", path, true, 0)
+	require.Nil(t, err)
+	defer s.Close()
+	version, err := MigrateSchema(s.db, SQLite)
+	require.Nil(t, err)
+	assert.Equal(t, len(migrations), version)
+
+	_, err = Open("mysql", path, true, 0)
+	assert.NotNil(t, err)
+}
+
+func TestMigrateSchemaKeepsRows(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "binn.sqlite")
+	db, err := sql.Open("sqlite", path)
+	require.Nil(t, err)
+	_, err = db.Exec(`CREATE TABLE binn_schema_migrations (version INTEGER PRIMARY KEY)`)
+	require.Nil(t, err)
+	for _, stmt := range migrations[0](SQLite) {
+		_, err := db.Exec(stmt)
+		require.Nil(t, err)
+	}
+	_, err = db.Exec(`INSERT INTO binn_schema_migrations (version) VALUES (1)`)
+	require.Nil(t, err)
+	_, err = db.Exec(`INSERT INTO binn_containers (id, text) VALUES ('old', 'hello')`)
+	require.Nil(t, err)
+	require.Nil(t, db.Close())
+
+	s, err := Open("sqlite", path, false, 0)
+	require.Nil(t, err)
+	defer s.Close()
+	c, err := s.Get()
+	require.Nil(t, err)
+	assert.Equal(t, "old", c.ID())
+	assert.Equal(t, "hello", c.Message().Text)
+	assert.Nil(t, c.Message().CreatedAt)
+	assert.Nil(t, c.Message().Tags)
+}
+
+func TestRebind(t *testing.T) {
+	assert.Equal(t, "a = ? AND b = ?", SQLite.rebind("a = ? AND b = ?"))
+	assert.Equal(t, "a = $1 AND b = $2", Postgres.rebind("a = ? AND b = ?"))
+}
+
+func TestConformance(t *testing.T) {
+	keepertest.Run(t, func(t *testing.T, e time.Duration) *keepertest.Harness {
+		s, err := Open("sqlite", filepath.Join(t.TempDir(), "binn.sqlite"), true, e)
+		require.Nil(t, err)
+		t.Cleanup(func() { s.Close() })
+		return &keepertest.Harness{
+			Keeper:     s,
+			Issue:      s.Issue,
+			FailCommit: func(err error) { failCommit(s, err) },
+			Check:      func(t *testing.T) { checkConsistency(t, s) },
+		}
+	})
+}